@@ -0,0 +1,26 @@
+package postsocket
+
+import (
+	"net"
+	"strconv"
+)
+
+// addrIPPort returns the IP address and port of an address, or a nil
+// address and port zero if it has none, as for an address that is not an
+// IP address.
+func addrIPPort(a net.Addr) (net.IP, uint16) {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port)
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port)
+	case nil:
+		return nil, 0
+	}
+	host, portstr, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return nil, 0
+	}
+	port, _ := strconv.ParseUint(portstr, 10, 16)
+	return net.ParseIP(host), uint16(port)
+}
@@ -0,0 +1,162 @@
+package postsocket
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// AdoptableSocket converts a socket as passed to TransportContext.Adopt into
+// a net.Listener, net.PacketConn, or net.Conn, in that order of preference.
+// Files and raw file descriptors are converted with net.FileListener if
+// the socket is listening, and otherwise with net.FilePacketConn or
+// net.FileConn, whichever first succeeds. On success, the original file or
+// descriptor is closed, as the returned socket holds its own duplicate of
+// the descriptor; on failure, it is left open and remains the caller's.
+// Sockets that are already a net.Listener, net.PacketConn, or net.Conn are
+// returned unchanged.
+func AdoptableSocket(sock interface{}) (interface{}, error) {
+	switch s := sock.(type) {
+	case net.Listener, net.PacketConn, net.Conn:
+		return s, nil
+	case *os.File:
+		return adoptFile(s)
+	case uintptr:
+		return adoptFD(int(s))
+	case int:
+		if s < 0 {
+			return nil, fmt.Errorf("postsocket: cannot adopt invalid file descriptor %d", s)
+		}
+		return adoptFD(s)
+	default:
+		return nil, fmt.Errorf("postsocket: cannot adopt socket of type %T", sock)
+	}
+}
+
+// adoptFD adopts a duplicate of a raw file descriptor, so that an *os.File
+// wrapping it can be closed without closing the caller's descriptor if
+// adoption fails. The descriptor itself is closed only on success.
+func adoptFD(fd int) (interface{}, error) {
+	dup, err := dupFD(fd)
+	if err != nil {
+		return nil, fmt.Errorf("postsocket: cannot adopt fd %d: %v", fd, err)
+	}
+	f := os.NewFile(uintptr(dup), fmt.Sprintf("fd %d", fd))
+	sock, err := adoptFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	os.NewFile(uintptr(fd), "").Close()
+	return sock, nil
+}
+
+func adoptFile(f *os.File) (interface{}, error) {
+	if f == nil {
+		return nil, fmt.Errorf("postsocket: cannot adopt invalid file descriptor")
+	}
+
+	// net.FileListener and net.FileConn both accept a stream socket in any
+	// state, so ask the kernel whether this one is listening.
+	listening, err := isListeningSocket(f)
+	if err != nil {
+		return nil, fmt.Errorf("postsocket: cannot adopt %s: %v", f.Name(), err)
+	}
+
+	var sock interface{}
+	if listening {
+		sock, err = net.FileListener(f)
+	} else if sock, err = net.FilePacketConn(f); err != nil {
+		sock, err = net.FileConn(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postsocket: cannot adopt %s: %v", f.Name(), err)
+	}
+
+	f.Close()
+	return sock, nil
+}
+
+// socketNetwork returns the network name of an adoptable socket, as given
+// by the Network method of its local address.
+func socketNetwork(sock interface{}) string {
+	var addr net.Addr
+	switch s := sock.(type) {
+	case net.Listener:
+		addr = s.Addr()
+	case net.PacketConn:
+		addr = s.LocalAddr()
+	case net.Conn:
+		addr = s.LocalAddr()
+	}
+	if addr == nil {
+		return ""
+	}
+	return addr.Network()
+}
+
+// InferTransportParameters adds requirements and prohibitions to tp
+// describing the transport service provided by an adoptable socket, and
+// returns the resulting TransportParameters. Stream sockets (TCP and Unix
+// stream sockets, and any other net.Conn that is not a net.PacketConn)
+// require full reliability and order preservation; Unix seqpacket sockets
+// require the same; Unix datagram sockets require full reliability only;
+// UDP and raw IP sockets prohibit both. The socket is not consumed: files
+// and file descriptors are inspected in place, and remain the caller's.
+func InferTransportParameters(tp TransportParameters, sock interface{}) (TransportParameters, error) {
+	var network string
+	var packet bool
+	switch s := sock.(type) {
+	case net.Listener, net.PacketConn, net.Conn:
+		network = socketNetwork(s)
+		_, packet = s.(net.PacketConn)
+	case *os.File:
+		rc, err := s.SyscallConn()
+		if err != nil {
+			return nil, fmt.Errorf("postsocket: cannot inspect %s: %v", s.Name(), err)
+		}
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			network, serr = fdNetwork(int(fd))
+		}); err != nil {
+			serr = err
+		}
+		if serr != nil {
+			return nil, fmt.Errorf("postsocket: cannot inspect %s: %v", s.Name(), serr)
+		}
+	case uintptr:
+		var err error
+		if network, err = fdNetwork(int(s)); err != nil {
+			return nil, fmt.Errorf("postsocket: cannot inspect fd %d: %v", s, err)
+		}
+	case int:
+		if s < 0 {
+			return nil, fmt.Errorf("postsocket: cannot inspect invalid file descriptor %d", s)
+		}
+		var err error
+		if network, err = fdNetwork(s); err != nil {
+			return nil, fmt.Errorf("postsocket: cannot inspect fd %d: %v", s, err)
+		}
+	default:
+		return nil, fmt.Errorf("postsocket: cannot adopt socket of type %T", sock)
+	}
+
+	switch {
+	case network == "unixgram":
+		tp = tp.Require(TransportFullyReliable, nil)
+	case network == "unixpacket":
+		tp = tp.Require(TransportFullyReliable, nil).
+			Require(TransportOrderPreserved, nil)
+	case strings.HasPrefix(network, "udp"), strings.HasPrefix(network, "ip"):
+		tp = tp.Prohibit(TransportFullyReliable, nil).
+			Prohibit(TransportOrderPreserved, nil)
+	default:
+		if packet {
+			return nil, fmt.Errorf("postsocket: cannot infer transport parameters for %q socket", network)
+		}
+		tp = tp.Require(TransportFullyReliable, nil).
+			Require(TransportOrderPreserved, nil)
+	}
+	return tp, nil
+}
@@ -0,0 +1,27 @@
+//go:build !(darwin || freebsd || linux || netbsd || openbsd)
+
+package postsocket
+
+import (
+	"errors"
+	"os"
+)
+
+// isListeningSocket returns true if f is a socket in the listening state.
+// Listening sockets cannot be detected on this platform, so all sockets are
+// assumed to be connected.
+func isListeningSocket(f *os.File) (bool, error) {
+	return false, nil
+}
+
+// dupFD returns a duplicate of a file descriptor. Raw descriptors cannot
+// be adopted on this platform, so it always returns an error.
+func dupFD(fd int) (int, error) {
+	return -1, errors.New("adopting file descriptors is not supported on this platform")
+}
+
+// fdNetwork returns the network name of a socket file descriptor. Sockets
+// cannot be inspected on this platform, so it always returns an error.
+func fdNetwork(fd int) (string, error) {
+	return "", errors.New("socket inspection is not supported on this platform")
+}
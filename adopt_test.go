@@ -0,0 +1,185 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+
+package postsocket_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// rawFD returns a duplicate of the descriptor underlying a socket or file,
+// owned by the caller, and closes the socket or file.
+func rawFD(t *testing.T, sock interface {
+	syscall.Conn
+	io.Closer
+}) int {
+	t.Helper()
+	defer sock.Close()
+	rc, err := sock.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := -1
+	rc.Control(func(s uintptr) {
+		fd, err = syscall.Dup(int(s))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// fdOpen reports whether fd is an open descriptor, after giving any
+// finalizer that might close it a chance to run.
+func fdOpen(fd int) bool {
+	runtime.GC()
+	runtime.GC()
+	time.Sleep(10 * time.Millisecond)
+	var st syscall.Stat_t
+	return syscall.Fstat(fd, &st) == nil
+}
+
+func TestAdoptableSocketDescriptor(t *testing.T) {
+	tl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := rawFD(t, tl)
+	sock, err := postsocket.AdoptableSocket(fd)
+	if err != nil {
+		syscall.Close(fd)
+		t.Fatal(err)
+	}
+	l, ok := sock.(net.Listener)
+	if !ok {
+		t.Fatalf("adopted listening socket as %T, want net.Listener", sock)
+	}
+	l.Close()
+	if fdOpen(fd) {
+		syscall.Close(fd)
+		t.Error("adopted descriptor left open")
+	}
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd = rawFD(t, uc)
+	sock, err = postsocket.AdoptableSocket(uintptr(fd))
+	if err != nil {
+		syscall.Close(fd)
+		t.Fatal(err)
+	}
+	pc, ok := sock.(net.PacketConn)
+	if !ok {
+		t.Fatalf("adopted UDP socket as %T, want net.PacketConn", sock)
+	}
+	pc.Close()
+}
+
+func TestAdoptableSocketFailureKeepsDescriptor(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fd := rawFD(t, r)
+	defer syscall.Close(fd)
+
+	if _, err := postsocket.AdoptableSocket(fd); err == nil {
+		t.Fatal("adopted a pipe")
+	}
+	if !fdOpen(fd) {
+		t.Error("descriptor closed after failed adoption")
+	}
+}
+
+func TestInferTransportParameters(t *testing.T) {
+	dir := t.TempDir()
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	ug, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "gram"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ug.Close()
+	up, err := net.Listen("unixpacket", filepath.Join(dir, "packet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	ugFile, err := ug.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ugFile.Close()
+	upFile, err := up.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upFile.Close()
+	tlFile, err := tl.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlFile.Close()
+
+	reliable := [2]postsocket.Preference{postsocket.PrefRequire, postsocket.PrefRequire}
+	tests := []struct {
+		name string
+		sock interface{}
+		want [2]postsocket.Preference // FullyReliable, OrderPreserved
+	}{
+		{"tcp listener", tl, reliable},
+		{"tcp file", tlFile, reliable},
+		{"tcp fd", int(tlFile.Fd()), reliable},
+		{"udp", uc, [2]postsocket.Preference{postsocket.PrefProhibit, postsocket.PrefProhibit}},
+		{"unixgram fd", ugFile.Fd(), [2]postsocket.Preference{postsocket.PrefRequire, postsocket.PrefIgnore}},
+		{"unixpacket file", upFile, reliable},
+	}
+
+	ctx := sim.NewNetwork(sim.NewClock(time.Unix(0, 0))).NewContext(net.IPv4(10, 0, 0, 1))
+	for _, tt := range tests {
+		tp, err := postsocket.InferTransportParameters(ctx.NewTransportParameters(), tt.sock)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		pp := tp.(postsocket.PreferenceParameters)
+		got := [2]postsocket.Preference{}
+		got[0], _ = pp.Preference(postsocket.TransportFullyReliable)
+		got[1], _ = pp.Preference(postsocket.TransportOrderPreserved)
+		if got != tt.want {
+			t.Errorf("%s: FullyReliable, OrderPreserved are %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Inspected descriptors remain open and usable.
+	if !fdOpen(int(tlFile.Fd())) {
+		t.Error("inspected descriptor closed")
+	}
+
+	if _, err := postsocket.InferTransportParameters(ctx.NewTransportParameters(), -1); err == nil {
+		t.Error("inferred parameters for an invalid descriptor")
+	}
+	if _, err := postsocket.InferTransportParameters(ctx.NewTransportParameters(), "socket"); err == nil {
+		t.Error("inferred parameters for a string")
+	}
+}
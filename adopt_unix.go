@@ -0,0 +1,71 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+
+package postsocket
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// isListeningSocket returns true if f is a socket in the listening state.
+func isListeningSocket(f *os.File) (bool, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+
+	var accepting int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		accepting, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	}); err != nil {
+		return false, err
+	}
+	if serr != nil {
+		return false, serr
+	}
+	return accepting != 0, nil
+}
+
+// dupFD returns a duplicate of a file descriptor, with close-on-exec set.
+func dupFD(fd int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(dup)
+	return dup, nil
+}
+
+// fdNetwork returns the network name of a socket file descriptor, as the
+// Network method of its local address would give, from its type and the
+// family of its local address. The descriptor is only inspected.
+func fdNetwork(fd int) (string, error) {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return "", err
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return "", err
+	}
+	_, unix := sa.(*syscall.SockaddrUnix)
+	switch {
+	case typ == syscall.SOCK_STREAM && unix:
+		return "unix", nil
+	case typ == syscall.SOCK_STREAM:
+		return "tcp", nil
+	case typ == syscall.SOCK_DGRAM && unix:
+		return "unixgram", nil
+	case typ == syscall.SOCK_DGRAM:
+		return "udp", nil
+	case typ == syscall.SOCK_SEQPACKET && unix:
+		return "unixpacket", nil
+	case typ == syscall.SOCK_RAW:
+		return "ip", nil
+	}
+	return "", fmt.Errorf("unsupported socket type %d", typ)
+}
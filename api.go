@@ -19,11 +19,25 @@ package postsocket
 import (
 	"crypto"
 	"crypto/tls"
+	"errors"
 	"io"
+	"log/slog"
 	"net"
 	"time"
 )
 
+// Errors reported by the adapters in this package, for Messages and
+// Connections whose fate is signaled through events rather than returns.
+var (
+	// ErrExpired is reported when a Message's lifetime expired before it
+	// could be sent.
+	ErrExpired = errors.New("postsocket: message lifetime expired")
+
+	// ErrClosed is reported when an operation is attempted on, or was
+	// pending on, a Connection that has closed.
+	ErrClosed = errors.New("postsocket: connection closed")
+)
+
 // TransportContext encapsulates all the state kept by the API at a single
 // endpoint, and is the "root" of the API. It can be used to create new
 // default transport and security parameters, locals and remotes bound to the
@@ -37,14 +51,25 @@ type TransportContext interface {
 
 	// NewTransportParameters creates a new TransportParameters object with
 	// system and user defaults for this TransportContext. The specification
-	// of system and user defaults is implementation-specific.
+	// of system and user defaults is implementation-specific, but includes
+	// those of any Policy loaded with LoadPolicy.
 	NewTransportParameters() TransportParameters
 
 	// NewSecurityParameters creates a new SecurityParameters object with
 	// system and user defaults for this TransportContext. The specification
-	// of system and user defaults is implementation-specific.
+	// of system and user defaults is implementation-specific, but includes
+	// those of any Policy loaded with LoadPolicy.
 	NewSecurityParameters() SecurityParameters
 
+	// LoadPolicy loads a Policy from a policy file, as by the LoadPolicy
+	// function, replacing any Policy loaded before. Its defaults apply to
+	// parameters subsequently created with NewTransportParameters and
+	// NewSecurityParameters, and its destination policies to those of
+	// Connections subsequently initiated to Remotes they match, overriding
+	// the parameters the application gave. Errors in the file are
+	// PolicyErrors, and leave the current Policy in place.
+	LoadPolicy(filename string) error
+
 	// NewRemore creates a new, empty Remote specifier.
 	NewRemote() Remote
 
@@ -104,6 +129,78 @@ type TransportContext interface {
 	// Connection(s), with this Connection as antecedent.
 	Listen(evh EventHandler, loc Local, tp TransportParameters, sp SecurityParameters) (Connection, error)
 
+	// Adopt wraps an existing socket, owned until now by the application, in
+	// a Connection with the given event and framing handlers. Either handler
+	// may be nil, in which case the context defaults are used. The socket may
+	// be a net.Conn, a net.PacketConn, a net.Listener, an *os.File, or a raw
+	// file descriptor as an int or uintptr; see AdoptableSocket. The
+	// Connection takes ownership of the socket, and its transport parameters
+	// are inferred from the socket type as by InferTransportParameters. For
+	// a connected socket, the EventHandler's Ready callback will be called
+	// with this connection and a nil antecedent; for a listening socket, the
+	// returned Connection behaves as one returned by Listen.
+	Adopt(evh EventHandler, fh FramingHandler, sock interface{}) (Connection, error)
+
+	// Intercept adds interceptors to this context, to be applied to every
+	// Connection subsequently created within it, whether by initiation,
+	// rendezvous, acceptance, cloning, or adoption. Interceptors compose as by
+	// ChainInterceptors, in the order declared across all calls to
+	// Intercept: the first interceptor added is outermost.
+	Intercept(ics ...Interceptor)
+
+	// Metrics returns the metrics collected for this context, which also
+	// serve as an http.Handler exposing them to Prometheus. Implementations
+	// apply the Metrics' Interceptor to every Connection in this context, in
+	// addition to recording connection lifecycle events.
+	Metrics() *Metrics
+
+	// SetTracer sets a Tracer to record a timeline of events on every
+	// Connection subsequently created within this context, from resolution
+	// and candidate racing through Message transfer to close. Tracing is
+	// disabled by default; pass nil to disable it again.
+	SetTracer(t *Tracer)
+
+	// SetPacketCapture sets a PacketCapture to record the packets emitted
+	// and received by userland protocol stacks on every Connection
+	// subsequently created within this context, along with the TLS secrets
+	// of those Connections. Stacks implemented in the kernel, such as TCP,
+	// are not captured. Capture is disabled by default; pass nil to disable
+	// it again.
+	SetPacketCapture(c *PacketCapture)
+
+	// SetLogger sets a structured logger for events internal to this
+	// context, such as resolution, candidate racing and protocol errors.
+	// Records concerning a Connection carry the attributes returned by
+	// ConnectionAttrs. Logging is disabled by default; pass nil to disable
+	// it again.
+	SetLogger(l *slog.Logger)
+
+	// Connections returns all live Connections in this context: those which
+	// have been created and have not yet Closed, including listening
+	// Connections.
+	Connections() []Connection
+
+	// SetResolver sets the Resolver used to resolve hostnames and service
+	// names in the Remotes and Locals of Connections subsequently created
+	// within this context. The default is SystemResolver. For Remotes
+	// giving both hostnames and service names, endpoints are discovered with
+	// ResolveService if the Resolver is an SRVResolver or SVCBResolver.
+	SetResolver(r Resolver)
+
+	// ResolutionCache returns the cache through which all Connections in
+	// this context resolve hostnames, using the Resolver set with
+	// SetResolver. The cache is saved and restored with the context's state
+	// by Save and Restore, so that a restored context may race the
+	// addresses last known while it revalidates them.
+	ResolutionCache() *ResolutionCache
+
+	// SetClock sets the Clock used for all timing within this context.
+	// The default is SystemClock. A context whose timing is fixed by its
+	// implementation, such as a simulated context running on the Clock of
+	// its simulated network, may ignore the Clock given; its documentation
+	// says so.
+	SetClock(c Clock)
+
 	// Save this context's state to a file on disk. The format of this state
 	// file is not specified and not necessarily portable across
 	// implementations of the API.
@@ -143,7 +240,9 @@ type Remote interface {
 // resolution error will be reported via the EventHandler when Intiate,
 // Listen, or Rendezvous is called.
 type Local interface {
-	// Return a local specifier with the given local network interface name or alias added to this specifier
+	// Return a local specifier with the given local network interface name or alias added to this specifier.
+	// Aliases are the built-in ones ("loopback", "any-ipv4", "any-ipv6") and
+	// those of the context's Policy; see ExpandInterface.
 	WithInterface(iface string) Local
 
 	// Return a local specifier with the given hostname added to this specifier
@@ -425,6 +524,30 @@ type Connection interface {
 
 	// GetTransportParameters returns this connection's current transport parameter set.
 	GetTransportParameters() TransportParameters
+
+	// LocalAddr returns the local address of the path selected for this
+	// connection, or nil if no path has been selected yet.
+	LocalAddr() net.Addr
+
+	// RemoteAddr returns the remote address of the path selected for this
+	// connection, or nil if no path has been selected yet or if this is a
+	// listening Connection.
+	RemoteAddr() net.Addr
+
+	// Stats returns statistics on this connection's traffic and path so
+	// far. Returns an error if statistics are not available for the
+	// selected protocol stack.
+	Stats() (ConnectionStats, error)
+
+	// Info returns a description of this connection for logging, tracing
+	// and debugging.
+	Info() ConnectionInfo
+
+	// Logger returns a logger scoped to this connection, derived from the
+	// context's logger as by ConnectionLogger, for the application's own
+	// logging about this connection. If the context has no logger, the
+	// returned logger discards all records.
+	Logger() *slog.Logger
 }
 
 // Message provides the interface implemented by received Messages passed to a
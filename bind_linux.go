@@ -0,0 +1,40 @@
+//go:build linux
+
+package postsocket
+
+import (
+	"log/slog"
+	"syscall"
+)
+
+// BindToDeviceControl returns a function for the Control member of a
+// net.Dialer or net.ListenConfig that binds sockets to the named interface
+// with SO_BINDTODEVICE, so that their traffic only uses that interface.
+// Advertise installs it on the mDNS sockets of an advertisement on an
+// interface; nothing in this package opens sockets for Connections, so it
+// is up to TransportContext implementations over the host's sockets to
+// install it for Locals naming an interface. Where the process is not permitted to
+// bind, as before Linux 5.7 without CAP_NET_RAW, sockets are left to their
+// local address alone, and a warning is logged to l if it is not nil. An
+// empty name leaves sockets unbound.
+func BindToDeviceControl(name string, l *slog.Logger) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		if name == "" {
+			return nil
+		}
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			serr = syscall.BindToDevice(int(fd), name)
+		}); err != nil {
+			return err
+		}
+		if serr == syscall.EPERM {
+			if l != nil {
+				l.Warn("not permitted to bind socket to interface",
+					"interface", name, "network", network, "address", address)
+			}
+			return nil
+		}
+		return serr
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package postsocket
+
+import (
+	"log/slog"
+	"syscall"
+)
+
+// BindToDeviceControl returns a function for the Control member of a
+// net.Dialer or net.ListenConfig. SO_BINDTODEVICE is only supported on
+// Linux, so elsewhere sockets are left to their local address alone, and a
+// warning is logged to l if it is not nil.
+func BindToDeviceControl(name string, l *slog.Logger) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, _ syscall.RawConn) error {
+		if name != "" && l != nil {
+			l.Warn("cannot bind socket to interface on this platform",
+				"interface", name, "network", network, "address", address)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,137 @@
+package postsocket
+
+import (
+	"context"
+	"net"
+)
+
+// SyncContext wraps a TransportContext to provide a synchronous API, in
+// which each call blocks until the event it implies has occurred, or until
+// a given context.Context is done. Events not consumed by the synchronous
+// API, such as Error events not related to a Message sent with
+// SyncConn.Send, are passed on to the EventHandler given to NewSyncContext.
+type SyncContext struct {
+	tc  TransportContext
+	evh EventHandler
+}
+
+// NewSyncContext creates a SyncContext wrapping the given TransportContext.
+// Events not consumed by the synchronous API are passed to evh, which may be
+// nil to discard them.
+func NewSyncContext(tc TransportContext, evh EventHandler) *SyncContext {
+	return &SyncContext{tc: tc, evh: evh}
+}
+
+// SyncConn wraps a Connection to provide a synchronous API.
+type SyncConn struct {
+	a *adapter
+}
+
+// SyncListener wraps a listening Connection to provide a synchronous API.
+type SyncListener struct {
+	l *acceptor
+}
+
+// Dial initiates a Connection with the given remote, local, and parameters,
+// and waits until it is Ready. Any of these except Remote may be nil, in
+// which case context defaults will be used. If ctx is done before the
+// Connection is Ready, the Connection is closed and ctx.Err() is returned;
+// if the Connection closes before it is Ready, the error it closed with is
+// returned.
+func (sc *SyncContext) Dial(ctx context.Context, rem Remote, loc Local, tp TransportParameters, sp SecurityParameters) (*SyncConn, error) {
+	a := newAdapter(nil, sc.evh)
+	pc, err := sc.tc.Preconnect(a, nil, rem, loc, tp, sp)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pc.Initiate()
+	if err != nil {
+		return nil, err
+	}
+	a.setConn(conn)
+
+	select {
+	case <-a.ready:
+		return &SyncConn{a: a}, nil
+	case <-a.closed:
+		return nil, a.closedError()
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Listen listens on the given Local with optional transport and security
+// parameters, as TransportContext.Listen. Use Accept on the returned
+// SyncListener to wait for accepted Connections.
+func (sc *SyncContext) Listen(loc Local, tp TransportParameters, sp SecurityParameters) (*SyncListener, error) {
+	lconn, err := sc.tc.Listen(sc.evh, loc, tp, sp)
+	if err != nil {
+		return nil, err
+	}
+	return &SyncListener{l: newAcceptor(lconn)}, nil
+}
+
+// Accept waits for the next Connection accepted by this listener. If ctx is
+// done first, ctx.Err() is returned; Connections accepted later remain
+// available to subsequent calls to Accept.
+func (sl *SyncListener) Accept(ctx context.Context) (*SyncConn, error) {
+	a, err := sl.l.accept(ctx.Done())
+	if err == errCanceled {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, err
+	}
+	return &SyncConn{a: a}, nil
+}
+
+// Close closes the listening Connection.
+func (sl *SyncListener) Close() error {
+	return sl.l.lconn.Close()
+}
+
+// Addr returns the local address the listening Connection is bound to.
+func (sl *SyncListener) Addr() net.Addr {
+	return sl.l.lconn.LocalAddr()
+}
+
+// Connection returns the listening Connection wrapped by this listener.
+func (sl *SyncListener) Connection() Connection {
+	return sl.l.lconn
+}
+
+// Send sends a Message on this Connection, as Connection.Send, and waits
+// until it has been Sent. It returns ErrExpired if the Message's lifetime
+// expired, or the error given on an Error event for the Message. If ctx is
+// done first, ctx.Err() is returned; the Message may nevertheless still be
+// sent, as a Send cannot be withdrawn.
+func (c *SyncConn) Send(ctx context.Context, msg interface{}, sp SendParameters) error {
+	err := c.a.send(msg, sp, ctx.Done())
+	if err == errCanceled {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Receive waits for the next Message received on this Connection. If ctx is
+// done first, ctx.Err() is returned, and the Message, when it arrives, is
+// returned by the next call to Receive. Once the Connection has closed and
+// all Messages received have been returned, Receive returns the error the
+// Connection closed with, or ErrClosed.
+func (c *SyncConn) Receive(ctx context.Context) (Message, error) {
+	msg, err := c.a.receive(ctx.Done())
+	if err == errCanceled {
+		return nil, ctx.Err()
+	}
+	return msg, err
+}
+
+// Close closes this Connection.
+func (c *SyncConn) Close() error {
+	return c.a.conn.Close()
+}
+
+// Connection returns the Connection wrapped by this SyncConn.
+func (c *SyncConn) Connection() Connection {
+	return c.a.conn
+}
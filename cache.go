@@ -0,0 +1,312 @@
+package postsocket
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for a ResolutionCache.
+const (
+	// DefaultResolutionTTL is the time to live of answers from Resolvers
+	// that do not give one.
+	DefaultResolutionTTL = time.Minute
+
+	// DefaultResolutionMaxStale is how long after their expiry answers may
+	// be served stale, as suggested by RFC 8767.
+	DefaultResolutionMaxStale = 24 * time.Hour
+
+	// DefaultResolutionCacheSize is the number of hostnames cached.
+	DefaultResolutionCacheSize = 1024
+)
+
+// TTLResolver is implemented by Resolvers that know how long the addresses
+// they return may be cached, such as DNSResolver.
+type TTLResolver interface {
+	Resolver
+
+	// LookupIPTTL returns the IPv4 and IPv6 addresses of a host, as
+	// LookupIP, with the time for which they may be cached.
+	LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// ResolutionCache is a Resolver caching the addresses of hostnames looked
+// up through another Resolver, for the time to live of each answer if the
+// Resolver is a TTLResolver, and for a default time otherwise; answers
+// with a zero time to live are not cached. A TransportContext resolves the
+// hostnames of all its Connections through its ResolutionCache, and saves
+// and restores the cache with its state.
+//
+// Once an answer expires, it is served stale for a while longer, so that
+// candidate racing can begin with the addresses last known while the
+// answer is revalidated in the background; this lets a TransportContext
+// restored from saved state begin connecting before fresh answers arrive.
+// Answers past this grace period are looked up again before returning.
+// Service lookups are passed through uncached. All methods may be called
+// concurrently. The zero ResolutionCache is not usable; create one with
+// NewResolutionCache.
+type ResolutionCache struct {
+	mu       sync.Mutex
+	res      Resolver
+	clock    Clock
+	ttl      time.Duration
+	maxStale time.Duration
+	size     int
+	entries  map[string]*resolutionEntry
+}
+
+type resolutionEntry struct {
+	addrs        []net.IP
+	expires      time.Time
+	revalidating bool
+}
+
+// NewResolutionCache creates an empty ResolutionCache looking up hostnames
+// through r, or through SystemResolver if r is nil.
+func NewResolutionCache(r Resolver) *ResolutionCache {
+	if r == nil {
+		r = SystemResolver
+	}
+	return &ResolutionCache{
+		res:      r,
+		clock:    SystemClock,
+		ttl:      DefaultResolutionTTL,
+		maxStale: DefaultResolutionMaxStale,
+		size:     DefaultResolutionCacheSize,
+		entries:  make(map[string]*resolutionEntry),
+	}
+}
+
+// SetResolver sets the Resolver through which hostnames are looked up, or
+// SystemResolver if r is nil. Answers already cached are kept.
+func (c *ResolutionCache) SetResolver(r Resolver) {
+	if r == nil {
+		r = SystemResolver
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.res = r
+}
+
+// SetClock sets the Clock against which answers expire, and on which
+// stale answers are revalidated, which should be that of the
+// TransportContext using the cache. The default is SystemClock.
+func (c *ResolutionCache) SetClock(clock Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clock
+}
+
+// SetLimits sets the time to live of answers from Resolvers that do not
+// give one, how long answers are served stale after they expire, and the
+// number of hostnames cached, beyond which those expiring soonest are
+// evicted. Zero values leave the corresponding limit unchanged.
+func (c *ResolutionCache) SetLimits(ttl, maxStale time.Duration, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl > 0 {
+		c.ttl = ttl
+	}
+	if maxStale > 0 {
+		c.maxStale = maxStale
+	}
+	if size > 0 {
+		c.size = size
+	}
+}
+
+// Flush empties the cache.
+func (c *ResolutionCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*resolutionEntry)
+}
+
+// Lookup returns the cached addresses of a host without looking it up, and
+// whether they are stale. It returns nil if the host has no answer cached,
+// or only one past being served stale.
+func (c *ResolutionCache) Lookup(host string) (addrs []net.IP, stale bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[resolutionKey(host)]
+	if e == nil {
+		return nil, false
+	}
+	now := c.clock.Now()
+	if !now.Before(e.expires.Add(c.maxStale)) {
+		return nil, false
+	}
+	return append([]net.IP(nil), e.addrs...), !now.Before(e.expires)
+}
+
+// LookupIP implements Resolver, returning cached addresses if fresh or
+// still within the stale grace period, and revalidating stale ones in the
+// background. If the background lookup fails, the stale answer is kept.
+func (c *ResolutionCache) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	key := resolutionKey(host)
+
+	c.mu.Lock()
+	res := c.res
+	if e := c.entries[key]; e != nil {
+		now := c.clock.Now()
+		if now.Before(e.expires.Add(c.maxStale)) {
+			addrs := append([]net.IP(nil), e.addrs...)
+			if !now.Before(e.expires) && !e.revalidating {
+				e.revalidating = true
+				c.clock.AfterFunc(0, func() { c.revalidate(res, key, host) })
+			}
+			c.mu.Unlock()
+			return addrs, nil
+		}
+	}
+	c.mu.Unlock()
+
+	addrs, ttl, err := lookupIPTTL(ctx, res, host)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, addrs, ttl)
+	return addrs, nil
+}
+
+// revalidate looks up a host with a stale answer in the background.
+func (c *ResolutionCache) revalidate(res Resolver, key, host string) {
+	addrs, ttl, err := lookupIPTTL(context.Background(), res, host)
+	if err != nil {
+		c.mu.Lock()
+		if e := c.entries[key]; e != nil {
+			e.revalidating = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.store(key, addrs, ttl)
+}
+
+// store caches an answer, with the default time to live if ttl is
+// negative, evicting the entry expiring soonest if the cache is full. An
+// answer with a zero time to live is not cached, and replaces any answer
+// cached before.
+func (c *ResolutionCache) store(key string, addrs []net.IP, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl < 0 {
+		ttl = c.ttl
+	}
+	if ttl == 0 {
+		delete(c.entries, key)
+		return
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		var oldest string
+		for k, e := range c.entries {
+			if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = &resolutionEntry{
+		addrs:   append([]net.IP(nil), addrs...),
+		expires: c.clock.Now().Add(ttl),
+	}
+}
+
+// lookupIPTTL looks up a host through r, returning a negative time to live
+// if r does not give one.
+func lookupIPTTL(ctx context.Context, r Resolver, host string) ([]net.IP, time.Duration, error) {
+	if tr, ok := r.(TTLResolver); ok {
+		return tr.LookupIPTTL(ctx, host)
+	}
+	addrs, err := r.LookupIP(ctx, host)
+	return addrs, -1, err
+}
+
+func resolutionKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// LookupPort implements Resolver, passing the lookup through uncached.
+func (c *ResolutionCache) LookupPort(ctx context.Context, network, service string) (int, error) {
+	c.mu.Lock()
+	res := c.res
+	c.mu.Unlock()
+	return res.LookupPort(ctx, network, service)
+}
+
+// LookupSRV implements SRVResolver, passing the lookup through uncached if
+// the cache's Resolver is an SRVResolver, and failing as for a service
+// with no records otherwise.
+func (c *ResolutionCache) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	c.mu.Lock()
+	res := c.res
+	c.mu.Unlock()
+	if sr, ok := res.(SRVResolver); ok {
+		return sr.LookupSRV(ctx, service, proto, name)
+	}
+	return nil, &net.DNSError{Err: "SRV lookup not supported", Name: name, IsNotFound: true}
+}
+
+// LookupSVCB implements SVCBResolver, passing the lookup through uncached
+// if the cache's Resolver is an SVCBResolver, and failing as for a service
+// with no records otherwise.
+func (c *ResolutionCache) LookupSVCB(ctx context.Context, service, host string) ([]SVCBRecord, error) {
+	c.mu.Lock()
+	res := c.res
+	c.mu.Unlock()
+	if sr, ok := res.(SVCBResolver); ok {
+		return sr.LookupSVCB(ctx, service, host)
+	}
+	return nil, &net.DNSError{Err: "SVCB lookup not supported", Name: host, IsNotFound: true}
+}
+
+// savedResolution is a cached answer as saved by MarshalJSON.
+type savedResolution struct {
+	Host      string    `json:"host"`
+	Addresses []net.IP  `json:"addresses"`
+	Expires   time.Time `json:"expires"`
+}
+
+// MarshalJSON implements json.Marshaler, saving the cached answers with
+// their expiry times, for a TransportContext to save with its state.
+func (c *ResolutionCache) MarshalJSON() ([]byte, error) {
+	c.mu.Lock()
+	saved := make([]savedResolution, 0, len(c.entries))
+	for host, e := range c.entries {
+		saved = append(saved, savedResolution{Host: host, Addresses: e.addrs, Expires: e.expires})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Host < saved[j].Host })
+	return json.Marshal(saved)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, replacing the cached answers
+// with those saved by MarshalJSON. Answers expired since they were saved
+// are served stale while revalidated, and those past being served stale
+// are dropped.
+func (c *ResolutionCache) UnmarshalJSON(b []byte) error {
+	var saved []savedResolution
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	c.entries = make(map[string]*resolutionEntry, len(saved))
+	for _, s := range saved {
+		if len(s.Addresses) == 0 || !now.Before(s.Expires.Add(c.maxStale)) {
+			continue
+		}
+		c.entries[resolutionKey(s.Host)] = &resolutionEntry{addrs: s.Addresses, expires: s.Expires}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package postsocket_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// ttlResolver answers every lookup with the same addresses and time to
+// live, counting the lookups made.
+type ttlResolver struct {
+	addrs   []net.IP
+	ttl     time.Duration
+	err     error
+	lookups int
+}
+
+func (r *ttlResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, _, err := r.LookupIPTTL(ctx, host)
+	return addrs, err
+}
+
+func (r *ttlResolver) LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	return r.addrs, r.ttl, nil
+}
+
+func (r *ttlResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return 0, errors.New("no ports")
+}
+
+func newTestCache(r postsocket.Resolver) (*postsocket.ResolutionCache, *sim.Clock) {
+	clock := sim.NewClock(time.Unix(0, 0))
+	c := postsocket.NewResolutionCache(r)
+	c.SetClock(clock)
+	c.SetLimits(0, time.Minute, 0)
+	return c, clock
+}
+
+func TestResolutionCacheServeStale(t *testing.T) {
+	oldAddrs := []net.IP{net.IPv4(192, 0, 2, 1)}
+	newAddrs := []net.IP{net.IPv4(192, 0, 2, 2)}
+	r := &ttlResolver{addrs: oldAddrs, ttl: 10 * time.Second}
+	c, clock := newTestCache(r)
+	ctx := context.Background()
+
+	lookup := func(want []net.IP, lookups int) {
+		t.Helper()
+		addrs, err := c.LookupIP(ctx, "Example.test.")
+		if err != nil || !reflect.DeepEqual(addrs, want) {
+			t.Errorf("LookupIP returned %v, %v; want %v", addrs, err, want)
+		}
+		if r.lookups != lookups {
+			t.Errorf("%d lookups through the Resolver, want %d", r.lookups, lookups)
+		}
+	}
+
+	lookup(oldAddrs, 1)
+	clock.RunFor(5 * time.Second)
+	lookup(oldAddrs, 1)
+
+	// Once expired, the answer is served stale and revalidated once on
+	// the Clock, however many times it is looked up meanwhile.
+	r.addrs = newAddrs
+	clock.RunFor(10 * time.Second)
+	lookup(oldAddrs, 1)
+	lookup(oldAddrs, 1)
+	if addrs, stale := c.Lookup("example.test"); !stale || !reflect.DeepEqual(addrs, oldAddrs) {
+		t.Errorf("Lookup returned %v, stale %v; want the old answer, stale", addrs, stale)
+	}
+	clock.RunFor(0)
+	if r.lookups != 2 {
+		t.Errorf("%d lookups through the Resolver, want 2 after revalidation", r.lookups)
+	}
+	if addrs, stale := c.Lookup("example.test"); stale || !reflect.DeepEqual(addrs, newAddrs) {
+		t.Errorf("Lookup returned %v, stale %v; want the new answer, fresh", addrs, stale)
+	}
+	lookup(newAddrs, 2)
+
+	// A failed revalidation keeps the stale answer, and a later lookup
+	// revalidates again.
+	r.err = &net.DNSError{Err: "server failure", Name: "example.test", IsTemporary: true}
+	clock.RunFor(15 * time.Second)
+	lookup(newAddrs, 2)
+	clock.RunFor(0)
+	lookup(newAddrs, 3)
+	clock.RunFor(0)
+	if r.lookups != 4 {
+		t.Errorf("%d lookups through the Resolver, want 4 after a second revalidation", r.lookups)
+	}
+
+	// Past the grace period, the answer is looked up before returning.
+	r.err = nil
+	clock.RunFor(time.Minute)
+	if addrs, _ := c.Lookup("example.test"); addrs != nil {
+		t.Errorf("Lookup returned %v past the grace period", addrs)
+	}
+	r.addrs = oldAddrs
+	lookup(oldAddrs, 5)
+}
+
+func TestResolutionCacheZeroTTL(t *testing.T) {
+	addrs := []net.IP{net.IPv4(192, 0, 2, 1)}
+	r := &ttlResolver{addrs: addrs}
+	c, clock := newTestCache(r)
+	ctx := context.Background()
+
+	for i := 1; i <= 2; i++ {
+		if _, err := c.LookupIP(ctx, "example.test"); err != nil {
+			t.Fatal(err)
+		}
+		if r.lookups != i {
+			t.Errorf("%d lookups through the Resolver, want %d: zero TTL answer cached", r.lookups, i)
+		}
+	}
+
+	// An answer with a zero TTL replaces one cached before.
+	r.ttl = time.Second
+	c.LookupIP(ctx, "example.test")
+	clock.RunFor(2 * time.Second)
+	r.ttl = 0
+	c.LookupIP(ctx, "example.test")
+	clock.RunFor(0)
+	if cached, _ := c.Lookup("example.test"); cached != nil {
+		t.Errorf("Lookup returned %v after revalidation with zero TTL", cached)
+	}
+}
+
+func TestResolutionCacheDefaultTTL(t *testing.T) {
+	// A Resolver that gives no TTL has its answers cached for the default.
+	r := &ttlResolver{addrs: []net.IP{net.IPv4(192, 0, 2, 1)}}
+	c, clock := newTestCache(struct{ postsocket.Resolver }{r})
+	c.SetLimits(30*time.Second, 0, 0)
+	c.LookupIP(context.Background(), "example.test")
+	clock.RunFor(29 * time.Second)
+	if _, stale := c.Lookup("example.test"); stale {
+		t.Error("answer stale before the default TTL")
+	}
+	clock.RunFor(time.Second)
+	if _, stale := c.Lookup("example.test"); !stale {
+		t.Error("answer fresh after the default TTL")
+	}
+}
+
+func TestResolutionCacheSaveRestore(t *testing.T) {
+	r := &ttlResolver{addrs: []net.IP{net.IPv4(192, 0, 2, 1)}, ttl: 10 * time.Second}
+	c, clock := newTestCache(r)
+	c.LookupIP(context.Background(), "example.test")
+	b, err := c.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored after expiry, the answer is served stale; restored past
+	// the grace period, it is dropped.
+	for _, tc := range []struct {
+		after time.Duration
+		stale bool
+	}{
+		{5 * time.Second, false},
+		{30 * time.Second, true},
+		{2 * time.Minute, false},
+	} {
+		restored, rclock := newTestCache(r)
+		rclock.RunFor(clock.Now().Sub(rclock.Now()) + tc.after)
+		if err := restored.UnmarshalJSON(b); err != nil {
+			t.Fatal(err)
+		}
+		addrs, stale := restored.Lookup("example.test")
+		wantAddrs := tc.after < 70*time.Second
+		if (addrs != nil) != wantAddrs || stale != tc.stale {
+			t.Errorf("restored after %v: Lookup returned %v, stale %v", tc.after, addrs, stale)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package postsocket
+
+import "time"
+
+// Clock is the source of time for an implementation of this API. Every
+// timeout, Message lifetime, racing delay and keepalive is measured and
+// scheduled through the Clock set with TransportContext.SetClock, so that a
+// simulated clock can drive an implementation through time deterministically
+// and without waiting.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f in its own
+	// goroutine, or in the goroutine driving a simulated clock. It returns a
+	// Timer that can be used to cancel the call.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call scheduled with Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the call from happening. It returns false if the call
+	// has already happened or been stopped.
+	Stop() bool
+}
+
+// SystemClock is the Clock of the system's wall time, using the time
+// package. It is the default Clock of a TransportContext.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,146 @@
+package postsocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// debugConnection is the view of a Connection rendered by the debug handler.
+type debugConnection struct {
+	ConnectionInfo
+	Local      string
+	Remote     string
+	Stats      *ConnectionStats `json:",omitempty"`
+	StatsError string           `json:",omitempty"`
+	Parameters []debugParameter `json:",omitempty"`
+}
+
+type debugParameter struct {
+	Name  string
+	Value string
+}
+
+func newDebugConnection(conn Connection, detail bool) debugConnection {
+	dc := debugConnection{
+		ConnectionInfo: conn.Info(),
+		Local:          addrString(conn.LocalAddr()),
+		Remote:         addrString(conn.RemoteAddr()),
+	}
+	if stats, err := conn.Stats(); err != nil {
+		dc.StatsError = err.Error()
+	} else {
+		dc.Stats = &stats
+	}
+
+	if detail {
+		if tp := conn.GetTransportParameters(); tp != nil {
+			for _, p := range transportParameterIDs() {
+				if v, err := tp.Get(p); err == nil {
+					dc.Parameters = append(dc.Parameters, debugParameter{p.String(), fmt.Sprint(v)})
+				}
+			}
+		}
+	}
+	return dc
+}
+
+// debugHandler serves the debug pages of a TransportContext.
+type debugHandler struct {
+	tc TransportContext
+}
+
+// NewDebugHandler returns an http.Handler for inspecting the live
+// Connections of a TransportContext. Its root lists every live Connection
+// with its addresses, selected protocol stack, connection group, pending
+// Receive count and statistics; the path conn/ID, relative to the root,
+// shows the Connection with the given identifier in detail, including its
+// transport parameter values. Add the query parameter format=json to
+// either page for a JSON rendering. Mount the handler under a prefix with
+// http.StripPrefix.
+func NewDebugHandler(tc TransportContext) http.Handler {
+	return debugHandler{tc}
+}
+
+// ServeHTTP implements http.Handler.
+func (h debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	asJSON := r.URL.Query().Get("format") == "json"
+
+	if path == "" {
+		conns := h.tc.Connections()
+		list := make([]debugConnection, len(conns))
+		for i, conn := range conns {
+			list[i] = newDebugConnection(conn, false)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		h.render(w, asJSON, debugListTemplate, list)
+		return
+	}
+
+	idstr := strings.TrimPrefix(path, "conn/")
+	id, err := strconv.ParseUint(idstr, 10, 64)
+	if idstr == path || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, conn := range h.tc.Connections() {
+		if conn.Info().ID == id {
+			h.render(w, asJSON, debugDetailTemplate, newDebugConnection(conn, true))
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("no live connection %d", id), http.StatusNotFound)
+}
+
+func (h debugHandler) render(w http.ResponseWriter, asJSON bool, t *template.Template, v interface{}) {
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+const debugStatsTemplate = `{{define "stats"}}{{with .Stats}}sent {{.MessagesSent}} msgs/{{.BytesSent}} B, received {{.MessagesReceived}} msgs/{{.BytesReceived}} B, expired {{.MessagesExpired}}, retransmitted {{.Retransmissions}}, srtt {{.SmoothedRTT}}, cwnd {{.CongestionWindow}} B, rate {{.DeliveryRate}} B/s{{else}}{{.StatsError}}{{end}}{{end}}`
+
+var debugListTemplate = template.Must(template.New("list").Parse(debugStatsTemplate + `<!DOCTYPE html>
+<html><head><title>postsocket connections</title></head>
+<body>
+<h1>Live connections ({{len .}})</h1>
+<table border="1" cellpadding="4">
+<tr><th>ID</th><th>Local</th><th>Remote</th><th>Stack</th><th>Security</th><th>Group</th><th>Pending receives</th><th>Stats</th></tr>
+{{range .}}<tr><td><a href="conn/{{.ID}}">{{.ID}}</a></td><td>{{.Local}}</td><td>{{.Remote}}</td><td>{{.Stack}}</td><td>{{.SecuritySuite}}</td><td>{{.Group}}</td><td>{{.PendingReceives}}</td><td>{{template "stats" .}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+var debugDetailTemplate = template.Must(template.New("detail").Parse(debugStatsTemplate + `<!DOCTYPE html>
+<html><head><title>postsocket connection {{.ID}}</title></head>
+<body>
+<h1>Connection {{.ID}}</h1>
+<p><a href="../">all connections</a></p>
+<table border="1" cellpadding="4">
+<tr><th>Local</th><td>{{.Local}}</td></tr>
+<tr><th>Remote</th><td>{{.Remote}}</td></tr>
+<tr><th>Stack</th><td>{{.Stack}}</td></tr>
+<tr><th>Security</th><td>{{.SecuritySuite}}</td></tr>
+<tr><th>Group</th><td>{{.Group}}</td></tr>
+<tr><th>Pending receives</th><td>{{.PendingReceives}}</td></tr>
+<tr><th>Stats</th><td>{{template "stats" .}}</td></tr>
+</table>
+<h2>Transport parameters</h2>
+<table border="1" cellpadding="4">
+{{range .Parameters}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
@@ -0,0 +1,82 @@
+package postsocket_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+func TestDebugHandler(t *testing.T) {
+	clock := sim.NewClock(time.Unix(0, 0))
+	n := sim.NewNetwork(clock)
+	ctx := n.NewContext(net.IPv4(10, 0, 0, 1))
+	tp := ctx.NewTransportParameters().Require(postsocket.TransportFullyReliable, true)
+	listener, err := ctx.Listen(nil, ctx.NewLocal().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), tp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clock.RunFor(time.Second)
+	id := listener.Info().ID
+
+	h := postsocket.NewDebugHandler(ctx)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	var list []struct {
+		ID    uint64
+		Local string
+		Stats *postsocket.ConnectionStats
+	}
+	w := get("/?format=json")
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("list: %v in %s", err, w.Body)
+	}
+	if len(list) != 1 || list[0].ID != id || list[0].Local != "10.0.0.1:7000" || list[0].Stats == nil {
+		t.Errorf("list is %+v, want the listener at 10.0.0.1:7000 with stats", list)
+	}
+
+	w = get("/")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("list Content-Type %q, want HTML", ct)
+	}
+	if link := fmt.Sprintf(`<a href="conn/%d">`, id); !strings.Contains(w.Body.String(), link) {
+		t.Errorf("list page does not link %s:\n%s", link, w.Body)
+	}
+
+	var detail struct {
+		ID         uint64
+		Parameters []struct{ Name, Value string }
+	}
+	w = get(fmt.Sprintf("/conn/%d?format=json", id))
+	if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil {
+		t.Fatalf("detail: %v in %s", err, w.Body)
+	}
+	if detail.ID != id {
+		t.Errorf("detail page for %d shows %d", id, detail.ID)
+	}
+	found := false
+	for _, p := range detail.Parameters {
+		found = found || p.Name == postsocket.ParameterIdentifier(postsocket.TransportFullyReliable).String() && p.Value == "true"
+	}
+	if !found {
+		t.Errorf("detail parameters %v do not include %v=true", detail.Parameters, postsocket.TransportFullyReliable)
+	}
+
+	for _, path := range []string{fmt.Sprintf("/conn/%d", id+1000), "/conn/x", "/other"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s returned %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
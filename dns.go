@@ -0,0 +1,563 @@
+package postsocket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNS record types and other constants, from RFC 1035, RFC 2782, RFC 3596
+// and RFC 9460.
+const (
+	dnsTypeA     = 1
+	dnsTypePTR   = 12
+	dnsTypeTXT   = 16
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+	dnsTypeSVCB  = 64
+	dnsTypeHTTPS = 65
+	dnsTypeANY   = 255
+	dnsClassIN   = 1
+
+	// SvcParamKeys, from RFC 9460.
+	svcParamALPN          = 1
+	svcParamNoDefaultALPN = 2
+	svcParamPort          = 3
+	svcParamIPv4Hint      = 4
+	svcParamECH           = 5
+	svcParamIPv6Hint      = 6
+
+	// svcbMaxAliases bounds the alias mode records followed in one lookup.
+	svcbMaxAliases = 8
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	dnsHeaderLength   = 12
+	dnsMaxUDPLength   = 1232 // as advertised by EDNS(0), per DNS Flag Day 2020
+	dnsTypeOPT        = 41
+	dnsMaxPointers    = 64 // bound on compression pointers followed in one name
+	dnsDefaultTimeout = 5 * time.Second
+)
+
+// DNSResolver is a Resolver querying a single DNS server directly, rather
+// than through the operating system's configuration; use it to resolve
+// through a split-horizon server, or through a stand-in server in tests.
+// Queries are made over UDP, and retried over TCP if the answer is
+// truncated, or over TCP only if Network is "tcp". Service names are
+// resolved to ports from the system's services database, as DNS has no
+// such mapping. The zero DNSResolver is not usable; create one with
+// NewDNSResolver.
+type DNSResolver struct {
+	// Server is the address of the DNS server, as a host and port.
+	Server string
+
+	// Network is "udp" or "tcp".
+	Network string
+
+	// Timeout bounds each query, in addition to any deadline of the
+	// context passed to the lookup.
+	Timeout time.Duration
+}
+
+// NewDNSResolver creates a DNSResolver querying the given server over UDP,
+// falling back to TCP. If server has no port, port 53 is used.
+func NewDNSResolver(server string) *DNSResolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	return &DNSResolver{Server: server, Network: "udp", Timeout: dnsDefaultTimeout}
+}
+
+// LookupIP implements Resolver, querying for A and AAAA records.
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := r.LookupIPTTL(ctx, host)
+	return ips, err
+}
+
+// LookupIPTTL implements TTLResolver, querying for A and AAAA records. The
+// time to live is the least of those of the records returned.
+func (r *DNSResolver) LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	var firstErr error
+	for _, typ := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		resp, err := r.query(ctx, host, typ)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, rr := range resp.answers {
+			switch {
+			case rr.typ == dnsTypeA && typ == dnsTypeA && len(rr.data) == net.IPv4len:
+				ips = append(ips, net.IP(rr.data).To16())
+			case rr.typ == dnsTypeAAAA && typ == dnsTypeAAAA && len(rr.data) == net.IPv6len:
+				ips = append(ips, net.IP(rr.data))
+			default:
+				continue
+			}
+			if len(ips) == 1 || rr.ttl < ttl {
+				ttl = rr.ttl
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if firstErr != nil {
+			return nil, 0, firstErr
+		}
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: r.Server, IsNotFound: true}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// LookupPort implements Resolver, using the system's services database.
+func (r *DNSResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return net.DefaultResolver.LookupPort(ctx, network, service)
+}
+
+// LookupSRV implements SRVResolver. If service and proto are empty, name
+// is looked up directly.
+func (r *DNSResolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	qname := name
+	if service != "" || proto != "" {
+		qname = "_" + service + "._" + proto + "." + name
+	}
+	resp, err := r.query(ctx, qname, dnsTypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	var srvs []*net.SRV
+	for _, rr := range resp.answers {
+		if rr.typ != dnsTypeSRV {
+			continue
+		}
+		srv, err := rr.srv()
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: qname, Server: r.Server}
+		}
+		srvs = append(srvs, srv)
+	}
+	if len(srvs) == 0 {
+		return nil, &net.DNSError{Err: "no SRV records", Name: qname, Server: r.Server, IsNotFound: true}
+	}
+	orderSRV(srvs)
+	return srvs, nil
+}
+
+// LookupSVCB implements SVCBResolver.
+func (r *DNSResolver) LookupSVCB(ctx context.Context, service, host string) ([]SVCBRecord, error) {
+	qname, typ := "_"+service+"."+host, uint16(dnsTypeSVCB)
+	if service == "https" {
+		qname, typ = host, dnsTypeHTTPS
+	}
+
+	for aliases := 0; aliases <= svcbMaxAliases; aliases++ {
+		resp, err := r.query(ctx, qname, typ)
+		if err != nil {
+			return nil, err
+		}
+
+		var recs []SVCBRecord
+		alias, unavailable := "", false
+		for _, rr := range resp.answers {
+			if rr.typ != typ {
+				continue
+			}
+			rec, err := rr.svcb()
+			if err != nil {
+				return nil, &net.DNSError{Err: err.Error(), Name: qname, Server: r.Server}
+			}
+			if rec.Priority == 0 {
+				// An alias to the root means the service is not
+				// available.
+				alias, unavailable = rec.Target, rec.Target == ""
+				continue
+			}
+			// A target of "." is the owner of the record.
+			if rec.Target == "" {
+				rec.Target = rr.name
+			}
+			recs = append(recs, rec)
+		}
+		// Service mode records take precedence over alias mode records.
+		if len(recs) > 0 {
+			sort.SliceStable(recs, func(i, j int) bool { return recs[i].Priority < recs[j].Priority })
+			return recs, nil
+		}
+		if unavailable {
+			return []SVCBRecord{{}}, nil
+		}
+		if alias == "" {
+			return nil, &net.DNSError{Err: "no SVCB records", Name: qname, Server: r.Server, IsNotFound: true}
+		}
+		qname = alias
+	}
+	return nil, &net.DNSError{Err: "too many SVCB aliases", Name: host, Server: r.Server}
+}
+
+// dnsRR is a resource record in a DNS response. Its data is a slice of the
+// whole message, for decompressing names within it.
+type dnsRR struct {
+	name  string
+	typ   uint16
+	class uint16
+	ttl   uint32
+	msg   []byte
+	off   int // offset of data in msg
+	data  []byte
+}
+
+// dnsResponse is a parsed DNS response.
+type dnsResponse struct {
+	rcode     int
+	truncated bool
+	answers   []dnsRR
+}
+
+// query queries for records of the given type for a name, returning an
+// error for responses other than success.
+func (r *DNSResolver) query(ctx context.Context, name string, typ uint16) (*dnsResponse, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = dnsDefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+	q, err := dnsQuery(id, name, typ)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, Server: r.Server}
+	}
+
+	var resp *dnsResponse
+	if r.Network != "tcp" {
+		resp, err = r.exchange(ctx, "udp", q, id)
+	}
+	if r.Network == "tcp" || (err == nil && resp.truncated) {
+		resp, err = r.exchange(ctx, "tcp", q, id)
+	}
+	if err != nil {
+		return nil, &net.DNSError{
+			Err: err.Error(), Name: name, Server: r.Server,
+			IsTimeout: errors.Is(err, context.DeadlineExceeded) || isTimeout(err),
+		}
+	}
+
+	switch resp.rcode {
+	case dnsRcodeSuccess:
+		return resp, nil
+	case dnsRcodeNXDomain:
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: r.Server, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("server failure (rcode %d)", resp.rcode), Name: name, Server: r.Server}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// exchange sends a query to the server over the given network and reads
+// the response with the matching ID.
+func (r *DNSResolver) exchange(ctx context.Context, network string, q []byte, id uint16) (*dnsResponse, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, r.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if network == "tcp" {
+		msg := make([]byte, 2, 2+len(q))
+		binary.BigEndian.PutUint16(msg, uint16(len(q)))
+		if _, err := conn.Write(append(msg, q...)); err != nil {
+			return nil, err
+		}
+		var lb [2]byte
+		if _, err := io.ReadFull(conn, lb[:]); err != nil {
+			return nil, err
+		}
+		msg = make([]byte, binary.BigEndian.Uint16(lb[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return nil, err
+		}
+		return dnsParse(msg, id)
+	}
+
+	if _, err := conn.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxUDPLength)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray responses, as to an earlier query.
+		if resp, err := dnsParse(buf[:n], id); err == nil {
+			return resp, nil
+		}
+	}
+}
+
+// dnsQuery builds a recursive query for records of the given type, with an
+// EDNS(0) OPT record advertising the UDP payload size accepted.
+func dnsQuery(id uint16, name string, typ uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLength, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 1<<8) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)    // QDCOUNT
+	binary.BigEndian.PutUint16(msg[10:], 1)   // ARCOUNT
+
+	msg, err := dnsAppendName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	// OPT: root name, type, UDP payload size as class, zero TTL and data.
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, dnsMaxUDPLength)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	return msg, nil
+}
+
+// dnsAppendName appends a name in uncompressed wire format.
+func dnsAppendName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, errors.New("name too long")
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid label %q", label)
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	return append(msg, 0), nil
+}
+
+var errDNSShort = errors.New("short DNS message")
+
+// srv parses the data of an SRV record.
+func (rr dnsRR) srv() (*net.SRV, error) {
+	if len(rr.data) < 7 {
+		return nil, errDNSShort
+	}
+	target, _, err := dnsReadName(rr.msg, rr.off+6)
+	if err != nil {
+		return nil, err
+	}
+	return &net.SRV{
+		Priority: binary.BigEndian.Uint16(rr.data[0:]),
+		Weight:   binary.BigEndian.Uint16(rr.data[2:]),
+		Port:     binary.BigEndian.Uint16(rr.data[4:]),
+		Target:   target + ".",
+	}, nil
+}
+
+// svcb parses the data of an SVCB or HTTPS record. The target is empty if
+// it is the root, standing for the owner of the record.
+func (rr dnsRR) svcb() (SVCBRecord, error) {
+	var rec SVCBRecord
+	if len(rr.data) < 3 {
+		return rec, errDNSShort
+	}
+	rec.Priority = binary.BigEndian.Uint16(rr.data)
+	// The target name is not compressed, so its length in the data is
+	// that of its wire form.
+	target, end, err := dnsReadName(rr.msg, rr.off+2)
+	if err != nil {
+		return rec, err
+	}
+	rec.Target = target
+	if end > rr.off+len(rr.data) {
+		return rec, errDNSShort
+	}
+
+	params := rr.msg[end : rr.off+len(rr.data)]
+	for len(params) > 0 {
+		if len(params) < 4 {
+			return rec, errDNSShort
+		}
+		key := binary.BigEndian.Uint16(params)
+		l := int(binary.BigEndian.Uint16(params[2:]))
+		if len(params) < 4+l {
+			return rec, errDNSShort
+		}
+		v := params[4 : 4+l]
+		params = params[4+l:]
+
+		switch key {
+		case svcParamALPN:
+			for len(v) > 0 {
+				n := int(v[0])
+				if len(v) < 1+n {
+					return rec, errDNSShort
+				}
+				rec.ALPN = append(rec.ALPN, string(v[1:1+n]))
+				v = v[1+n:]
+			}
+		case svcParamNoDefaultALPN:
+			rec.NoDefaultALPN = true
+		case svcParamPort:
+			if len(v) != 2 {
+				return rec, errors.New("bad SVCB port")
+			}
+			rec.Port = binary.BigEndian.Uint16(v)
+		case svcParamIPv4Hint:
+			for ; len(v) >= net.IPv4len; v = v[net.IPv4len:] {
+				rec.IPv4Hints = append(rec.IPv4Hints, net.IP(append([]byte(nil), v[:net.IPv4len]...)).To16())
+			}
+		case svcParamECH:
+			rec.ECHConfig = append([]byte(nil), v...)
+		case svcParamIPv6Hint:
+			for ; len(v) >= net.IPv6len; v = v[net.IPv6len:] {
+				rec.IPv6Hints = append(rec.IPv6Hints, net.IP(append([]byte(nil), v[:net.IPv6len]...)))
+			}
+		}
+	}
+	return rec, nil
+}
+
+// dnsParse parses a response with the given ID, returning its answer
+// records.
+func dnsParse(msg []byte, id uint16) (*dnsResponse, error) {
+	if len(msg) < dnsHeaderLength {
+		return nil, errDNSShort
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&(1<<15) == 0 {
+		return nil, errors.New("DNS message is not a response")
+	}
+	resp := &dnsResponse{
+		rcode:     int(flags & 0xf),
+		truncated: flags&(1<<9) != 0,
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := dnsHeaderLength
+	for i := 0; i < qdcount; i++ {
+		_, n, err := dnsReadName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+		if off > len(msg) {
+			return nil, errDNSShort
+		}
+	}
+	for i := 0; i < ancount; i++ {
+		rr, n, err := dnsReadRR(msg, off)
+		if err != nil {
+			// A truncated response may end mid-record.
+			if resp.truncated {
+				break
+			}
+			return nil, err
+		}
+		resp.answers = append(resp.answers, rr)
+		off = n
+	}
+	return resp, nil
+}
+
+// dnsReadRR reads the resource record at off, returning it and the offset
+// following it.
+func dnsReadRR(msg []byte, off int) (dnsRR, int, error) {
+	name, off, err := dnsReadName(msg, off)
+	if err != nil {
+		return dnsRR{}, 0, err
+	}
+	if off+10 > len(msg) {
+		return dnsRR{}, 0, errDNSShort
+	}
+	rr := dnsRR{
+		name:  name,
+		typ:   binary.BigEndian.Uint16(msg[off:]),
+		class: binary.BigEndian.Uint16(msg[off+2:]),
+		ttl:   binary.BigEndian.Uint32(msg[off+4:]),
+		msg:   msg,
+		off:   off + 10,
+	}
+	end := rr.off + int(binary.BigEndian.Uint16(msg[off+8:]))
+	if end > len(msg) {
+		return dnsRR{}, 0, errDNSShort
+	}
+	rr.data = msg[rr.off:end]
+	return rr, end, nil
+}
+
+// dnsReadName reads the possibly compressed name at off, returning it
+// without a trailing dot, and the offset following it.
+func dnsReadName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1 // offset following the name, once a pointer is followed
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if pointers++; pointers > dnsMaxPointers {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case l&0xc0 != 0:
+			return "", 0, fmt.Errorf("unsupported DNS label type %#x", l&0xc0)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package postsocket_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+// dnsQuestion is the question of a query received by a stand-in server.
+type dnsQuestion struct {
+	id   uint16
+	name string
+	typ  uint16
+	raw  []byte // question section, as sent
+}
+
+// dnsServer is a stand-in DNS server on the loopback address, answering
+// UDP and TCP queries on the same port through handle.
+type dnsServer struct {
+	addr       string
+	handle     func(q dnsQuestion, tcp bool) []byte
+	tcpQueries int32
+}
+
+func newDNSServer(t *testing.T, handle func(q dnsQuestion, tcp bool) []byte) *dnsServer {
+	t.Helper()
+	s := &dnsServer{handle: handle}
+	var pc net.PacketConn
+	var l net.Listener
+	for tries := 0; l == nil; tries++ {
+		var err error
+		if pc, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+			t.Skip(err)
+		}
+		if l, err = net.Listen("tcp4", pc.LocalAddr().String()); err != nil {
+			pc.Close()
+			if tries > 10 {
+				t.Skip(err)
+			}
+		}
+	}
+	s.addr = pc.LocalAddr().String()
+	t.Cleanup(func() { pc.Close(); l.Close() })
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := s.answer(buf[:n], false); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.tcpQueries, 1)
+			go func() {
+				defer c.Close()
+				var lb [2]byte
+				if _, err := io.ReadFull(c, lb[:]); err != nil {
+					return
+				}
+				q := make([]byte, binary.BigEndian.Uint16(lb[:]))
+				if _, err := io.ReadFull(c, q); err != nil {
+					return
+				}
+				if resp := s.answer(q, true); resp != nil {
+					c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *dnsServer) answer(msg []byte, tcp bool) []byte {
+	q := dnsQuestion{id: binary.BigEndian.Uint16(msg)}
+	var labels []string
+	off := 12
+	for msg[off] != 0 {
+		l := int(msg[off])
+		labels = append(labels, string(msg[off+1:off+1+l]))
+		off += 1 + l
+	}
+	q.name = strings.Join(labels, ".")
+	q.typ = binary.BigEndian.Uint16(msg[off+1:])
+	q.raw = msg[12 : off+5]
+	return s.handle(q, tcp)
+}
+
+// Header flags and response codes of stand-in responses.
+const (
+	dnsTC       = 1 << 9
+	dnsNXDomain = 3
+	dnsServFail = 2
+)
+
+// dnsMessage builds a response to q with the given flags and answers.
+func dnsMessage(q dnsQuestion, flags uint16, answers ...[]byte) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, q.id)
+	msg = binary.BigEndian.AppendUint16(msg, 1<<15|1<<8|1<<7|flags)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+	msg = append(msg, 0, 0, 0, 0)
+	msg = append(msg, q.raw...)
+	for _, a := range answers {
+		msg = append(msg, a...)
+	}
+	return msg
+}
+
+// dnsQName is the compressed form of the name of the question, which
+// stand-in responses always carry at offset 12.
+var dnsQName = []byte{0xc0, 12}
+
+// dnsAnswer builds a resource record with the given owner name, in wire
+// form, type, TTL and data.
+func dnsAnswer(name []byte, typ uint16, ttl uint32, data []byte) []byte {
+	rr := append([]byte(nil), name...)
+	rr = binary.BigEndian.AppendUint16(rr, typ)
+	rr = binary.BigEndian.AppendUint16(rr, 1)
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(data)))
+	return append(rr, data...)
+}
+
+func testResolver(s *dnsServer) *postsocket.DNSResolver {
+	r := postsocket.NewDNSResolver(s.addr)
+	r.Timeout = 2 * time.Second
+	return r
+}
+
+func TestDNSResolverCompression(t *testing.T) {
+	s := newDNSServer(t, func(q dnsQuestion, tcp bool) []byte {
+		switch q.typ {
+		case 1: // A
+			return dnsMessage(q, 0,
+				dnsAnswer(dnsQName, 1, 300, []byte{192, 0, 2, 1}),
+				dnsAnswer(dnsQName, 1, 60, []byte{192, 0, 2, 2}))
+		case 33: // SRV: target "host" followed by a pointer into the question
+			target := append([]byte{4, 'h', 'o', 's', 't', 0xc0}, byte(12+len("_x._tcp.")))
+			data := []byte{0, 10, 0, 5, 0x1f, 0x90}
+			return dnsMessage(q, 0, dnsAnswer(dnsQName, 33, 60, append(data, target...)))
+		}
+		return dnsMessage(q, 0)
+	})
+	r := testResolver(s)
+
+	ips, ttl, err := r.LookupIPTTL(context.Background(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) || ttl != time.Minute {
+		t.Errorf("LookupIPTTL returned %v, %v; want two addresses with the least TTL of 1m", ips, ttl)
+	}
+
+	srvs, err := r.LookupSRV(context.Background(), "x", "tcp", "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*net.SRV{{Target: "host.example.test.", Port: 8080, Priority: 10, Weight: 5}}
+	if !reflect.DeepEqual(srvs, want) {
+		t.Errorf("LookupSRV returned %+v, want %+v", srvs[0], want[0])
+	}
+}
+
+func TestDNSResolverTruncation(t *testing.T) {
+	s := newDNSServer(t, func(q dnsQuestion, tcp bool) []byte {
+		if q.typ != 1 {
+			return dnsMessage(q, 0)
+		}
+		if !tcp {
+			// A truncated answer may end mid-record.
+			return dnsMessage(q, dnsTC, dnsAnswer(dnsQName, 1, 60, []byte{192, 0, 2, 1})[:8])
+		}
+		return dnsMessage(q, 0, dnsAnswer(dnsQName, 1, 60, []byte{192, 0, 2, 9}))
+	})
+
+	ips, err := testResolver(s).LookupIP(context.Background(), "big.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 9)) {
+		t.Errorf("LookupIP returned %v, want the address answered over TCP", ips)
+	}
+	if n := atomic.LoadInt32(&s.tcpQueries); n != 1 {
+		t.Errorf("%d queries over TCP, want 1 for the truncated answer", n)
+	}
+}
+
+func TestDNSResolverRcodes(t *testing.T) {
+	s := newDNSServer(t, func(q dnsQuestion, tcp bool) []byte {
+		if strings.HasPrefix(q.name, "missing") {
+			return dnsMessage(q, dnsNXDomain)
+		}
+		return dnsMessage(q, dnsServFail)
+	})
+	r := testResolver(s)
+
+	_, err := r.LookupIP(context.Background(), "missing.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("NXDOMAIN returned %v, want a not-found DNSError", err)
+	}
+
+	_, err = r.LookupSRV(context.Background(), "x", "tcp", "broken.test")
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !strings.Contains(dnsErr.Err, "server failure") {
+		t.Errorf("SERVFAIL returned %v, want a server failure DNSError", err)
+	}
+}
+
+func TestDNSResolverMalformed(t *testing.T) {
+	tests := map[string]func(q dnsQuestion) []byte{
+		"compression loop": func(q dnsQuestion) []byte {
+			// The answer's name points at itself.
+			msg := dnsMessage(q, 0)
+			loop := []byte{0xc0, byte(len(msg))}
+			return dnsMessage(q, 0, dnsAnswer(loop, 33, 60, []byte{0, 0, 0, 0, 0, 0, 0}))
+		},
+		"short record": func(q dnsQuestion) []byte {
+			rr := dnsAnswer(dnsQName, 33, 60, []byte{0, 0, 0, 0, 0, 0, 0})
+			return dnsMessage(q, 0, rr[:len(rr)-3])
+		},
+		"short SRV data": func(q dnsQuestion) []byte {
+			return dnsMessage(q, 0, dnsAnswer(dnsQName, 33, 60, []byte{0, 1}))
+		},
+		"SRV target overrun": func(q dnsQuestion) []byte {
+			return dnsMessage(q, 0, dnsAnswer(dnsQName, 33, 60, []byte{0, 1, 0, 1, 0, 80, 9, 'x'}))
+		},
+	}
+	for name, respond := range tests {
+		s := newDNSServer(t, func(q dnsQuestion, tcp bool) []byte { return respond(q) })
+		r := testResolver(s)
+		r.Timeout = 200 * time.Millisecond
+		if srvs, err := r.LookupSRV(context.Background(), "x", "tcp", "bad.test"); err == nil {
+			t.Errorf("%s: LookupSRV returned %v", name, srvs)
+		}
+	}
+}
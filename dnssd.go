@@ -0,0 +1,352 @@
+package postsocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSDService describes an instance of a service to advertise with
+// DNS-based service discovery.
+type DNSSDService struct {
+	// Instance is the name of the instance, a single label such as
+	// "Living Room".
+	Instance string
+
+	// Service is the name of the service, such as "ipp", and Proto its
+	// protocol, "tcp" or "udp"; if empty, "tcp" is used.
+	Service string
+	Proto   string
+
+	// Host is the hostname in the local. domain at which the instance is
+	// found. If empty, the first label of the system's hostname is used.
+	Host string
+
+	// Text holds key=value strings for the instance's TXT record.
+	Text []string
+
+	// Interface is the interface on which to advertise, or nil for the
+	// default multicast interface.
+	Interface *net.Interface
+
+	// Clock schedules the repeated announcement of the instance, and
+	// should be that of the Connection's TransportContext. If nil,
+	// SystemClock is used.
+	Clock Clock
+}
+
+// Advertisement is an advertisement of a listening Connection with DNS-SD
+// over multicast DNS, made by Advertise.
+type Advertisement struct {
+	records  []*mdnsRecord
+	ifi      *net.Interface
+	conns    []*net.UDPConn
+	announce Timer
+	once     sync.Once
+}
+
+// mdnsRecord is a record an Advertisement answers with.
+type mdnsRecord struct {
+	name   string // in presentation form, to match questions against
+	wire   []byte // name in wire form
+	typ    uint16
+	unique bool // as opposed to shared, such as PTR records
+	ttl    uint32
+	data   []byte
+}
+
+// Advertise advertises a listening Connection as an instance of a service
+// on the link, with DNS-SD (RFC 6763) over multicast DNS (RFC 6762), so
+// that an MDNSResolver can discover it. The instance is advertised at the
+// port of the Connection's local address, and at the host's addresses on
+// the interface if the Connection listens on the unspecified address. The
+// Advertisement answers queries until it is closed, which should be when
+// the Connection closes. Names are not probed for conflicts, so instance
+// and host names must be unique on the link.
+func Advertise(c Connection, svc DNSSDService) (*Advertisement, error) {
+	ip, port := addrIPPort(c.LocalAddr())
+	if port == 0 {
+		return nil, errors.New("postsocket: cannot advertise a Connection without a local port")
+	}
+	var addrs []net.IP
+	if ip != nil && !ip.IsUnspecified() {
+		addrs = []net.IP{ip}
+	} else {
+		addrs = advertisedAddrs(svc.Interface)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("postsocket: no addresses to advertise")
+	}
+
+	host := svc.Host
+	if host == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		host = strings.SplitN(hostname, ".", 2)[0] + ".local"
+	}
+	proto := svc.Proto
+	if proto == "" {
+		proto = "tcp"
+	}
+	records, err := dnssdRecords(svc.Instance, "_"+svc.Service+"._"+proto+".local", host, port, svc.Text, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Advertisement{records: records, ifi: svc.Interface}
+	var firstErr error
+	for _, network := range []string{"udp4", "udp6"} {
+		conn, err := mdnsListen(network, svc.Interface)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		a.conns = append(a.conns, conn)
+	}
+	if len(a.conns) == 0 {
+		return nil, firstErr
+	}
+	for _, conn := range a.conns {
+		go a.serve(conn)
+	}
+
+	// Announce the records twice, a second apart, as in RFC 6762 section
+	// 8.3.
+	a.multicast(a.records, false)
+	clock := svc.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	a.announce = clock.AfterFunc(time.Second, func() {
+		a.multicast(a.records, false)
+	})
+	return a, nil
+}
+
+// Close withdraws the advertisement, announcing that its records are gone,
+// and stops answering queries.
+func (a *Advertisement) Close() error {
+	a.once.Do(func() {
+		a.announce.Stop()
+		a.multicast(a.records, true)
+		for _, conn := range a.conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+// serve answers the queries arriving at a socket, until it is closed.
+// Queries from ports other than the mDNS port are legacy unicast queries,
+// answered directly to the querier.
+func (a *Advertisement) serve(conn *net.UDPConn) {
+	buf := make([]byte, mdnsMaxLength)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m, err := dnsParseMessage(buf[:n])
+		if err != nil || m.flags&(1<<15) != 0 {
+			continue
+		}
+		answers, additional := a.answer(m)
+		if len(answers) == 0 {
+			continue
+		}
+
+		unicast := from.Port != mdnsPort
+		for _, class := range m.classes {
+			unicast = unicast || class&mdnsUnicastResponse != 0
+		}
+		if !unicast {
+			a.multicast(append(answers, additional...), false)
+			continue
+		}
+		legacy := from.Port != mdnsPort
+		if resp := mdnsResponse(m, answers, additional, legacy, false); resp != nil {
+			conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+// answer returns the records answering the questions of a query, and
+// those to add to the answer, such as the SRV and address records of an
+// instance.
+func (a *Advertisement) answer(m *dnsMessage) (answers, additional []*mdnsRecord) {
+	has := func(rs []*mdnsRecord, r *mdnsRecord) bool {
+		for _, s := range rs {
+			if s == r {
+				return true
+			}
+		}
+		return false
+	}
+	for _, q := range m.questions {
+		for _, r := range a.records {
+			if strings.EqualFold(r.name, q.name) && (q.typ == r.typ || q.typ == dnsTypeANY) && !has(answers, r) {
+				answers = append(answers, r)
+			}
+		}
+	}
+	for _, ans := range answers {
+		if ans.typ != dnsTypePTR && ans.typ != dnsTypeSRV {
+			continue
+		}
+		for _, r := range a.records {
+			if r.typ == dnsTypePTR || has(answers, r) || has(additional, r) {
+				continue
+			}
+			if ans.typ == dnsTypeSRV && r.typ != dnsTypeA && r.typ != dnsTypeAAAA {
+				continue
+			}
+			additional = append(additional, r)
+		}
+	}
+	return answers, additional
+}
+
+// multicast sends an unsolicited response with the given records to the
+// mDNS group, with a time to live of zero if goodbye is true.
+func (a *Advertisement) multicast(records []*mdnsRecord, goodbye bool) {
+	resp := mdnsResponse(nil, records, nil, false, goodbye)
+	for _, conn := range a.conns {
+		dst := &net.UDPAddr{IP: mdnsGroupIPv4, Port: mdnsPort}
+		if conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+			dst.IP = mdnsGroupIPv6
+			if a.ifi != nil {
+				dst.Zone = a.ifi.Name
+			}
+		}
+		conn.WriteToUDP(resp, dst)
+	}
+}
+
+// mdnsResponse builds a response to a query, or an unsolicited response
+// if query is nil. Responses to legacy unicast queries echo the query's ID
+// and questions, and cap the time to live of records.
+func mdnsResponse(query *dnsMessage, answers, additional []*mdnsRecord, legacy, goodbye bool) []byte {
+	msg := make([]byte, dnsHeaderLength, 512)
+	binary.BigEndian.PutUint16(msg[2:], 1<<15|1<<10) // QR, AA
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(additional)))
+	if legacy {
+		binary.BigEndian.PutUint16(msg[0:], query.id)
+		binary.BigEndian.PutUint16(msg[4:], uint16(len(query.questions)))
+		for _, q := range query.questions {
+			var err error
+			if msg, err = dnsAppendName(msg, q.name); err != nil {
+				// Not a name we could have answered.
+				return nil
+			}
+			msg = binary.BigEndian.AppendUint16(msg, q.typ)
+			msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+		}
+	}
+
+	for _, r := range append(answers, additional...) {
+		class := uint16(dnsClassIN)
+		if r.unique && !legacy {
+			class |= mdnsCacheFlush
+		}
+		ttl := r.ttl
+		if goodbye {
+			ttl = 0
+		} else if legacy && ttl > mdnsLegacyMaxTTL {
+			ttl = mdnsLegacyMaxTTL
+		}
+		msg = append(msg, r.wire...)
+		msg = binary.BigEndian.AppendUint16(msg, r.typ)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(r.data)))
+		msg = append(msg, r.data...)
+	}
+	return msg
+}
+
+// dnssdRecords builds the records advertising an instance of a service:
+// PTR records enumerating the service and its instance, SRV and TXT
+// records of the instance, and address records of its host.
+func dnssdRecords(instance, service, host string, port uint16, text []string, addrs []net.IP) ([]*mdnsRecord, error) {
+	if instance == "" || len(instance) > 63 {
+		return nil, errors.New("postsocket: DNS-SD instance name must be 1 to 63 bytes")
+	}
+	serviceWire, err := dnsAppendName(nil, service)
+	if err != nil {
+		return nil, err
+	}
+	servicesWire, _ := dnsAppendName(nil, mdnsServicesName)
+	hostWire, err := dnsAppendName(nil, host)
+	if err != nil {
+		return nil, err
+	}
+	instanceName := instance + "." + service
+	instanceWire := append([]byte{byte(len(instance))}, instance...)
+	instanceWire = append(instanceWire, serviceWire...)
+
+	srv := make([]byte, 6, 6+len(hostWire))
+	binary.BigEndian.PutUint16(srv[4:], port)
+	srv = append(srv, hostWire...)
+
+	var txt []byte
+	for _, t := range text {
+		if len(t) > 255 {
+			return nil, errors.New("postsocket: DNS-SD text string longer than 255 bytes")
+		}
+		txt = append(txt, byte(len(t)))
+		txt = append(txt, t...)
+	}
+	if len(txt) == 0 {
+		txt = []byte{0}
+	}
+
+	records := []*mdnsRecord{
+		{name: service, wire: serviceWire, typ: dnsTypePTR, ttl: mdnsServiceTTL, data: instanceWire},
+		{name: mdnsServicesName, wire: servicesWire, typ: dnsTypePTR, ttl: mdnsServiceTTL, data: serviceWire},
+		{name: instanceName, wire: instanceWire, typ: dnsTypeSRV, unique: true, ttl: mdnsHostTTL, data: srv},
+		{name: instanceName, wire: instanceWire, typ: dnsTypeTXT, unique: true, ttl: mdnsServiceTTL, data: txt},
+	}
+	for _, ip := range addrs {
+		r := &mdnsRecord{name: host, wire: hostWire, typ: dnsTypeAAAA, unique: true, ttl: mdnsHostTTL, data: ip.To16()}
+		if ip4 := ip.To4(); ip4 != nil {
+			r.typ, r.data = dnsTypeA, ip4
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// advertisedAddrs returns the addresses of an interface, or of all up
+// interfaces other than loopback if ifi is nil.
+func advertisedAddrs(ifi *net.Interface) []net.IP {
+	var ifis []net.Interface
+	if ifi != nil {
+		ifis = []net.Interface{*ifi}
+	} else {
+		all, _ := net.Interfaces()
+		for _, i := range all {
+			if i.Flags&net.FlagUp != 0 && i.Flags&net.FlagLoopback == 0 {
+				ifis = append(ifis, i)
+			}
+		}
+	}
+	var ips []net.IP
+	for _, i := range ifis {
+		addrs, _ := i.Addrs()
+		for _, addr := range addrs {
+			if ipn, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipn.IP)
+			}
+		}
+	}
+	return ips
+}
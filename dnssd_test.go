@@ -0,0 +1,91 @@
+package postsocket_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// loopbackMulticast returns the loopback interface, skipping the test
+// unless a multicast datagram sent on it loops back.
+func loopbackMulticast(t *testing.T) *net.Interface {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	var lo *net.Interface
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagLoopback != 0 && ifis[i].Flags&net.FlagUp != 0 {
+			lo = &ifis[i]
+			break
+		}
+	}
+	if lo == nil {
+		t.Skip("no loopback interface")
+	}
+
+	group := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 250), Port: 5350}
+	c, err := net.ListenMulticastUDP("udp4", lo, group)
+	if err != nil {
+		t.Skipf("multicast on %s unavailable: %v", lo.Name, err)
+	}
+	defer c.Close()
+	s, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, group)
+	if err != nil {
+		t.Skipf("multicast on %s unavailable: %v", lo.Name, err)
+	}
+	defer s.Close()
+	s.Write([]byte("probe"))
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := c.ReadFromUDP(make([]byte, 16)); err != nil {
+		t.Skipf("multicast on %s unavailable: %v", lo.Name, err)
+	}
+	return lo
+}
+
+func TestAdvertiseBrowseResolve(t *testing.T) {
+	lo := loopbackMulticast(t)
+
+	n := sim.NewNetwork(sim.NewClock(time.Now()))
+	ctx := n.NewContext(net.IPv4(127, 0, 0, 1))
+	l, err := ctx.Listen(nil, ctx.NewLocal().WithAddress(net.IPv4(127, 0, 0, 1)).WithPort(8631), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Clock().RunFor(time.Second)
+
+	a, err := postsocket.Advertise(l, postsocket.DNSSDService{
+		Instance:  "Test Instance",
+		Service:   "postsocket-test",
+		Host:      "postsocket-test.local",
+		Text:      []string{"v=1"},
+		Interface: lo,
+		Clock:     n.Clock(),
+	})
+	if err != nil {
+		t.Skipf("cannot advertise on %s: %v", lo.Name, err)
+	}
+	defer a.Close()
+
+	r := postsocket.NewMDNSResolver(lo)
+	r.Timeout = 500 * time.Millisecond
+	insts, err := r.Browse(context.Background(), "postsocket-test", "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 1 || insts[0].Port != 8631 {
+		t.Fatalf("Browse found %+v, want one instance at port 8631", insts)
+	}
+
+	cands, err := postsocket.ResolveService(context.Background(), r, "postsocket-test", "tcp", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cands) != 1 || cands[0].Port != 8631 {
+		t.Fatalf("ResolveService returned %+v, want one candidate at port 8631", cands)
+	}
+}
@@ -0,0 +1,131 @@
+package postsocket
+
+// ReadyEvent is the value of a Ready event delivered by EventChannels.
+type ReadyEvent struct {
+	Conn Connection
+	Ante Connection
+}
+
+// SentEvent is the value of a Sent event delivered by EventChannels.
+type SentEvent struct {
+	Conn   Connection
+	MsgRef interface{}
+}
+
+// ExpiredEvent is the value of an Expired event delivered by EventChannels.
+type ExpiredEvent struct {
+	Conn   Connection
+	MsgRef interface{}
+}
+
+// ErrorEvent is the value of an Error event delivered by EventChannels.
+type ErrorEvent struct {
+	Conn   Connection
+	MsgRef interface{}
+	Err    error
+}
+
+// ClosedEvent is the value of a Closed event delivered by EventChannels.
+type ClosedEvent struct {
+	Conn Connection
+	Err  error
+}
+
+// ReceivedEvent is a Message received on a Connection, delivered by
+// EventChannels.
+type ReceivedEvent struct {
+	Msg  Message
+	Conn Connection
+}
+
+// EventChannels delivers each event on a Connection as a typed value on a
+// channel, so that a single goroutine can select over the events of many
+// Connections. Set the EventHandler returned by its Handler method as the
+// EventHandler of any number of Connections, and call its Receive method in
+// place of Connection.Receive to have received Messages delivered on the
+// Received channel.
+//
+// Event delivery blocks the caller of the EventHandler method until the
+// event's channel has room for it; an application that does not drain a
+// channel it has no interest in should size the buffer accordingly, or
+// leave events of that kind to another EventHandler.
+type EventChannels struct {
+	Ready    <-chan ReadyEvent
+	Sent     <-chan SentEvent
+	Expired  <-chan ExpiredEvent
+	Error    <-chan ErrorEvent
+	Closed   <-chan ClosedEvent
+	Received <-chan ReceivedEvent
+
+	ready    chan ReadyEvent
+	sent     chan SentEvent
+	expired  chan ExpiredEvent
+	err      chan ErrorEvent
+	closed   chan ClosedEvent
+	received chan ReceivedEvent
+}
+
+// NewEventChannels creates a new EventChannels, each of whose channels has
+// room for buffer events.
+func NewEventChannels(buffer int) *EventChannels {
+	ec := &EventChannels{
+		ready:    make(chan ReadyEvent, buffer),
+		sent:     make(chan SentEvent, buffer),
+		expired:  make(chan ExpiredEvent, buffer),
+		err:      make(chan ErrorEvent, buffer),
+		closed:   make(chan ClosedEvent, buffer),
+		received: make(chan ReceivedEvent, buffer),
+	}
+	ec.Ready = ec.ready
+	ec.Sent = ec.sent
+	ec.Expired = ec.expired
+	ec.Error = ec.err
+	ec.Closed = ec.closed
+	ec.Received = ec.received
+	return ec
+}
+
+// Receive calls Receive on the given Connection, arranging for the Message
+// received to be delivered on the Received channel.
+func (ec *EventChannels) Receive(conn Connection) {
+	conn.Receive(ec.receiver)
+}
+
+func (ec *EventChannels) receiver(msg Message, conn Connection) {
+	ec.received <- ReceivedEvent{Msg: msg, Conn: conn}
+}
+
+// Handler returns an EventHandler delivering events on these channels.
+func (ec *EventChannels) Handler() EventHandler {
+	return channelHandler{ec}
+}
+
+// channelHandler is the EventHandler view of an EventChannels.
+type channelHandler struct {
+	ec *EventChannels
+}
+
+// Ready implements EventHandler.
+func (h channelHandler) Ready(conn Connection, ante Connection) {
+	h.ec.ready <- ReadyEvent{Conn: conn, Ante: ante}
+}
+
+// Sent implements EventHandler.
+func (h channelHandler) Sent(conn Connection, msgref interface{}) {
+	h.ec.sent <- SentEvent{Conn: conn, MsgRef: msgref}
+}
+
+// Expired implements EventHandler.
+func (h channelHandler) Expired(conn Connection, msgref interface{}) {
+	h.ec.expired <- ExpiredEvent{Conn: conn, MsgRef: msgref}
+}
+
+// Error implements EventHandler.
+func (h channelHandler) Error(conn Connection, msgref interface{}, err error) {
+	h.ec.err <- ErrorEvent{Conn: conn, MsgRef: msgref, Err: err}
+}
+
+// Closed implements EventHandler.
+func (h channelHandler) Closed(conn Connection, err error) {
+	h.ec.closed <- ClosedEvent{Conn: conn, Err: err}
+}
@@ -0,0 +1,90 @@
+package postsocket_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+func TestEventChannels(t *testing.T) {
+	clock := sim.NewClock(time.Unix(0, 0))
+	defer clock.Start()()
+	n := sim.NewNetwork(clock)
+	sctx := n.NewContext(net.IPv4(10, 0, 0, 1))
+	cctx := n.NewContext(net.IPv4(10, 0, 0, 2))
+
+	// One EventChannels serves both ends.
+	ec := postsocket.NewEventChannels(4)
+	listener, err := sctx.Listen(ec.Handler(), sctx.NewLocal().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pc, err := cctx.Preconnect(ec.Handler(), nil, cctx.NewRemote().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pc.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	var server postsocket.Connection
+	for readies := 0; readies < 2; readies++ {
+		select {
+		case ev := <-ec.Ready:
+			switch {
+			case ev.Conn == client && ev.Ante == nil:
+			case ev.Ante == listener:
+				server = ev.Conn
+			default:
+				t.Fatalf("unexpected Ready event %+v", ev)
+			}
+		case <-timeout:
+			t.Fatal("Connections not Ready")
+		}
+	}
+	if server == nil {
+		t.Fatal("no Connection accepted")
+	}
+
+	ec.Receive(server)
+	if err := client.Send([]byte("ping"), "ping", postsocket.SendParameters{}); err != nil {
+		t.Fatal(err)
+	}
+	for got := 0; got < 2; got++ {
+		select {
+		case ev := <-ec.Sent:
+			if ev.Conn != client || ev.MsgRef != "ping" {
+				t.Errorf("Sent event %+v, want client and msgref ping", ev)
+			}
+		case ev := <-ec.Received:
+			if ev.Conn != server || string(ev.Msg.Bytes()) != "ping" {
+				t.Errorf("Received %q on %v, want ping on the server", ev.Msg.Bytes(), ev.Conn)
+			}
+		case <-timeout:
+			t.Fatal("no Sent and Received events")
+		}
+	}
+
+	client.Close()
+	closed := map[postsocket.Connection]bool{}
+	for len(closed) < 2 {
+		select {
+		case ev := <-ec.Closed:
+			if ev.Err != nil {
+				t.Errorf("Closed with %v", ev.Err)
+			}
+			closed[ev.Conn] = true
+		case <-timeout:
+			t.Fatalf("Closed on %d Connections, want 2", len(closed))
+		}
+	}
+	if !closed[client] || !closed[server] {
+		t.Error("Closed not delivered for both ends")
+	}
+}
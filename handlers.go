@@ -0,0 +1,100 @@
+package postsocket
+
+// FuncHandler is an EventHandler built from optional functions, one per
+// event. A nil function ignores its event, so the zero FuncHandler ignores
+// all events.
+type FuncHandler struct {
+	OnReady   func(conn Connection, ante Connection)
+	OnSent    func(conn Connection, msgref interface{})
+	OnExpired func(conn Connection, msgref interface{})
+	OnError   func(conn Connection, msgref interface{}, err error)
+	OnClosed  func(conn Connection, err error)
+}
+
+// Ready implements EventHandler by calling OnReady, if set.
+func (h FuncHandler) Ready(conn Connection, ante Connection) {
+	if h.OnReady != nil {
+		h.OnReady(conn, ante)
+	}
+}
+
+// Sent implements EventHandler by calling OnSent, if set.
+func (h FuncHandler) Sent(conn Connection, msgref interface{}) {
+	if h.OnSent != nil {
+		h.OnSent(conn, msgref)
+	}
+}
+
+// Expired implements EventHandler by calling OnExpired, if set.
+func (h FuncHandler) Expired(conn Connection, msgref interface{}) {
+	if h.OnExpired != nil {
+		h.OnExpired(conn, msgref)
+	}
+}
+
+// Error implements EventHandler by calling OnError, if set.
+func (h FuncHandler) Error(conn Connection, msgref interface{}, err error) {
+	if h.OnError != nil {
+		h.OnError(conn, msgref, err)
+	}
+}
+
+// Closed implements EventHandler by calling OnClosed, if set.
+func (h FuncHandler) Closed(conn Connection, err error) {
+	if h.OnClosed != nil {
+		h.OnClosed(conn, err)
+	}
+}
+
+// multiHandler fans each event out to a list of EventHandlers.
+type multiHandler []EventHandler
+
+// MultiHandler creates an EventHandler that passes each event to each of the
+// given EventHandlers in turn, in the order given. Nil EventHandlers are
+// skipped.
+func MultiHandler(evhs ...EventHandler) EventHandler {
+	mh := make(multiHandler, 0, len(evhs))
+	for _, evh := range evhs {
+		if inner, ok := evh.(multiHandler); ok {
+			mh = append(mh, inner...)
+		} else if evh != nil {
+			mh = append(mh, evh)
+		}
+	}
+	return mh
+}
+
+// Ready implements EventHandler.
+func (mh multiHandler) Ready(conn Connection, ante Connection) {
+	for _, evh := range mh {
+		evh.Ready(conn, ante)
+	}
+}
+
+// Sent implements EventHandler.
+func (mh multiHandler) Sent(conn Connection, msgref interface{}) {
+	for _, evh := range mh {
+		evh.Sent(conn, msgref)
+	}
+}
+
+// Expired implements EventHandler.
+func (mh multiHandler) Expired(conn Connection, msgref interface{}) {
+	for _, evh := range mh {
+		evh.Expired(conn, msgref)
+	}
+}
+
+// Error implements EventHandler.
+func (mh multiHandler) Error(conn Connection, msgref interface{}, err error) {
+	for _, evh := range mh {
+		evh.Error(conn, msgref, err)
+	}
+}
+
+// Closed implements EventHandler.
+func (mh multiHandler) Closed(conn Connection, err error) {
+	for _, evh := range mh {
+		evh.Closed(conn, err)
+	}
+}
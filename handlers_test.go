@@ -0,0 +1,73 @@
+package postsocket_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mami-project/postsocket"
+)
+
+// logHandler returns a FuncHandler appending each event, tagged with name,
+// to log.
+func logHandler(name string, log *[]string) postsocket.FuncHandler {
+	return postsocket.FuncHandler{
+		OnReady: func(conn, ante postsocket.Connection) {
+			*log = append(*log, name+" Ready")
+		},
+		OnSent: func(conn postsocket.Connection, msgref interface{}) {
+			*log = append(*log, fmt.Sprint(name, " Sent ", msgref))
+		},
+		OnExpired: func(conn postsocket.Connection, msgref interface{}) {
+			*log = append(*log, fmt.Sprint(name, " Expired ", msgref))
+		},
+		OnError: func(conn postsocket.Connection, msgref interface{}, err error) {
+			*log = append(*log, fmt.Sprint(name, " Error ", msgref, " ", err))
+		},
+		OnClosed: func(conn postsocket.Connection, err error) {
+			*log = append(*log, fmt.Sprint(name, " Closed ", err))
+		},
+	}
+}
+
+// emitAll calls each EventHandler method once.
+func emitAll(evh postsocket.EventHandler) {
+	evh.Ready(nil, nil)
+	evh.Sent(nil, 1)
+	evh.Expired(nil, 2)
+	evh.Error(nil, 3, errors.New("boom"))
+	evh.Closed(nil, nil)
+}
+
+func TestFuncHandlerZero(t *testing.T) {
+	// The zero FuncHandler ignores every event without panicking.
+	emitAll(postsocket.FuncHandler{})
+
+	var log []string
+	emitAll(postsocket.FuncHandler{OnSent: logHandler("h", &log).OnSent})
+	if want := []string{"h Sent 1"}; !reflect.DeepEqual(log, want) {
+		t.Errorf("events %q, want %q", log, want)
+	}
+}
+
+func TestMultiHandler(t *testing.T) {
+	var log []string
+	inner := postsocket.MultiHandler(logHandler("b", &log), nil, logHandler("c", &log))
+	mh := postsocket.MultiHandler(logHandler("a", &log), inner, nil)
+	emitAll(mh)
+
+	want := []string{
+		"a Ready", "b Ready", "c Ready",
+		"a Sent 1", "b Sent 1", "c Sent 1",
+		"a Expired 2", "b Expired 2", "c Expired 2",
+		"a Error 3 boom", "b Error 3 boom", "c Error 3 boom",
+		"a Closed <nil>", "b Closed <nil>", "c Closed <nil>",
+	}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("events\n%q\nwant\n%q", log, want)
+	}
+
+	// A MultiHandler of nothing ignores every event.
+	emitAll(postsocket.MultiHandler(nil))
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package postsocket
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysClassNet is where sysfs describes network interfaces. It is a
+// variable so that tests can classify interfaces from a fake tree.
+var sysClassNet = "/sys/class/net"
+
+// Link types from linux/if_arp.h.
+const (
+	arphrdEther    = 1
+	arphrdPPP      = 512
+	arphrdRawIP    = 519
+	arphrdTunnel   = 768
+	arphrdTunnel6  = 769
+	arphrdLoopback = 772
+	arphrdSit      = 776
+	arphrdIPGRE    = 778
+	arphrdIP6GRE   = 823
+	arphrdNone     = 65534
+)
+
+// classifyInterface returns the type of an interface, from the device type
+// in its uevent, the files sysfs gives wireless and tun devices, and its
+// link type. Ethernet links without an underlying device, such as veth
+// pairs, bridges and dummies, are virtual; raw IP links, as of WWAN
+// modems, cellular; and PPP and IP-in-IP links tunnels.
+func classifyInterface(ifi *net.Interface) InterfaceType {
+	if ifi.Flags&net.FlagLoopback != 0 {
+		return InterfaceTypeLoopback
+	}
+	dir := filepath.Join(sysClassNet, ifi.Name)
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	switch ueventDevtype(filepath.Join(dir, "uevent")) {
+	case "wlan":
+		return InterfaceTypeWireless
+	case "wwan":
+		return InterfaceTypeCellular
+	case "vlan", "bridge", "bond", "team", "macvlan", "ipvlan", "vxlan":
+		return InterfaceTypeVirtual
+	}
+	if exists("wireless") || exists("phy80211") {
+		return InterfaceTypeWireless
+	}
+	if exists("tun_flags") {
+		return InterfaceTypeTunnel
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "type"))
+	if err != nil {
+		return fallbackInterfaceType(ifi)
+	}
+	typ, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	switch typ {
+	case arphrdLoopback:
+		return InterfaceTypeLoopback
+	case arphrdEther:
+		if !exists("device") {
+			return InterfaceTypeVirtual
+		}
+		return InterfaceTypeEthernet
+	case arphrdRawIP:
+		return InterfaceTypeCellular
+	case arphrdPPP, arphrdTunnel, arphrdTunnel6, arphrdSit, arphrdIPGRE, arphrdIP6GRE, arphrdNone:
+		return InterfaceTypeTunnel
+	}
+	return InterfaceTypeUnknown
+}
+
+// ueventDevtype returns the DEVTYPE of a uevent file, or the empty string.
+func ueventDevtype(filename string) string {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "DEVTYPE="); ok {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package postsocket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassifyInterface(t *testing.T) {
+	// Each interface of the fake sysfs tree is described by the files in
+	// its directory, and the type it is classified as.
+	tests := []struct {
+		name  string
+		flags net.Flags
+		files map[string]string // contents by name; "/" makes a directory
+		want  InterfaceType
+	}{
+		{"lo", net.FlagLoopback, nil, InterfaceTypeLoopback},
+		{"lo2", 0, map[string]string{"type": "772\n"}, InterfaceTypeLoopback},
+		{"eth0", 0, map[string]string{"type": "1\n", "device": "/"}, InterfaceTypeEthernet},
+		{"veth0", 0, map[string]string{"type": "1\n"}, InterfaceTypeVirtual},
+		{"br0", 0, map[string]string{"type": "1\n", "uevent": "INTERFACE=br0\nDEVTYPE=bridge\n"}, InterfaceTypeVirtual},
+		{"wlan0", 0, map[string]string{"type": "1\n", "device": "/", "uevent": "DEVTYPE=wlan\nIFINDEX=3\n"}, InterfaceTypeWireless},
+		{"wlp2s0", 0, map[string]string{"type": "1\n", "device": "/", "phy80211": "/"}, InterfaceTypeWireless},
+		{"wwan0", 0, map[string]string{"type": "519\n"}, InterfaceTypeCellular},
+		{"wwan1", 0, map[string]string{"type": "1\n", "uevent": "DEVTYPE=wwan\n"}, InterfaceTypeCellular},
+		{"tun0", 0, map[string]string{"type": "65534\n", "tun_flags": "0x1002\n"}, InterfaceTypeTunnel},
+		{"ppp0", 0, map[string]string{"type": "512\n"}, InterfaceTypeTunnel},
+		{"gre0", 0, map[string]string{"type": "778\n"}, InterfaceTypeTunnel},
+		{"can0", 0, map[string]string{"type": "280\n"}, InterfaceTypeUnknown},
+		{"gone", net.FlagPointToPoint, nil, InterfaceTypeTunnel},
+		{"gone2", 0, nil, InterfaceTypeUnknown},
+	}
+
+	old := sysClassNet
+	sysClassNet = t.TempDir()
+	defer func() { sysClassNet = old }()
+	for _, test := range tests {
+		if test.files == nil {
+			continue
+		}
+		dir := filepath.Join(sysClassNet, test.name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range test.files {
+			var err error
+			if contents == "/" {
+				err = os.Mkdir(filepath.Join(dir, name), 0755)
+			} else {
+				err = os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, test := range tests {
+		ifi := &net.Interface{Name: test.name, Flags: test.flags | net.FlagUp}
+		if got := classifyInterface(ifi); got != test.want {
+			t.Errorf("%s classified as %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package postsocket
+
+import "net"
+
+// classifyInterface returns the type of an interface. Without sysfs, only
+// loopback interfaces and point-to-point tunnels are told apart.
+func classifyInterface(ifi *net.Interface) InterfaceType {
+	return fallbackInterfaceType(ifi)
+}
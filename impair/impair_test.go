@@ -0,0 +1,175 @@
+package impair_test
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/impair"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// fates returns the arrival times, relative to start, of packets sent every
+// millisecond over a Link with the given impairments.
+func fates(cfg impair.Config, packets int) [][]time.Duration {
+	start := time.Unix(0, 0)
+	l := impair.NewLink(cfg, start)
+	out := make([][]time.Duration, packets)
+	for i := range out {
+		now := start.Add(time.Duration(i) * time.Millisecond)
+		for _, at := range l.Send(now, 100) {
+			out[i] = append(out[i], at.Sub(start))
+		}
+	}
+	return out
+}
+
+func TestLinkSeedReproducible(t *testing.T) {
+	cfg := impair.Config{
+		Delay:     10 * time.Millisecond,
+		Jitter:    3 * time.Millisecond,
+		Loss:      0.2,
+		Duplicate: 0.05,
+		Reorder:   0.1,
+		Seed:      42,
+	}
+	a, b := fates(cfg, 500), fates(cfg, 500)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("same seed impaired the same packets differently")
+	}
+
+	var lost, duplicated, reordered int
+	var last time.Duration
+	for _, f := range a {
+		switch len(f) {
+		case 0:
+			lost++
+			continue
+		case 2:
+			duplicated++
+		}
+		if f[0] < last {
+			reordered++
+		}
+		last = f[0]
+	}
+	if lost == 0 || duplicated == 0 || reordered == 0 {
+		t.Errorf("%d lost, %d duplicated, %d reordered of 500; want some of each", lost, duplicated, reordered)
+	}
+
+	cfg.Seed++
+	if reflect.DeepEqual(a, fates(cfg, 500)) {
+		t.Error("different seeds impaired every packet the same way")
+	}
+}
+
+// sentOrder sends Messages from a simulated context impaired by cfg and
+// returns the msgref and virtual time of each Sent event, in order.
+func sentOrder(t *testing.T, cfg impair.Config, msgs int) []string {
+	clock := sim.NewClock(time.Unix(0, 0))
+	n := sim.NewNetwork(clock)
+	sctx := n.NewContext(net.IPv4(10, 0, 0, 1))
+	cctx := n.NewContext(net.IPv4(10, 0, 0, 2))
+	cfg.Clock = clock
+	cctx.Intercept(impair.Interceptor(cfg))
+
+	if _, err := sctx.Listen(nil, sctx.NewLocal().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	pc, err := cctx.Preconnect(postsocket.FuncHandler{
+		OnSent: func(conn postsocket.Connection, msgref interface{}) {
+			sent = append(sent, fmt.Sprintf("%v@%v", msgref, clock.Now().Sub(time.Unix(0, 0))))
+		},
+	}, nil, cctx.NewRemote().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pc.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.RunFor(time.Second)
+	for i := 0; i < msgs; i++ {
+		client.Send([]byte("x"), i, postsocket.SendParameters{})
+		clock.RunFor(time.Millisecond)
+	}
+	clock.RunFor(10 * time.Second)
+	if len(sent) != msgs {
+		t.Fatalf("%d of %d Messages Sent", len(sent), msgs)
+	}
+	return sent
+}
+
+func TestInterceptorSeedReproducible(t *testing.T) {
+	cfg := impair.Config{
+		Delay:   5 * time.Millisecond,
+		Jitter:  4 * time.Millisecond,
+		Loss:    0.2,
+		Reorder: 0.2,
+		Seed:    7,
+	}
+	a := sentOrder(t, cfg, 100)
+	if b := sentOrder(t, cfg, 100); !reflect.DeepEqual(a, b) {
+		t.Errorf("same seed gave Sent events\n%v\nthen\n%v", a, b)
+	}
+	inOrder := true
+	for i, s := range a {
+		inOrder = inOrder && strings.HasPrefix(s, fmt.Sprintf("%d@", i))
+	}
+	if inOrder {
+		t.Error("no Message overtaken over a reordering, lossy link")
+	}
+}
+
+func TestInterceptorLossWithoutLifetime(t *testing.T) {
+	clock := sim.NewClock(time.Unix(0, 0))
+	n := sim.NewNetwork(clock)
+	sctx := n.NewContext(net.IPv4(10, 0, 0, 1))
+	cctx := n.NewContext(net.IPv4(10, 0, 0, 2))
+
+	// An interceptor outside the impairment sees the events it reports.
+	var seen []error
+	cctx.Intercept(postsocket.Interceptor{
+		EventHandler: func(next postsocket.EventHandler) postsocket.EventHandler {
+			return postsocket.FuncHandler{
+				OnError: func(conn postsocket.Connection, msgref interface{}, err error) {
+					seen = append(seen, err)
+					next.Error(conn, msgref, err)
+				},
+			}
+		},
+	}, impair.Interceptor(impair.Config{Loss: 1, Clock: clock}))
+
+	if _, err := sctx.Listen(nil, sctx.NewLocal().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var failed error
+	pc, err := cctx.Preconnect(postsocket.FuncHandler{
+		OnError: func(conn postsocket.Connection, msgref interface{}, err error) { failed = err },
+	}, nil, cctx.NewRemote().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pc.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.RunFor(time.Second)
+	client.Send([]byte("x"), 1, postsocket.SendParameters{})
+	clock.RunFor(time.Minute)
+
+	if failed != impair.ErrLost {
+		t.Errorf("Message lost on every send failed with %v, want ErrLost", failed)
+	}
+	if len(seen) != 1 || seen[0] != impair.ErrLost {
+		t.Errorf("outer interceptor saw errors %v, want ErrLost", seen)
+	}
+	if clock.Pending() != 0 {
+		t.Errorf("%d calls still scheduled after the Message failed", clock.Pending())
+	}
+}
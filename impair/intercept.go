@@ -0,0 +1,146 @@
+package impair
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+// maxRetransmits bounds the retransmissions of a lost Message without a
+// Lifetime, so that a link losing everything fails it rather than sending it
+// forever.
+const maxRetransmits = 32
+
+// ErrLost is reported in an Error event for a Message without a Lifetime
+// still lost after maxRetransmits retransmissions.
+var ErrLost = errors.New("impair: message lost on every retransmission")
+
+// retransmitTimeout returns the time after which a lost Message is sent
+// again over a Link with the given impairments.
+func retransmitTimeout(cfg Config) time.Duration {
+	rto := 2 * (cfg.Delay + cfg.Jitter)
+	if rto < 10*time.Millisecond {
+		rto = 10 * time.Millisecond
+	}
+	return rto
+}
+
+// Interceptor returns a postsocket.Interceptor impairing the Messages sent
+// on each Connection it is applied to, for example through
+// TransportContext.Intercept. Each Connection gets its own Link. A Message
+// is handed to the underlying Send only once it has crossed the Link, so
+// its Sent event is delayed accordingly. A lost Message is sent again after
+// a retransmission timeout if its Lifetime is zero or less, as by a fully
+// reliable transport, up to 32 times, after which the Error event occurs
+// with ErrLost; otherwise, and for any Message still in flight when its
+// Lifetime runs out, the Expired event occurs instead. These events are
+// reported through postsocket.ChainedEventHandler, so that every
+// interceptor sees them. Messages sent while the link is down are held
+// until it is up again. Duplication does not apply to Messages, as no
+// transport delivers a Message twice. Like NewLink, Interceptor panics if
+// the flaps of cfg leave the link never up.
+func Interceptor(cfg Config) postsocket.Interceptor {
+	cfg.check()
+	msgcfg := cfg
+	msgcfg.Duplicate = 0
+	clock := cfg.clock()
+
+	return postsocket.Interceptor{
+		Send: func(next postsocket.SendFunc) postsocket.SendFunc {
+			link := NewLink(msgcfg, clock.Now())
+			return func(conn postsocket.Connection, msg interface{}, msgref interface{}, sp postsocket.SendParameters) error {
+				if b, ok := msg.([]byte); ok {
+					// The caller may reuse b once Send returns.
+					msg = append([]byte(nil), b...)
+				}
+				m := &impairedMessage{
+					link: link, clock: clock, next: next, conn: conn,
+					msg: msg, msgref: msgref, sp: sp,
+					rto: retransmitTimeout(cfg),
+				}
+				if sp.Lifetime > 0 {
+					m.expiry = clock.Now().Add(sp.Lifetime)
+				}
+				m.send()
+				return nil
+			}
+		},
+	}
+}
+
+// impairedMessage is a Message in flight over an impaired Link.
+type impairedMessage struct {
+	link   *Link
+	clock  postsocket.Clock
+	next   postsocket.SendFunc
+	conn   postsocket.Connection
+	msg    interface{}
+	msgref interface{}
+	sp     postsocket.SendParameters
+	rto    time.Duration
+	expiry time.Time // zero if the Message never expires
+	losses int       // times lost so far
+}
+
+func (m *impairedMessage) size() int {
+	switch b := m.msg.(type) {
+	case []byte:
+		return len(b)
+	case postsocket.Message:
+		return len(b.Bytes())
+	default:
+		return 0
+	}
+}
+
+// send sends the Message over the link, now or once the link is up.
+func (m *impairedMessage) send() {
+	now := m.clock.Now()
+	if up := m.link.NextUp(now); up.After(now) {
+		m.at(up, m.send)
+		return
+	}
+
+	arrivals := m.link.Send(now, m.size())
+	if len(arrivals) == 0 {
+		m.losses++
+		switch {
+		case m.expiry.IsZero() && m.losses > maxRetransmits:
+			m.fail(ErrLost)
+		case m.expiry.IsZero():
+			m.at(now.Add(m.rto), m.send)
+		default:
+			m.at(m.expiry, m.expire)
+		}
+		return
+	}
+	m.at(arrivals[0], m.deliver)
+}
+
+// at schedules f at the given time, or expires the Message instead if its
+// lifetime runs out first.
+func (m *impairedMessage) at(t time.Time, f func()) {
+	if !m.expiry.IsZero() && t.After(m.expiry) {
+		t, f = m.expiry, m.expire
+	}
+	m.clock.AfterFunc(t.Sub(m.clock.Now()), f)
+}
+
+func (m *impairedMessage) deliver() {
+	if err := m.next(m.conn, m.msg, m.msgref, m.sp); err != nil {
+		m.fail(err)
+	}
+}
+
+func (m *impairedMessage) fail(err error) {
+	if evh := postsocket.ChainedEventHandler(m.conn); evh != nil {
+		evh.Error(m.conn, m.msgref, err)
+	}
+}
+
+func (m *impairedMessage) expire() {
+	if evh := postsocket.ChainedEventHandler(m.conn); evh != nil {
+		evh.Expired(m.conn, m.msgref)
+	}
+}
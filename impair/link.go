@@ -0,0 +1,190 @@
+// Package impair emulates impaired network links for testing, without root
+// privileges or traffic control. It can impair the packets a userland
+// protocol stack writes to a net.PacketConn, or, through a
+// postsocket.Interceptor, the Messages sent on any Connection of any
+// TransportContext, including in-memory ones. Impairments include delay,
+// jitter, loss, reordering, duplication, bandwidth limits and link flaps.
+// Random decisions are drawn from a seeded source, in the order packets or
+// Messages are sent, so a given sequence of sends is impaired the same way
+// on every run.
+package impair
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+// Config describes the impairments of a Link. The zero Config describes a
+// perfect link.
+type Config struct {
+	// Delay is the one-way propagation delay added to every packet.
+	Delay time.Duration
+
+	// Jitter is the maximum random variation of Delay, drawn uniformly from
+	// [-Jitter, Jitter]. Total delay is never negative. Jitter larger than
+	// the interval between packets reorders them.
+	Jitter time.Duration
+
+	// Loss is the probability that a packet is lost.
+	Loss float64
+
+	// Duplicate is the probability that a packet is delivered twice.
+	Duplicate float64
+
+	// Reorder is the probability that a packet is held back by an extra
+	// ReorderDelay, letting packets sent after it overtake it.
+	Reorder float64
+
+	// ReorderDelay is the extra delay of packets held back for reordering.
+	// If zero, Delay is used, or one millisecond if Delay is also zero.
+	ReorderDelay time.Duration
+
+	// Bandwidth is the capacity of the link in bits per second. Packets are
+	// serialized onto the link one after the other, queueing behind each
+	// other. Zero means unlimited.
+	Bandwidth int64
+
+	// FlapPeriod and FlapDown describe link flaps: the link goes down for
+	// FlapDown at the end of every FlapPeriod, counted from the link's
+	// creation. Packets sent while the link is down are lost. If either is
+	// zero, the link never flaps. FlapDown must be less than FlapPeriod, or
+	// the link would never be up.
+	FlapPeriod time.Duration
+	FlapDown   time.Duration
+
+	// Seed seeds the random source of the link's random decisions.
+	Seed int64
+
+	// Clock schedules the delivery of delayed packets and Messages. If nil,
+	// postsocket.SystemClock is used; use the Clock of a simulated
+	// TransportContext to impair it in virtual time.
+	Clock postsocket.Clock
+}
+
+func (cfg Config) clock() postsocket.Clock {
+	if cfg.Clock == nil {
+		return postsocket.SystemClock
+	}
+	return cfg.Clock
+}
+
+// Link models a unidirectional impaired link, deciding the fate of each
+// packet sent over it. Its methods may be called concurrently.
+type Link struct {
+	cfg   Config
+	start time.Time
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	busyUntil time.Time // end of serialization of the last packet
+}
+
+// check panics if the impairments of cfg are inconsistent.
+func (cfg Config) check() {
+	if cfg.FlapPeriod > 0 && cfg.FlapDown >= cfg.FlapPeriod {
+		panic("impair: FlapDown must be less than FlapPeriod")
+	}
+}
+
+// NewLink creates a new Link with the given impairments, whose flap cycle
+// starts at the given time. It panics if FlapDown is not less than a
+// nonzero FlapPeriod.
+func NewLink(cfg Config, start time.Time) *Link {
+	cfg.check()
+	return &Link{
+		cfg:   cfg,
+		start: start,
+		rng:   rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+// Up returns true if the link is up at the given time.
+func (l *Link) Up(now time.Time) bool {
+	if l.cfg.FlapPeriod <= 0 || l.cfg.FlapDown <= 0 {
+		return true
+	}
+	phase := now.Sub(l.start) % l.cfg.FlapPeriod
+	return phase < l.cfg.FlapPeriod-l.cfg.FlapDown
+}
+
+// NextUp returns the earliest time not before now at which the link is up.
+func (l *Link) NextUp(now time.Time) time.Time {
+	if l.Up(now) {
+		return now
+	}
+	phase := now.Sub(l.start) % l.cfg.FlapPeriod
+	return now.Add(l.cfg.FlapPeriod - phase)
+}
+
+// Send decides the fate of a packet of the given size in bytes sent at the
+// given time, and returns the times at which it arrives at the other end
+// of the link: none if it is lost, two if it is duplicated.
+func (l *Link) Send(now time.Time, size int) []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Draw every random value for every packet, so that the fate of each
+	// packet does not depend on the fate of the ones before it.
+	lost := l.rng.Float64() < l.cfg.Loss
+	duplicated := l.rng.Float64() < l.cfg.Duplicate
+	reordered := l.rng.Float64() < l.cfg.Reorder
+	jitter := l.jitter()
+	dupJitter := l.jitter()
+
+	if !l.Up(now) {
+		return nil
+	}
+
+	departure := now
+	if l.busyUntil.After(departure) {
+		departure = l.busyUntil
+	}
+	if l.cfg.Bandwidth > 0 {
+		departure = departure.Add(time.Duration(int64(size) * 8 * int64(time.Second) / l.cfg.Bandwidth))
+	}
+	l.busyUntil = departure
+
+	if lost {
+		return nil
+	}
+
+	delay := l.cfg.Delay + jitter
+	if reordered {
+		delay += l.reorderDelay()
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	arrivals := []time.Time{departure.Add(delay)}
+
+	if duplicated {
+		delay = l.cfg.Delay + dupJitter
+		if delay < 0 {
+			delay = 0
+		}
+		arrivals = append(arrivals, departure.Add(delay))
+	}
+	return arrivals
+}
+
+func (l *Link) jitter() time.Duration {
+	if l.cfg.Jitter <= 0 {
+		l.rng.Int63() // keep the draw sequence independent of Jitter
+		return 0
+	}
+	return time.Duration(l.rng.Int63n(2*int64(l.cfg.Jitter)+1)) - l.cfg.Jitter
+}
+
+func (l *Link) reorderDelay() time.Duration {
+	switch {
+	case l.cfg.ReorderDelay > 0:
+		return l.cfg.ReorderDelay
+	case l.cfg.Delay > 0:
+		return l.cfg.Delay
+	default:
+		return time.Millisecond
+	}
+}
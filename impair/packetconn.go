@@ -0,0 +1,42 @@
+package impair
+
+import (
+	"net"
+
+	"github.com/mami-project/postsocket"
+)
+
+// packetConn impairs the packets written to a net.PacketConn.
+type packetConn struct {
+	net.PacketConn
+	link  *Link
+	clock postsocket.Clock
+}
+
+// NewPacketConn wraps a net.PacketConn, such as the UDP socket underlying a
+// userland protocol stack, so that packets written to it pass through an
+// impaired Link before they are written to the underlying socket. WriteTo
+// returns immediately, reporting success for lost packets as the network
+// would. Only packets written are impaired; wrap the sockets at both ends of
+// a path to impair both directions.
+func NewPacketConn(pc net.PacketConn, cfg Config) net.PacketConn {
+	clock := cfg.clock()
+	return &packetConn{PacketConn: pc, link: NewLink(cfg, clock.Now()), clock: clock}
+}
+
+// WriteTo implements net.PacketConn.
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	now := c.clock.Now()
+	arrivals := c.link.Send(now, len(p))
+	if len(arrivals) == 0 {
+		return len(p), nil
+	}
+
+	pkt := append([]byte(nil), p...)
+	for _, at := range arrivals {
+		c.clock.AfterFunc(at.Sub(now), func() {
+			c.PacketConn.WriteTo(pkt, addr)
+		})
+	}
+	return len(p), nil
+}
@@ -0,0 +1,227 @@
+package postsocket
+
+import "sync"
+
+// SendFunc has the signature of Connection.Send, with the Connection made
+// explicit.
+type SendFunc func(conn Connection, msg interface{}, msgref interface{}, sp SendParameters) error
+
+// ReceiveFunc has the signature of Connection.Receive, with the Connection
+// made explicit.
+type ReceiveFunc func(conn Connection, receiver func(msg Message, conn Connection))
+
+// Interceptor applies cross-cutting behavior to Connections, by wrapping
+// their EventHandlers and their Send and Receive calls. Each field is
+// optional; a nil field leaves the corresponding path unchanged. Each
+// wrapping function takes the next EventHandler, SendFunc, or ReceiveFunc in
+// the chain and returns one that will be called in its place; it may act
+// before and after calling the next one, or not call it at all.
+type Interceptor struct {
+	// EventHandler wraps the EventHandler of each Connection.
+	EventHandler func(next EventHandler) EventHandler
+
+	// Send wraps each call to Connection.Send.
+	Send func(next SendFunc) SendFunc
+
+	// Receive wraps each call to Connection.Receive. To intercept received
+	// Messages, the returned ReceiveFunc passes its own receiver to next.
+	Receive func(next ReceiveFunc) ReceiveFunc
+}
+
+// ChainInterceptors composes interceptors into a single Interceptor. The
+// first interceptor given is outermost: it sees each event and each Send and
+// Receive call first, and each returned error and received Message last.
+func ChainInterceptors(ics ...Interceptor) Interceptor {
+	var chain Interceptor
+	for i := len(ics) - 1; i >= 0; i-- {
+		chain = chain.then(ics[i])
+	}
+	return chain
+}
+
+// then returns an Interceptor with outer applied around ic.
+func (ic Interceptor) then(outer Interceptor) Interceptor {
+	chain := ic
+	if outer.EventHandler != nil {
+		if inner := ic.EventHandler; inner != nil {
+			chain.EventHandler = func(next EventHandler) EventHandler {
+				return outer.EventHandler(inner(next))
+			}
+		} else {
+			chain.EventHandler = outer.EventHandler
+		}
+	}
+	if outer.Send != nil {
+		if inner := ic.Send; inner != nil {
+			chain.Send = func(next SendFunc) SendFunc {
+				return outer.Send(inner(next))
+			}
+		} else {
+			chain.Send = outer.Send
+		}
+	}
+	if outer.Receive != nil {
+		if inner := ic.Receive; inner != nil {
+			chain.Receive = func(next ReceiveFunc) ReceiveFunc {
+				return outer.Receive(inner(next))
+			}
+		} else {
+			chain.Receive = outer.Receive
+		}
+	}
+	return chain
+}
+
+// WrapEventHandler applies this interceptor to an EventHandler. A nil
+// EventHandler is replaced with one ignoring all events, so that the
+// interceptor still sees them.
+func (ic Interceptor) WrapEventHandler(evh EventHandler) EventHandler {
+	if ic.EventHandler == nil {
+		return evh
+	}
+	if evh == nil {
+		evh = FuncHandler{}
+	}
+	return ic.EventHandler(evh)
+}
+
+// intercepted is a Connection with an Interceptor applied.
+type intercepted struct {
+	Connection
+	ic      Interceptor
+	send    SendFunc
+	receive ReceiveFunc
+
+	mu      sync.Mutex
+	evh     EventHandler
+	chained EventHandler // evh wrapped by the interceptor
+}
+
+// InterceptConnection applies an Interceptor to a Connection. It is intended
+// for use by implementations of TransportContext.Intercept: the returned
+// Connection passes Send and Receive calls through the interceptor, and
+// replaces the Connection's EventHandler with one wrapped by the
+// interceptor. Events on the underlying Connection, and Messages received on
+// it, are reported with the returned Connection in its place. Connections
+// returned by Clone are those of the underlying Connection: implementations
+// apply the interceptor to clones as they do to every Connection they
+// create.
+func InterceptConnection(conn Connection, ic Interceptor) Connection {
+	c := &intercepted{Connection: conn, ic: ic}
+
+	c.send = func(conn Connection, msg interface{}, msgref interface{}, sp SendParameters) error {
+		return c.Connection.Send(msg, msgref, sp)
+	}
+	if ic.Send != nil {
+		c.send = ic.Send(c.send)
+	}
+
+	c.receive = func(conn Connection, receiver func(msg Message, conn Connection)) {
+		c.Connection.Receive(func(msg Message, _ Connection) {
+			receiver(msg, c)
+		})
+	}
+	if ic.Receive != nil {
+		c.receive = ic.Receive(c.receive)
+	}
+
+	c.SetEventHandler(conn.GetEventHandler())
+	return c
+}
+
+// Send implements Connection.
+func (c *intercepted) Send(msg interface{}, msgref interface{}, sp SendParameters) error {
+	return c.send(c, msg, msgref, sp)
+}
+
+// Receive implements Connection.
+func (c *intercepted) Receive(receiver func(msg Message, conn Connection)) {
+	c.receive(c, receiver)
+}
+
+// GetEventHandler implements Connection, returning the EventHandler most
+// recently set, without the interceptor applied.
+func (c *intercepted) GetEventHandler() EventHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evh
+}
+
+// SetEventHandler implements Connection.
+func (c *intercepted) SetEventHandler(evh EventHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evh = evh
+	c.chained = c.ic.WrapEventHandler(evh)
+	c.Connection.SetEventHandler(substituteHandler{
+		evh:   c.chained,
+		inner: c.Connection,
+		outer: c,
+	})
+}
+
+// ChainedEventHandler returns the EventHandler through which events on a
+// Connection reach its application: for a Connection returned by
+// InterceptConnection, the EventHandler most recently set, wrapped by the
+// interceptor; for any other, its EventHandler. Interceptors that report
+// events of their own, such as Expired for a Message they held back, report
+// them through it, so that every interceptor sees them as it would the
+// events of the underlying Connection.
+func ChainedEventHandler(conn Connection) EventHandler {
+	if c, ok := conn.(*intercepted); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.chained
+	}
+	return conn.GetEventHandler()
+}
+
+// substituteHandler reports events on an inner Connection as events on the
+// outer Connection wrapping it.
+type substituteHandler struct {
+	evh   EventHandler
+	inner Connection
+	outer Connection
+}
+
+func (h substituteHandler) sub(conn Connection) Connection {
+	if conn == h.inner {
+		return h.outer
+	}
+	return conn
+}
+
+// Ready implements EventHandler.
+func (h substituteHandler) Ready(conn Connection, ante Connection) {
+	if h.evh != nil {
+		h.evh.Ready(h.sub(conn), h.sub(ante))
+	}
+}
+
+// Sent implements EventHandler.
+func (h substituteHandler) Sent(conn Connection, msgref interface{}) {
+	if h.evh != nil {
+		h.evh.Sent(h.sub(conn), msgref)
+	}
+}
+
+// Expired implements EventHandler.
+func (h substituteHandler) Expired(conn Connection, msgref interface{}) {
+	if h.evh != nil {
+		h.evh.Expired(h.sub(conn), msgref)
+	}
+}
+
+// Error implements EventHandler.
+func (h substituteHandler) Error(conn Connection, msgref interface{}, err error) {
+	if h.evh != nil {
+		h.evh.Error(h.sub(conn), msgref, err)
+	}
+}
+
+// Closed implements EventHandler.
+func (h substituteHandler) Closed(conn Connection, err error) {
+	if h.evh != nil {
+		h.evh.Closed(h.sub(conn), err)
+	}
+}
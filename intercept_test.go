@@ -0,0 +1,159 @@
+package postsocket_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// logInterceptor returns an Interceptor logging, tagged with name, each
+// Ready event and each Send and received Message as it passes inward and
+// outward.
+func logInterceptor(name string, log *[]string) postsocket.Interceptor {
+	return postsocket.Interceptor{
+		EventHandler: func(next postsocket.EventHandler) postsocket.EventHandler {
+			return postsocket.FuncHandler{
+				OnReady: func(conn, ante postsocket.Connection) {
+					*log = append(*log, name+" Ready")
+					next.Ready(conn, ante)
+				},
+			}
+		},
+		Send: func(next postsocket.SendFunc) postsocket.SendFunc {
+			return func(conn postsocket.Connection, msg, msgref interface{}, sp postsocket.SendParameters) error {
+				*log = append(*log, name+" Send")
+				err := next(conn, msg, msgref, sp)
+				*log = append(*log, name+" Sent")
+				return err
+			}
+		},
+		Receive: func(next postsocket.ReceiveFunc) postsocket.ReceiveFunc {
+			return func(conn postsocket.Connection, receiver func(postsocket.Message, postsocket.Connection)) {
+				*log = append(*log, name+" Receive")
+				next(conn, func(msg postsocket.Message, conn postsocket.Connection) {
+					*log = append(*log, name+" Received")
+					receiver(msg, conn)
+				})
+			}
+		},
+	}
+}
+
+func TestChainInterceptorsOrder(t *testing.T) {
+	var log []string
+	chain := postsocket.ChainInterceptors(
+		logInterceptor("a", &log),
+		postsocket.Interceptor{},
+		logInterceptor("b", &log),
+		logInterceptor("c", &log),
+	)
+
+	chain.WrapEventHandler(postsocket.FuncHandler{
+		OnReady: func(conn, ante postsocket.Connection) { log = append(log, "handler Ready") },
+	}).Ready(nil, nil)
+	chain.Send(func(conn postsocket.Connection, msg, msgref interface{}, sp postsocket.SendParameters) error {
+		log = append(log, "transport Send")
+		return nil
+	})(nil, nil, nil, postsocket.SendParameters{})
+	chain.Receive(func(conn postsocket.Connection, receiver func(postsocket.Message, postsocket.Connection)) {
+		log = append(log, "transport Receive")
+		receiver(nil, conn)
+	})(nil, func(postsocket.Message, postsocket.Connection) { log = append(log, "receiver") })
+
+	want := []string{
+		"a Ready", "b Ready", "c Ready", "handler Ready",
+		"a Send", "b Send", "c Send", "transport Send", "c Sent", "b Sent", "a Sent",
+		"a Receive", "b Receive", "c Receive", "transport Receive",
+		"c Received", "b Received", "a Received", "receiver",
+	}
+	if !reflect.DeepEqual(log, want) {
+		t.Errorf("calls\n%q\nwant\n%q", log, want)
+	}
+}
+
+// connEvent is an event as seen by an intercepted EventHandler.
+type connEvent struct {
+	kind       string
+	conn, ante postsocket.Connection
+}
+
+// eventInterceptor returns an Interceptor recording the Connections each
+// Ready, Sent and Closed event is reported on.
+func eventInterceptor(events *[]connEvent) postsocket.Interceptor {
+	return postsocket.Interceptor{
+		EventHandler: func(next postsocket.EventHandler) postsocket.EventHandler {
+			return postsocket.FuncHandler{
+				OnReady: func(conn, ante postsocket.Connection) {
+					*events = append(*events, connEvent{"Ready", conn, ante})
+				},
+				OnSent: func(conn postsocket.Connection, msgref interface{}) {
+					*events = append(*events, connEvent{"Sent", conn, nil})
+				},
+				OnClosed: func(conn postsocket.Connection, err error) {
+					*events = append(*events, connEvent{"Closed", conn, nil})
+				},
+			}
+		},
+	}
+}
+
+func TestInterceptConnectionSubstitutes(t *testing.T) {
+	// The Clock is run by hand, so that the Connections can be intercepted
+	// before any event occurs.
+	clock := sim.NewClock(time.Unix(0, 0))
+	n := sim.NewNetwork(clock)
+	sctx := n.NewContext(net.IPv4(10, 0, 0, 1))
+	cctx := n.NewContext(net.IPv4(10, 0, 0, 2))
+
+	var sevents, cevents []connEvent
+	listener, err := sctx.Listen(nil, sctx.NewLocal().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lw := postsocket.InterceptConnection(listener, eventInterceptor(&sevents))
+	pc, err := cctx.Preconnect(nil, nil, cctx.NewRemote().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pc.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw := postsocket.InterceptConnection(client, eventInterceptor(&cevents))
+	if cw.GetEventHandler() != nil {
+		t.Errorf("GetEventHandler returned %v, want the nil EventHandler set", cw.GetEventHandler())
+	}
+	clock.RunFor(time.Second)
+
+	if len(cevents) != 1 || cevents[0] != (connEvent{"Ready", cw, nil}) {
+		t.Fatalf("client events %v, want Ready on the intercepted Connection", cevents)
+	}
+	if len(sevents) != 1 || sevents[0].kind != "Ready" || sevents[0].ante != lw {
+		t.Fatalf("listener events %v, want Ready with the intercepted listener as antecedent", sevents)
+	}
+	server := sevents[0].conn
+
+	var receivedOn postsocket.Connection
+	cw.Receive(func(msg postsocket.Message, conn postsocket.Connection) { receivedOn = conn })
+	if err := cw.Send([]byte("ping"), 1, postsocket.SendParameters{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Send([]byte("pong"), 2, postsocket.SendParameters{}); err != nil {
+		t.Fatal(err)
+	}
+	clock.RunFor(time.Second)
+	if receivedOn != cw {
+		t.Errorf("Message received on %v, want the intercepted Connection", receivedOn)
+	}
+
+	cw.Close()
+	clock.RunFor(time.Second)
+	want := []connEvent{{"Ready", cw, nil}, {"Sent", cw, nil}, {"Closed", cw, nil}}
+	if !reflect.DeepEqual(cevents, want) {
+		t.Errorf("client events %v, want %v", cevents, want)
+	}
+}
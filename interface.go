@@ -0,0 +1,256 @@
+package postsocket
+
+import (
+	"fmt"
+	"net"
+)
+
+// Built-in interface aliases, which ExpandInterface understands alongside
+// the names of interfaces and the aliases of a Policy.
+const (
+	// InterfaceLoopback denotes the loopback interfaces.
+	InterfaceLoopback = "loopback"
+
+	// InterfaceAnyIPv4 and InterfaceAnyIPv6 denote the unspecified address
+	// of each family, so any interface.
+	InterfaceAnyIPv4 = "any-ipv4"
+	InterfaceAnyIPv6 = "any-ipv6"
+)
+
+// InterfaceType is the kind of link an interface is on, the value of the
+// TransportInterfaceType parameter.
+type InterfaceType int
+
+// List of InterfaceType values.
+const (
+	InterfaceTypeUnknown InterfaceType = iota
+	InterfaceTypeLoopback
+	InterfaceTypeEthernet
+	InterfaceTypeWireless
+	InterfaceTypeCellular
+	InterfaceTypeTunnel
+	InterfaceTypeVirtual
+)
+
+// maxInterfaceAliasDepth bounds the expansion of aliases naming aliases.
+const maxInterfaceAliasDepth = 8
+
+// Interface is a network interface of the host, with its addresses and
+// type.
+type Interface struct {
+	net.Interface
+	Addrs []net.IP
+	Type  InterfaceType
+}
+
+// LocalCandidate is an address on an interface a Local may be bound to.
+// Link-local IPv6 addresses are scoped to the interface, whose name serves
+// as their zone.
+type LocalCandidate struct {
+	// Interface is the name of the interface, or empty for an unspecified
+	// address.
+	Interface string
+	IP        net.IP
+
+	// Type is the type of the interface, InterfaceTypeUnknown for an
+	// unspecified address.
+	Type InterfaceType
+}
+
+// Interfaces returns the network interfaces of the host, with their
+// addresses, as net.Interfaces enumerates them; on Linux, over netlink.
+// Interfaces are classified by type from sysfs on Linux, and only as
+// loopback or point-to-point tunnels elsewhere.
+func Interfaces() ([]Interface, error) {
+	nifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ifis := make([]Interface, len(nifis))
+	for i, nifi := range nifis {
+		ifis[i].Interface = nifi
+		ifis[i].Type = classifyInterface(&ifis[i].Interface)
+		addrs, err := nifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipn, ok := addr.(*net.IPNet); ok {
+				ifis[i].Addrs = append(ifis[i].Addrs, ipn.IP)
+			}
+		}
+	}
+	return ifis, nil
+}
+
+// ExpandInterface expands the name or alias of an interface, as given to
+// Local.WithInterface, into the candidate addresses it denotes among ifis,
+// in order. Names are looked up first in aliases, such as a Policy's
+// Interfaces, whose entries name interfaces or other aliases, then among
+// the built-in aliases, then among the names of ifis. Interfaces that are
+// down have no candidates. It returns an error if the name denotes no
+// interface, or no candidates.
+func ExpandInterface(ifis []Interface, name string, aliases map[string][]string) ([]LocalCandidate, error) {
+	cands, err := expandInterface(ifis, name, aliases, 0)
+	if err != nil {
+		return nil, err
+	}
+	var out []LocalCandidate
+	seen := make(map[string]bool)
+	for _, c := range cands {
+		key := c.Interface + "%" + c.IP.String()
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, c)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("postsocket: interface %q has no usable addresses", name)
+	}
+	return out, nil
+}
+
+func expandInterface(ifis []Interface, name string, aliases map[string][]string, depth int) ([]LocalCandidate, error) {
+	if depth > maxInterfaceAliasDepth {
+		return nil, fmt.Errorf("postsocket: interface alias %q nested too deeply", name)
+	}
+	if names, ok := aliases[name]; ok {
+		var cands []LocalCandidate
+		for _, n := range names {
+			c, err := expandInterface(ifis, n, aliases, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			cands = append(cands, c...)
+		}
+		return cands, nil
+	}
+
+	switch name {
+	case InterfaceAnyIPv4:
+		return []LocalCandidate{{IP: net.IPv4zero}}, nil
+	case InterfaceAnyIPv6:
+		return []LocalCandidate{{IP: net.IPv6unspecified}}, nil
+	case InterfaceLoopback:
+		var cands []LocalCandidate
+		for i := range ifis {
+			if ifis[i].Flags&net.FlagLoopback != 0 {
+				cands = append(cands, interfaceCandidates(&ifis[i])...)
+			}
+		}
+		return cands, nil
+	}
+	for i := range ifis {
+		if ifis[i].Name == name {
+			return interfaceCandidates(&ifis[i]), nil
+		}
+	}
+	return nil, fmt.Errorf("postsocket: no interface or alias %q", name)
+}
+
+// interfaceCandidates returns the candidates on an interface, none if it
+// is down.
+func interfaceCandidates(ifi *Interface) []LocalCandidate {
+	if ifi.Flags&net.FlagUp == 0 {
+		return nil
+	}
+	cands := make([]LocalCandidate, len(ifi.Addrs))
+	for i, ip := range ifi.Addrs {
+		cands[i] = LocalCandidate{Interface: ifi.Name, IP: ip, Type: ifi.Type}
+	}
+	return cands
+}
+
+// fallbackInterfaceType returns the type of an interface as far as its
+// flags tell.
+func fallbackInterfaceType(ifi *net.Interface) InterfaceType {
+	switch {
+	case ifi.Flags&net.FlagLoopback != 0:
+		return InterfaceTypeLoopback
+	case ifi.Flags&net.FlagPointToPoint != 0:
+		return InterfaceTypeTunnel
+	}
+	return InterfaceTypeUnknown
+}
+
+// PreferenceParameters is implemented by TransportParameters whose
+// preferences can be read back.
+type PreferenceParameters interface {
+	TransportParameters
+
+	// Preference returns the preference set for a parameter, with its
+	// value, or PrefIgnore if none is set.
+	Preference(p ParameterIdentifier) (Preference, interface{})
+}
+
+// SelectLocalCandidates returns the candidates that take part in racing
+// under the TransportInterfaceType preference of tp, in the order to try
+// them. The value of the preference is an InterfaceType, a slice of them,
+// or their names. Candidates not of a required type, or of a prohibited
+// one, are left out; those of a preferred type come first, and those of
+// an avoided type last, in their order otherwise. It returns an error if
+// no candidate remains. Candidates are returned as is if tp is not a
+// PreferenceParameters.
+func SelectLocalCandidates(cands []LocalCandidate, tp TransportParameters) ([]LocalCandidate, error) {
+	pp, ok := tp.(PreferenceParameters)
+	if !ok {
+		return cands, nil
+	}
+	pref, v := pp.Preference(TransportInterfaceType)
+	if pref == PrefIgnore {
+		return cands, nil
+	}
+	types, err := interfaceTypes(v)
+	if err != nil {
+		return nil, err
+	}
+	match := func(c LocalCandidate) bool {
+		for _, t := range types {
+			if c.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	var first, last []LocalCandidate
+	for _, c := range cands {
+		switch m := match(c); {
+		case pref == PrefRequire && !m, pref == PrefProhibit && m:
+		case pref == PrefPrefer && !m, pref == PrefAvoid && m:
+			last = append(last, c)
+		default:
+			first = append(first, c)
+		}
+	}
+	selected := append(first, last...)
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("postsocket: no local candidates with interface type %s %v", pref, types)
+	}
+	return selected, nil
+}
+
+// interfaceTypes returns the interface types of a TransportInterfaceType
+// value.
+func interfaceTypes(v interface{}) ([]InterfaceType, error) {
+	switch v := v.(type) {
+	case InterfaceType:
+		return []InterfaceType{v}, nil
+	case []InterfaceType:
+		return v, nil
+	case string:
+		if t, ok := interfaceTypeByName(v); ok {
+			return []InterfaceType{t}, nil
+		}
+	case []string:
+		types := make([]InterfaceType, len(v))
+		for i, name := range v {
+			var ok bool
+			if types[i], ok = interfaceTypeByName(name); !ok {
+				return nil, fmt.Errorf("postsocket: unknown interface type %q", name)
+			}
+		}
+		return types, nil
+	}
+	return nil, fmt.Errorf("postsocket: invalid value %v for %v", v, ParameterIdentifier(TransportInterfaceType))
+}
@@ -0,0 +1,146 @@
+package postsocket_test
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// testInterfaces is a fixed set of interfaces: loopback, Ethernet and
+// wireless interfaces that are up, and an Ethernet interface that is down.
+var testInterfaces = []postsocket.Interface{
+	{
+		Interface: net.Interface{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		Addrs:     []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		Type:      postsocket.InterfaceTypeLoopback,
+	},
+	{
+		Interface: net.Interface{Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast},
+		Addrs:     []net.IP{net.IPv4(192, 0, 2, 10), net.ParseIP("fe80::1")},
+		Type:      postsocket.InterfaceTypeEthernet,
+	},
+	{
+		Interface: net.Interface{Index: 3, Name: "wlan0", Flags: net.FlagUp | net.FlagMulticast},
+		Addrs:     []net.IP{net.IPv4(198, 51, 100, 5)},
+		Type:      postsocket.InterfaceTypeWireless,
+	},
+	{
+		Interface: net.Interface{Index: 4, Name: "eth1"},
+		Addrs:     []net.IP{net.IPv4(203, 0, 113, 1)},
+		Type:      postsocket.InterfaceTypeEthernet,
+	},
+}
+
+func TestExpandInterface(t *testing.T) {
+	lo := []postsocket.LocalCandidate{
+		{Interface: "lo", IP: net.IPv4(127, 0, 0, 1), Type: postsocket.InterfaceTypeLoopback},
+		{Interface: "lo", IP: net.IPv6loopback, Type: postsocket.InterfaceTypeLoopback},
+	}
+	eth0 := []postsocket.LocalCandidate{
+		{Interface: "eth0", IP: net.IPv4(192, 0, 2, 10), Type: postsocket.InterfaceTypeEthernet},
+		{Interface: "eth0", IP: net.ParseIP("fe80::1"), Type: postsocket.InterfaceTypeEthernet},
+	}
+	wlan0 := []postsocket.LocalCandidate{
+		{Interface: "wlan0", IP: net.IPv4(198, 51, 100, 5), Type: postsocket.InterfaceTypeWireless},
+	}
+	cat := func(lists ...[]postsocket.LocalCandidate) []postsocket.LocalCandidate {
+		var out []postsocket.LocalCandidate
+		for _, l := range lists {
+			out = append(out, l...)
+		}
+		return out
+	}
+
+	aliases := map[string][]string{
+		"uplink":   {"eth0", "wlan0"},
+		"all":      {"uplink", "loopback", "eth0"},
+		"wildcard": {"any-ipv6", "any-ipv4"},
+		"lo":       {"wlan0"}, // aliases shadow interface names
+		"cycle":    {"cycle2"},
+		"cycle2":   {"cycle"},
+		"down":     {"eth1"},
+		"missing":  {"eth0", "eth9"},
+	}
+	// A chain of aliases: deep0 names deep1, and so on, and deep8 names
+	// eth0, so that deep1 reaches eth0 at the depth limit and deep0 one
+	// alias past it.
+	for i := 0; i < 8; i++ {
+		aliases["deep"+strconv.Itoa(i)] = []string{"deep" + strconv.Itoa(i+1)}
+	}
+	aliases["deep8"] = []string{"eth0"}
+
+	tests := []struct {
+		name string
+		want []postsocket.LocalCandidate // nil if an error is expected
+	}{
+		{"eth0", eth0},
+		{"loopback", lo},
+		{"any-ipv4", []postsocket.LocalCandidate{{IP: net.IPv4zero}}},
+		{"wildcard", []postsocket.LocalCandidate{{IP: net.IPv6unspecified}, {IP: net.IPv4zero}}},
+		{"uplink", cat(eth0, wlan0)},
+		{"all", cat(eth0, wlan0, lo)},
+		{"lo", wlan0},
+		{"deep1", eth0},
+		{"deep0", nil},
+		{"cycle", nil},
+		{"eth1", nil},
+		{"down", nil},
+		{"eth9", nil},
+		{"missing", nil},
+	}
+	for _, test := range tests {
+		cands, err := postsocket.ExpandInterface(testInterfaces, test.name, aliases)
+		switch {
+		case test.want == nil && err == nil:
+			t.Errorf("%s expanded to %v, want an error", test.name, cands)
+		case test.want != nil && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case !reflect.DeepEqual(cands, test.want):
+			t.Errorf("%s expanded to %v, want %v", test.name, cands, test.want)
+		}
+	}
+}
+
+func TestSelectLocalCandidates(t *testing.T) {
+	ctx := sim.NewNetwork(sim.NewClock(time.Unix(0, 0))).NewContext(net.IPv4(10, 0, 0, 1))
+	lo := postsocket.LocalCandidate{Interface: "lo", IP: net.IPv4(127, 0, 0, 1), Type: postsocket.InterfaceTypeLoopback}
+	eth0 := postsocket.LocalCandidate{Interface: "eth0", IP: net.IPv4(192, 0, 2, 10), Type: postsocket.InterfaceTypeEthernet}
+	eth1 := postsocket.LocalCandidate{Interface: "eth1", IP: net.IPv4(203, 0, 113, 1), Type: postsocket.InterfaceTypeEthernet}
+	wlan0 := postsocket.LocalCandidate{Interface: "wlan0", IP: net.IPv4(198, 51, 100, 5), Type: postsocket.InterfaceTypeWireless}
+	any4 := postsocket.LocalCandidate{IP: net.IPv4zero}
+	cands := []postsocket.LocalCandidate{lo, eth0, wlan0, any4, eth1}
+
+	tp := ctx.NewTransportParameters()
+	tests := []struct {
+		name string
+		tp   postsocket.TransportParameters
+		want []postsocket.LocalCandidate // nil if an error is expected
+	}{
+		{"ignore", tp, cands},
+		{"not PreferenceParameters", struct{ postsocket.TransportParameters }{tp.Require(postsocket.TransportInterfaceType, postsocket.InterfaceTypeEthernet)}, cands},
+		{"require", tp.Require(postsocket.TransportInterfaceType, postsocket.InterfaceTypeEthernet), []postsocket.LocalCandidate{eth0, eth1}},
+		{"require names", tp.Require(postsocket.TransportInterfaceType, []string{"wireless", "loopback"}), []postsocket.LocalCandidate{lo, wlan0}},
+		{"require none", tp.Require(postsocket.TransportInterfaceType, "cellular"), nil},
+		{"prefer", tp.Prefer(postsocket.TransportInterfaceType, postsocket.InterfaceTypeWireless), []postsocket.LocalCandidate{wlan0, lo, eth0, any4, eth1}},
+		{"avoid", tp.Avoid(postsocket.TransportInterfaceType, []postsocket.InterfaceType{postsocket.InterfaceTypeEthernet}), []postsocket.LocalCandidate{lo, wlan0, any4, eth0, eth1}},
+		{"prohibit", tp.Prohibit(postsocket.TransportInterfaceType, []postsocket.InterfaceType{postsocket.InterfaceTypeEthernet, postsocket.InterfaceTypeLoopback}), []postsocket.LocalCandidate{wlan0, any4}},
+		{"invalid name", tp.Prefer(postsocket.TransportInterfaceType, "carrier-pigeon"), nil},
+		{"invalid value", tp.Prefer(postsocket.TransportInterfaceType, 42), nil},
+	}
+	for _, test := range tests {
+		selected, err := postsocket.SelectLocalCandidates(cands, test.tp)
+		switch {
+		case test.want == nil && err == nil:
+			t.Errorf("%s: selected %v, want an error", test.name, selected)
+		case test.want != nil && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case !reflect.DeepEqual(selected, test.want):
+			t.Errorf("%s: selected %v, want %v", test.name, selected, test.want)
+		}
+	}
+}
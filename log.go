@@ -0,0 +1,66 @@
+package postsocket
+
+import (
+	"log/slog"
+)
+
+// ConnectionInfo describes a Connection for logging, tracing and debugging.
+// It is a snapshot, taken when Connection.Info is called.
+type ConnectionInfo struct {
+	// ID identifies the Connection uniquely within its TransportContext. It
+	// is the identifier under which the Connection's events are traced.
+	ID uint64
+
+	// Stack names the protocol stack selected for the Connection, such as
+	// "tcp", "tls/tcp" or "quic", or is empty if none has been selected yet.
+	Stack string
+
+	// SecuritySuite names the security protocol and ciphersuite negotiated
+	// for the Connection, such as "TLS 1.3 TLS_AES_128_GCM_SHA256", or is
+	// empty if the Connection is not secured.
+	SecuritySuite string
+
+	// Group identifies the connection group the Connection belongs to.
+	// Connections created by Clone share the group of the Connection they
+	// were cloned from.
+	Group uint64
+
+	// PendingReceives is the number of calls to Receive whose callbacks
+	// have not yet been invoked.
+	PendingReceives int
+}
+
+// ConnectionAttrs returns structured logging attributes describing a
+// Connection: its identifier, its remote address, its selected protocol
+// stack, and its security suite. Attributes with no value are omitted.
+func ConnectionAttrs(conn Connection) []slog.Attr {
+	info := conn.Info()
+	attrs := []slog.Attr{slog.Uint64("conn_id", info.ID)}
+	if remote := conn.RemoteAddr(); remote != nil {
+		attrs = append(attrs, slog.String("remote", remote.String()))
+	}
+	if info.Stack != "" {
+		attrs = append(attrs, slog.String("stack", info.Stack))
+	}
+	if info.SecuritySuite != "" {
+		attrs = append(attrs, slog.String("security_suite", info.SecuritySuite))
+	}
+	return attrs
+}
+
+// ConnectionLogger derives a connection-scoped logger from l, which adds the
+// attributes returned by ConnectionAttrs to every record. Attributes are
+// evaluated when ConnectionLogger is called, so implementations should
+// derive the logger returned by Connection.Logger again once the Connection
+// is Ready. If l is nil, the returned logger discards all records.
+func ConnectionLogger(l *slog.Logger, conn Connection) *slog.Logger {
+	if l == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	attrs := ConnectionAttrs(conn)
+	args := make([]interface{}, len(attrs))
+	for i, a := range attrs {
+		args[i] = a
+	}
+	return l.With(args...)
+}
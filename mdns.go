@@ -0,0 +1,428 @@
+package postsocket
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+// Multicast DNS constants, from RFC 6762 and RFC 6763.
+const (
+	mdnsPort            = 5353
+	mdnsCacheFlush      = 1 << 15 // in the class of a response record
+	mdnsUnicastResponse = 1 << 15 // in the class of a question
+	mdnsHostTTL         = 120
+	mdnsServiceTTL      = 4500
+	mdnsLegacyMaxTTL    = 10 // in responses to legacy unicast queries
+	mdnsMaxLength       = 9000
+	mdnsDefaultTimeout  = time.Second
+	mdnsServicesName    = "_services._dns-sd._udp.local"
+)
+
+var (
+	mdnsGroupIPv4 = net.IPv4(224, 0, 0, 251)
+	mdnsGroupIPv6 = net.ParseIP("ff02::fb")
+)
+
+// MDNSResolver is a Resolver for device-to-device applications on a LAN,
+// resolving names in the local. domain with multicast DNS (RFC 6762), and
+// discovering the instances of services with DNS-based service discovery
+// (RFC 6763). Names outside the local. domain are resolved through a
+// fallback Resolver.
+//
+// An MDNSResolver is an SRVResolver: a Remote giving the hostname "local"
+// and a service name, as with WithHostname("local").WithServiceName("ipp"),
+// is resolved to the instances of the service, such as
+// "_ipp._tcp.local", advertised on the link, as by Advertise.
+type MDNSResolver struct {
+	// Interface is the interface on which to query, or nil for the
+	// default multicast interface.
+	Interface *net.Interface
+
+	// Timeout bounds how long to wait for responses. Address lookups
+	// return at the first answer, but service discovery waits for all of
+	// Timeout to collect answers from every responder.
+	Timeout time.Duration
+
+	// Fallback resolves names outside the local. domain, and service
+	// names to ports. If nil, SystemResolver is used.
+	Fallback Resolver
+}
+
+// NewMDNSResolver creates an MDNSResolver querying on the given interface,
+// or on the default multicast interface if ifi is nil, and falling back
+// to SystemResolver.
+func NewMDNSResolver(ifi *net.Interface) *MDNSResolver {
+	return &MDNSResolver{Interface: ifi, Timeout: mdnsDefaultTimeout, Fallback: SystemResolver}
+}
+
+// ServiceInstance is an instance of a service discovered with DNS-SD.
+type ServiceInstance struct {
+	// Instance is the name of the instance, such as "Living Room".
+	Instance string
+
+	// Service is the name of the service, such as "_ipp._tcp.local".
+	Service string
+
+	// Host and Port are the hostname and port of the instance.
+	Host string
+	Port uint16
+
+	// Addrs are the addresses of Host, if given by the responder.
+	Addrs []net.IP
+
+	// Text holds the key=value strings of the instance's TXT record.
+	Text []string
+}
+
+func (r *MDNSResolver) fallback() Resolver {
+	if r.Fallback == nil {
+		return SystemResolver
+	}
+	return r.Fallback
+}
+
+// LookupIP implements Resolver, querying for A and AAAA records of names
+// in the local. domain with multicast DNS.
+func (r *MDNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if !isMDNSName(host) {
+		return r.fallback().LookupIP(ctx, host)
+	}
+	name := strings.TrimSuffix(host, ".")
+
+	var ips []net.IP
+	err := r.exchange(ctx, []dnsQuestion{{name, dnsTypeA}, {name, dnsTypeAAAA}}, func(m *dnsMessage) bool {
+		ips = append(ips, mdnsAddrs(m, name)...)
+		return len(ips) > 0
+	})
+	if len(ips) == 0 {
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: host}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// LookupPort implements Resolver, through the fallback Resolver.
+func (r *MDNSResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return r.fallback().LookupPort(ctx, network, service)
+}
+
+// LookupSRV implements SRVResolver. For names in the local. domain, it
+// discovers the instances of the service with Browse, and returns an SRV
+// record for each in order of discovery; others are looked up through the
+// fallback Resolver, if it is an SRVResolver.
+func (r *MDNSResolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	if !isMDNSName(name) {
+		if sr, ok := r.fallback().(SRVResolver); ok {
+			return sr.LookupSRV(ctx, service, proto, name)
+		}
+		return nil, &net.DNSError{Err: "SRV lookup not supported", Name: name, IsNotFound: true}
+	}
+
+	insts, err := r.Browse(ctx, service, proto)
+	if err != nil {
+		return nil, err
+	}
+	srvs := make([]*net.SRV, len(insts))
+	for i, inst := range insts {
+		srvs[i] = &net.SRV{Target: inst.Host + ".", Port: inst.Port}
+	}
+	return srvs, nil
+}
+
+// Browse discovers the instances of a service, such as "ipp", on a
+// protocol, "tcp" or "udp", advertised on the link, in order of discovery.
+func (r *MDNSResolver) Browse(ctx context.Context, service, proto string) ([]ServiceInstance, error) {
+	svcName := "_" + service + "._" + proto + ".local"
+
+	var names []string
+	srvs := make(map[string]*net.SRV)
+	texts := make(map[string][]string)
+	hosts := make(map[string][]net.IP)
+	collect := func(m *dnsMessage) bool {
+		for _, rr := range m.records {
+			key := resolutionKey(rr.name)
+			switch rr.typ {
+			case dnsTypePTR:
+				target, _, err := dnsReadName(rr.msg, rr.off)
+				if err != nil || !strings.EqualFold(rr.name, svcName) {
+					continue
+				}
+				if !containsFold(names, target) {
+					names = append(names, target)
+				}
+			case dnsTypeSRV:
+				if srv, err := rr.srv(); err == nil {
+					srvs[key] = srv
+				}
+			case dnsTypeTXT:
+				texts[key] = dnsTXT(rr.data)
+			case dnsTypeA, dnsTypeAAAA:
+				if ip := rr.addr(); ip != nil {
+					hosts[key] = append(hosts[key], ip)
+				}
+			}
+		}
+		return false
+	}
+	if err := r.exchange(ctx, []dnsQuestion{{svcName, dnsTypePTR}}, collect); err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: svcName}
+	}
+
+	// Ask for the records that responders left out of their answers.
+	var missing []dnsQuestion
+	for _, name := range names {
+		if srvs[resolutionKey(name)] == nil {
+			missing = append(missing, dnsQuestion{name, dnsTypeSRV}, dnsQuestion{name, dnsTypeTXT})
+		}
+	}
+	if len(missing) > 0 {
+		r.exchange(ctx, missing, func(m *dnsMessage) bool {
+			collect(m)
+			for _, name := range names {
+				if srvs[resolutionKey(name)] == nil {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	var insts []ServiceInstance
+	for _, name := range names {
+		srv := srvs[resolutionKey(name)]
+		if srv == nil {
+			continue
+		}
+		host := strings.TrimSuffix(srv.Target, ".")
+		instance := name
+		if i := len(name) - len(svcName) - 1; i > 0 && strings.EqualFold(name[i:], "."+svcName) {
+			instance = name[:i]
+		}
+		insts = append(insts, ServiceInstance{
+			Instance: instance,
+			Service:  svcName,
+			Host:     host,
+			Port:     srv.Port,
+			Addrs:    hosts[resolutionKey(host)],
+			Text:     texts[resolutionKey(name)],
+		})
+	}
+	if len(insts) == 0 {
+		return nil, &net.DNSError{Err: "no instances of service", Name: svcName, IsNotFound: true}
+	}
+	return insts, nil
+}
+
+// exchange multicasts a query with the given questions over IPv4 and
+// IPv6, and passes each response to handle until it returns true or the
+// Timeout elapses. Responses arrive at the querying socket, rather than
+// the mDNS port, as legacy unicast responses.
+func (r *MDNSResolver) exchange(ctx context.Context, qs []dnsQuestion, handle func(*dnsMessage) bool) error {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = mdnsDefaultTimeout
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	q, err := mdnsQuery(qs)
+	if err != nil {
+		return err
+	}
+
+	msgs := make(chan *dnsMessage)
+	var firstErr error
+	sent := 0
+	for _, network := range []string{"udp4", "udp6"} {
+		c, err := net.ListenUDP(network, nil)
+		if err == nil {
+			err = setMulticastInterface(c, network, r.Interface)
+			if err != nil {
+				c.Close()
+			}
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		defer c.Close()
+
+		dst := &net.UDPAddr{IP: mdnsGroupIPv4, Port: mdnsPort}
+		if network == "udp6" {
+			dst.IP = mdnsGroupIPv6
+			if r.Interface != nil {
+				dst.Zone = r.Interface.Name
+			}
+		}
+		if _, err := c.WriteTo(q, dst); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+
+		go func() {
+			buf := make([]byte, mdnsMaxLength)
+			for {
+				n, _, err := c.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				m, err := dnsParseMessage(append([]byte(nil), buf[:n]...))
+				if err != nil || m.flags&(1<<15) == 0 {
+					continue
+				}
+				select {
+				case msgs <- m:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	if sent == 0 {
+		return firstErr
+	}
+
+	for {
+		select {
+		case m := <-msgs:
+			if handle(m) {
+				return nil
+			}
+		case <-ctx.Done():
+			return parent.Err()
+		}
+	}
+}
+
+// isMDNSName returns true if name is in the local. domain.
+func isMDNSName(name string) bool {
+	name = resolutionKey(name)
+	return name == "local" || strings.HasSuffix(name, ".local")
+}
+
+// mdnsAddrs returns the addresses given for a name in a message.
+func mdnsAddrs(m *dnsMessage, name string) []net.IP {
+	var ips []net.IP
+	for _, rr := range m.records {
+		if ip := rr.addr(); ip != nil && strings.EqualFold(rr.name, strings.TrimSuffix(name, ".")) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// addr returns the address of an A or AAAA record, or nil for records of
+// other types.
+func (rr dnsRR) addr() net.IP {
+	switch {
+	case rr.typ == dnsTypeA && len(rr.data) == net.IPv4len:
+		return net.IP(append([]byte(nil), rr.data...)).To16()
+	case rr.typ == dnsTypeAAAA && len(rr.data) == net.IPv6len:
+		return net.IP(append([]byte(nil), rr.data...))
+	}
+	return nil
+}
+
+func containsFold(ss []string, s string) bool {
+	for _, t := range ss {
+		if strings.EqualFold(t, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsQuestion is a question of a DNS message.
+type dnsQuestion struct {
+	name string
+	typ  uint16
+}
+
+// dnsMessage is a parsed DNS message, with the records of all its
+// sections.
+type dnsMessage struct {
+	id, flags uint16
+	questions []dnsQuestion
+	classes   []uint16 // of the questions
+	records   []dnsRR
+}
+
+// dnsParseMessage parses a DNS query or response.
+func dnsParseMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < dnsHeaderLength {
+		return nil, errDNSShort
+	}
+	m := &dnsMessage{
+		id:    binary.BigEndian.Uint16(msg[0:]),
+		flags: binary.BigEndian.Uint16(msg[2:]),
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := dnsHeaderLength
+	for i := 0; i < qdcount; i++ {
+		name, n, err := dnsReadName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+4 > len(msg) {
+			return nil, errDNSShort
+		}
+		m.questions = append(m.questions, dnsQuestion{name, binary.BigEndian.Uint16(msg[n:])})
+		m.classes = append(m.classes, binary.BigEndian.Uint16(msg[n+2:]))
+		off = n + 4
+	}
+	for i := 0; i < rrcount; i++ {
+		rr, n, err := dnsReadRR(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		m.records = append(m.records, rr)
+		off = n
+	}
+	return m, nil
+}
+
+// mdnsQuery builds a multicast DNS query with the given questions.
+func mdnsQuery(qs []dnsQuestion) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLength, 512)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(qs)))
+	for _, q := range qs {
+		var err error
+		if msg, err = dnsAppendName(msg, q.name); err != nil {
+			return nil, err
+		}
+		msg = binary.BigEndian.AppendUint16(msg, q.typ)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+	return msg, nil
+}
+
+// dnsTXT parses the strings of a TXT record.
+func dnsTXT(data []byte) []string {
+	var txt []string
+	for len(data) > 0 {
+		n := int(data[0])
+		if len(data) < 1+n {
+			break
+		}
+		if n > 0 {
+			txt = append(txt, string(data[1:1+n]))
+		}
+		data = data[1+n:]
+	}
+	return txt
+}
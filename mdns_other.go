@@ -0,0 +1,24 @@
+//go:build !(darwin || freebsd || linux || netbsd || openbsd)
+
+package postsocket
+
+import "net"
+
+// mdnsListen opens a socket on the mDNS port and joins the mDNS group of
+// the given network ("udp4" or "udp6") on an interface, or on the default
+// interface if ifi is nil. The port cannot be shared with other responders
+// on this platform.
+func mdnsListen(network string, ifi *net.Interface) (*net.UDPConn, error) {
+	group := mdnsGroupIPv4
+	if network == "udp6" {
+		group = mdnsGroupIPv6
+	}
+	return net.ListenMulticastUDP(network, ifi, &net.UDPAddr{IP: group, Port: mdnsPort})
+}
+
+// setMulticastInterface sets the interface on which multicasts from c go
+// out. This is not supported on this platform, where they go out on the
+// default interface.
+func setMulticastInterface(c *net.UDPConn, network string, ifi *net.Interface) error {
+	return nil
+}
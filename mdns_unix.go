@@ -0,0 +1,113 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+
+package postsocket
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// mdnsListen opens a socket on the mDNS port, shared with any other
+// responder on the host, and joins the mDNS group of the given network
+// ("udp4" or "udp6") on an interface, or on the default interface if ifi
+// is nil. Multicasts from the socket go out on the same interface. Where
+// supported, the socket is bound to the interface, so that it only answers
+// queries received on it.
+func mdnsListen(network string, ifi *net.Interface) (*net.UDPConn, error) {
+	var name string
+	if ifi != nil {
+		name = ifi.Name
+	}
+	bind := BindToDeviceControl(name, nil)
+	lc := net.ListenConfig{Control: func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			return serr
+		}
+		return bind(network, address, rc)
+	}}
+	pc, err := lc.ListenPacket(context.Background(), network, ":"+strconv.Itoa(mdnsPort))
+	if err != nil {
+		return nil, err
+	}
+	c := pc.(*net.UDPConn)
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		if network == "udp4" {
+			mreq := &syscall.IPMreq{Interface: mdnsInterfaceAddr(ifi)}
+			copy(mreq.Multiaddr[:], mdnsGroupIPv4.To4())
+			serr = syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+		} else {
+			mreq := &syscall.IPv6Mreq{}
+			copy(mreq.Multiaddr[:], mdnsGroupIPv6)
+			if ifi != nil {
+				mreq.Interface = uint32(ifi.Index)
+			}
+			serr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+		}
+	}); err != nil {
+		serr = err
+	}
+	if serr == nil {
+		serr = setMulticastInterface(c, network, ifi)
+	}
+	if serr != nil {
+		c.Close()
+		return nil, serr
+	}
+	return c, nil
+}
+
+// setMulticastInterface sets the interface on which multicasts from c go
+// out, if ifi is not nil.
+func setMulticastInterface(c *net.UDPConn, network string, ifi *net.Interface) error {
+	if ifi == nil {
+		return nil
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		if network == "udp4" {
+			serr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, mdnsInterfaceAddr(ifi))
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// mdnsInterfaceAddr returns the first IPv4 address of an interface, which
+// identifies it to the IPv4 multicast socket options, or the unspecified
+// address if ifi is nil or has none.
+func mdnsInterfaceAddr(ifi *net.Interface) [4]byte {
+	var a [4]byte
+	if ifi == nil {
+		return a
+	}
+	addrs, _ := ifi.Addrs()
+	for _, addr := range addrs {
+		if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			copy(a[:], ipn.IP.To4())
+			break
+		}
+	}
+	return a
+}
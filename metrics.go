@@ -0,0 +1,373 @@
+package postsocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RaceOutcome identifies the outcome of one candidate in candidate racing.
+type RaceOutcome int
+
+// List of RaceOutcome values
+const (
+	// RaceWon: the candidate was selected for the Connection.
+	RaceWon RaceOutcome = iota
+	// RaceLost: the candidate was abandoned because another won.
+	RaceLost
+	// RaceFailed: the candidate failed before any candidate won.
+	RaceFailed
+)
+
+var raceOutcomeNames = [...]string{
+	RaceWon:    "won",
+	RaceLost:   "lost",
+	RaceFailed: "failed",
+}
+
+// String returns the name of this race outcome.
+func (o RaceOutcome) String() string {
+	if o >= 0 && int(o) < len(raceOutcomeNames) {
+		return raceOutcomeNames[o]
+	}
+	return "RaceOutcome(" + strconv.Itoa(int(o)) + ")"
+}
+
+// ErrorKind classifies an error reported by an Error or Closed event into a
+// coarse kind suitable as a metric label: "expired", "closed", "canceled",
+// "timeout", "resolution", "refused", "reset", "unreachable", "security", or
+// "other".
+func ErrorKind(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+
+	switch {
+	case errors.Is(err, ErrExpired):
+		return "expired"
+	case errors.Is(err, ErrClosed), errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "resolution"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.As(err, &recordErr), errors.As(err, &certErr),
+		errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		return "security"
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
+// handshakeBuckets are the upper bounds, in seconds, of the handshake
+// latency histogram buckets.
+var handshakeBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative histogram over handshakeBuckets.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(handshakeBuckets)+1)
+	}
+	i := sort.SearchFloat64s(handshakeBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// raceKey and bytesKey are the label sets of multi-label counters.
+type raceKey struct {
+	stack   string
+	outcome RaceOutcome
+}
+
+type bytesKey struct {
+	profile CapacityProfile
+	sent    bool
+}
+
+// Metrics collects context-wide counters and histograms for a
+// TransportContext, and serves them over HTTP in the Prometheus text
+// exposition format. Implementations record connection lifecycle events
+// through its methods; the Interceptor it returns records Error events and
+// bytes sent and received. All methods may be called concurrently.
+type Metrics struct {
+	mu        sync.Mutex
+	opened    map[string]uint64 // by stack
+	closed    map[string]uint64 // by stack
+	handshake map[string]*histogram
+	races     map[raceKey]uint64
+	errors    map[string]uint64 // by ErrorKind
+	bytes     map[bytesKey]uint64
+}
+
+// NewMetrics creates a new, empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		opened:    make(map[string]uint64),
+		closed:    make(map[string]uint64),
+		handshake: make(map[string]*histogram),
+		races:     make(map[raceKey]uint64),
+		errors:    make(map[string]uint64),
+		bytes:     make(map[bytesKey]uint64),
+	}
+}
+
+// ConnectionOpened counts a Connection that became Ready over the named
+// protocol stack.
+func (m *Metrics) ConnectionOpened(stack string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.opened[stack]++
+}
+
+// ConnectionClosed counts a Connection over the named protocol stack that
+// Closed.
+func (m *Metrics) ConnectionClosed(stack string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed[stack]++
+}
+
+// Handshake records the time taken to establish a Connection over the named
+// protocol stack, from the start of the attempt that won the race to Ready.
+func (m *Metrics) Handshake(stack string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.handshake[stack]
+	if h == nil {
+		h = new(histogram)
+		m.handshake[stack] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+// Race counts the outcome of a candidate over the named protocol stack in
+// candidate racing.
+func (m *Metrics) Race(stack string, outcome RaceOutcome) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.races[raceKey{stack, outcome}]++
+}
+
+// Error counts an error reported by an Error event, by ErrorKind.
+func (m *Metrics) Error(err error) {
+	kind := ErrorKind(err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[kind]++
+}
+
+// Bytes counts n bytes sent, or received if sent is false, under the given
+// capacity profile.
+func (m *Metrics) Bytes(profile CapacityProfile, sent bool, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[bytesKey{profile, sent}] += uint64(n)
+}
+
+// Interceptor returns an Interceptor recording Error events, bytes sent by
+// the CapacityProfile in their SendParameters, and bytes received by the
+// TransportCapacityProfile of the receiving Connection. Bytes sent are
+// counted for Messages given as []byte or Message; bytes of Messages left to
+// the FramingHandler are not counted.
+func (m *Metrics) Interceptor() Interceptor {
+	return Interceptor{
+		EventHandler: func(next EventHandler) EventHandler {
+			return metricsHandler{next, m}
+		},
+		Send: func(next SendFunc) SendFunc {
+			return func(conn Connection, msg interface{}, msgref interface{}, sp SendParameters) error {
+				err := next(conn, msg, msgref, sp)
+				if err == nil {
+					switch b := msg.(type) {
+					case []byte:
+						m.Bytes(sp.CapacityProfile, true, len(b))
+					case Message:
+						m.Bytes(sp.CapacityProfile, true, len(b.Bytes()))
+					}
+				}
+				return err
+			}
+		},
+		Receive: func(next ReceiveFunc) ReceiveFunc {
+			return func(conn Connection, receiver func(msg Message, conn Connection)) {
+				next(conn, func(msg Message, conn Connection) {
+					m.Bytes(connCapacityProfile(conn), false, len(msg.Bytes()))
+					receiver(msg, conn)
+				})
+			}
+		},
+	}
+}
+
+// connCapacityProfile returns the capacity profile of a Connection, or
+// CapProfDefault if none is available.
+func connCapacityProfile(conn Connection) CapacityProfile {
+	tp := conn.GetTransportParameters()
+	if tp == nil {
+		return CapProfDefault
+	}
+	v, err := tp.Get(TransportCapacityProfile)
+	if err != nil {
+		return CapProfDefault
+	}
+	switch cp := v.(type) {
+	case CapacityProfile:
+		return cp
+	case int:
+		// The CapProf constants are untyped, so profiles often arrive as ints.
+		return CapacityProfile(cp)
+	}
+	return CapProfDefault
+}
+
+// metricsHandler counts Error events before passing them on.
+type metricsHandler struct {
+	EventHandler
+	m *Metrics
+}
+
+// Error implements EventHandler.
+func (h metricsHandler) Error(conn Connection, msgref interface{}, err error) {
+	h.m.Error(err)
+	h.EventHandler.Error(conn, msgref, err)
+}
+
+// ServeHTTP implements http.Handler, writing all metrics in the Prometheus
+// text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.write(&buf)
+	return buf.WriteTo(w)
+}
+
+func (m *Metrics) write(w *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "postsocket_connections_opened_total", "counter", "Connections that became Ready, by protocol stack.")
+	for _, stack := range sortedKeys(m.opened) {
+		fmt.Fprintf(w, "postsocket_connections_opened_total{stack=%s} %d\n", quoteLabel(stack), m.opened[stack])
+	}
+
+	writeHeader(w, "postsocket_connections_closed_total", "counter", "Connections that Closed, by protocol stack.")
+	for _, stack := range sortedKeys(m.closed) {
+		fmt.Fprintf(w, "postsocket_connections_closed_total{stack=%s} %d\n", quoteLabel(stack), m.closed[stack])
+	}
+
+	writeHeader(w, "postsocket_handshake_duration_seconds", "histogram", "Time from the start of the winning attempt to Ready, by protocol stack.")
+	stacks := make([]string, 0, len(m.handshake))
+	for stack := range m.handshake {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	for _, stack := range stacks {
+		h := m.handshake[stack]
+		var cum uint64
+		for i, le := range handshakeBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "postsocket_handshake_duration_seconds_bucket{stack=%s,le=\"%s\"} %d\n",
+				quoteLabel(stack), strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "postsocket_handshake_duration_seconds_bucket{stack=%s,le=\"+Inf\"} %d\n", quoteLabel(stack), h.count)
+		fmt.Fprintf(w, "postsocket_handshake_duration_seconds_sum{stack=%s} %s\n", quoteLabel(stack), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "postsocket_handshake_duration_seconds_count{stack=%s} %d\n", quoteLabel(stack), h.count)
+	}
+
+	writeHeader(w, "postsocket_race_candidates_total", "counter", "Candidates in candidate racing, by protocol stack and outcome.")
+	races := make([]raceKey, 0, len(m.races))
+	for k := range m.races {
+		races = append(races, k)
+	}
+	sort.Slice(races, func(i, j int) bool {
+		if races[i].stack != races[j].stack {
+			return races[i].stack < races[j].stack
+		}
+		return races[i].outcome < races[j].outcome
+	})
+	for _, k := range races {
+		fmt.Fprintf(w, "postsocket_race_candidates_total{stack=%s,outcome=%s} %d\n",
+			quoteLabel(k.stack), quoteLabel(k.outcome.String()), m.races[k])
+	}
+
+	writeHeader(w, "postsocket_errors_total", "counter", "Error events, by kind.")
+	for _, kind := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "postsocket_errors_total{kind=%s} %d\n", quoteLabel(kind), m.errors[kind])
+	}
+
+	writeHeader(w, "postsocket_bytes_total", "counter", "Message bytes sent and received, by capacity profile.")
+	byteKeys := make([]bytesKey, 0, len(m.bytes))
+	for k := range m.bytes {
+		byteKeys = append(byteKeys, k)
+	}
+	sort.Slice(byteKeys, func(i, j int) bool {
+		if byteKeys[i].profile != byteKeys[j].profile {
+			return byteKeys[i].profile < byteKeys[j].profile
+		}
+		return byteKeys[i].sent && !byteKeys[j].sent
+	})
+	for _, k := range byteKeys {
+		direction := "received"
+		if k.sent {
+			direction = "sent"
+		}
+		fmt.Fprintf(w, "postsocket_bytes_total{profile=%s,direction=\"%s\"} %d\n",
+			quoteLabel(k.profile.String()), direction, m.bytes[k])
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value for the text exposition format.
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
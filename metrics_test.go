@@ -0,0 +1,156 @@
+package postsocket_test
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// metricsText returns the Prometheus text rendering of m.
+func metricsText(t *testing.T, m *postsocket.Metrics) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// checkLines fails t for each of want not a line of text, and for each of
+// unwanted that is a prefix of one.
+func checkLines(t *testing.T, text string, want, unwanted []string) {
+	t.Helper()
+	lines := strings.Split(text, "\n")
+	has := make(map[string]bool, len(lines))
+	for _, l := range lines {
+		has[l] = true
+	}
+	for _, w := range want {
+		if !has[w] {
+			t.Errorf("missing line %q", w)
+		}
+	}
+	for _, u := range unwanted {
+		for _, l := range lines {
+			if strings.HasPrefix(l, u) {
+				t.Errorf("unexpected line %q", l)
+			}
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics:\n%s", text)
+	}
+}
+
+func TestMetricsText(t *testing.T) {
+	m := postsocket.NewMetrics()
+	m.ConnectionOpened("tcp")
+	m.ConnectionOpened("tcp")
+	m.ConnectionClosed("tcp")
+	m.Handshake("tcp", 3*time.Millisecond)
+	m.Handshake("tcp", 20*time.Millisecond)
+	m.Race("tcp", postsocket.RaceWon)
+	m.Race("tcp", postsocket.RaceFailed)
+	m.Error(postsocket.ErrExpired)
+	m.Error(postsocket.ErrExpired)
+	m.Bytes(postsocket.CapProfBulk, true, 100)
+	m.Bytes(postsocket.CapProfBulk, false, 40)
+	m.ConnectionOpened("quic \"v1\"\n")
+
+	checkLines(t, metricsText(t, m), []string{
+		"# HELP postsocket_connections_opened_total Connections that became Ready, by protocol stack.",
+		"# TYPE postsocket_connections_opened_total counter",
+		`postsocket_connections_opened_total{stack="quic \"v1\"\n"} 1`,
+		`postsocket_connections_opened_total{stack="tcp"} 2`,
+		`postsocket_connections_closed_total{stack="tcp"} 1`,
+		"# TYPE postsocket_handshake_duration_seconds histogram",
+		`postsocket_handshake_duration_seconds_bucket{stack="tcp",le="0.001"} 0`,
+		`postsocket_handshake_duration_seconds_bucket{stack="tcp",le="0.005"} 1`,
+		`postsocket_handshake_duration_seconds_bucket{stack="tcp",le="0.025"} 2`,
+		`postsocket_handshake_duration_seconds_bucket{stack="tcp",le="+Inf"} 2`,
+		`postsocket_handshake_duration_seconds_sum{stack="tcp"} 0.023`,
+		`postsocket_handshake_duration_seconds_count{stack="tcp"} 2`,
+		`postsocket_race_candidates_total{stack="tcp",outcome="won"} 1`,
+		`postsocket_race_candidates_total{stack="tcp",outcome="failed"} 1`,
+		`postsocket_errors_total{kind="expired"} 2`,
+		`postsocket_bytes_total{profile="bulk",direction="sent"} 100`,
+		`postsocket_bytes_total{profile="bulk",direction="received"} 40`,
+	}, nil)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q, want the text exposition format", ct)
+	}
+	if w.Body.String() != metricsText(t, m) {
+		t.Error("ServeHTTP and WriteTo differ")
+	}
+}
+
+func TestMetricsSimulated(t *testing.T) {
+	clock := sim.NewClock(time.Unix(0, 0))
+	n := sim.NewNetwork(clock)
+	n.SetLatency(10 * time.Millisecond)
+	sctx := n.NewContext(net.IPv4(10, 0, 0, 1))
+	cctx := n.NewContext(net.IPv4(10, 0, 0, 2))
+
+	// The untyped CapProf constants make an int parameter value.
+	tp := sctx.NewTransportParameters().Require(postsocket.TransportCapacityProfile, postsocket.CapProfBulk)
+	var server postsocket.Connection
+	listener, err := sctx.Listen(postsocket.FuncHandler{
+		OnReady: func(conn, ante postsocket.Connection) { server = conn },
+	}, sctx.NewLocal().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), tp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := cctx.Preconnect(nil, nil, cctx.NewRemote().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pc.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.RunFor(time.Second)
+	if server == nil {
+		t.Fatal("no Connection accepted")
+	}
+
+	server.Receive(func(postsocket.Message, postsocket.Connection) {})
+	client.Send([]byte("hello"), nil, postsocket.SendParameters{CapacityProfile: postsocket.CapProfInteractive})
+	clock.RunFor(time.Second)
+	client.Close()
+	listener.Close()
+
+	// Closed events are not Error events, even when Closed reports an error.
+	var refused error
+	pc, err = cctx.Preconnect(postsocket.FuncHandler{
+		OnClosed: func(conn postsocket.Connection, err error) { refused = err },
+	}, nil, cctx.NewRemote().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7001), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.Initiate(); err != nil {
+		t.Fatal(err)
+	}
+	clock.RunFor(time.Second)
+	if refused == nil {
+		t.Fatal("Connection to a closed port not refused")
+	}
+
+	// The handshake takes a round trip.
+	checkLines(t, metricsText(t, cctx.Metrics()), []string{
+		`postsocket_handshake_duration_seconds_sum{stack="sim"} 0.02`,
+		`postsocket_handshake_duration_seconds_count{stack="sim"} 1`,
+		`postsocket_bytes_total{profile="interactive",direction="sent"} 5`,
+	}, []string{"postsocket_errors_total{"})
+	checkLines(t, metricsText(t, sctx.Metrics()), []string{
+		`postsocket_bytes_total{profile="bulk",direction="received"} 5`,
+	}, []string{"postsocket_errors_total{"})
+}
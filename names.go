@@ -0,0 +1,145 @@
+package postsocket
+
+import (
+	"strconv"
+	"strings"
+)
+
+var capacityProfileNames = [...]string{
+	CapProfDefault:      "default",
+	CapProfInteractive:  "interactive",
+	CapProfConstantRate: "constant-rate",
+	CapProfBulk:         "bulk",
+}
+
+// String returns the name of this capacity profile.
+func (cp CapacityProfile) String() string {
+	if cp >= 0 && int(cp) < len(capacityProfileNames) {
+		return capacityProfileNames[cp]
+	}
+	return "CapacityProfile(" + strconv.Itoa(int(cp)) + ")"
+}
+
+// capacityProfileByName returns the capacity profile with the given name,
+// ignoring case.
+func capacityProfileByName(name string) (CapacityProfile, bool) {
+	for cp, n := range capacityProfileNames {
+		if strings.EqualFold(name, n) {
+			return CapacityProfile(cp), true
+		}
+	}
+	return 0, false
+}
+
+var preferenceNames = [...]string{
+	PrefIgnore:   "ignore",
+	PrefRequire:  "require",
+	PrefPrefer:   "prefer",
+	PrefAvoid:    "avoid",
+	PrefProhibit: "prohibit",
+}
+
+// String returns the name of this preference.
+func (pref Preference) String() string {
+	if pref >= 0 && int(pref) < len(preferenceNames) {
+		return preferenceNames[pref]
+	}
+	return "Preference(" + strconv.Itoa(int(pref)) + ")"
+}
+
+// preferenceByName returns the preference with the given name, ignoring
+// case.
+func preferenceByName(name string) (Preference, bool) {
+	for pref, n := range preferenceNames {
+		if strings.EqualFold(name, n) {
+			return Preference(pref), true
+		}
+	}
+	return 0, false
+}
+
+var interfaceTypeNames = [...]string{
+	InterfaceTypeUnknown:  "unknown",
+	InterfaceTypeLoopback: "loopback",
+	InterfaceTypeEthernet: "ethernet",
+	InterfaceTypeWireless: "wireless",
+	InterfaceTypeCellular: "cellular",
+	InterfaceTypeTunnel:   "tunnel",
+	InterfaceTypeVirtual:  "virtual",
+}
+
+// String returns the name of this interface type.
+func (t InterfaceType) String() string {
+	if t >= 0 && int(t) < len(interfaceTypeNames) {
+		return interfaceTypeNames[t]
+	}
+	return "InterfaceType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// interfaceTypeByName returns the interface type with the given name,
+// ignoring case.
+func interfaceTypeByName(name string) (InterfaceType, bool) {
+	for t, n := range interfaceTypeNames {
+		if strings.EqualFold(name, n) {
+			return InterfaceType(t), true
+		}
+	}
+	return 0, false
+}
+
+var parameterNames = [...]string{
+	TransportFullyReliable:                  "TransportFullyReliable",
+	TransportOrderPreserved:                 "TransportOrderPreserved",
+	TransportPerMessageReliable:             "TransportPerMessageReliable",
+	TransportIdempotent0RTT:                 "TransportIdempotent0RTT",
+	TransportMultistreaming:                 "TransportMultistreaming",
+	TransportTimeoutNegotiationSupport:      "TransportTimeoutNegotiationSupport",
+	TransportExtendedErrorSupport:           "TransportExtendedErrorSupport",
+	TransportChecksumControl:                "TransportChecksumControl",
+	TransportInterfaceType:                  "TransportInterfaceType",
+	TransportCapacityProfile:                "TransportCapacityProfile",
+	TransportTimeout:                        "TransportTimeout",
+	TransportSuggestTimeout:                 "TransportSuggestTimeout",
+	TransportRetransmissionThreshold:        "TransportRetransmissionThreshold",
+	TransportMinimumReceiveChecksumCoverage: "TransportMinimumReceiveChecksumCoverage",
+	TransportGroupTransmissionScheduler:     "TransportGroupTransmissionScheduler",
+	TransportMaxIdempotent0RTT:              "TransportMaxIdempotent0RTT",
+	TransportMaxNoFragment:                  "TransportMaxNoFragment",
+	TransportMaxNonpartialSend:              "TransportMaxNonpartialSend",
+	TransportMaxNonpartialReceive:           "TransportMaxNonpartialReceive",
+	TransportNiceness:                       "TransportNiceness",
+	SecuritySupportedGroup:                  "SecuritySupportedGroup",
+	SecurityCiphersuite:                     "SecurityCiphersuite",
+	SecuritySignatureAlgorithm:              "SecuritySignatureAlgorithm",
+	SecuritySessionCacheCapacity:            "SecuritySessionCacheCapacity",
+	SecuritySessionCacheLifetime:            "SecuritySessionCacheLifetime",
+	SecuritySessionCacheReuse:               "SecuritySessionCacheReuse",
+}
+
+// String returns the name of this parameter identifier, as spelled in the
+// constant identifying it.
+func (p ParameterIdentifier) String() string {
+	if p >= 0 && int(p) < len(parameterNames) {
+		return parameterNames[p]
+	}
+	return "ParameterIdentifier(" + strconv.Itoa(int(p)) + ")"
+}
+
+// parameterByName returns the parameter identifier spelled as name.
+func parameterByName(name string) (ParameterIdentifier, bool) {
+	for p, n := range parameterNames {
+		if n == name {
+			return ParameterIdentifier(p), true
+		}
+	}
+	return 0, false
+}
+
+// transportParameterIDs lists all transport parameter identifiers, in order.
+func transportParameterIDs() []ParameterIdentifier {
+	ids := make([]ParameterIdentifier, 0, SecuritySupportedGroup)
+	for p := ParameterIdentifier(TransportFullyReliable); p < SecuritySupportedGroup; p++ {
+		ids = append(ids, p)
+	}
+	return ids
+}
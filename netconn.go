@@ -0,0 +1,590 @@
+package postsocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// sendRef is the message reference used by adapters in this package to
+// recognize events for Messages they sent themselves. Each Send gets a fresh
+// *sendRef, so references are unique by pointer identity.
+type sendRef struct {
+	done chan error
+}
+
+func newSendRef() *sendRef {
+	return &sendRef{done: make(chan error, 1)}
+}
+
+// complete reports the fate of the referenced Message. Only the first call
+// has any effect.
+func (r *sendRef) complete(err error) {
+	select {
+	case r.done <- err:
+	default:
+	}
+}
+
+// deadline is a resettable deadline for blocking operations, in the style of
+// the one used by net.Pipe. The channel returned by wait is closed once the
+// deadline has passed.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will expire. A zero value for
+// t disables the deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// errCanceled is returned by adapter waits abandoned through their cancel
+// channel; callers replace it with their own deadline or context error.
+var errCanceled = errors.New("postsocket: wait canceled")
+
+// adapter is the EventHandler interposed on a Connection by the adapters in
+// this package. It consumes events for the Messages sent through it, keeps
+// at most one Receive outstanding, and tracks whether the Connection has
+// closed; every other event is passed on to the EventHandler it replaced.
+type adapter struct {
+	conn Connection // set under mu if not known when created
+	prev EventHandler
+
+	// recv carries Messages from the single outstanding Receive.
+	recv chan Message
+
+	// ready is closed once the Connection is Ready.
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	mu        sync.Mutex
+	pending   bool // a Receive is outstanding
+	closeErr  error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newAdapter(conn Connection, prev EventHandler) *adapter {
+	return &adapter{
+		conn:   conn,
+		prev:   prev,
+		recv:   make(chan Message, 1),
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// receive waits for the next Message on the Connection, calling Receive if
+// no Receive is already outstanding. If cancel is closed first, receive
+// returns errCanceled and leaves the Receive outstanding for the next call.
+// Once the Connection has closed and no Message remains, receive returns the
+// error the Connection closed with, or ErrClosed.
+func (a *adapter) receive(cancel <-chan struct{}) (Message, error) {
+	a.mu.Lock()
+	if !a.pending && !isClosedChan(a.closed) {
+		a.pending = true
+		a.mu.Unlock()
+		a.conn.Receive(a.received)
+	} else {
+		a.mu.Unlock()
+	}
+
+	select {
+	case msg := <-a.recv:
+		return a.take(msg), nil
+	case <-a.closed:
+		// Prefer a Message that arrived before the close.
+		select {
+		case msg := <-a.recv:
+			return a.take(msg), nil
+		default:
+		}
+		return nil, a.closedError()
+	case <-cancel:
+		return nil, errCanceled
+	}
+}
+
+func (a *adapter) take(msg Message) Message {
+	a.mu.Lock()
+	a.pending = false
+	a.mu.Unlock()
+	return msg
+}
+
+func (a *adapter) received(msg Message, conn Connection) {
+	a.recv <- msg
+}
+
+// send sends a Message and waits until it has been Sent, has Expired, or has
+// failed. If cancel is closed first, send returns errCanceled; the Message
+// remains in flight.
+func (a *adapter) send(msg interface{}, sp SendParameters, cancel <-chan struct{}) error {
+	if isClosedChan(a.closed) {
+		return a.closedError()
+	}
+
+	ref := newSendRef()
+	if err := a.conn.Send(msg, ref, sp); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-ref.done:
+		return err
+	case <-a.closed:
+		return a.closedError()
+	case <-cancel:
+		return errCanceled
+	}
+}
+
+func (a *adapter) closedError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closeErr != nil {
+		return a.closeErr
+	}
+	return ErrClosed
+}
+
+// owns returns true if an event on conn concerns the adapted Connection,
+// rather than a clone of it, which inherits the adapter as EventHandler.
+// Until the adapted Connection is known, the first Connection to report an
+// event is taken as it, as it cannot have been cloned yet.
+func (a *adapter) owns(conn Connection) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		a.conn = conn
+	}
+	return a.conn == conn
+}
+
+// setConn sets the adapted Connection, once known, unless an event has
+// already reported it.
+func (a *adapter) setConn(conn Connection) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		a.conn = conn
+	}
+}
+
+func (a *adapter) markReady() {
+	a.readyOnce.Do(func() { close(a.ready) })
+}
+
+// Ready implements EventHandler.
+func (a *adapter) Ready(conn Connection, ante Connection) {
+	if ante == nil && a.owns(conn) {
+		a.markReady()
+	}
+	if a.prev != nil {
+		a.prev.Ready(conn, ante)
+	}
+}
+
+// Sent implements EventHandler.
+func (a *adapter) Sent(conn Connection, msgref interface{}) {
+	if ref, ok := msgref.(*sendRef); ok {
+		ref.complete(nil)
+	} else if a.prev != nil {
+		a.prev.Sent(conn, msgref)
+	}
+}
+
+// Expired implements EventHandler.
+func (a *adapter) Expired(conn Connection, msgref interface{}) {
+	if ref, ok := msgref.(*sendRef); ok {
+		ref.complete(ErrExpired)
+	} else if a.prev != nil {
+		a.prev.Expired(conn, msgref)
+	}
+}
+
+// Error implements EventHandler.
+func (a *adapter) Error(conn Connection, msgref interface{}, err error) {
+	if ref, ok := msgref.(*sendRef); ok {
+		ref.complete(err)
+	} else if a.prev != nil {
+		a.prev.Error(conn, msgref, err)
+	}
+}
+
+// Closed implements EventHandler.
+func (a *adapter) Closed(conn Connection, err error) {
+	if a.owns(conn) {
+		a.closeOnce.Do(func() {
+			a.mu.Lock()
+			a.closeErr = err
+			a.mu.Unlock()
+			close(a.closed)
+		})
+	}
+	if a.prev != nil {
+		a.prev.Closed(conn, err)
+	}
+}
+
+// netConn adapts a Connection to net.Conn.
+type netConn struct {
+	a  *adapter
+	sp SendParameters
+
+	mu   sync.Mutex
+	rbuf []byte // received bytes not yet returned by Read
+
+	rdeadline *deadline
+	wdeadline *deadline
+
+	// closed is closed by Close, after which Read and Write fail with
+	// net.ErrClosed.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewNetConn wraps a Connection as a net.Conn. Read calls Receive on the
+// underlying Connection and returns the bytes of each received Message in
+// order; Write sends each call's bytes as a single Message with the given
+// SendParameters and blocks until the Message has been Sent, has Expired, or
+// has failed. Read and write deadlines bound the time spent waiting for
+// Receive and Send to complete; a Receive or Send interrupted by a deadline
+// remains outstanding on the Connection.
+//
+// NewNetConn replaces the Connection's EventHandler. Events not related to
+// Messages written through the returned net.Conn are passed on to the
+// Connection's previous EventHandler, if any.
+func NewNetConn(conn Connection, sp SendParameters) net.Conn {
+	a := newAdapter(conn, conn.GetEventHandler())
+	conn.SetEventHandler(a)
+	return newNetConn(a, sp)
+}
+
+func newNetConn(a *adapter, sp SendParameters) *netConn {
+	return &netConn{
+		a:         a,
+		sp:        sp,
+		rdeadline: newDeadline(),
+		wdeadline: newDeadline(),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Read implements net.Conn.
+func (c *netConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if isClosedChan(c.closed) {
+		return 0, net.ErrClosed
+	}
+	if len(c.rbuf) == 0 {
+		msg, err := c.a.receive(c.rdeadline.wait())
+		switch {
+		case err == errCanceled:
+			return 0, os.ErrDeadlineExceeded
+		case err == ErrClosed && isClosedChan(c.closed):
+			return 0, net.ErrClosed
+		case err == ErrClosed:
+			return 0, io.EOF
+		case err != nil:
+			return 0, err
+		}
+		c.rbuf = msg.Bytes()
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write implements net.Conn.
+func (c *netConn) Write(b []byte) (int, error) {
+	if isClosedChan(c.closed) {
+		return 0, net.ErrClosed
+	}
+	err := c.a.send(append([]byte(nil), b...), c.sp, c.wdeadline.wait())
+	switch {
+	case err == errCanceled:
+		return 0, os.ErrDeadlineExceeded
+	case err == ErrClosed:
+		return 0, net.ErrClosed
+	case err != nil:
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close implements net.Conn.
+func (c *netConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.a.conn.Close()
+}
+
+// LocalAddr implements net.Conn.
+func (c *netConn) LocalAddr() net.Addr {
+	return c.a.conn.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.
+func (c *netConn) RemoteAddr() net.Addr {
+	return c.a.conn.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn.
+func (c *netConn) SetDeadline(t time.Time) error {
+	c.rdeadline.set(t)
+	c.wdeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *netConn) SetReadDeadline(t time.Time) error {
+	c.rdeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *netConn) SetWriteDeadline(t time.Time) error {
+	c.wdeadline.set(t)
+	return nil
+}
+
+// acceptor is the EventHandler interposed on a listening Connection by the
+// adapters in this package. It interposes an adapter on each Connection
+// accepted, queues it for accept, and routes events on accepted
+// Connections to their adapters until the adapters take over as their
+// EventHandlers. Events for the listening Connection itself are passed on
+// to the EventHandler it replaced.
+type acceptor struct {
+	lconn Connection
+	prev  EventHandler
+
+	mu        sync.Mutex
+	conns     map[Connection]*adapter // accepted, keyed for event routing
+	queue     []*adapter              // accepted but not yet returned by accept
+	notify    chan struct{}
+	closeErr  error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newAcceptor(lconn Connection) *acceptor {
+	l := &acceptor{
+		lconn:  lconn,
+		prev:   lconn.GetEventHandler(),
+		conns:  make(map[Connection]*adapter),
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	lconn.SetEventHandler(l)
+	return l
+}
+
+// accept waits for the next accepted Connection and returns its adapter. If
+// cancel is closed first, accept returns errCanceled. Once the listening
+// Connection has closed, accept returns the error it closed with, or
+// ErrClosed.
+func (l *acceptor) accept(cancel <-chan struct{}) (*adapter, error) {
+	for {
+		l.mu.Lock()
+		if len(l.queue) > 0 {
+			a := l.queue[0]
+			l.queue = l.queue[1:]
+			l.mu.Unlock()
+			return a, nil
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-l.notify:
+		case <-l.closed:
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.closeErr != nil {
+				return nil, l.closeErr
+			}
+			return nil, ErrClosed
+		case <-cancel:
+			return nil, errCanceled
+		}
+	}
+}
+
+// lookup returns the adapter on an accepted Connection, or nil if the event
+// concerns the listening Connection.
+func (l *acceptor) lookup(conn Connection) *adapter {
+	if conn == l.lconn {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns[conn]
+}
+
+// Ready implements EventHandler.
+func (l *acceptor) Ready(conn Connection, ante Connection) {
+	if ante != l.lconn || conn == l.lconn {
+		if l.prev != nil {
+			l.prev.Ready(conn, ante)
+		}
+		return
+	}
+
+	a := newAdapter(conn, l.prev)
+	a.markReady()
+	l.mu.Lock()
+	l.conns[conn] = a
+	l.queue = append(l.queue, a)
+	l.mu.Unlock()
+	conn.SetEventHandler(a)
+
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Sent implements EventHandler.
+func (l *acceptor) Sent(conn Connection, msgref interface{}) {
+	if a := l.lookup(conn); a != nil {
+		a.Sent(conn, msgref)
+	} else if l.prev != nil {
+		l.prev.Sent(conn, msgref)
+	}
+}
+
+// Expired implements EventHandler.
+func (l *acceptor) Expired(conn Connection, msgref interface{}) {
+	if a := l.lookup(conn); a != nil {
+		a.Expired(conn, msgref)
+	} else if l.prev != nil {
+		l.prev.Expired(conn, msgref)
+	}
+}
+
+// Error implements EventHandler.
+func (l *acceptor) Error(conn Connection, msgref interface{}, err error) {
+	if a := l.lookup(conn); a != nil {
+		a.Error(conn, msgref, err)
+	} else if l.prev != nil {
+		l.prev.Error(conn, msgref, err)
+	}
+}
+
+// Closed implements EventHandler.
+func (l *acceptor) Closed(conn Connection, err error) {
+	if a := l.lookup(conn); a != nil {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		a.Closed(conn, err)
+		return
+	}
+	if conn == l.lconn {
+		l.closeOnce.Do(func() {
+			l.mu.Lock()
+			l.closeErr = err
+			l.mu.Unlock()
+			close(l.closed)
+		})
+	}
+	if l.prev != nil {
+		l.prev.Closed(conn, err)
+	}
+}
+
+// netListener adapts a listening Connection to net.Listener.
+type netListener struct {
+	l  *acceptor
+	sp SendParameters
+}
+
+// NewNetListener wraps a listening Connection, as returned by Listen, as a
+// net.Listener. Each Connection passed to the Ready event with the
+// listening Connection as antecedent is wrapped as by NewNetConn and
+// returned by Accept.
+//
+// NewNetListener replaces the listening Connection's EventHandler. Events
+// for the listening Connection itself are passed on to its previous
+// EventHandler, as are events on accepted Connections not related to
+// Messages written through the net.Conn wrapping them.
+func NewNetListener(lconn Connection, sp SendParameters) net.Listener {
+	return &netListener{l: newAcceptor(lconn), sp: sp}
+}
+
+// Accept implements net.Listener.
+func (l *netListener) Accept() (net.Conn, error) {
+	a, err := l.l.accept(nil)
+	if err == ErrClosed {
+		return nil, net.ErrClosed
+	} else if err != nil {
+		return nil, err
+	}
+	return newNetConn(a, l.sp), nil
+}
+
+// Close implements net.Listener.
+func (l *netListener) Close() error {
+	return l.l.lconn.Close()
+}
+
+// Addr implements net.Listener.
+func (l *netListener) Addr() net.Addr {
+	return l.l.lconn.LocalAddr()
+}
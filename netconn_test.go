@@ -0,0 +1,133 @@
+package postsocket_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// netPipe returns a net.Listener in one simulated context and a client
+// net.Conn and the server net.Conn it accepted from another.
+func netPipe(t *testing.T) (ln net.Listener, client, server net.Conn) {
+	t.Helper()
+	clock := sim.NewClock(time.Unix(0, 0))
+	t.Cleanup(clock.Start())
+	n := sim.NewNetwork(clock)
+	sctx := n.NewContext(net.IPv4(10, 0, 0, 1))
+	cctx := n.NewContext(net.IPv4(10, 0, 0, 2))
+
+	lconn, err := sctx.Listen(nil, sctx.NewLocal().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = postsocket.NewNetListener(lconn, postsocket.SendParameters{})
+	t.Cleanup(func() { ln.Close() })
+
+	pc, err := cctx.Preconnect(nil, nil, cctx.NewRemote().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := pc.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = postsocket.NewNetConn(conn, postsocket.SendParameters{})
+	t.Cleanup(func() { client.Close() })
+
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return ln, client, server
+}
+
+func TestNetConnReadWrite(t *testing.T) {
+	_, client, server := netPipe(t)
+
+	if _, err := client.Write([]byte("hello, ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Small reads return the rest of a Message before the next one.
+	var got []byte
+	buf := make([]byte, 3)
+	for len(got) < len("hello, world") {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, []byte("hello, world")) {
+		t.Errorf("read %q, want %q", got, "hello, world")
+	}
+
+	if server.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("server RemoteAddr %v, client LocalAddr %v", server.RemoteAddr(), client.LocalAddr())
+	}
+}
+
+func TestNetConnReadDeadline(t *testing.T) {
+	_, client, server := netPipe(t)
+
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := server.Read(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read past deadline returned %v, want os.ErrDeadlineExceeded", err)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read past deadline returned %v, want a timeout net.Error", err)
+	}
+
+	// The Receive left outstanding by the expired Read delivers to the next.
+	server.SetReadDeadline(time.Time{})
+	if _, err := client.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "late" {
+		t.Errorf("Read after clearing deadline returned %q, %v; want %q", buf[:n], err, "late")
+	}
+}
+
+func TestNetConnClose(t *testing.T) {
+	_, client, server := netPipe(t)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close returned %v, want net.ErrClosed", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after Close returned %v, want net.ErrClosed", err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after remote Close returned %v, want io.EOF", err)
+	}
+}
+
+func TestNetListenerClose(t *testing.T) {
+	ln, _, _ := netPipe(t)
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close returned %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,274 @@
+package postsocket
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// pcapng block types and constants, from
+// draft-ietf-opsawg-pcapng.
+const (
+	pcapngSectionHeader       = 0x0a0d0d0a
+	pcapngInterfaceDesc       = 0x00000001
+	pcapngEnhancedPacket      = 0x00000006
+	pcapngDecryptionSecrets   = 0x0000000a
+	pcapngByteOrderMagic      = 0x1a2b3c4d
+	pcapngLinkTypeRaw         = 101 // LINKTYPE_RAW: raw IPv4 or IPv6
+	pcapngSecretsTLSKeyLog    = 0x544c534b
+	pcapngOptionEnd           = 0
+	pcapngOptionEPBFlags      = 2
+	pcapngEPBFlagsInbound     = 1
+	pcapngEPBFlagsOutbound    = 2
+	pcapngMaxUDPPayloadLength = 65507
+)
+
+// PacketCapture writes a pcapng capture of the packets emitted and received
+// by protocol stacks implemented in userland, which have no kernel
+// interface for a packet sniffer to watch. Each packet is written with a
+// synthetic IPv4 or IPv6 and UDP header built from the addresses of its
+// path, so that Wireshark dissects it by port as it would the real thing.
+// A PacketCapture is also an io.Writer of TLS key log lines, as written to
+// tls.Config.KeyLogWriter, which it embeds in the capture as decryption
+// secrets, so that Wireshark can decrypt TLS and QUIC without a separate
+// key log file. All methods may be called concurrently.
+type PacketCapture struct {
+	mu    sync.Mutex
+	w     io.Writer
+	clock Clock
+	err   error // first write error
+}
+
+// NewPacketCapture creates a PacketCapture writing a pcapng capture to w.
+func NewPacketCapture(w io.Writer) *PacketCapture {
+	c := &PacketCapture{w: w, clock: SystemClock}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)          // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0)          // minor version
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0)) // section length unknown
+	c.writeBlock(pcapngSectionHeader, shb)
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length
+	c.writeBlock(pcapngInterfaceDesc, idb)
+	return c
+}
+
+// SetClock sets the Clock that timestamps packets, which should be that of
+// the TransportContexts captured. The default is SystemClock.
+func (c *PacketCapture) SetClock(clock Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clock
+}
+
+// Err returns the first error encountered writing the capture, if any.
+// Capture is best-effort: a PacketCapture that fails to write keeps going.
+func (c *PacketCapture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Packet captures a packet with the given payload on the path between
+// local and remote, emitted by this endpoint if outbound is true and
+// received by it otherwise. Addresses that are not IP addresses with
+// ports, as given by net.SplitHostPort on their String form, are captured
+// as unspecified addresses and port zero. Payloads too long for a UDP
+// datagram are truncated in the capture, which records their original
+// length.
+func (c *PacketCapture) Packet(local, remote net.Addr, outbound bool, payload []byte) {
+	src, sport := addrIPPort(local)
+	dst, dport := addrIPPort(remote)
+	flags := uint32(pcapngEPBFlagsInbound)
+	if outbound {
+		flags = pcapngEPBFlagsOutbound
+	} else {
+		src, sport, dst, dport = dst, dport, src, sport
+	}
+	pkt, origLen := syntheticDatagram(src, sport, dst, dport, payload)
+
+	c.mu.Lock()
+	now := c.clock.Now()
+	c.mu.Unlock()
+	ts := uint64(now.UnixNano() / int64(time.Microsecond))
+
+	epb := make([]byte, 20, 20+pad4(len(pkt))+12)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface ID
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(origLen))
+	epb = append(epb, pkt...)
+	epb = append(epb, make([]byte, pad4(len(pkt))-len(pkt))...)
+
+	opt := make([]byte, 12)
+	binary.LittleEndian.PutUint16(opt[0:], pcapngOptionEPBFlags)
+	binary.LittleEndian.PutUint16(opt[2:], 4)
+	binary.LittleEndian.PutUint32(opt[4:], flags)
+	binary.LittleEndian.PutUint16(opt[8:], pcapngOptionEnd)
+	epb = append(epb, opt...)
+
+	c.writeBlock(pcapngEnhancedPacket, epb)
+}
+
+// Write implements io.Writer, embedding TLS key log lines in the capture as
+// a decryption secrets block.
+func (c *PacketCapture) Write(p []byte) (int, error) {
+	dsb := make([]byte, 8, 8+pad4(len(p)))
+	binary.LittleEndian.PutUint32(dsb[0:], pcapngSecretsTLSKeyLog)
+	binary.LittleEndian.PutUint32(dsb[4:], uint32(len(p)))
+	dsb = append(dsb, p...)
+	dsb = append(dsb, make([]byte, pad4(len(p))-len(p))...)
+
+	c.writeBlock(pcapngDecryptionSecrets, dsb)
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeBlock writes a pcapng block with the given type and body, which
+// must already be padded to a multiple of four bytes, recording the first
+// error encountered.
+func (c *PacketCapture) writeBlock(typ uint32, body []byte) {
+	length := uint32(12 + len(body))
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[0:], typ)
+	binary.LittleEndian.PutUint32(block[4:], length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.w.Write(block); err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// pad4 rounds n up to a multiple of four.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// syntheticDatagram builds an IP packet holding a UDP datagram with the
+// given addresses, ports and payload, truncated to fit if necessary, and
+// returns it with the length it would have had untruncated. The packet is
+// IPv6 if either address is IPv6, and IPv4 otherwise.
+func syntheticDatagram(src net.IP, sport uint16, dst net.IP, dport uint16, payload []byte) ([]byte, int) {
+	v4 := (src == nil || src.To4() != nil) && (dst == nil || dst.To4() != nil)
+	if v4 {
+		src, dst = pcapngIP(src, net.IPv4zero).To4(), pcapngIP(dst, net.IPv4zero).To4()
+	} else {
+		src, dst = pcapngIP(src, net.IPv6zero).To16(), pcapngIP(dst, net.IPv6zero).To16()
+	}
+
+	origLen := 8 + len(payload)
+	if len(payload) > pcapngMaxUDPPayloadLength {
+		payload = payload[:pcapngMaxUDPPayloadLength]
+	}
+	udpLen := 8 + len(payload)
+
+	udp := make([]byte, 8, udpLen)
+	binary.BigEndian.PutUint16(udp[0:], sport)
+	binary.BigEndian.PutUint16(udp[2:], dport)
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	udp = append(udp, payload...)
+
+	// The checksum covers a pseudo-header of addresses, protocol and
+	// length.
+	sum := checksumAdd(0, src)
+	sum = checksumAdd(sum, dst)
+	sum += 17 + uint32(udpLen)
+	csum := checksumFold(checksumAdd(sum, udp))
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], csum)
+
+	var ip []byte
+	if v4 {
+		ip = make([]byte, 20, 20+udpLen)
+		ip[0] = 0x45 // version 4, 5-word header
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+udpLen))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:], src)
+		copy(ip[16:], dst)
+		binary.BigEndian.PutUint16(ip[10:], checksumFold(checksumAdd(0, ip)))
+		origLen += 20
+	} else {
+		ip = make([]byte, 40, 40+udpLen)
+		ip[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(ip[4:], uint16(udpLen))
+		ip[6] = 17 // UDP
+		ip[7] = 64 // hop limit
+		copy(ip[8:], src)
+		copy(ip[24:], dst)
+		origLen += 40
+	}
+	return append(ip, udp...), origLen
+}
+
+func pcapngIP(ip, unspecified net.IP) net.IP {
+	if ip == nil {
+		return unspecified
+	}
+	return ip
+}
+
+// checksumAdd adds b to an Internet checksum (RFC 1071) in progress.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksumFold completes an Internet checksum.
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// capturedPacketConn captures the packets read from and written to a
+// net.PacketConn.
+type capturedPacketConn struct {
+	net.PacketConn
+	c *PacketCapture
+}
+
+// CapturePacketConn wraps a net.PacketConn, such as the UDP socket
+// underlying a userland protocol stack, so that every packet read from or
+// written to it is captured to c.
+func CapturePacketConn(pc net.PacketConn, c *PacketCapture) net.PacketConn {
+	return &capturedPacketConn{PacketConn: pc, c: c}
+}
+
+// ReadFrom implements net.PacketConn.
+func (pc *capturedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := pc.PacketConn.ReadFrom(p)
+	if n > 0 {
+		pc.c.Packet(pc.LocalAddr(), addr, false, p[:n])
+	}
+	return n, addr, err
+}
+
+// WriteTo implements net.PacketConn.
+func (pc *capturedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := pc.PacketConn.WriteTo(p, addr)
+	if n > 0 {
+		pc.c.Packet(pc.LocalAddr(), addr, true, p[:n])
+	}
+	return n, err
+}
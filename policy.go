@@ -0,0 +1,576 @@
+package postsocket
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Preference is a level of preference for a transport parameter, as set by
+// the methods of TransportParameters of the same name.
+type Preference int
+
+// List of Preference values.
+const (
+	PrefIgnore Preference = iota
+	PrefRequire
+	PrefPrefer
+	PrefAvoid
+	PrefProhibit
+)
+
+// Apply returns tp with this preference for parameter p, with the optional
+// value v, added.
+func (pref Preference) Apply(tp TransportParameters, p ParameterIdentifier, v interface{}) TransportParameters {
+	switch pref {
+	case PrefRequire:
+		return tp.Require(p, v)
+	case PrefPrefer:
+		return tp.Prefer(p, v)
+	case PrefAvoid:
+		return tp.Avoid(p, v)
+	case PrefProhibit:
+		return tp.Prohibit(p, v)
+	default:
+		return tp.Ignore(p)
+	}
+}
+
+// TransportPreference is a preference for a transport parameter set by a
+// Policy.
+type TransportPreference struct {
+	Parameter  ParameterIdentifier
+	Preference Preference
+	Value      interface{}
+}
+
+// SecurityPolicy holds the security parameters set by a Policy. Zero
+// values are unset.
+type SecurityPolicy struct {
+	Ciphersuites         []uint16
+	SupportedGroups      []tls.CurveID
+	SignatureAlgorithms  []tls.SignatureScheme
+	SessionCacheCapacity int
+	SessionCacheLifetime time.Duration
+	SessionCacheReuse    *bool
+}
+
+// Apply sets the parameters of this SecurityPolicy on sp, and returns it.
+// Parameters sp rejects are skipped.
+func (s *SecurityPolicy) Apply(sp SecurityParameters) SecurityParameters {
+	if len(s.Ciphersuites) > 0 {
+		sp.Set(SecurityCiphersuite, s.Ciphersuites)
+	}
+	if len(s.SupportedGroups) > 0 {
+		sp.Set(SecuritySupportedGroup, s.SupportedGroups)
+	}
+	if len(s.SignatureAlgorithms) > 0 {
+		sp.Set(SecuritySignatureAlgorithm, s.SignatureAlgorithms)
+	}
+	if s.SessionCacheCapacity > 0 {
+		sp.Set(SecuritySessionCacheCapacity, s.SessionCacheCapacity)
+	}
+	if s.SessionCacheLifetime > 0 {
+		sp.Set(SecuritySessionCacheLifetime, s.SessionCacheLifetime)
+	}
+	if s.SessionCacheReuse != nil {
+		sp.Set(SecuritySessionCacheReuse, *s.SessionCacheReuse)
+	}
+	return sp
+}
+
+// DestinationPolicy overrides the defaults of a Policy for the Remotes it
+// matches.
+type DestinationPolicy struct {
+	// Hosts are hostname patterns: a hostname, matched exactly, "*.domain",
+	// matching any name under the domain, or "*", matching any name.
+	Hosts []string
+
+	// Networks match the addresses of Remotes, given or resolved.
+	Networks []*net.IPNet
+
+	Transport []TransportPreference
+	Security  SecurityPolicy
+}
+
+// Matches returns true if the destination policy applies to a Remote with
+// the given hostname and addresses.
+func (d *DestinationPolicy) Matches(host string, addrs []net.IP) bool {
+	host = resolutionKey(host)
+	for _, pattern := range d.Hosts {
+		pattern = resolutionKey(pattern)
+		switch {
+		case host == "":
+		case pattern == "*" || pattern == host:
+			return true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			return true
+		}
+	}
+	for _, n := range d.Networks {
+		for _, a := range addrs {
+			if n.Contains(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Policy holds the system and user defaults of a TransportContext, as
+// loaded from a policy file by LoadPolicy: default transport preferences
+// and security parameters, overridden for matching Remotes by destination
+// policies. Defaults apply beneath the application: they are set when
+// parameters are created, and the application may change them. Destination
+// policies apply above it: they are applied when a Connection is initiated,
+// and override the application's explicit preferences and values for the
+// parameters they name.
+//
+// A policy file is in JSON, or in a subset of TOML, chosen by its
+// extension, ".json" or ".toml". In TOML:
+//
+//	[transport]
+//	FullyReliable = "require"
+//	CapacityProfile = { preference = "prefer", value = "interactive" }
+//
+//	[security]
+//	ciphersuites = ["TLS_AES_128_GCM_SHA256", "TLS_CHACHA20_POLY1305_SHA256"]
+//	groups = ["X25519", "CurveP256"]
+//
+//	[session_cache]
+//	capacity = 1000
+//	lifetime = "24h"
+//
+//	[[destination]]
+//	hosts = ["*.example.com"]
+//	networks = ["192.0.2.0/24", "2001:db8::/32"]
+//	[destination.transport]
+//	Multistreaming = "prefer"
+//
+//	[interfaces]
+//	uplink = ["eth0", "wlan0"]
+//	local-only = ["loopback"]
+//
+// The JSON form has the same structure, with "destination" an array of
+// objects. Transport parameters are named as ParameterIdentifier.String
+// gives, with or without the "Transport" prefix. Values of the
+// CapacityProfile parameter are named as CapacityProfile.String gives, and
+// values of Timeout parameters are durations as parsed by
+// time.ParseDuration, and those of InterfaceType an interface type name or
+// array of them; other values are given as is. Session caches are
+// configured in the security section or their own. Interface aliases, for
+// Local.WithInterface, name interfaces or other aliases, as expanded by
+// ExpandInterface.
+type Policy struct {
+	Transport    []TransportPreference
+	Security     SecurityPolicy
+	Destinations []DestinationPolicy
+	Interfaces   map[string][]string
+}
+
+// PolicyError is an error in a policy file, at a position within it.
+type PolicyError struct {
+	File         string
+	Line, Column int
+	Err          string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Err)
+}
+
+// LoadPolicy loads a Policy from a policy file, in JSON if its name ends in
+// ".json" and in TOML otherwise. Syntax and validation errors are
+// PolicyErrors.
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(filename, data)
+}
+
+// ParsePolicy parses a Policy from the contents of a policy file with the
+// given name, as LoadPolicy.
+func ParsePolicy(filename string, data []byte) (*Policy, error) {
+	var root *policyNode
+	var err error
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		root, err = parsePolicyJSON(filename, data)
+	} else {
+		root, err = parsePolicyTOML(filename, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &policyDecoder{file: filename}
+	p := d.policy(root)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
+
+// TransportParameters returns tp with the default transport preferences
+// of the Policy added.
+func (p *Policy) TransportParameters(tp TransportParameters) TransportParameters {
+	return applyTransportPreferences(tp, p.Transport)
+}
+
+// SecurityParameters returns sp with the default security parameters of
+// the Policy set.
+func (p *Policy) SecurityParameters(sp SecurityParameters) SecurityParameters {
+	return p.Security.Apply(sp)
+}
+
+// ForDestination returns tp and sp with the overrides of every destination
+// policy matching a Remote with the given hostname and addresses applied,
+// in the order of the policy file, replacing any preferences and values
+// already set for the parameters they name. Either of tp and sp may be
+// nil.
+func (p *Policy) ForDestination(host string, addrs []net.IP, tp TransportParameters, sp SecurityParameters) (TransportParameters, SecurityParameters) {
+	for i := range p.Destinations {
+		d := &p.Destinations[i]
+		if !d.Matches(host, addrs) {
+			continue
+		}
+		if tp != nil {
+			tp = applyTransportPreferences(tp, d.Transport)
+		}
+		if sp != nil {
+			sp = d.Security.Apply(sp)
+		}
+	}
+	return tp, sp
+}
+
+func applyTransportPreferences(tp TransportParameters, prefs []TransportPreference) TransportParameters {
+	for _, pref := range prefs {
+		tp = pref.Preference.Apply(tp, pref.Parameter, pref.Value)
+	}
+	return tp
+}
+
+// policyDecoder decodes a Policy from a parsed policy file, recording the
+// first error.
+type policyDecoder struct {
+	file string
+	err  error
+}
+
+func (d *policyDecoder) errorf(n *policyNode, format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = &PolicyError{File: d.file, Line: n.line, Column: n.col, Err: fmt.Sprintf(format, args...)}
+	}
+}
+
+// table returns the table held by a node, or nil if it holds none.
+func (d *policyDecoder) table(n *policyNode, what string) *policyTable {
+	t, ok := n.value.(*policyTable)
+	if !ok {
+		d.errorf(n, "%s must be a table", what)
+	}
+	return t
+}
+
+func (d *policyDecoder) policy(root *policyNode) *Policy {
+	p := &Policy{}
+	t := d.table(root, "policy")
+	if t == nil {
+		return p
+	}
+	for _, k := range t.keys {
+		n := t.fields[k]
+		switch k {
+		case "transport":
+			p.Transport = d.transport(n)
+		case "security":
+			d.security(n, &p.Security)
+		case "session_cache":
+			d.sessionCache(n, &p.Security)
+		case "destination":
+			arr, ok := n.value.([]*policyNode)
+			if !ok {
+				d.errorf(n, "destination must be an array of tables")
+				break
+			}
+			for _, dn := range arr {
+				p.Destinations = append(p.Destinations, d.destination(dn))
+			}
+		case "interfaces":
+			it := d.table(n, k)
+			if it == nil {
+				break
+			}
+			p.Interfaces = make(map[string][]string, len(it.keys))
+			for _, alias := range it.keys {
+				p.Interfaces[alias] = d.strings(it.fields[alias], "interface alias "+alias)
+			}
+		default:
+			d.errorf(t.pos[k], "unknown key %q", k)
+		}
+	}
+	return p
+}
+
+func (d *policyDecoder) destination(n *policyNode) DestinationPolicy {
+	var dp DestinationPolicy
+	t := d.table(n, "destination")
+	if t == nil {
+		return dp
+	}
+	for _, k := range t.keys {
+		n := t.fields[k]
+		switch k {
+		case "hosts":
+			dp.Hosts = d.strings(n, k)
+		case "networks":
+			for i, s := range d.strings(n, k) {
+				_, ipn, err := net.ParseCIDR(s)
+				if err != nil {
+					d.errorf(n.value.([]*policyNode)[i], "invalid network %q", s)
+					continue
+				}
+				dp.Networks = append(dp.Networks, ipn)
+			}
+		case "transport":
+			dp.Transport = d.transport(n)
+		case "security":
+			d.security(n, &dp.Security)
+		case "session_cache":
+			d.sessionCache(n, &dp.Security)
+		default:
+			d.errorf(t.pos[k], "unknown key %q", k)
+		}
+	}
+	if len(dp.Hosts) == 0 && len(dp.Networks) == 0 {
+		d.errorf(n, "destination must have hosts or networks")
+	}
+	return dp
+}
+
+func (d *policyDecoder) transport(n *policyNode) []TransportPreference {
+	t := d.table(n, "transport")
+	if t == nil {
+		return nil
+	}
+	var prefs []TransportPreference
+	for _, k := range t.keys {
+		p, ok := transportParameterByName(k)
+		if !ok {
+			d.errorf(t.pos[k], "unknown transport parameter %q", k)
+			continue
+		}
+		n := t.fields[k]
+		tpref := TransportPreference{Parameter: p}
+		switch v := n.value.(type) {
+		case string:
+			tpref.Preference = d.preference(n, v)
+		case *policyTable:
+			pn, ok := v.fields["preference"]
+			if !ok {
+				d.errorf(n, "%s has no preference", k)
+				continue
+			}
+			s, _ := pn.value.(string)
+			tpref.Preference = d.preference(pn, s)
+			if vn, ok := v.fields["value"]; ok {
+				tpref.Value = d.transportValue(p, vn)
+			}
+			for _, vk := range v.keys {
+				if vk != "preference" && vk != "value" {
+					d.errorf(v.pos[vk], "unknown key %q", vk)
+				}
+			}
+		default:
+			d.errorf(n, "%s must be a preference or a table of preference and value", k)
+		}
+		prefs = append(prefs, tpref)
+	}
+	return prefs
+}
+
+func (d *policyDecoder) preference(n *policyNode, s string) Preference {
+	if pref, ok := preferenceByName(s); ok {
+		return pref
+	}
+	d.errorf(n, "invalid preference %q: must be require, prefer, ignore, avoid or prohibit", s)
+	return PrefIgnore
+}
+
+func (d *policyDecoder) transportValue(p ParameterIdentifier, n *policyNode) interface{} {
+	switch p {
+	case TransportCapacityProfile:
+		s, _ := n.value.(string)
+		if cp, ok := capacityProfileByName(s); ok {
+			return cp
+		}
+		d.errorf(n, "invalid capacity profile %v", n.value)
+		return nil
+	case TransportTimeout, TransportSuggestTimeout:
+		return d.duration(n, p.String())
+	case TransportInterfaceType:
+		if s, ok := n.value.(string); ok {
+			if t, ok := interfaceTypeByName(s); ok {
+				return t
+			}
+			d.errorf(n, "unknown interface type %q", s)
+			return nil
+		}
+		names := d.strings(n, p.String())
+		types := make([]InterfaceType, len(names))
+		for i, name := range names {
+			var ok bool
+			if types[i], ok = interfaceTypeByName(name); !ok {
+				d.errorf(n.value.([]*policyNode)[i], "unknown interface type %q", name)
+			}
+		}
+		return types
+	}
+	if i, ok := n.value.(int64); ok {
+		return int(i)
+	}
+	if _, ok := n.value.(*policyTable); ok {
+		d.errorf(n, "invalid value for %v", p)
+		return nil
+	}
+	return n.value
+}
+
+func (d *policyDecoder) security(n *policyNode, sp *SecurityPolicy) {
+	t := d.table(n, "security")
+	if t == nil {
+		return
+	}
+	for _, k := range t.keys {
+		n := t.fields[k]
+		switch k {
+		case "ciphersuites":
+			for i, s := range d.strings(n, k) {
+				if id, ok := ciphersuiteByName(s); ok {
+					sp.Ciphersuites = append(sp.Ciphersuites, id)
+				} else {
+					d.errorf(n.value.([]*policyNode)[i], "unknown ciphersuite %q", s)
+				}
+			}
+		case "groups":
+			for i, s := range d.strings(n, k) {
+				if id, ok := groupByName(s); ok {
+					sp.SupportedGroups = append(sp.SupportedGroups, id)
+				} else {
+					d.errorf(n.value.([]*policyNode)[i], "unknown group %q", s)
+				}
+			}
+		case "signature_algorithms":
+			for i, s := range d.strings(n, k) {
+				if id, ok := signatureSchemeByName(s); ok {
+					sp.SignatureAlgorithms = append(sp.SignatureAlgorithms, id)
+				} else {
+					d.errorf(n.value.([]*policyNode)[i], "unknown signature algorithm %q", s)
+				}
+			}
+		default:
+			d.errorf(t.pos[k], "unknown key %q", k)
+		}
+	}
+}
+
+func (d *policyDecoder) sessionCache(n *policyNode, sp *SecurityPolicy) {
+	t := d.table(n, "session_cache")
+	if t == nil {
+		return
+	}
+	for _, k := range t.keys {
+		n := t.fields[k]
+		switch k {
+		case "capacity":
+			i, ok := n.value.(int64)
+			if !ok || i <= 0 {
+				d.errorf(n, "capacity must be a positive integer")
+			}
+			sp.SessionCacheCapacity = int(i)
+		case "lifetime":
+			sp.SessionCacheLifetime = d.duration(n, k)
+		case "reuse":
+			b, ok := n.value.(bool)
+			if !ok {
+				d.errorf(n, "reuse must be a boolean")
+			}
+			sp.SessionCacheReuse = &b
+		default:
+			d.errorf(t.pos[k], "unknown key %q", k)
+		}
+	}
+}
+
+func (d *policyDecoder) duration(n *policyNode, what string) time.Duration {
+	s, ok := n.value.(string)
+	dur, err := time.ParseDuration(s)
+	if !ok || err != nil || dur < 0 {
+		d.errorf(n, "%s must be a duration, such as \"30s\"", what)
+	}
+	return dur
+}
+
+func (d *policyDecoder) strings(n *policyNode, what string) []string {
+	arr, ok := n.value.([]*policyNode)
+	if !ok {
+		d.errorf(n, "%s must be an array of strings", what)
+		return nil
+	}
+	ss := make([]string, len(arr))
+	for i, e := range arr {
+		if ss[i], ok = e.value.(string); !ok {
+			d.errorf(e, "%s must be an array of strings", what)
+		}
+	}
+	return ss
+}
+
+// transportParameterByName returns the transport parameter with the given
+// name, with or without its "Transport" prefix, ignoring case.
+func transportParameterByName(name string) (ParameterIdentifier, bool) {
+	for _, p := range transportParameterIDs() {
+		full := p.String()
+		if strings.EqualFold(name, full) || strings.EqualFold(name, strings.TrimPrefix(full, "Transport")) {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+func ciphersuiteByName(name string) (uint16, bool) {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+func groupByName(name string) (tls.CurveID, bool) {
+	for _, g := range []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521, tls.X25519MLKEM768} {
+		if strings.EqualFold(g.String(), name) {
+			return g, true
+		}
+	}
+	return 0, false
+}
+
+func signatureSchemeByName(name string) (tls.SignatureScheme, bool) {
+	for _, s := range []tls.SignatureScheme{
+		tls.PSSWithSHA256, tls.PSSWithSHA384, tls.PSSWithSHA512,
+		tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512,
+		tls.Ed25519,
+		tls.PKCS1WithSHA256, tls.PKCS1WithSHA384, tls.PKCS1WithSHA512,
+	} {
+		if strings.EqualFold(s.String(), name) {
+			return s, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,164 @@
+package postsocket_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+const testPolicyTOML = `# Defaults
+[transport]
+FullyReliable = "require"
+CapacityProfile = { preference = "prefer", value = "interactive" }
+TransportTimeout = { preference = "require", value = "30s" }
+
+[security]
+ciphersuites = ["TLS_AES_128_GCM_SHA256", "TLS_CHACHA20_POLY1305_SHA256"]
+groups = ["X25519", "CurveP256"]
+
+[session_cache]
+capacity = 1_000
+lifetime = "24h"
+
+[[destination]]
+hosts = ["*.example.com"]
+networks = ["192.0.2.0/24", "2001:db8::/32"]
+[destination.transport]
+Multistreaming = "prefer"
+
+[interfaces]
+uplink = ["eth0", 'wlan0']
+local-only = ["loopback"]
+`
+
+const testPolicyJSON = `{
+	"transport": {
+		"FullyReliable": "require",
+		"CapacityProfile": {"preference": "prefer", "value": "interactive"},
+		"TransportTimeout": {"preference": "require", "value": "30s"}
+	},
+	"security": {
+		"ciphersuites": ["TLS_AES_128_GCM_SHA256", "TLS_CHACHA20_POLY1305_SHA256"],
+		"groups": ["X25519", "CurveP256"]
+	},
+	"session_cache": {"capacity": 1000, "lifetime": "24h"},
+	"destination": [{
+		"hosts": ["*.example.com"],
+		"networks": ["192.0.2.0/24", "2001:db8::/32"],
+		"transport": {"Multistreaming": "prefer"}
+	}],
+	"interfaces": {"uplink": ["eth0", "wlan0"], "local-only": ["loopback"]}
+}`
+
+func TestParsePolicy(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("192.0.2.0/24")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	want := &postsocket.Policy{
+		Transport: []postsocket.TransportPreference{
+			{Parameter: postsocket.TransportFullyReliable, Preference: postsocket.PrefRequire},
+			{Parameter: postsocket.TransportCapacityProfile, Preference: postsocket.PrefPrefer, Value: postsocket.CapacityProfile(postsocket.CapProfInteractive)},
+			{Parameter: postsocket.TransportTimeout, Preference: postsocket.PrefRequire, Value: 30 * time.Second},
+		},
+		Security: postsocket.SecurityPolicy{
+			Ciphersuites:         []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_CHACHA20_POLY1305_SHA256},
+			SupportedGroups:      []tls.CurveID{tls.X25519, tls.CurveP256},
+			SessionCacheCapacity: 1000,
+			SessionCacheLifetime: 24 * time.Hour,
+		},
+		Destinations: []postsocket.DestinationPolicy{{
+			Hosts:    []string{"*.example.com"},
+			Networks: []*net.IPNet{v4, v6},
+			Transport: []postsocket.TransportPreference{
+				{Parameter: postsocket.TransportMultistreaming, Preference: postsocket.PrefPrefer},
+			},
+		}},
+		Interfaces: map[string][]string{"uplink": {"eth0", "wlan0"}, "local-only": {"loopback"}},
+	}
+
+	for name, data := range map[string]string{"policy.toml": testPolicyTOML, "policy.json": testPolicyJSON} {
+		p, err := postsocket.ParsePolicy(name, []byte(data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, want) {
+			t.Errorf("%s parsed as\n%+v\nwant\n%+v", name, p, want)
+		}
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	tests := []struct {
+		file, data string
+		line, col  int
+		err        string
+	}{
+		{"p.toml", "colour = 1\n", 1, 1, `unknown key "colour"`},
+		{"p.toml", "[transport]\nBogus = \"require\"\n", 2, 1, `unknown transport parameter "Bogus"`},
+		{"p.toml", "[transport]\nFullyReliable = \"maybe\"\n", 2, 17, `invalid preference "maybe"`},
+		{"p.toml", "[transport]\nCapacityProfile = { preference = \"prefer\", valeu = \"bulk\" }\n", 2, 44, `unknown key "valeu"`},
+		{"p.toml", "[transport]\nCapacityProfile = { preference = \"prefer\", value = \"fast\" }\n", 2, 52, "invalid capacity profile fast"},
+		{"p.toml", "[transport]\nTimeout = { preference = \"require\", value = \"soon\" }\n", 2, 45, "must be a duration"},
+		{"p.toml", "[session_cache]\nlifetime = \"-1s\"\n", 2, 12, "must be a duration"},
+		{"p.toml", "[session_cache]\ncapacity = 0\n", 2, 12, "positive integer"},
+		{"p.toml", "[[destination]]\nhosts = [\"a.test\"]\nnetworks = [\"192.0.2.0/24\", \"300.0.0.0/8\"]\n", 3, 29, `invalid network "300.0.0.0/8"`},
+		{"p.toml", "[[destination]]\nhosts = [\"a.test\"]\nnetworks = [\"192.0.2.1\"]\n", 3, 13, `invalid network "192.0.2.1"`},
+		{"p.toml", "[[destination]]\n[destination.transport]\nMultistreaming = \"prefer\"\n", 1, 1, "must have hosts or networks"},
+		{"p.toml", "[security]\ngroups = [\"X25519\", \"P-999\"]\n", 2, 21, `unknown group "P-999"`},
+		{"p.toml", "[security]\n\nname = \"x\n", 3, 8, "unterminated string"},
+		{"p.toml", "[transport]\n[transport]\n", 2, 1, "defined twice"},
+		{"p.toml", "a.b = 1\n", 1, 2, "dotted keys"},
+		{"p.json", "{\n  \"security\": {\n    \"cipher\": []\n  }\n}", 3, 5, `unknown key "cipher"`},
+		{"p.json", "{\n  \"transport\": {\"FullyReliable\": }\n}", 2, 34, ""}, // the message depends on encoding/json
+		{"p.json", "{\"transport\": null}", 1, 15, "null is not allowed"},
+		{"p.json", "{\"a\": 1, \"a\": 2}", 1, 10, `duplicate key "a"`},
+		{"p.json", "{} {}", 1, 4, "unexpected data"},
+	}
+	for _, test := range tests {
+		_, err := postsocket.ParsePolicy(test.file, []byte(test.data))
+		var perr *postsocket.PolicyError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s %q: returned %v, want a PolicyError", test.file, test.data, err)
+			continue
+		}
+		if perr.File != test.file || perr.Line != test.line || perr.Column != test.col || !strings.Contains(perr.Err, test.err) {
+			t.Errorf("%s %q: returned %v, want %s:%d:%d: ...%s...", test.file, test.data, err, test.file, test.line, test.col, test.err)
+		}
+	}
+}
+
+func TestDestinationPolicyMatches(t *testing.T) {
+	_, n, _ := net.ParseCIDR("192.0.2.0/24")
+	d := &postsocket.DestinationPolicy{Hosts: []string{"*.Example.com", "exact.test."}, Networks: []*net.IPNet{n}}
+	tests := []struct {
+		host  string
+		addrs []net.IP
+		want  bool
+	}{
+		{"www.example.com", nil, true},
+		{"a.b.EXAMPLE.com.", nil, true},
+		{"example.com", nil, false},
+		{"badexample.com", nil, false},
+		{"exact.test", nil, true},
+		{"sub.exact.test", nil, false},
+		{"", []net.IP{net.IPv4(198, 51, 100, 1), net.IPv4(192, 0, 2, 7)}, true},
+		{"other.test", []net.IP{net.IPv4(198, 51, 100, 1)}, false},
+		{"", nil, false},
+	}
+	for _, test := range tests {
+		if got := d.Matches(test.host, test.addrs); got != test.want {
+			t.Errorf("Matches(%q, %v) = %v, want %v", test.host, test.addrs, got, test.want)
+		}
+	}
+
+	any := &postsocket.DestinationPolicy{Hosts: []string{"*"}}
+	if !any.Matches("anything.test", nil) || any.Matches("", []net.IP{net.IPv4(192, 0, 2, 1)}) {
+		t.Error("* must match any hostname, and only hostnames")
+	}
+}
@@ -0,0 +1,504 @@
+package postsocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// policyNode is a value parsed from a policy file, with its position: a
+// string, int64, float64, bool, []*policyNode or *policyTable.
+type policyNode struct {
+	line, col int
+	value     interface{}
+}
+
+// policyTable is a table or object parsed from a policy file, with its keys
+// in order and their positions.
+type policyTable struct {
+	keys   []string
+	fields map[string]*policyNode
+	pos    map[string]*policyNode
+}
+
+func newPolicyTable() *policyTable {
+	return &policyTable{fields: make(map[string]*policyNode), pos: make(map[string]*policyNode)}
+}
+
+func (t *policyTable) set(key string, keyPos, n *policyNode) bool {
+	if _, ok := t.fields[key]; ok {
+		return false
+	}
+	t.keys = append(t.keys, key)
+	t.fields[key] = n
+	t.pos[key] = keyPos
+	return true
+}
+
+// policyPosition returns the line and column of an offset in data.
+func policyPosition(data []byte, off int) (int, int) {
+	if off > len(data) {
+		off = len(data)
+	}
+	if off < 0 {
+		off = 0
+	}
+	line := 1 + bytes.Count(data[:off], []byte("\n"))
+	col := off - bytes.LastIndexByte(data[:off], '\n')
+	return line, col
+}
+
+// parsePolicyJSON parses a JSON policy file.
+func parsePolicyJSON(file string, data []byte) (*policyNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	p := &policyJSON{file: file, data: data, dec: dec}
+	n, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	extra := p.node()
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, &PolicyError{File: file, Line: extra.line, Column: extra.col, Err: "unexpected data after policy"}
+	}
+	return n, nil
+}
+
+type policyJSON struct {
+	file string
+	data []byte
+	dec  *json.Decoder
+}
+
+// node returns a node at the start of the next token.
+func (p *policyJSON) node() *policyNode {
+	off := int(p.dec.InputOffset())
+	for off < len(p.data) && strings.IndexByte(" \t\r\n:,", p.data[off]) >= 0 {
+		off++
+	}
+	line, col := policyPosition(p.data, off)
+	return &policyNode{line: line, col: col}
+}
+
+func (p *policyJSON) errorf(format string, args ...interface{}) error {
+	n := p.node()
+	return &PolicyError{File: p.file, Line: n.line, Column: n.col, Err: fmt.Sprintf(format, args...)}
+}
+
+func (p *policyJSON) token() (json.Token, error) {
+	tok, err := p.dec.Token()
+	if err != nil {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			// The error is in the last byte read.
+			line, col := policyPosition(p.data, int(serr.Offset)-1)
+			return nil, &PolicyError{File: p.file, Line: line, Column: col, Err: serr.Error()}
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, p.errorf("%v", err)
+	}
+	return tok, nil
+}
+
+func (p *policyJSON) value() (*policyNode, error) {
+	n := p.node()
+	tok, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		switch tok {
+		case '{':
+			t := newPolicyTable()
+			for p.dec.More() {
+				kn := p.node()
+				ktok, err := p.token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				if !t.set(ktok.(string), kn, v) {
+					return nil, &PolicyError{File: p.file, Line: kn.line, Column: kn.col, Err: fmt.Sprintf("duplicate key %q", ktok)}
+				}
+			}
+			n.value = t
+		case '[':
+			arr := []*policyNode{}
+			for p.dec.More() {
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, v)
+			}
+			n.value = arr
+		}
+		// Consume the closing delimiter.
+		if _, err := p.token(); err != nil {
+			return nil, err
+		}
+	case json.Number:
+		if i, err := tok.Int64(); err == nil {
+			n.value = i
+		} else {
+			f, _ := tok.Float64()
+			n.value = f
+		}
+	case nil:
+		return nil, &PolicyError{File: p.file, Line: n.line, Column: n.col, Err: "null is not allowed"}
+	default:
+		n.value = tok
+	}
+	return n, nil
+}
+
+// parsePolicyTOML parses a policy file in the subset of TOML of key/value
+// pairs, tables, arrays of tables, arrays and inline tables, with basic and
+// literal strings on a single line, integers, floats and booleans.
+func parsePolicyTOML(file string, data []byte) (*policyNode, error) {
+	p := &policyTOML{file: file, data: data, line: 1, col: 1}
+	root := &policyNode{line: 1, col: 1, value: newPolicyTable()}
+	cur := root.value.(*policyTable)
+	defined := make(map[*policyTable]bool)
+
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return root, nil
+		}
+		if p.peek() == '[' {
+			start := p.here()
+			p.next()
+			array := !p.eof() && p.peek() == '['
+			if array {
+				p.next()
+			}
+			path, poss, err := p.keyPath()
+			if err != nil {
+				return nil, err
+			}
+			closing := "]"
+			if array {
+				closing = "]]"
+			}
+			if !p.consume(closing) {
+				return nil, p.errorf("expected %q", closing)
+			}
+			if cur, err = p.header(root, path, poss, array, start); err != nil {
+				return nil, err
+			}
+			if !array {
+				if defined[cur] {
+					return nil, p.errorAt(start, "table %q defined twice", strings.Join(path, "."))
+				}
+				defined[cur] = true
+			}
+		} else {
+			kn := p.here()
+			key, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if !p.eof() && p.peek() == '.' {
+				return nil, p.errorf("dotted keys are not supported")
+			}
+			if !p.consume("=") {
+				return nil, p.errorf("expected '=' after key")
+			}
+			p.skipSpace(false)
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			if !cur.set(key, kn, v) {
+				return nil, p.errorAt(kn, "duplicate key %q", key)
+			}
+		}
+		p.skipSpace(false)
+		if !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+			return nil, p.errorf("expected end of line")
+		}
+	}
+}
+
+type policyTOML struct {
+	file      string
+	data      []byte
+	off       int
+	line, col int
+}
+
+func (p *policyTOML) eof() bool  { return p.off >= len(p.data) }
+func (p *policyTOML) peek() byte { return p.data[p.off] }
+
+func (p *policyTOML) next() byte {
+	c := p.data[p.off]
+	p.off++
+	if c == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+	return c
+}
+
+func (p *policyTOML) here() *policyNode {
+	return &policyNode{line: p.line, col: p.col}
+}
+
+func (p *policyTOML) errorAt(n *policyNode, format string, args ...interface{}) error {
+	return &PolicyError{File: p.file, Line: n.line, Column: n.col, Err: fmt.Sprintf(format, args...)}
+}
+
+func (p *policyTOML) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.here(), format, args...)
+}
+
+func (p *policyTOML) consume(s string) bool {
+	if !bytes.HasPrefix(p.data[p.off:], []byte(s)) {
+		return false
+	}
+	for range s {
+		p.next()
+	}
+	return true
+}
+
+// skipSpace skips spaces, tabs and comments, and newlines if newlines is
+// true.
+func (p *policyTOML) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.next()
+		case c == '\r' || c == '\n':
+			if !newlines {
+				return
+			}
+			p.next()
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.next()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// key parses a bare or quoted key.
+func (p *policyTOML) key() (string, error) {
+	if p.eof() {
+		return "", p.errorf("expected key")
+	}
+	if c := p.peek(); c == '"' || c == '\'' {
+		return p.str()
+	}
+	start := p.off
+	for !p.eof() {
+		c := p.peek()
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			p.next()
+			continue
+		}
+		break
+	}
+	if p.off == start {
+		return "", p.errorf("expected key")
+	}
+	return string(p.data[start:p.off]), nil
+}
+
+// keyPath parses the dotted key of a table header.
+func (p *policyTOML) keyPath() ([]string, []*policyNode, error) {
+	var path []string
+	var poss []*policyNode
+	for {
+		p.skipSpace(false)
+		poss = append(poss, p.here())
+		k, err := p.key()
+		if err != nil {
+			return nil, nil, err
+		}
+		path = append(path, k)
+		p.skipSpace(false)
+		if p.eof() || p.peek() != '.' {
+			return path, poss, nil
+		}
+		p.next()
+	}
+}
+
+// header returns the table named by a table or array of tables header,
+// creating it and the tables leading to it as needed. A path through an
+// array of tables leads to its last table.
+func (p *policyTOML) header(root *policyNode, path []string, poss []*policyNode, array bool, start *policyNode) (*policyTable, error) {
+	t := root.value.(*policyTable)
+	for i, k := range path {
+		last := i == len(path)-1
+		n, ok := t.fields[k]
+		if !ok {
+			n = &policyNode{line: start.line, col: start.col}
+			if last && array {
+				n.value = []*policyNode{}
+			} else {
+				n.value = newPolicyTable()
+			}
+			t.set(k, poss[i], n)
+		}
+		switch v := n.value.(type) {
+		case *policyTable:
+			if last && array {
+				return nil, p.errorAt(poss[i], "%q is a table, not an array of tables", k)
+			}
+			t = v
+		case []*policyNode:
+			if last && array {
+				elem := &policyNode{line: start.line, col: start.col, value: newPolicyTable()}
+				n.value = append(v, elem)
+				return elem.value.(*policyTable), nil
+			}
+			if len(v) == 0 {
+				return nil, p.errorAt(poss[i], "%q is an empty array", k)
+			}
+			tt, ok := v[len(v)-1].value.(*policyTable)
+			if !ok {
+				return nil, p.errorAt(poss[i], "%q is not an array of tables", k)
+			}
+			t = tt
+		default:
+			return nil, p.errorAt(poss[i], "%q is not a table", k)
+		}
+	}
+	return t, nil
+}
+
+// value parses a value.
+func (p *policyTOML) value() (*policyNode, error) {
+	n := p.here()
+	if p.eof() {
+		return nil, p.errorf("expected value")
+	}
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		n.value = s
+	case c == '[':
+		p.next()
+		arr := []*policyNode{}
+		for {
+			p.skipSpace(true)
+			if p.consume("]") {
+				break
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+			p.skipSpace(true)
+			if p.consume("]") {
+				break
+			}
+			if !p.consume(",") {
+				return nil, p.errorf("expected ',' or ']' in array")
+			}
+		}
+		n.value = arr
+	case c == '{':
+		p.next()
+		t := newPolicyTable()
+		p.skipSpace(false)
+		for !p.consume("}") {
+			if len(t.keys) > 0 && !p.consume(",") {
+				return nil, p.errorf("expected ',' or '}' in inline table")
+			}
+			p.skipSpace(false)
+			kn := p.here()
+			k, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if !p.consume("=") {
+				return nil, p.errorf("expected '=' after key")
+			}
+			p.skipSpace(false)
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			if !t.set(k, kn, v) {
+				return nil, p.errorAt(kn, "duplicate key %q", k)
+			}
+			p.skipSpace(false)
+		}
+		n.value = t
+	default:
+		start := p.off
+		for !p.eof() && strings.IndexByte(" \t\r\n,]}#", p.peek()) < 0 {
+			p.next()
+		}
+		tok := string(p.data[start:p.off])
+		switch {
+		case tok == "true" || tok == "false":
+			n.value = tok == "true"
+		case tok == "":
+			return nil, p.errorf("expected value")
+		default:
+			num := strings.ReplaceAll(tok, "_", "")
+			if i, err := strconv.ParseInt(num, 0, 64); err == nil {
+				n.value = i
+			} else if f, err := strconv.ParseFloat(num, 64); err == nil {
+				n.value = f
+			} else {
+				return nil, p.errorAt(n, "invalid value %q", tok)
+			}
+		}
+	}
+	return n, nil
+}
+
+// str parses a basic or literal string on a single line.
+func (p *policyTOML) str() (string, error) {
+	start := p.here()
+	quote := p.next()
+	from := p.off
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorAt(start, "unterminated string")
+		}
+		c := p.next()
+		if c == '\\' && quote == '"' && !p.eof() {
+			p.next()
+			continue
+		}
+		if c == quote {
+			break
+		}
+	}
+	raw := string(p.data[from : p.off-1])
+	if quote == '\'' {
+		return raw, nil
+	}
+	s, err := strconv.Unquote(`"` + raw + `"`)
+	if err != nil {
+		return "", p.errorAt(start, "invalid string escape")
+	}
+	return s, nil
+}
@@ -0,0 +1,619 @@
+// Package postsockettest provides a conformance test suite for
+// implementations of the postsocket API. Backend authors call
+// TestTransportContext from a test function with a Harness describing how
+// to create and connect their TransportContexts, and get a subtest for each
+// behavioral requirement the API places on them.
+package postsockettest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/impair"
+)
+
+// Harness describes how to create and connect the TransportContexts under
+// test. Only NewContext is required.
+type Harness struct {
+	// NewContext returns a new TransportContext. It is called once for each
+	// endpoint in each check, and should arrange for the context to be
+	// cleaned up with t.Cleanup if necessary.
+	NewContext func(t *testing.T) postsocket.TransportContext
+
+	// ListenLocal returns the Local a context listens on. If nil, the
+	// IPv4 loopback address with port 0 is used.
+	ListenLocal func(tc postsocket.TransportContext) postsocket.Local
+
+	// RemoteFor returns a Remote addressing a listening Connection in
+	// another context. If nil, the Remote is built from the address and
+	// port of the listening Connection's LocalAddr.
+	RemoteFor func(tc postsocket.TransportContext, listener postsocket.Connection) postsocket.Remote
+
+	// Clock is the Clock of the contexts, on which impairments applied
+	// through TransportContext.Intercept are scheduled. If nil,
+	// postsocket.SystemClock is used.
+	Clock postsocket.Clock
+
+	// Timeout bounds each wait for an event. If zero, five seconds is used.
+	Timeout time.Duration
+}
+
+// TestTransportContext runs the conformance checks against the
+// TransportContexts created by h, each as a subtest of t:
+//
+//   - ReadyAntecedent: Ready occurs with a nil antecedent for initiated
+//     Connections and with the listening Connection for accepted ones.
+//   - EventOrdering: no Message event precedes Ready, each Message gets at
+//     most one Sent, Expired or Error event, and no event follows Closed.
+//   - ClosedAfterClose: Close causes exactly one Closed event, locally and
+//     at the remote endpoint.
+//   - ExpiredOnLifetime: each Message sent with a lifetime is either Sent or
+//     Expired, never both, and never left without either; over a path
+//     losing every Message, each one Expires.
+//   - Clone: a Clone is Ready with the original as antecedent, carries its
+//     own Messages, and can be closed without closing the original.
+//   - PartialOffsets: a large Message is received whole or as partial
+//     Messages with contiguous offsets ending in a final part.
+//   - ConcurrentSendReceive: concurrent Send and Receive calls lose no data.
+func TestTransportContext(t *testing.T, h Harness) {
+	if h.NewContext == nil {
+		t.Fatal("postsockettest: Harness.NewContext is required")
+	}
+	if h.Timeout == 0 {
+		h.Timeout = 5 * time.Second
+	}
+
+	t.Run("ReadyAntecedent", h.testReadyAntecedent)
+	t.Run("EventOrdering", h.testEventOrdering)
+	t.Run("ClosedAfterClose", h.testClosedAfterClose)
+	t.Run("ExpiredOnLifetime", h.testExpiredOnLifetime)
+	t.Run("Clone", h.testClone)
+	t.Run("PartialOffsets", h.testPartialOffsets)
+	t.Run("ConcurrentSendReceive", h.testConcurrentSendReceive)
+}
+
+// Event kinds recorded by a recorder.
+const (
+	evReady   = "Ready"
+	evSent    = "Sent"
+	evExpired = "Expired"
+	evError   = "Error"
+	evClosed  = "Closed"
+)
+
+// event is an event recorded by a recorder.
+type event struct {
+	kind   string
+	conn   postsocket.Connection
+	ante   postsocket.Connection
+	msgref interface{}
+	err    error
+}
+
+func (ev event) String() string {
+	return fmt.Sprintf("%s(msgref=%v, err=%v)", ev.kind, ev.msgref, ev.err)
+}
+
+// recorder is an EventHandler recording every event, in order.
+type recorder struct {
+	mu     sync.Mutex
+	events []event
+	notify chan struct{} // closed and replaced on every event
+}
+
+func newRecorder() *recorder {
+	return &recorder{notify: make(chan struct{})}
+}
+
+func (r *recorder) record(ev event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+	close(r.notify)
+	r.notify = make(chan struct{})
+}
+
+// snapshot returns the events recorded so far.
+func (r *recorder) snapshot() []event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]event(nil), r.events...)
+}
+
+// on returns the events recorded so far on the given Connection.
+func (r *recorder) on(conn postsocket.Connection) []event {
+	var evs []event
+	for _, ev := range r.snapshot() {
+		if ev.conn == conn {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
+
+// wait waits until pred holds for the events recorded so far, and returns
+// false if it does not within the timeout.
+func (r *recorder) wait(timeout time.Duration, pred func(evs []event) bool) bool {
+	deadline := time.After(timeout)
+	for {
+		r.mu.Lock()
+		ok := pred(r.events)
+		notify := r.notify
+		r.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func (r *recorder) Ready(conn postsocket.Connection, ante postsocket.Connection) {
+	r.record(event{kind: evReady, conn: conn, ante: ante})
+}
+
+func (r *recorder) Sent(conn postsocket.Connection, msgref interface{}) {
+	r.record(event{kind: evSent, conn: conn, msgref: msgref})
+}
+
+func (r *recorder) Expired(conn postsocket.Connection, msgref interface{}) {
+	r.record(event{kind: evExpired, conn: conn, msgref: msgref})
+}
+
+func (r *recorder) Error(conn postsocket.Connection, msgref interface{}, err error) {
+	r.record(event{kind: evError, conn: conn, msgref: msgref, err: err})
+}
+
+func (r *recorder) Closed(conn postsocket.Connection, err error) {
+	r.record(event{kind: evClosed, conn: conn, err: err})
+}
+
+// has returns a predicate matching an event of the given kind on conn.
+func has(kind string, conn postsocket.Connection) func([]event) bool {
+	return func(evs []event) bool {
+		for _, ev := range evs {
+			if ev.kind == kind && (conn == nil || ev.conn == conn) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// pair is a connected pair of Connections in two contexts.
+type pair struct {
+	cctx, sctx       postsocket.TransportContext
+	client, server   postsocket.Connection
+	listener         postsocket.Connection
+	cevents, sevents *recorder
+}
+
+// connect creates a client and a server context, listens on the server,
+// initiates from the client, and waits until both ends are Ready.
+func (h Harness) connect(t *testing.T) *pair {
+	t.Helper()
+	return h.connectWith(t, nil)
+}
+
+// connectWith connects as connect does, calling setup, if not nil, on the
+// client context before initiating.
+func (h Harness) connectWith(t *testing.T, setup func(cctx postsocket.TransportContext)) *pair {
+	t.Helper()
+	p := &pair{
+		cctx:    h.NewContext(t),
+		sctx:    h.NewContext(t),
+		cevents: newRecorder(),
+		sevents: newRecorder(),
+	}
+	if setup != nil {
+		setup(p.cctx)
+	}
+
+	var loc postsocket.Local
+	if h.ListenLocal != nil {
+		loc = h.ListenLocal(p.sctx)
+	} else {
+		loc = p.sctx.NewLocal().WithAddress(net.IPv4(127, 0, 0, 1)).WithPort(0)
+	}
+	listener, err := p.sctx.Listen(p.sevents, loc, nil, nil)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	p.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	rem, err := h.remoteFor(p.cctx, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := p.cctx.Preconnect(p.cevents, nil, rem, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Preconnect: %v", err)
+	}
+	client, err := pc.Initiate()
+	if err != nil {
+		t.Fatalf("Initiate: %v", err)
+	}
+	p.client = client
+	t.Cleanup(func() { client.Close() })
+
+	if !p.cevents.wait(h.Timeout, has(evReady, client)) {
+		t.Fatalf("initiated Connection not Ready within %v; events: %v", h.Timeout, p.cevents.snapshot())
+	}
+	if !p.sevents.wait(h.Timeout, func(evs []event) bool {
+		for _, ev := range evs {
+			if ev.kind == evReady && ev.ante == listener {
+				p.server = ev.conn
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Fatalf("no Connection accepted within %v; events: %v", h.Timeout, p.sevents.snapshot())
+	}
+	t.Cleanup(func() { p.server.Close() })
+	return p
+}
+
+func (h Harness) remoteFor(tc postsocket.TransportContext, listener postsocket.Connection) (postsocket.Remote, error) {
+	if h.RemoteFor != nil {
+		return h.RemoteFor(tc, listener), nil
+	}
+	addr := listener.LocalAddr()
+	if addr == nil {
+		return nil, fmt.Errorf("listening Connection has no LocalAddr; set Harness.RemoteFor")
+	}
+	host, portstr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive Remote from listener address %v: %v; set Harness.RemoteFor", addr, err)
+	}
+	var port uint16
+	if _, err := fmt.Sscan(portstr, &port); err != nil {
+		return nil, fmt.Errorf("cannot derive Remote from listener address %v: %v; set Harness.RemoteFor", addr, err)
+	}
+	rem := tc.NewRemote().WithPort(port)
+	if ip := net.ParseIP(host); ip != nil {
+		return rem.WithAddress(ip), nil
+	}
+	return rem.WithHostname(host), nil
+}
+
+// receiveBytes receives Messages on conn until n bytes have arrived, and
+// returns them, along with the Messages they arrived in.
+func (h Harness) receiveBytes(t *testing.T, conn postsocket.Connection, n int) ([]byte, []postsocket.Message) {
+	t.Helper()
+	msgs := make(chan postsocket.Message, 1)
+	var got []byte
+	var all []postsocket.Message
+	for len(got) < n {
+		conn.Receive(func(msg postsocket.Message, _ postsocket.Connection) {
+			msgs <- msg
+		})
+		select {
+		case msg := <-msgs:
+			got = append(got, msg.Bytes()...)
+			all = append(all, msg)
+		case <-time.After(h.Timeout):
+			t.Fatalf("received %d of %d bytes within %v", len(got), n, h.Timeout)
+		}
+	}
+	return got, all
+}
+
+func (h Harness) testReadyAntecedent(t *testing.T) {
+	p := h.connect(t)
+
+	for _, ev := range p.cevents.on(p.client) {
+		if ev.kind == evReady && ev.ante != nil {
+			t.Errorf("initiated Connection Ready with non-nil antecedent %v", ev.ante)
+		}
+	}
+	if p.server == p.listener {
+		t.Errorf("accepted Connection is the listening Connection")
+	}
+	for _, ev := range p.sevents.snapshot() {
+		if ev.kind == evReady && ev.conn == p.listener {
+			t.Errorf("listening Connection passed to Ready as a new Connection")
+		}
+	}
+}
+
+func (h Harness) testEventOrdering(t *testing.T) {
+	p := h.connect(t)
+	sp := p.cctx.DefaultSendParameters()
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		if err := p.client.Send([]byte{byte(i)}, i, sp); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	h.receiveBytes(t, p.server, count)
+
+	p.client.Close()
+	if !p.cevents.wait(h.Timeout, has(evClosed, p.client)) {
+		t.Fatalf("no Closed event within %v after Close", h.Timeout)
+	}
+	// Give stray events a chance to show up.
+	time.Sleep(h.Timeout / 50)
+
+	ready, closed := false, false
+	fates := make(map[interface{}]string)
+	for _, ev := range p.cevents.on(p.client) {
+		if closed {
+			t.Errorf("%v after Closed", ev)
+		}
+		switch ev.kind {
+		case evReady:
+			ready = true
+		case evClosed:
+			closed = true
+		case evSent, evExpired, evError:
+			if !ready {
+				t.Errorf("%v before Ready", ev)
+			}
+			if ev.msgref == nil {
+				continue
+			}
+			if prev, ok := fates[ev.msgref]; ok {
+				t.Errorf("%v for Message already %s", ev, prev)
+			}
+			fates[ev.msgref] = ev.kind
+		}
+	}
+	for i := 0; i < count; i++ {
+		if _, ok := fates[i]; !ok {
+			t.Errorf("Message %d neither Sent, Expired nor failed before Closed", i)
+		}
+	}
+}
+
+func (h Harness) testClosedAfterClose(t *testing.T) {
+	p := h.connect(t)
+
+	if err := p.client.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !p.cevents.wait(h.Timeout, has(evClosed, p.client)) {
+		t.Fatalf("no Closed event within %v after Close", h.Timeout)
+	}
+	if !p.sevents.wait(h.Timeout, has(evClosed, p.server)) {
+		t.Errorf("remote endpoint saw no Closed event within %v after Close", h.Timeout)
+	}
+
+	// A second Close must not produce a second Closed event.
+	p.client.Close()
+	time.Sleep(h.Timeout / 50)
+	n := 0
+	for _, ev := range p.cevents.on(p.client) {
+		if ev.kind == evClosed {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d Closed events, want 1", n)
+	}
+}
+
+func (h Harness) testExpiredOnLifetime(t *testing.T) {
+	p := h.connect(t)
+	sp := p.cctx.DefaultSendParameters()
+	sp.Lifetime = time.Nanosecond
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		if err := p.client.Send(make([]byte, 1024), i, sp); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	fates := func(evs []event) map[interface{}][]string {
+		m := make(map[interface{}][]string)
+		for _, ev := range evs {
+			if ev.conn == p.client && (ev.kind == evSent || ev.kind == evExpired || ev.kind == evError) {
+				m[ev.msgref] = append(m[ev.msgref], ev.kind)
+			}
+		}
+		return m
+	}
+	if !p.cevents.wait(h.Timeout, func(evs []event) bool {
+		return len(fates(evs)) == count
+	}) {
+		t.Fatalf("%d of %d Messages with lifetimes neither Sent nor Expired within %v",
+			count-len(fates(p.cevents.snapshot())), count, h.Timeout)
+	}
+	time.Sleep(h.Timeout / 50)
+	for ref, kinds := range fates(p.cevents.snapshot()) {
+		if len(kinds) != 1 {
+			t.Errorf("Message %v: events %v, want exactly one of Sent or Expired", ref, kinds)
+		}
+	}
+
+	// Over a path losing every Message, each must expire.
+	lossy := h.connectWith(t, func(cctx postsocket.TransportContext) {
+		cctx.Intercept(impair.Interceptor(impair.Config{Loss: 1, Clock: h.Clock}))
+	})
+	sp = lossy.cctx.DefaultSendParameters()
+	sp.Lifetime = h.Timeout / 10
+	for i := 0; i < count; i++ {
+		if err := lossy.client.Send(make([]byte, 1024), i, sp); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	expired := func(evs []event) int {
+		n := 0
+		for _, ev := range evs {
+			if ev.conn == lossy.client && ev.kind == evExpired {
+				n++
+			}
+		}
+		return n
+	}
+	if !lossy.cevents.wait(h.Timeout, func(evs []event) bool {
+		return expired(evs) == count
+	}) {
+		t.Fatalf("%d of %d Messages lost on the path Expired within %v; events: %v",
+			expired(lossy.cevents.snapshot()), count, h.Timeout, lossy.cevents.on(lossy.client))
+	}
+	for _, ev := range lossy.cevents.on(lossy.client) {
+		if ev.kind == evSent {
+			t.Errorf("Message %v lost on the path was Sent", ev.msgref)
+		}
+	}
+}
+
+func (h Harness) testClone(t *testing.T) {
+	p := h.connect(t)
+
+	clone, err := p.client.Clone()
+	if err != nil {
+		t.Skipf("Clone not supported: %v", err)
+	}
+	t.Cleanup(func() { clone.Close() })
+	if clone == p.client {
+		t.Fatalf("Clone returned the original Connection")
+	}
+	if !p.cevents.wait(h.Timeout, has(evReady, clone)) {
+		t.Fatalf("clone not Ready within %v", h.Timeout)
+	}
+	for _, ev := range p.cevents.on(clone) {
+		if ev.kind == evReady && ev.ante != p.client {
+			t.Errorf("clone Ready with antecedent %v, want the original Connection", ev.ante)
+		}
+	}
+
+	// The remote endpoint gets a new Connection for the clone.
+	var remoteClone postsocket.Connection
+	if !p.sevents.wait(h.Timeout, func(evs []event) bool {
+		for _, ev := range evs {
+			if ev.kind == evReady && ev.conn != p.server && ev.conn != p.listener {
+				remoteClone = ev.conn
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Fatalf("remote endpoint saw no Connection for the clone within %v", h.Timeout)
+	}
+	t.Cleanup(func() { remoteClone.Close() })
+
+	payload := []byte("clone")
+	if err := clone.Send(payload, nil, p.cctx.DefaultSendParameters()); err != nil {
+		t.Fatalf("Send on clone: %v", err)
+	}
+	if got, _ := h.receiveBytes(t, remoteClone, len(payload)); !bytes.Equal(got, payload) {
+		t.Errorf("received %q on remote clone, want %q", got, payload)
+	}
+
+	clone.Close()
+	if !p.cevents.wait(h.Timeout, has(evClosed, clone)) {
+		t.Fatalf("no Closed event for clone within %v", h.Timeout)
+	}
+	time.Sleep(h.Timeout / 50)
+	for _, ev := range p.cevents.on(p.client) {
+		if ev.kind == evClosed {
+			t.Errorf("closing the clone closed the original Connection")
+		}
+	}
+	payload = []byte("original")
+	if err := p.client.Send(payload, nil, p.cctx.DefaultSendParameters()); err != nil {
+		t.Fatalf("Send on original after closing clone: %v", err)
+	}
+	if got, _ := h.receiveBytes(t, p.server, len(payload)); !bytes.Equal(got, payload) {
+		t.Errorf("received %q on original, want %q", got, payload)
+	}
+}
+
+func (h Harness) testPartialOffsets(t *testing.T) {
+	p := h.connect(t)
+
+	payload := make([]byte, 1<<20)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	if err := p.client.Send(payload, nil, p.cctx.DefaultSendParameters()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	got, msgs := h.receiveBytes(t, p.server, len(payload))
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("received %d bytes differing from the %d sent", len(got), len(payload))
+	}
+
+	offset := 0
+	for i, msg := range msgs {
+		partial, off, more := msg.Partial()
+		last := i == len(msgs)-1
+		switch {
+		case !partial && len(msgs) > 1:
+			t.Errorf("part %d of %d is not marked partial", i, len(msgs))
+		case !partial:
+			// received whole
+		case off != offset:
+			t.Errorf("part %d at offset %d, want %d", i, off, offset)
+		case more == last:
+			t.Errorf("part %d of %d: more=%v", i, len(msgs), more)
+		}
+		offset += len(msg.Bytes())
+	}
+}
+
+func (h Harness) testConcurrentSendReceive(t *testing.T) {
+	p := h.connect(t)
+	sp := p.cctx.DefaultSendParameters()
+
+	const senders, perSender, size = 8, 16, 64
+	total := senders * perSender * size
+
+	// Keep several Receive calls outstanding at once, issuing a new one
+	// whenever one completes.
+	received := make(chan int, senders)
+	receive := func() {
+		p.server.Receive(func(msg postsocket.Message, _ postsocket.Connection) {
+			received <- len(msg.Bytes())
+		})
+	}
+	for r := 0; r < senders; r++ {
+		receive()
+	}
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				if err := p.client.Send(bytes.Repeat([]byte{byte(s)}, size), nil, sp); err != nil {
+					t.Errorf("Send: %v", err)
+					return
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	got := 0
+	timeout := time.After(h.Timeout)
+	for got < total {
+		select {
+		case n := <-received:
+			got += n
+			if got < total {
+				receive()
+			}
+		case <-timeout:
+			t.Fatalf("received %d of %d bytes sent concurrently within %v", got, total, h.Timeout)
+		}
+	}
+	if got != total {
+		t.Errorf("received %d bytes, sent %d", got, total)
+	}
+}
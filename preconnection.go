@@ -0,0 +1,513 @@
+package postsocket
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PreconnectionConfigVersion is the version of the JSON schema of a
+// PreconnectionConfig.
+const PreconnectionConfigVersion = 1
+
+// PreconnectionConfig describes the specifiers added to a Preconnection,
+// so that recipes for Connections can be kept in configuration rather than
+// code. It marshals to and from JSON as:
+//
+//	{
+//	  "version": 1,
+//	  "specifiers": [{
+//	    "remote": {"hostnames": ["example.com"], "services": ["https"]},
+//	    "local": {"interfaces": ["eth0"]},
+//	    "transport": {
+//	      "preferences": [
+//	        {"parameter": "TransportFullyReliable", "preference": "require"},
+//	        {"parameter": "TransportCapacityProfile", "preference": "prefer", "value": "interactive"}
+//	      ],
+//	      "values": {"TransportTimeout": "30s"}
+//	    },
+//	    "security": {
+//	      "trust_policy": "corporate-ca",
+//	      "values": {"SecurityCiphersuite": ["TLS_AES_128_GCM_SHA256"]}
+//	    }
+//	  }]
+//	}
+//
+// Parameters are named as their constants are. Capacity profiles,
+// interface types, durations, ciphersuites, groups and signature
+// algorithms are given by name, and other values as JSON numbers, strings
+// or booleans. Capacity profiles are also accepted as numbers.
+//
+// Event and framing handlers are not part of a PreconnectionConfig, and
+// neither are identities, keys and pre-shared keys, which must be added to
+// the SecurityParameters of a reconstructed Preconnection. Trust callbacks
+// are only included as the name of a TrustPolicy.
+type PreconnectionConfig struct {
+	Specifiers []SpecifierConfig
+}
+
+// SpecifierConfig describes a set of parameters added to a Preconnection
+// by AddSpecifier. Nil members were not given.
+type SpecifierConfig struct {
+	Remote    *EndpointConfig
+	Local     *EndpointConfig
+	Transport *TransportConfig
+	Security  *SecurityConfig
+}
+
+// EndpointConfig holds the values added to a Remote or Local, in the order
+// they were added.
+type EndpointConfig struct {
+	Interfaces []string `json:"interfaces,omitempty"`
+	Hostnames  []string `json:"hostnames,omitempty"`
+	Addresses  []net.IP `json:"addresses,omitempty"`
+	Ports      []uint16 `json:"ports,omitempty"`
+	Services   []string `json:"services,omitempty"`
+}
+
+// TransportConfig holds the preferences and values of TransportParameters.
+type TransportConfig struct {
+	Preferences []TransportPreference
+	Values      map[ParameterIdentifier]interface{}
+}
+
+// SecurityConfig holds the trust policy and values of SecurityParameters.
+type SecurityConfig struct {
+	// TrustPolicy is the name of a registered TrustPolicy, or empty.
+	TrustPolicy string
+
+	Values map[ParameterIdentifier]interface{}
+}
+
+// ConfigPreconnection is implemented by Preconnections that can describe
+// their specifiers as a PreconnectionConfig.
+type ConfigPreconnection interface {
+	Preconnection
+
+	// Config returns the specifiers of this Preconnection. It returns an
+	// error if they hold trust callbacks not set by WithTrustPolicy, or
+	// values that cannot be marshalled.
+	Config() (*PreconnectionConfig, error)
+}
+
+// MarshalPreconnection marshals the specifiers of a Preconnection, which
+// must be a ConfigPreconnection, to JSON.
+func MarshalPreconnection(pc Preconnection) ([]byte, error) {
+	cp, ok := pc.(ConfigPreconnection)
+	if !ok {
+		return nil, fmt.Errorf("postsocket: cannot marshal Preconnection of type %T", pc)
+	}
+	c, err := cp.Config()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(c, "", "  ")
+}
+
+// UnmarshalPreconnection reconstructs a Preconnection bound to a
+// TransportContext from its JSON form, with the given event and framing
+// handlers.
+func UnmarshalPreconnection(ctx TransportContext, evh EventHandler, fh FramingHandler, data []byte) (Preconnection, error) {
+	var c PreconnectionConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return c.Preconnect(ctx, evh, fh)
+}
+
+// Preconnect returns a new Preconnection bound to a TransportContext, with
+// the specifiers of this PreconnectionConfig added in order.
+func (c *PreconnectionConfig) Preconnect(ctx TransportContext, evh EventHandler, fh FramingHandler) (Preconnection, error) {
+	if len(c.Specifiers) == 0 {
+		return nil, errors.New("postsocket: PreconnectionConfig has no specifiers")
+	}
+	var pc Preconnection
+	for i := range c.Specifiers {
+		rem, loc, tp, sp, err := c.Specifiers[i].parameters(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if pc == nil {
+			if pc, err = ctx.Preconnect(evh, fh, rem, loc, tp, sp); err != nil {
+				return nil, err
+			}
+		} else {
+			pc.AddSpecifier(rem, loc, tp, sp)
+		}
+	}
+	return pc, nil
+}
+
+// parameters returns the parameters of the specifier bound to a context,
+// leaving those not given nil.
+func (s *SpecifierConfig) parameters(ctx TransportContext) (rem Remote, loc Local, tp TransportParameters, sp SecurityParameters, err error) {
+	if e := s.Remote; e != nil {
+		if len(e.Interfaces) > 0 {
+			return nil, nil, nil, nil, errors.New("postsocket: remote cannot name an interface")
+		}
+		rem = ctx.NewRemote()
+		for _, h := range e.Hostnames {
+			rem = rem.WithHostname(h)
+		}
+		for _, a := range e.Addresses {
+			rem = rem.WithAddress(a)
+		}
+		for _, p := range e.Ports {
+			rem = rem.WithPort(p)
+		}
+		for _, svc := range e.Services {
+			rem = rem.WithServiceName(svc)
+		}
+	}
+	if e := s.Local; e != nil {
+		loc = ctx.NewLocal()
+		for _, i := range e.Interfaces {
+			loc = loc.WithInterface(i)
+		}
+		for _, h := range e.Hostnames {
+			loc = loc.WithHostname(h)
+		}
+		for _, a := range e.Addresses {
+			loc = loc.WithAddress(a)
+		}
+		for _, p := range e.Ports {
+			loc = loc.WithPort(p)
+		}
+		for _, svc := range e.Services {
+			loc = loc.WithServiceName(svc)
+		}
+	}
+	if t := s.Transport; t != nil {
+		tp = applyTransportPreferences(ctx.NewTransportParameters(), t.Preferences)
+		for p, v := range t.Values {
+			if err := tp.Set(p, v); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+	}
+	if sc := s.Security; sc != nil {
+		sp = ctx.NewSecurityParameters()
+		for p, v := range sc.Values {
+			if err := sp.Set(p, v); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+		if sc.TrustPolicy != "" {
+			if sp, err = WithTrustPolicy(sp, sc.TrustPolicy); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+	}
+	return rem, loc, tp, sp, nil
+}
+
+// The JSON forms of a PreconnectionConfig and its members.
+type (
+	preconnectionJSON struct {
+		Version    int             `json:"version"`
+		Specifiers []specifierJSON `json:"specifiers"`
+	}
+	specifierJSON struct {
+		Remote    *EndpointConfig `json:"remote,omitempty"`
+		Local     *EndpointConfig `json:"local,omitempty"`
+		Transport *transportJSON  `json:"transport,omitempty"`
+		Security  *securityJSON   `json:"security,omitempty"`
+	}
+	transportJSON struct {
+		Preferences []preferenceJSON           `json:"preferences,omitempty"`
+		Values      map[string]json.RawMessage `json:"values,omitempty"`
+	}
+	preferenceJSON struct {
+		Parameter  string          `json:"parameter"`
+		Preference string          `json:"preference"`
+		Value      json.RawMessage `json:"value,omitempty"`
+	}
+	securityJSON struct {
+		TrustPolicy string                     `json:"trust_policy,omitempty"`
+		Values      map[string]json.RawMessage `json:"values,omitempty"`
+	}
+)
+
+// MarshalJSON implements json.Marshaler.
+func (c *PreconnectionConfig) MarshalJSON() ([]byte, error) {
+	out := preconnectionJSON{
+		Version:    PreconnectionConfigVersion,
+		Specifiers: make([]specifierJSON, len(c.Specifiers)),
+	}
+	for i, s := range c.Specifiers {
+		sj := &out.Specifiers[i]
+		sj.Remote, sj.Local = s.Remote, s.Local
+		if t := s.Transport; t != nil {
+			sj.Transport = &transportJSON{}
+			for _, pref := range t.Preferences {
+				v, err := marshalParameterValue(pref.Parameter, pref.Value)
+				if err != nil {
+					return nil, err
+				}
+				sj.Transport.Preferences = append(sj.Transport.Preferences, preferenceJSON{pref.Parameter.String(), pref.Preference.String(), v})
+			}
+			var err error
+			if sj.Transport.Values, err = marshalParameterValues(t.Values); err != nil {
+				return nil, err
+			}
+		}
+		if sc := s.Security; sc != nil {
+			sj.Security = &securityJSON{TrustPolicy: sc.TrustPolicy}
+			var err error
+			if sj.Security.Values, err = marshalParameterValues(sc.Values); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *PreconnectionConfig) UnmarshalJSON(b []byte) error {
+	var in preconnectionJSON
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	if in.Version != PreconnectionConfigVersion {
+		return fmt.Errorf("postsocket: unsupported Preconnection version %d", in.Version)
+	}
+	specs := make([]SpecifierConfig, len(in.Specifiers))
+	for i, sj := range in.Specifiers {
+		s := &specs[i]
+		s.Remote, s.Local = sj.Remote, sj.Local
+		if t := sj.Transport; t != nil {
+			s.Transport = &TransportConfig{}
+			for _, pj := range t.Preferences {
+				p, ok := parameterByName(pj.Parameter)
+				if !ok || p >= SecuritySupportedGroup {
+					return fmt.Errorf("postsocket: unknown transport parameter %q", pj.Parameter)
+				}
+				pref, ok := preferenceByName(pj.Preference)
+				if !ok {
+					return fmt.Errorf("postsocket: invalid preference %q for %v", pj.Preference, p)
+				}
+				v, err := unmarshalParameterValue(p, pj.Value)
+				if err != nil {
+					return err
+				}
+				s.Transport.Preferences = append(s.Transport.Preferences, TransportPreference{p, pref, v})
+			}
+			var err error
+			if s.Transport.Values, err = unmarshalParameterValues(t.Values, false); err != nil {
+				return err
+			}
+		}
+		if sj.Security != nil {
+			s.Security = &SecurityConfig{TrustPolicy: sj.Security.TrustPolicy}
+			var err error
+			if s.Security.Values, err = unmarshalParameterValues(sj.Security.Values, true); err != nil {
+				return err
+			}
+		}
+	}
+	c.Specifiers = specs
+	return nil
+}
+
+func marshalParameterValues(values map[ParameterIdentifier]interface{}) (map[string]json.RawMessage, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]json.RawMessage, len(values))
+	for p, v := range values {
+		b, err := marshalParameterValue(p, v)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil {
+			out[p.String()] = b
+		}
+	}
+	return out, nil
+}
+
+func unmarshalParameterValues(in map[string]json.RawMessage, security bool) (map[ParameterIdentifier]interface{}, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	values := make(map[ParameterIdentifier]interface{}, len(in))
+	for name, b := range in {
+		p, ok := parameterByName(name)
+		if !ok || (p >= SecuritySupportedGroup) != security {
+			kind := "transport"
+			if security {
+				kind = "security"
+			}
+			return nil, fmt.Errorf("postsocket: unknown %s parameter %q", kind, name)
+		}
+		v, err := unmarshalParameterValue(p, b)
+		if err != nil {
+			return nil, err
+		}
+		values[p] = v
+	}
+	return values, nil
+}
+
+// marshalParameterValue returns the JSON form of the value of a parameter,
+// or nil for a nil value.
+func marshalParameterValue(p ParameterIdentifier, v interface{}) (json.RawMessage, error) {
+	if i, ok := v.(int); ok && p == TransportCapacityProfile {
+		// The CapProf constants are untyped, so profiles often arrive as ints.
+		v = CapacityProfile(i)
+	}
+	var out interface{}
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case CapacityProfile:
+		out = v.String()
+	case time.Duration:
+		out = v.String()
+	case InterfaceType:
+		out = v.String()
+	case []InterfaceType:
+		names := make([]string, len(v))
+		for i, t := range v {
+			names[i] = t.String()
+		}
+		out = names
+	case []uint16:
+		if p != SecurityCiphersuite {
+			return nil, fmt.Errorf("postsocket: cannot marshal value of type %T for %v", v, p)
+		}
+		names := make([]string, len(v))
+		for i, id := range v {
+			names[i] = tls.CipherSuiteName(id)
+		}
+		out = names
+	case []tls.CurveID:
+		names := make([]string, len(v))
+		for i, id := range v {
+			names[i] = id.String()
+		}
+		out = names
+	case []tls.SignatureScheme:
+		names := make([]string, len(v))
+		for i, s := range v {
+			names[i] = s.String()
+		}
+		out = names
+	case bool, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		out = v
+	default:
+		return nil, fmt.Errorf("postsocket: cannot marshal value of type %T for %v", v, p)
+	}
+	return json.Marshal(out)
+}
+
+// unmarshalParameterValue returns the value of a parameter from its JSON
+// form, typed as the parameter expects: integral numbers are ints, and
+// other numbers float64s.
+func unmarshalParameterValue(p ParameterIdentifier, b json.RawMessage) (interface{}, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return nil, nil
+	}
+	invalid := func() error {
+		return fmt.Errorf("postsocket: invalid value %s for %v", b, p)
+	}
+	names := func() ([]string, error) {
+		var ss []string
+		if err := json.Unmarshal(b, &ss); err != nil {
+			return nil, invalid()
+		}
+		return ss, nil
+	}
+
+	switch p {
+	case TransportCapacityProfile:
+		var s string
+		if json.Unmarshal(b, &s) == nil {
+			if cp, ok := capacityProfileByName(s); ok {
+				return cp, nil
+			}
+			return nil, invalid()
+		}
+		var i int
+		if json.Unmarshal(b, &i) == nil && i >= 0 && i < len(capacityProfileNames) {
+			return CapacityProfile(i), nil
+		}
+		return nil, invalid()
+	case TransportTimeout, TransportSuggestTimeout, SecuritySessionCacheLifetime:
+		var s string
+		json.Unmarshal(b, &s)
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, invalid()
+		}
+		return d, nil
+	case TransportInterfaceType:
+		var s string
+		if json.Unmarshal(b, &s) == nil {
+			if t, ok := interfaceTypeByName(s); ok {
+				return t, nil
+			}
+			return nil, invalid()
+		}
+		ss, err := names()
+		types := make([]InterfaceType, len(ss))
+		for i, s := range ss {
+			var ok bool
+			if types[i], ok = interfaceTypeByName(s); !ok {
+				return nil, fmt.Errorf("postsocket: unknown interface type %q", s)
+			}
+		}
+		return types, err
+	case SecurityCiphersuite:
+		ss, err := names()
+		ids := make([]uint16, len(ss))
+		for i, s := range ss {
+			var ok bool
+			if ids[i], ok = ciphersuiteByName(s); !ok {
+				return nil, fmt.Errorf("postsocket: unknown ciphersuite %q", s)
+			}
+		}
+		return ids, err
+	case SecuritySupportedGroup:
+		ss, err := names()
+		ids := make([]tls.CurveID, len(ss))
+		for i, s := range ss {
+			var ok bool
+			if ids[i], ok = groupByName(s); !ok {
+				return nil, fmt.Errorf("postsocket: unknown group %q", s)
+			}
+		}
+		return ids, err
+	case SecuritySignatureAlgorithm:
+		ss, err := names()
+		ids := make([]tls.SignatureScheme, len(ss))
+		for i, s := range ss {
+			var ok bool
+			if ids[i], ok = signatureSchemeByName(s); !ok {
+				return nil, fmt.Errorf("postsocket: unknown signature algorithm %q", s)
+			}
+		}
+		return ids, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, invalid()
+	}
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i), nil
+		}
+		return v.Float64()
+	case bool, string:
+		return v, nil
+	}
+	return nil, invalid()
+}
@@ -0,0 +1,211 @@
+package postsocket_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// testTrustPolicy is the name of a trust policy registered for tests.
+const testTrustPolicy = "postsocket-test"
+
+func registerTestTrustPolicy() {
+	if _, ok := postsocket.LookupTrustPolicy(testTrustPolicy); !ok {
+		postsocket.RegisterTrustPolicy(testTrustPolicy, postsocket.TrustPolicy{
+			VerifyTrust: func(m postsocket.SecurityMetadata) (bool, error) { return true, nil },
+		})
+	}
+}
+
+func TestMarshalPreconnection(t *testing.T) {
+	registerTestTrustPolicy()
+	ctx := sim.NewNetwork(sim.NewClock(time.Unix(0, 0))).NewContext(net.IPv4(10, 0, 0, 1))
+
+	tp := ctx.NewTransportParameters().
+		Require(postsocket.TransportFullyReliable, true).
+		Prefer(postsocket.TransportCapacityProfile, postsocket.CapProfInteractive)
+	tp.Set(postsocket.TransportTimeout, 30*time.Second)
+	sp, err := postsocket.WithTrustPolicy(ctx.NewSecurityParameters(), testTrustPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.Set(postsocket.SecurityCiphersuite, []uint16{tls.TLS_AES_128_GCM_SHA256})
+	sp.Set(postsocket.SecuritySupportedGroup, []tls.CurveID{tls.X25519})
+	sp.Set(postsocket.SecuritySignatureAlgorithm, []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256})
+	sp.Set(postsocket.SecuritySessionCacheLifetime, time.Hour)
+	pc, err := ctx.Preconnect(nil, nil,
+		ctx.NewRemote().WithHostname("example.com").WithServiceName("https"),
+		ctx.NewLocal().WithInterface("eth0"), tp, sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.AddSpecifier(ctx.NewRemote().WithAddress(net.IPv4(192, 0, 2, 1)).WithPort(443), nil, nil, nil)
+
+	b, err := postsocket.MarshalPreconnection(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`"value": "interactive"`,
+		`"TransportTimeout": "30s"`,
+		`"TLS_AES_128_GCM_SHA256"`,
+		`"X25519"`,
+		`"` + tls.ECDSAWithP256AndSHA256.String() + `"`,
+		`"SecuritySessionCacheLifetime": "1h0m0s"`,
+		`"trust_policy": "` + testTrustPolicy + `"`,
+	} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Errorf("marshalled Preconnection lacks %s:\n%s", s, b)
+		}
+	}
+
+	// Unmarshalled, the Preconnection has the same specifiers, with values
+	// typed as given, and marshals the same again.
+	upc, err := postsocket.UnmarshalPreconnection(ctx, nil, nil, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := upc.(postsocket.ConfigPreconnection).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Specifiers) != 2 {
+		t.Fatalf("unmarshalled %d specifiers, want 2", len(c.Specifiers))
+	}
+	s := c.Specifiers[0]
+	if !reflect.DeepEqual(s.Remote, &postsocket.EndpointConfig{Hostnames: []string{"example.com"}, Services: []string{"https"}}) ||
+		!reflect.DeepEqual(s.Local, &postsocket.EndpointConfig{Interfaces: []string{"eth0"}}) {
+		t.Errorf("unmarshalled endpoints %+v and %+v", s.Remote, s.Local)
+	}
+	var profile interface{}
+	for _, pref := range s.Transport.Preferences {
+		if pref.Parameter == postsocket.TransportCapacityProfile {
+			profile = pref.Value
+		}
+	}
+	if profile != postsocket.CapacityProfile(postsocket.CapProfInteractive) {
+		t.Errorf("unmarshalled capacity profile %#v", profile)
+	}
+	wantSecurity := map[postsocket.ParameterIdentifier]interface{}{
+		postsocket.SecurityCiphersuite:          []uint16{tls.TLS_AES_128_GCM_SHA256},
+		postsocket.SecuritySupportedGroup:       []tls.CurveID{tls.X25519},
+		postsocket.SecuritySignatureAlgorithm:   []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		postsocket.SecuritySessionCacheLifetime: time.Hour,
+	}
+	if s.Transport.Values[postsocket.TransportTimeout] != 30*time.Second ||
+		s.Security.TrustPolicy != testTrustPolicy || !reflect.DeepEqual(s.Security.Values, wantSecurity) {
+		t.Errorf("unmarshalled values %v and %v, trust policy %q", s.Transport.Values, s.Security.Values, s.Security.TrustPolicy)
+	}
+	again, err := postsocket.MarshalPreconnection(upc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, b) {
+		t.Errorf("remarshalled as\n%s\nwant\n%s", again, b)
+	}
+}
+
+func TestMarshalPreconnectionTrustCallbacks(t *testing.T) {
+	registerTestTrustPolicy()
+	ctx := sim.NewNetwork(sim.NewClock(time.Unix(0, 0))).NewContext(net.IPv4(10, 0, 0, 1))
+	verify := func(m postsocket.SecurityMetadata) (bool, error) { return true, nil }
+	rem := ctx.NewRemote().WithHostname("example.com").WithPort(443)
+
+	sp := ctx.NewSecurityParameters().VerifyTrustWith(verify)
+	pc, _ := ctx.Preconnect(nil, nil, rem, nil, nil, sp)
+	if _, err := postsocket.MarshalPreconnection(pc); err == nil {
+		t.Error("marshalled a trust callback not set through a trust policy")
+	}
+
+	// A callback set directly replaces the trust policy.
+	sp, _ = postsocket.WithTrustPolicy(ctx.NewSecurityParameters(), testTrustPolicy)
+	sp = sp.HandleChallengeWith(verify)
+	pc, _ = ctx.Preconnect(nil, nil, rem, nil, nil, sp)
+	if _, err := postsocket.MarshalPreconnection(pc); err == nil {
+		t.Error("marshalled a challenge callback set after a trust policy")
+	}
+
+	_, err := postsocket.UnmarshalPreconnection(ctx, nil, nil, []byte(`{"version": 1, "specifiers": [
+		{"remote": {"hostnames": ["example.com"]}, "security": {"trust_policy": "no-such-policy"}}]}`))
+	if err == nil || !strings.Contains(err.Error(), "no-such-policy") {
+		t.Errorf("unmarshalling an unknown trust policy returned %v", err)
+	}
+}
+
+func TestUnmarshalPreconnectionValues(t *testing.T) {
+	tests := []struct {
+		param string
+		value string
+		want  interface{} // nil if the value is invalid
+	}{
+		{"TransportCapacityProfile", `"interactive"`, postsocket.CapacityProfile(postsocket.CapProfInteractive)},
+		{"TransportCapacityProfile", `"Bulk"`, postsocket.CapacityProfile(postsocket.CapProfBulk)},
+		{"TransportCapacityProfile", `3`, postsocket.CapacityProfile(postsocket.CapProfBulk)},
+		{"TransportCapacityProfile", `"fast"`, nil},
+		{"TransportCapacityProfile", `99`, nil},
+		{"TransportCapacityProfile", `-1`, nil},
+		{"TransportTimeout", `"1m30s"`, 90 * time.Second},
+		{"TransportTimeout", `30`, nil},
+		{"TransportTimeout", `"soon"`, nil},
+		{"TransportFullyReliable", `true`, true},
+		{"TransportFullyReliable", `{}`, nil},
+		{"SecurityCiphersuite", `["TLS_CHACHA20_POLY1305_SHA256"]`, []uint16{tls.TLS_CHACHA20_POLY1305_SHA256}},
+		{"SecurityCiphersuite", `["TLS_NULL"]`, nil},
+		{"SecuritySupportedGroup", `["X25519", "CurveP384"]`, []tls.CurveID{tls.X25519, tls.CurveP384}},
+		{"SecuritySupportedGroup", `["P-999"]`, nil},
+		{"SecuritySupportedGroup", `"X25519"`, nil},
+		{"SecuritySignatureAlgorithm", `["` + tls.PSSWithSHA256.String() + `"]`, []tls.SignatureScheme{tls.PSSWithSHA256}},
+		{"SecuritySignatureAlgorithm", `["rot13"]`, nil},
+		{"SecuritySessionCacheCapacity", `100`, 100},
+	}
+	for _, test := range tests {
+		section := "transport"
+		if strings.HasPrefix(test.param, "Security") {
+			section = "security"
+		}
+		data := `{"version": 1, "specifiers": [{"` + section + `": {"values": {"` + test.param + `": ` + test.value + `}}}]}`
+		var c postsocket.PreconnectionConfig
+		err := json.Unmarshal([]byte(data), &c)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s %s unmarshalled", test.param, test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", test.param, test.value, err)
+			continue
+		}
+		var values map[postsocket.ParameterIdentifier]interface{}
+		if s := c.Specifiers[0]; s.Transport != nil {
+			values = s.Transport.Values
+		} else {
+			values = s.Security.Values
+		}
+		for _, got := range values {
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s %s unmarshalled as %#v, want %#v", test.param, test.value, got, test.want)
+			}
+		}
+	}
+
+	for _, data := range []string{
+		`{"version": 2, "specifiers": []}`,
+		`{"version": 1, "specifiers": [{"transport": {"values": {"SecurityCiphersuite": []}}}]}`,
+		`{"version": 1, "specifiers": [{"transport": {"preferences": [{"parameter": "TransportFullyReliable", "preference": "maybe"}]}}]}`,
+		`{"version": 1, "specifiers": [{"transport": {"preferences": [{"parameter": "SecurityCiphersuite", "preference": "require"}]}}]}`,
+	} {
+		var c postsocket.PreconnectionConfig
+		if err := json.Unmarshal([]byte(data), &c); err == nil {
+			t.Errorf("unmarshalled %s", data)
+		}
+	}
+}
@@ -0,0 +1,639 @@
+package postsocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Kinds of SessionRecord.
+const (
+	SessionReady   = "ready"
+	SessionSend    = "send"
+	SessionReceive = "receive"
+	SessionSent    = "sent"
+	SessionExpired = "expired"
+	SessionError   = "error"
+	SessionClosed  = "closed"
+)
+
+const (
+	// sessionVersion is the version of the recording format.
+	sessionVersion = 1
+
+	// replayStackName is the protocol stack of a replayed Connection.
+	replayStackName = "replay"
+)
+
+// SessionRecord is a single Message or event in a recorded session.
+type SessionRecord struct {
+	// Time is the time of the record relative to the start of recording.
+	Time time.Duration `json:"time"`
+
+	// Event is the kind of record: SessionReady, SessionSend,
+	// SessionReceive, SessionSent, SessionExpired, SessionError, or
+	// SessionClosed.
+	Event string `json:"event"`
+
+	// Data is the content of a Message sent or received.
+	Data []byte `json:"data,omitempty"`
+
+	// MsgRef is the message reference of a Message sent, formatted as by
+	// fmt.Sprint, for send, sent, expired, and error records.
+	MsgRef string `json:"msgref,omitempty"`
+
+	// Partial, Offset and More are the values returned by the Partial
+	// method of a Message received.
+	Partial bool `json:"partial,omitempty"`
+	Offset  int  `json:"offset,omitempty"`
+	More    bool `json:"more,omitempty"`
+
+	// Error is the error of an error or closed record, if any.
+	Error string `json:"error,omitempty"`
+
+	// Local and Remote are the addresses of the Connection when it became
+	// Ready, for ready records.
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// sessionHeader is the first record of a recorded session.
+type sessionHeader struct {
+	Version int    `json:"postsocket_session"`
+	Start   string `json:"start"`
+}
+
+// Recorder records the Messages sent and received on a Connection, and the
+// events occurring on it, as a JSON text sequence (RFC 7464): a header
+// record followed by one SessionRecord per Message or event. Read a
+// recording back with ReadSession. All methods may be called concurrently.
+type Recorder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	clock Clock
+	start time.Time
+	err   error // first write error
+}
+
+// NewRecorder creates a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w, clock: SystemClock}
+}
+
+// SetClock sets the Clock that timestamps records, which should be that of
+// the TransportContext of the Connection recorded. The default is
+// SystemClock.
+func (r *Recorder) SetClock(c Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = c
+}
+
+// Err returns the first error encountered writing the recording, if any.
+// Recording is best-effort: a Recorder that fails to write keeps going.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Record starts recording a Connection, and returns the Connection to use
+// in its place: Messages sent and received and events occurring on the
+// returned Connection are recorded, with their times relative to the call
+// to Record. Call Record once per Recorder, before the Connection is Ready,
+// as on the return from Initiate or in the Ready callback of a listening
+// Connection's EventHandler.
+func (r *Recorder) Record(conn Connection) Connection {
+	r.mu.Lock()
+	r.start = r.clock.Now()
+	start := r.start
+	r.mu.Unlock()
+
+	r.write(sessionHeader{Version: sessionVersion, Start: start.UTC().Format(time.RFC3339Nano)})
+	return InterceptConnection(conn, r.interceptor())
+}
+
+// record timestamps and writes a SessionRecord.
+func (r *Recorder) record(rec SessionRecord) {
+	r.mu.Lock()
+	rec.Time = r.clock.Now().Sub(r.start)
+	r.mu.Unlock()
+	r.write(rec)
+}
+
+// write writes a single JSON-SEQ record, recording the first error
+// encountered.
+func (r *Recorder) write(v interface{}) {
+	b, err := json.Marshal(v)
+	if err == nil {
+		rec := make([]byte, 0, len(b)+2)
+		rec = append(rec, recordSeparator)
+		rec = append(rec, b...)
+		rec = append(rec, '\n')
+		r.mu.Lock()
+		_, err = r.w.Write(rec)
+		r.mu.Unlock()
+	}
+	if err != nil {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Recorder) interceptor() Interceptor {
+	return Interceptor{
+		EventHandler: func(next EventHandler) EventHandler {
+			return recordingHandler{next, r}
+		},
+		Send: func(next SendFunc) SendFunc {
+			return func(conn Connection, msg interface{}, msgref interface{}, sp SendParameters) error {
+				err := next(conn, msg, msgref, sp)
+				if err == nil {
+					r.record(SessionRecord{Event: SessionSend, Data: sentBytes(conn, msg), MsgRef: msgrefString(msgref)})
+				}
+				return err
+			}
+		},
+		Receive: func(next ReceiveFunc) ReceiveFunc {
+			return func(conn Connection, receiver func(msg Message, conn Connection)) {
+				next(conn, func(msg Message, conn Connection) {
+					partial, offset, more := msg.Partial()
+					r.record(SessionRecord{
+						Event: SessionReceive, Data: msg.Bytes(),
+						Partial: partial, Offset: offset, More: more,
+					})
+					receiver(msg, conn)
+				})
+			}
+		},
+	}
+}
+
+// sentBytes returns the bytes of a Message passed to Send, framing it with
+// the Connection's FramingHandler if necessary. It returns nil if the
+// Message cannot be framed.
+func sentBytes(conn Connection, msg interface{}) []byte {
+	switch m := msg.(type) {
+	case []byte:
+		return m
+	case Message:
+		return m.Bytes()
+	}
+	if fh := conn.GetFramingHandler(); fh != nil {
+		if b, err := fh.Frame(msg); err == nil {
+			return b
+		}
+	}
+	return nil
+}
+
+// recordingHandler records events before passing them on.
+type recordingHandler struct {
+	next EventHandler
+	r    *Recorder
+}
+
+// Ready implements EventHandler.
+func (h recordingHandler) Ready(conn Connection, ante Connection) {
+	h.r.record(SessionRecord{
+		Event: SessionReady, Local: addrString(conn.LocalAddr()), Remote: addrString(conn.RemoteAddr()),
+	})
+	h.next.Ready(conn, ante)
+}
+
+// Sent implements EventHandler.
+func (h recordingHandler) Sent(conn Connection, msgref interface{}) {
+	h.r.record(SessionRecord{Event: SessionSent, MsgRef: msgrefString(msgref)})
+	h.next.Sent(conn, msgref)
+}
+
+// Expired implements EventHandler.
+func (h recordingHandler) Expired(conn Connection, msgref interface{}) {
+	h.r.record(SessionRecord{Event: SessionExpired, MsgRef: msgrefString(msgref)})
+	h.next.Expired(conn, msgref)
+}
+
+// Error implements EventHandler.
+func (h recordingHandler) Error(conn Connection, msgref interface{}, err error) {
+	h.r.record(SessionRecord{Event: SessionError, MsgRef: msgrefString(msgref), Error: errorString(err)})
+	h.next.Error(conn, msgref, err)
+}
+
+// Closed implements EventHandler.
+func (h recordingHandler) Closed(conn Connection, err error) {
+	h.r.record(SessionRecord{Event: SessionClosed, Error: errorString(err)})
+	h.next.Closed(conn, err)
+}
+
+// Session is a recorded session, as read by ReadSession.
+type Session struct {
+	// Start is the time recording started.
+	Start time.Time
+
+	// Records are the Messages and events recorded, in order.
+	Records []SessionRecord
+}
+
+// ReadSession reads a session recorded by a Recorder.
+func ReadSession(r io.Reader) (*Session, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Session)
+	header := true
+	for i, rec := range bytes.Split(b, []byte{recordSeparator}) {
+		rec = bytes.TrimSpace(rec)
+		if len(rec) == 0 {
+			continue
+		}
+		if header {
+			var h sessionHeader
+			if err := json.Unmarshal(rec, &h); err != nil {
+				return nil, fmt.Errorf("postsocket: bad session header: %v", err)
+			}
+			if h.Version != sessionVersion {
+				return nil, fmt.Errorf("postsocket: unsupported session version %d", h.Version)
+			}
+			if s.Start, err = time.Parse(time.RFC3339Nano, h.Start); err != nil {
+				return nil, fmt.Errorf("postsocket: bad session start time: %v", err)
+			}
+			header = false
+			continue
+		}
+		var sr SessionRecord
+		if err := json.Unmarshal(rec, &sr); err != nil {
+			return nil, fmt.Errorf("postsocket: bad session record %d: %v", i, err)
+		}
+		s.Records = append(s.Records, sr)
+	}
+	if header {
+		return nil, errors.New("postsocket: empty session")
+	}
+	return s, nil
+}
+
+// sessionError reconstructs a recorded error. The errors of this package
+// are reconstructed as themselves; others only by their text.
+func sessionError(s string) error {
+	switch s {
+	case "":
+		return nil
+	case ErrClosed.Error():
+		return ErrClosed
+	case ErrExpired.Error():
+		return ErrExpired
+	}
+	return errors.New(s)
+}
+
+// Replay returns a Connection reproducing the remote end of a recorded
+// session, as a fake peer for the application code under test. The
+// Connection becomes Ready, delivers the Messages received in the session
+// to Receive callbacks with the same boundaries and partial flags, reports
+// errors not concerning a Message sent, and Closes with the recorded
+// error, each at the recorded time multiplied by scale. A scale of zero or
+// less replays the session without delay. Events occur in recorded order,
+// and Closed only once every Message recorded before it has been received.
+// Messages sent on the Connection are discarded, each with a Sent event.
+// The clock schedules the replay; if nil, SystemClock is used.
+func (s *Session) Replay(evh EventHandler, clock Clock, scale float64) Connection {
+	if clock == nil {
+		clock = SystemClock
+	}
+	if scale < 0 {
+		scale = 0
+	}
+
+	c := &replayConn{clock: clock, scale: scale, evh: evh, start: clock.Now()}
+	for _, rec := range s.Records {
+		switch rec.Event {
+		case SessionReady, SessionReceive, SessionClosed:
+		case SessionError:
+			if rec.MsgRef != "" {
+				continue
+			}
+		default:
+			continue
+		}
+		c.records = append(c.records, rec)
+	}
+	c.next()
+	return c
+}
+
+// replayConn is a Connection replaying a Session.
+type replayConn struct {
+	clock Clock
+	scale float64
+	start time.Time
+
+	mu        sync.Mutex
+	evh       EventHandler
+	fh        FramingHandler
+	records   []SessionRecord // left to replay
+	timer     Timer
+	local     net.Addr
+	remote    net.Addr
+	ready     bool
+	unsent    []replaySend // Messages sent before Ready
+	inbox     []*replayMessage
+	receivers []func(msg Message, conn Connection)
+	closing   bool  // remote end closed
+	closeErr  error // error remote end closed with
+	closed    bool
+	stats     StatsCounter
+}
+
+// replayMessage implements Message.
+type replayMessage struct {
+	data    []byte
+	partial bool
+	offset  int
+	more    bool
+}
+
+func (m *replayMessage) Bytes() []byte {
+	return m.data
+}
+
+func (m *replayMessage) Partial() (bool, int, bool) {
+	return m.partial, m.offset, m.more
+}
+
+// replaySend is a Message sent on a replayed Connection.
+type replaySend struct {
+	msgref interface{}
+	length int
+}
+
+// replayAddr is an address recorded in a Session.
+type replayAddr string
+
+func (a replayAddr) Network() string {
+	return replayStackName
+}
+
+func (a replayAddr) String() string {
+	return string(a)
+}
+
+// next schedules the replay of the next record.
+func (c *replayConn) next() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.closing || len(c.records) == 0 {
+		return
+	}
+	at := c.start.Add(time.Duration(float64(c.records[0].Time) * c.scale))
+	c.timer = c.clock.AfterFunc(at.Sub(c.clock.Now()), c.step)
+}
+
+// step replays the next record, and schedules the one after it. Records
+// are replayed one at a time so that they keep their order even when
+// scheduled for the same time.
+func (c *replayConn) step() {
+	c.mu.Lock()
+	if c.closed || len(c.records) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	rec := c.records[0]
+	c.records = c.records[1:]
+	evh := c.evh
+	c.mu.Unlock()
+
+	switch rec.Event {
+	case SessionReady:
+		c.mu.Lock()
+		c.ready = true
+		if rec.Local != "" {
+			c.local = replayAddr(rec.Local)
+		}
+		if rec.Remote != "" {
+			c.remote = replayAddr(rec.Remote)
+		}
+		unsent := c.unsent
+		c.unsent = nil
+		c.mu.Unlock()
+		if evh != nil {
+			evh.Ready(c, nil)
+		}
+		for _, m := range unsent {
+			c.sent(m)
+		}
+		c.dispatch()
+	case SessionReceive:
+		c.mu.Lock()
+		c.inbox = append(c.inbox, &replayMessage{rec.Data, rec.Partial, rec.Offset, rec.More})
+		c.mu.Unlock()
+		c.dispatch()
+	case SessionError:
+		if evh != nil {
+			evh.Error(c, nil, sessionError(rec.Error))
+		}
+	case SessionClosed:
+		c.mu.Lock()
+		c.closing = true
+		c.closeErr = sessionError(rec.Error)
+		c.mu.Unlock()
+		c.dispatch()
+	}
+	c.next()
+}
+
+// dispatch passes received Messages to pending Receive callbacks, and
+// Closes the Connection once the remote end has closed and every Message
+// has been received.
+func (c *replayConn) dispatch() {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		if len(c.inbox) == 0 {
+			closing, err := c.closing, c.closeErr
+			c.mu.Unlock()
+			if closing {
+				c.close(err)
+			}
+			return
+		}
+		if len(c.receivers) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		msg, receiver := c.inbox[0], c.receivers[0]
+		c.inbox, c.receivers = c.inbox[1:], c.receivers[1:]
+		c.mu.Unlock()
+
+		c.stats.Received(len(msg.data))
+		receiver(msg, c)
+	}
+}
+
+// close Closes the Connection with the given error.
+func (c *replayConn) close(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	unsent, evh := c.unsent, c.evh
+	c.unsent, c.inbox, c.receivers = nil, nil, nil
+	c.mu.Unlock()
+
+	if evh == nil {
+		return
+	}
+	for _, m := range unsent {
+		evh.Error(c, m.msgref, ErrClosed)
+	}
+	evh.Closed(c, err)
+}
+
+// sent reports a Message sent.
+func (c *replayConn) sent(m replaySend) {
+	c.mu.Lock()
+	evh, closed := c.evh, c.closed
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	c.stats.Sent(m.length)
+	if evh != nil {
+		evh.Sent(c, m.msgref)
+	}
+}
+
+// Send implements Connection, discarding the Message.
+func (c *replayConn) Send(msg interface{}, msgref interface{}, sp SendParameters) error {
+	m := replaySend{msgref: msgref}
+	switch b := msg.(type) {
+	case []byte:
+		m.length = len(b)
+	case Message:
+		m.length = len(b.Bytes())
+	default:
+		fh := c.GetFramingHandler()
+		if fh == nil {
+			return fmt.Errorf("postsocket: cannot send %T without a FramingHandler", msg)
+		}
+		framed, err := fh.Frame(msg)
+		if err != nil {
+			return err
+		}
+		m.length = len(framed)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if !c.ready {
+		c.unsent = append(c.unsent, m)
+		return nil
+	}
+	c.clock.AfterFunc(0, func() { c.sent(m) })
+	return nil
+}
+
+// Receive implements Connection.
+func (c *replayConn) Receive(receiver func(msg Message, conn Connection)) {
+	c.mu.Lock()
+	c.receivers = append(c.receivers, receiver)
+	c.mu.Unlock()
+	c.clock.AfterFunc(0, c.dispatch)
+}
+
+// Clone implements Connection. Replayed Connections cannot be cloned.
+func (c *replayConn) Clone() (Connection, error) {
+	return nil, errors.New("postsocket: cannot clone a replayed Connection")
+}
+
+// Close implements Connection, ending the replay.
+func (c *replayConn) Close() error {
+	c.clock.AfterFunc(0, func() { c.close(nil) })
+	return nil
+}
+
+// GetEventHandler implements Connection.
+func (c *replayConn) GetEventHandler() EventHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evh
+}
+
+// SetEventHandler implements Connection.
+func (c *replayConn) SetEventHandler(evh EventHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evh = evh
+}
+
+// GetFramingHandler implements Connection.
+func (c *replayConn) GetFramingHandler() FramingHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fh
+}
+
+// SetFramingHandler implements Connection.
+func (c *replayConn) SetFramingHandler(fh FramingHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fh = fh
+}
+
+// GetTransportParameters implements Connection. Replayed Connections have
+// no transport parameters.
+func (c *replayConn) GetTransportParameters() TransportParameters {
+	return nil
+}
+
+// LocalAddr implements Connection, returning the recorded local address.
+func (c *replayConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.local
+}
+
+// RemoteAddr implements Connection, returning the recorded remote address.
+func (c *replayConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// Stats implements Connection.
+func (c *replayConn) Stats() (ConnectionStats, error) {
+	return c.stats.Stats(), nil
+}
+
+// Info implements Connection.
+func (c *replayConn) Info() ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ConnectionInfo{Stack: replayStackName, PendingReceives: len(c.receivers)}
+}
+
+// Logger implements Connection, returning a logger discarding all records.
+func (c *replayConn) Logger() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
@@ -0,0 +1,163 @@
+package postsocket_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// receipt is a Message as received, with its time since start.
+type receipt struct {
+	at      time.Duration
+	data    string
+	partial bool
+	offset  int
+	more    bool
+}
+
+// receiveAll keeps a Receive outstanding on conn, appending each Message
+// received to out with its time on clock since start.
+func receiveAll(conn postsocket.Connection, clock postsocket.Clock, start time.Time, out *[]receipt) {
+	var receiver func(msg postsocket.Message, conn postsocket.Connection)
+	receiver = func(msg postsocket.Message, conn postsocket.Connection) {
+		partial, offset, more := msg.Partial()
+		*out = append(*out, receipt{clock.Now().Sub(start), string(msg.Bytes()), partial, offset, more})
+		conn.Receive(receiver)
+	}
+	conn.Receive(receiver)
+}
+
+func TestRecordReplay(t *testing.T) {
+	clock := sim.NewClock(time.Unix(0, 0))
+	n := sim.NewNetwork(clock)
+	n.SetLatency(10 * time.Millisecond)
+	n.SetMaxMessageSize(1200)
+	sctx := n.NewContext(net.IPv4(10, 0, 0, 1))
+	cctx := n.NewContext(net.IPv4(10, 0, 0, 2))
+
+	large := bytes.Repeat([]byte("0123456789"), 300)
+	_, err := sctx.Listen(postsocket.FuncHandler{
+		OnReady: func(conn, ante postsocket.Connection) {
+			conn.Send([]byte("hello"), nil, postsocket.SendParameters{})
+			clock.AfterFunc(100*time.Millisecond, func() {
+				conn.Send(large, nil, postsocket.SendParameters{})
+				conn.Close()
+			})
+		},
+	}, sctx.NewLocal().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record the client end of the session.
+	var closedErr error = errors.New("not closed")
+	evh := postsocket.FuncHandler{
+		OnClosed: func(conn postsocket.Connection, err error) { closedErr = err },
+	}
+	pc, err := cctx.Preconnect(evh, nil, cctx.NewRemote().WithAddress(net.IPv4(10, 0, 0, 1)).WithPort(7000), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pc.Initiate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	rec := postsocket.NewRecorder(&buf)
+	rec.SetClock(clock)
+	start := clock.Now()
+	client = rec.Record(client)
+	var recorded []receipt
+	receiveAll(client, clock, start, &recorded)
+	clock.RunFor(time.Second)
+	if closedErr != nil {
+		t.Fatalf("recorded Connection closed with %v", closedErr)
+	}
+	if len(recorded) < 3 || recorded[0].data != "hello" || !recorded[1].partial {
+		t.Fatalf("received %+v, want hello then a partial Message", recorded)
+	}
+
+	session, err := postsocket.ReadSession(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.Start.Equal(start) {
+		t.Errorf("session started %v, want %v", session.Start, start)
+	}
+
+	// Replay at half speed on a fresh Clock.
+	rclock := sim.NewClock(time.Unix(1000, 0))
+	var ready bool
+	closedErr = errors.New("not closed")
+	replay := session.Replay(postsocket.FuncHandler{
+		OnReady:  func(conn, ante postsocket.Connection) { ready = true },
+		OnClosed: func(conn postsocket.Connection, err error) { closedErr = err },
+	}, rclock, 2)
+	var replayed []receipt
+	receiveAll(replay, rclock, rclock.Now(), &replayed)
+	rclock.RunFor(time.Minute)
+
+	if !ready || closedErr != nil {
+		t.Errorf("replay Ready %v, closed with %v; want Ready and closed cleanly", ready, closedErr)
+	}
+	want := make([]receipt, len(recorded))
+	for i, r := range recorded {
+		r.at *= 2
+		want[i] = r
+	}
+	if !reflect.DeepEqual(replayed, want) {
+		t.Errorf("replayed\n%+v\nwant\n%+v", replayed, want)
+	}
+	if got := replay.RemoteAddr().String(); got != client.RemoteAddr().String() {
+		t.Errorf("replay RemoteAddr %s, want %s", got, client.RemoteAddr())
+	}
+}
+
+func TestReplayCloseReason(t *testing.T) {
+	other := errors.New("connection reset")
+	for _, want := range []error{nil, postsocket.ErrClosed, postsocket.ErrExpired, other} {
+		var msg string
+		if want != nil {
+			msg = want.Error()
+		}
+		session := &postsocket.Session{Records: []postsocket.SessionRecord{
+			{Event: postsocket.SessionReady},
+			{Time: time.Millisecond, Event: postsocket.SessionClosed, Error: msg},
+		}}
+
+		clock := sim.NewClock(time.Unix(0, 0))
+		var got error = errors.New("not closed")
+		session.Replay(postsocket.FuncHandler{
+			OnClosed: func(conn postsocket.Connection, err error) { got = err },
+		}, clock, 1)
+		clock.RunFor(time.Second)
+
+		switch {
+		case want == other:
+			if got == nil || got.Error() != other.Error() {
+				t.Errorf("closed with %v, want an error reading %q", got, other)
+			}
+		case got != want:
+			t.Errorf("closed with %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReadSessionErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"\x1e{\"postsocket_session\":2,\"start\":\"1970-01-01T00:00:00Z\"}\n",
+		"\x1e{\"postsocket_session\":1,\"start\":\"yesterday\"}\n",
+		"\x1e{\"postsocket_session\":1,\"start\":\"1970-01-01T00:00:00Z\"}\n\x1e{bad\n",
+	} {
+		if _, err := postsocket.ReadSession(bytes.NewReader([]byte(in))); err == nil {
+			t.Errorf("ReadSession(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package postsocket
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver resolves the hostnames and service names given in Remotes and
+// Locals. Implementations resolve through the Resolver set with
+// TransportContext.SetResolver when a Connection is created, reporting
+// failures as for any other resolution error.
+type Resolver interface {
+	// LookupIP returns the IPv4 and IPv6 addresses of a host.
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+
+	// LookupPort returns the port of a service on the given network, such
+	// as "tcp" or "udp".
+	LookupPort(ctx context.Context, network, service string) (int, error)
+}
+
+// SystemResolver is the Resolver of the operating system, using
+// net.DefaultResolver. It is the default Resolver of a TransportContext.
+var SystemResolver Resolver = systemResolver{}
+
+type systemResolver struct{}
+
+func (systemResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+func (systemResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return net.DefaultResolver.LookupPort(ctx, network, service)
+}
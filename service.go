@@ -0,0 +1,272 @@
+package postsocket
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+)
+
+// SRVResolver is implemented by Resolvers that can look up DNS SRV records
+// (RFC 2782), to discover the targets of a service on a host.
+type SRVResolver interface {
+	Resolver
+
+	// LookupSRV returns the SRV records of the given service and protocol
+	// on a host, as for net.Resolver.LookupSRV: sorted by priority, and
+	// randomized by weight within each priority.
+	LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error)
+}
+
+// SVCBResolver is implemented by Resolvers that can look up DNS SVCB and
+// HTTPS records (RFC 9460), to discover the targets of a service on a host
+// together with the protocols they support.
+type SVCBResolver interface {
+	Resolver
+
+	// LookupSVCB returns the service mode SVCB records of the given service
+	// on a host, following alias mode records, sorted by priority. The
+	// service "https" is looked up as HTTPS records at the host itself;
+	// other services as SVCB records at "_service.host". An alias mode
+	// record whose target is the root, meaning that the service is not
+	// available, is returned alone, as a record of priority zero with an
+	// empty target.
+	LookupSVCB(ctx context.Context, service, host string) ([]SVCBRecord, error)
+}
+
+// SVCBRecord is a service mode SVCB or HTTPS record.
+type SVCBRecord struct {
+	// Priority orders records, lowest first.
+	Priority uint16
+
+	// Target is the hostname of the service endpoint.
+	Target string
+
+	// ALPN lists the application protocols the endpoint supports, in
+	// order of preference, and NoDefaultALPN is set if it does not support
+	// the default protocol of the service.
+	ALPN          []string
+	NoDefaultALPN bool
+
+	// Port is the port of the endpoint, or zero if it is the default port
+	// of the service.
+	Port uint16
+
+	// IPv4Hints and IPv6Hints are addresses of the target, which may be
+	// used before resolving it.
+	IPv4Hints []net.IP
+	IPv6Hints []net.IP
+
+	// ECHConfig is the Encrypted ClientHello configuration list of the
+	// endpoint, if any.
+	ECHConfig []byte
+}
+
+// ServiceCandidate is an endpoint of a service discovered by
+// ResolveService, to be resolved and raced as a candidate.
+type ServiceCandidate struct {
+	// Target is the hostname of the endpoint.
+	Target string
+
+	// Port is the port of the endpoint.
+	Port uint16
+
+	// ALPN lists the application protocols the endpoint advertised, if
+	// known, in order of preference.
+	ALPN []string
+
+	// Hints are addresses of the target known from discovery, which may
+	// be raced before the target is resolved.
+	Hints []net.IP
+}
+
+// Stacks returns the protocol stacks implied by the candidate's ALPN
+// hints, in order of preference: "quic" for HTTP/3 and DNS over QUIC, and
+// "tls/tcp" for other protocols. It returns nil if the candidate has no
+// hints.
+func (c ServiceCandidate) Stacks() []string {
+	var stacks []string
+	seen := make(map[string]bool)
+	for _, alpn := range c.ALPN {
+		stack := "tls/tcp"
+		if alpn == "h3" || strings.HasPrefix(alpn, "h3-") || alpn == "doq" {
+			stack = "quic"
+		}
+		if !seen[stack] {
+			seen[stack] = true
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks
+}
+
+// OrderServiceCandidates returns the candidates an implementation able to
+// race the given protocol stacks, in order of preference, can use, in the
+// order to race them. Candidates are ranked by the most preferred of
+// their Stacks it can race, so that QUIC comes first for endpoints
+// advertising HTTP/3 if "quic" is preferred, and are otherwise kept in
+// order. Candidates without ALPN hints follow those with, and candidates
+// whose hints imply only stacks not given are left out.
+func OrderServiceCandidates(cands []ServiceCandidate, stacks []string) []ServiceCandidate {
+	rank := func(c ServiceCandidate) int {
+		cs := c.Stacks()
+		if len(cs) == 0 {
+			return len(stacks)
+		}
+		best := -1
+		for _, s := range cs {
+			for i, t := range stacks {
+				if s == t && (best < 0 || i < best) {
+					best = i
+				}
+			}
+		}
+		return best
+	}
+
+	type ranked struct {
+		c    ServiceCandidate
+		rank int
+	}
+	var rs []ranked
+	for _, c := range cands {
+		if r := rank(c); r >= 0 {
+			rs = append(rs, ranked{c, r})
+		}
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].rank < rs[j].rank })
+	out := make([]ServiceCandidate, len(rs))
+	for i, r := range rs {
+		out[i] = r.c
+	}
+	return out
+}
+
+// ResolveService discovers the endpoints of a service on a host, in order
+// of preference, for a Remote giving both a hostname and a service name.
+// If r is an SVCBResolver and the host has SVCB or HTTPS records for the
+// service, these give the candidates, with their ALPN and address hints.
+// Otherwise, if r is an SRVResolver and the host has SRV records for the
+// service on the given network ("tcp" or "udp"), these give the
+// candidates, ordered by priority and weight. Otherwise, the single
+// candidate is the host itself, at the port of the service as given by
+// r.LookupPort. SVCB lookups are optional: if one fails for any reason,
+// such as a server failure, discovery carries on with SRV records. An SVCB
+// or SRV answer that the service is not available is an error.
+func ResolveService(ctx context.Context, r Resolver, service, network, host string) ([]ServiceCandidate, error) {
+	if sr, ok := r.(SVCBResolver); ok {
+		recs, err := sr.LookupSVCB(ctx, service, host)
+		if err == nil && len(recs) == 1 && recs[0].Priority == 0 {
+			return nil, &net.DNSError{Err: "service not available", Name: host, IsNotFound: true}
+		}
+		if err == nil && len(recs) > 0 {
+			return svcbCandidates(ctx, r, service, network, host, recs)
+		}
+	}
+
+	if sr, ok := r.(SRVResolver); ok {
+		srvs, err := sr.LookupSRV(ctx, service, network, host)
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		// A single record with the root as target means the service is
+		// decidedly not available.
+		if len(srvs) == 1 && (srvs[0].Target == "." || srvs[0].Target == "") {
+			return nil, &net.DNSError{Err: "service not available", Name: host, IsNotFound: true}
+		}
+		if len(srvs) > 0 {
+			cands := make([]ServiceCandidate, len(srvs))
+			for i, srv := range srvs {
+				cands[i] = ServiceCandidate{Target: strings.TrimSuffix(srv.Target, "."), Port: srv.Port}
+			}
+			return cands, nil
+		}
+	}
+
+	port, err := r.LookupPort(ctx, network, service)
+	if err != nil {
+		return nil, err
+	}
+	return []ServiceCandidate{{Target: host, Port: uint16(port)}}, nil
+}
+
+func svcbCandidates(ctx context.Context, r Resolver, service, network, host string, recs []SVCBRecord) ([]ServiceCandidate, error) {
+	var defaultPort uint16
+	cands := make([]ServiceCandidate, 0, len(recs))
+	for _, rec := range recs {
+		c := ServiceCandidate{
+			Target: rec.Target,
+			Port:   rec.Port,
+			ALPN:   append([]string(nil), rec.ALPN...),
+		}
+		c.Hints = append(c.Hints, rec.IPv6Hints...)
+		c.Hints = append(c.Hints, rec.IPv4Hints...)
+		if c.Target == "" || c.Target == "." {
+			c.Target = host
+		}
+		if c.Port == 0 {
+			if defaultPort == 0 {
+				port, err := r.LookupPort(ctx, network, service)
+				if err != nil {
+					return nil, err
+				}
+				defaultPort = uint16(port)
+			}
+			c.Port = defaultPort
+		}
+		cands = append(cands, c)
+	}
+	return cands, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// orderSRV sorts SRV records by priority, and orders the records of each
+// priority by weighted random selection, as specified by RFC 2782.
+func orderSRV(srvs []*net.SRV) {
+	sort.SliceStable(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		shuffleByWeight(srvs[i:j])
+		i = j
+	}
+}
+
+// shuffleByWeight orders records of equal priority by repeatedly selecting
+// one at random with probability proportional to its weight.
+func shuffleByWeight(srvs []*net.SRV) {
+	// Records of weight zero go first, so that they have a small chance
+	// of selection.
+	sort.SliceStable(srvs, func(i, j int) bool { return srvs[i].Weight == 0 && srvs[j].Weight != 0 })
+	total := 0
+	for _, srv := range srvs {
+		total += int(srv.Weight)
+	}
+	for len(srvs) > 1 && total > 0 {
+		n := rand.Intn(total + 1)
+		sum := 0
+		for i, srv := range srvs {
+			sum += int(srv.Weight)
+			if sum >= n {
+				srvs[0], srvs[i] = srvs[i], srvs[0]
+				break
+			}
+		}
+		total -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
+
+// LookupSRV implements SRVResolver.
+func (systemResolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, service, proto, name)
+	return srvs, err
+}
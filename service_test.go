@@ -0,0 +1,210 @@
+package postsocket_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mami-project/postsocket"
+)
+
+// stubResolver answers lookups from fixed records, counting the SRV
+// lookups made.
+type stubResolver struct {
+	ips     []net.IP
+	port    int
+	srvs    []*net.SRV
+	srvErr  error
+	svcb    []postsocket.SVCBRecord
+	svcbErr error
+	srvHits int
+}
+
+func (r *stubResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r.ips, nil
+}
+
+func (r *stubResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return r.port, nil
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	r.srvHits++
+	return r.srvs, r.srvErr
+}
+
+func (r *stubResolver) LookupSVCB(ctx context.Context, service, host string) ([]postsocket.SVCBRecord, error) {
+	return r.svcb, r.svcbErr
+}
+
+func TestResolveService(t *testing.T) {
+	notFound := &net.DNSError{Err: "no such host", Name: "example.test", IsNotFound: true}
+	servFail := &net.DNSError{Err: "server failure", Name: "example.test", IsTemporary: true}
+	srvs := []*net.SRV{
+		{Target: "a.example.test.", Port: 8001, Priority: 10},
+		{Target: "b.example.test.", Port: 8002, Priority: 20},
+	}
+	fromSRV := []postsocket.ServiceCandidate{
+		{Target: "a.example.test", Port: 8001},
+		{Target: "b.example.test", Port: 8002},
+	}
+	fromHost := []postsocket.ServiceCandidate{{Target: "example.test", Port: 443}}
+
+	tests := []struct {
+		name     string
+		r        *stubResolver
+		want     []postsocket.ServiceCandidate
+		notAvail bool
+		srvHits  int
+	}{
+		{
+			name: "SVCB",
+			r: &stubResolver{port: 443, svcb: []postsocket.SVCBRecord{
+				{Priority: 1, Target: ".", ALPN: []string{"h3", "h2"},
+					IPv4Hints: []net.IP{net.IPv4(192, 0, 2, 1)}, IPv6Hints: []net.IP{net.ParseIP("2001:db8::1")}},
+				{Priority: 2, Target: "alt.example.test", Port: 8443},
+			}},
+			want: []postsocket.ServiceCandidate{
+				{Target: "example.test", Port: 443, ALPN: []string{"h3", "h2"},
+					Hints: []net.IP{net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)}},
+				{Target: "alt.example.test", Port: 8443},
+			},
+		},
+		{
+			name:     "SVCB alias to root",
+			r:        &stubResolver{port: 443, svcb: []postsocket.SVCBRecord{{}}, srvs: srvs},
+			notAvail: true,
+		},
+		{
+			name:    "SVCB failure falls back to SRV",
+			r:       &stubResolver{port: 443, svcbErr: servFail, srvs: srvs},
+			want:    fromSRV,
+			srvHits: 1,
+		},
+		{
+			name:    "no SVCB records",
+			r:       &stubResolver{port: 443, svcbErr: notFound, srvs: srvs},
+			want:    fromSRV,
+			srvHits: 1,
+		},
+		{
+			name:     "SRV target root",
+			r:        &stubResolver{port: 443, svcbErr: notFound, srvs: []*net.SRV{{Target: "."}}},
+			notAvail: true,
+			srvHits:  1,
+		},
+		{
+			name:    "no SRV records",
+			r:       &stubResolver{port: 443, svcbErr: notFound, srvErr: notFound},
+			want:    fromHost,
+			srvHits: 1,
+		},
+	}
+	for _, test := range tests {
+		cands, err := postsocket.ResolveService(context.Background(), test.r, "https", "tcp", "example.test")
+		var dnsErr *net.DNSError
+		switch {
+		case test.notAvail:
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Errorf("%s: returned %v, %v; want a not-found DNSError", test.name, cands, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case !reflect.DeepEqual(cands, test.want):
+			t.Errorf("%s: returned %+v, want %+v", test.name, cands, test.want)
+		}
+		if test.r.srvHits != test.srvHits {
+			t.Errorf("%s: %d SRV lookups, want %d", test.name, test.r.srvHits, test.srvHits)
+		}
+	}
+
+	// An SRV server failure is an error, but a plain Resolver needs no
+	// records at all.
+	r := &stubResolver{port: 443, svcbErr: notFound, srvErr: servFail}
+	if _, err := postsocket.ResolveService(context.Background(), r, "https", "tcp", "example.test"); err != servFail {
+		t.Errorf("SRV server failure returned %v, want %v", err, servFail)
+	}
+	plain := struct{ postsocket.Resolver }{r}
+	cands, err := postsocket.ResolveService(context.Background(), plain, "https", "tcp", "example.test")
+	if err != nil || !reflect.DeepEqual(cands, fromHost) {
+		t.Errorf("plain Resolver returned %+v, %v; want %+v", cands, err, fromHost)
+	}
+}
+
+func TestOrderServiceCandidates(t *testing.T) {
+	h3 := postsocket.ServiceCandidate{Target: "h3", ALPN: []string{"h3"}}
+	h2 := postsocket.ServiceCandidate{Target: "h2", ALPN: []string{"h2", "http/1.1"}}
+	both := postsocket.ServiceCandidate{Target: "both", ALPN: []string{"h2", "h3-29"}}
+	none := postsocket.ServiceCandidate{Target: "none"}
+	cands := []postsocket.ServiceCandidate{none, h2, both, h3}
+
+	tests := []struct {
+		stacks []string
+		want   []string
+	}{
+		{[]string{"quic", "tls/tcp"}, []string{"both", "h3", "h2", "none"}},
+		{[]string{"tls/tcp", "quic"}, []string{"h2", "both", "h3", "none"}},
+		{[]string{"tls/tcp"}, []string{"h2", "both", "none"}},
+		{[]string{"quic"}, []string{"both", "h3", "none"}},
+		{nil, []string{"none"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, c := range postsocket.OrderServiceCandidates(cands, test.stacks) {
+			got = append(got, c.Target)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ordered for %v: %v, want %v", test.stacks, got, test.want)
+		}
+	}
+}
+
+func TestDNSResolverSRVWeights(t *testing.T) {
+	// Each record is identified by its port.
+	records := []struct{ priority, weight, port uint16 }{
+		{20, 50, 1},
+		{10, 0, 2},
+		{10, 90, 3},
+		{10, 10, 4},
+	}
+	s := newDNSServer(t, func(q dnsQuestion, tcp bool) []byte {
+		if q.typ != 33 {
+			return dnsMessage(q, 0)
+		}
+		var answers [][]byte
+		for _, rec := range records {
+			data := binary.BigEndian.AppendUint16(nil, rec.priority)
+			data = binary.BigEndian.AppendUint16(data, rec.weight)
+			data = binary.BigEndian.AppendUint16(data, rec.port)
+			answers = append(answers, dnsAnswer(dnsQName, 33, 60, append(data, dnsQName...)))
+		}
+		return dnsMessage(q, 0, answers...)
+	})
+	r := testResolver(s)
+
+	const lookups = 200
+	first := make(map[uint16]int)
+	for i := 0; i < lookups; i++ {
+		srvs, err := r.LookupSRV(context.Background(), "x", "tcp", "example.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs) != len(records) {
+			t.Fatalf("LookupSRV returned %d records, want %d", len(srvs), len(records))
+		}
+		for j := 1; j < len(srvs); j++ {
+			if srvs[j].Priority < srvs[j-1].Priority {
+				t.Fatalf("LookupSRV returned priority %d after %d", srvs[j].Priority, srvs[j-1].Priority)
+			}
+		}
+		first[srvs[0].Port]++
+	}
+	// The record of weight 90 is selected first about nine times in ten,
+	// and that of weight 10 about once in ten.
+	if first[3] < lookups*3/4 || first[4] == 0 || first[3]+first[4]+first[2] != lookups {
+		t.Errorf("first records by port over %d lookups: %v", lookups, first)
+	}
+}
@@ -0,0 +1,205 @@
+package sim
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+// Clock is a virtual postsocket.Clock. Its time only moves when it runs
+// scheduled calls: each call runs at exactly the time it was scheduled
+// for, and calls scheduled for the same time run in the order they were
+// scheduled, so a simulation driven by a Clock is deterministic. Calls run
+// in the goroutine driving the Clock, through Step, Run, RunFor, or the
+// background driver started by Start. Clock methods may be called
+// concurrently.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers timerHeap
+	wake   chan struct{} // signaled when a timer is added
+}
+
+// NewClock creates a new Clock whose time starts at the given time.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start, wake: make(chan struct{}, 1)}
+}
+
+// Now implements postsocket.Clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc implements postsocket.Clock. The call is made by whichever
+// goroutine drives the Clock once virtual time reaches now plus d.
+func (c *Clock) AfterFunc(d time.Duration, f func()) postsocket.Timer {
+	if d < 0 {
+		d = 0
+	}
+	c.mu.Lock()
+	t := &timer{c: c, when: c.now.Add(d), seq: c.seq, f: f}
+	c.seq++
+	heap.Push(&c.timers, t)
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return t
+}
+
+// Pending returns the number of calls scheduled and not yet run.
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// next removes and returns the earliest scheduled call if it is due no
+// later than limit, advancing time to it.
+func (c *Clock) next(limit time.Time) *timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 || c.timers[0].when.After(limit) {
+		return nil
+	}
+	t := heap.Pop(&c.timers).(*timer)
+	if t.when.After(c.now) {
+		c.now = t.when
+	}
+	return t
+}
+
+// Step runs the earliest scheduled call, advancing time to it, and returns
+// false if there was none.
+func (c *Clock) Step() bool {
+	t := c.next(maxTime)
+	if t == nil {
+		return false
+	}
+	t.f()
+	return true
+}
+
+// Run runs scheduled calls, including calls they schedule in turn, until
+// none remain.
+func (c *Clock) Run() {
+	for c.Step() {
+	}
+}
+
+// RunFor runs the calls scheduled within d of the current time, including
+// calls they schedule in turn, then advances time by d.
+func (c *Clock) RunFor(d time.Duration) {
+	end := c.Now().Add(d)
+	for {
+		t := c.next(end)
+		if t == nil {
+			break
+		}
+		t.f()
+	}
+	c.mu.Lock()
+	if end.After(c.now) {
+		c.now = end
+	}
+	c.mu.Unlock()
+}
+
+// Start drives the Clock from a background goroutine, running each call as
+// soon as it is scheduled and jumping time forward to it, until the
+// returned function is called. This lets code outside the simulation, such
+// as blocking API calls and tests waiting in real time, interact with it;
+// virtual time then races ahead of real time whenever the simulation is
+// waiting only on itself.
+func (c *Clock) Start() (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			if c.Step() {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				continue
+			}
+			select {
+			case <-c.wake:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+var maxTime = time.Unix(1<<62, 0)
+
+// timer is a call scheduled on a Clock.
+type timer struct {
+	c     *Clock
+	when  time.Time
+	seq   uint64
+	f     func()
+	index int // in the heap, or -1 once removed
+}
+
+// Stop implements postsocket.Timer.
+func (t *timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.c.timers, t.index)
+	return true
+}
+
+// timerHeap orders timers by time, then by order of scheduling.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].when.Equal(h[j].when) {
+		return h[i].when.Before(h[j].when)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
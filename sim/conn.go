@@ -0,0 +1,704 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+// stackName is the name of the simulated protocol stack.
+const stackName = "sim"
+
+// connState is the state of a simulated Connection.
+type connState int
+
+const (
+	stateConnecting connState = iota
+	stateListening
+	stateReady
+	stateClosed
+)
+
+// message implements postsocket.Message.
+type message struct {
+	data    []byte
+	partial bool
+	offset  int
+	more    bool
+}
+
+// Bytes implements postsocket.Message.
+func (m *message) Bytes() []byte {
+	return m.data
+}
+
+// Partial implements postsocket.Message.
+func (m *message) Partial() (bool, int, bool) {
+	return m.partial, m.offset, m.more
+}
+
+// outMessage is a Message sent and not yet departed.
+type outMessage struct {
+	data   []byte
+	msgref interface{}
+	expiry postsocket.Timer // nil without a lifetime
+}
+
+// conn is a simulated Connection. Every event occurs in a call scheduled
+// on the Network's Clock, never during a call into the Connection; each
+// call checks the Connection's state anew, so that no event follows
+// Closed.
+type conn struct {
+	ctx   *Context
+	self  postsocket.Connection // conn with the Context's interceptors applied
+	id    uint64
+	group uint64
+	trace *postsocket.ConnectionTrace
+
+	// capture is the context's PacketCapture when the Connection was
+	// created, or nil.
+	capture *postsocket.PacketCapture
+
+	mu         sync.Mutex
+	state      connState
+	closing    bool // Close called; Closed once all Messages depart
+	waiting    bool // rendezvousing, and the peer has not yet arrived
+	peerClosed bool // remote end closed; Closed once all Messages are received
+	evh        postsocket.EventHandler
+	fh         postsocket.FramingHandler
+	tp         *transportParameters
+	sp         *securityParameters
+	logger     *slog.Logger // context's logger
+	local      *endpoint
+	remote     *endpoint
+	listener   bool
+	peer       *conn
+	queued     []*outMessage // sent before Ready
+	unsent     []*outMessage // sent and not yet departed or expired
+	departure  time.Time     // when the link is next free
+	inbox      []*message
+	receivers  []func(msg postsocket.Message, conn postsocket.Connection)
+	stats      postsocket.StatsCounter
+}
+
+// schedule schedules a call on the Network's Clock.
+func (c *conn) schedule(d time.Duration, f func()) {
+	c.ctx.n.clock.AfterFunc(d, f)
+}
+
+// connecting returns true if the Connection is still being established.
+func (c *conn) connecting() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state == stateConnecting
+}
+
+// bind sets the local endpoint, assigning an ephemeral port if it has none.
+func (c *conn) bind(ep endpoint) {
+	if ep.port == 0 {
+		ep.port = c.ctx.n.ephemeralPort(net.IP(ep.ip))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.local = &ep
+}
+
+// fail closes a Connection that could not be established with the given
+// error, once the call creating it has returned.
+func (c *conn) fail(err error) {
+	c.ctx.n.clock.AfterFunc(0, func() {
+		c.closeWith(err, false)
+	})
+}
+
+// listen makes this a listening Connection bound to ep.
+func (c *conn) listen(ep endpoint) error {
+	c.bind(ep)
+	c.mu.Lock()
+	ep = *c.local
+	c.state = stateListening
+	c.listener = true
+	c.mu.Unlock()
+	return c.ctx.n.listen(ep, c)
+}
+
+// connect races the candidate remote endpoints, one at a time in order.
+func (c *conn) connect(cands []endpoint) {
+	latency, _, _ := c.ctx.n.properties()
+	c.mu.Lock()
+	local := *c.local
+	c.mu.Unlock()
+
+	cand := cands[0]
+	start := c.ctx.n.clock.Now()
+	c.trace.CandidateStarted(stackName, local.addr(), cand.addr())
+	c.schedule(latency, func() {
+		if !c.connecting() {
+			return
+		}
+		l := c.ctx.n.listener(cand)
+		if l == nil {
+			c.schedule(latency, func() {
+				c.trace.CandidateFailed(stackName, local.addr(), cand.addr(), errRefused)
+				c.ctx.metrics.Race(stackName, postsocket.RaceFailed)
+				if len(cands) > 1 {
+					if c.connecting() {
+						c.connect(cands[1:])
+					}
+					return
+				}
+				c.closeWith(errRefused, false)
+			})
+			return
+		}
+
+		c.mu.Lock()
+		c.remote = &cand
+		c.mu.Unlock()
+		if !l.accept(c) {
+			c.schedule(latency, func() {
+				c.closeWith(errRefused, false)
+			})
+			return
+		}
+		c.schedule(latency, func() {
+			c.trace.CandidateWon(stackName, local.addr(), cand.addr())
+			c.ctx.metrics.Race(stackName, postsocket.RaceWon)
+			c.ctx.metrics.Handshake(stackName, c.ctx.n.clock.Now().Sub(start))
+			c.ready(nil)
+		})
+	})
+}
+
+// accept creates the Connection accepting a connection from peer on this
+// listening Connection, makes it Ready, and returns false if this is no
+// longer listening.
+func (c *conn) accept(peer *conn) bool {
+	c.mu.Lock()
+	if c.state != stateListening || c.closing {
+		c.mu.Unlock()
+		return false
+	}
+	local, fh, tp, sp := *c.local, c.fh, c.tp.clone(), c.sp.clone()
+	c.mu.Unlock()
+
+	peer.mu.Lock()
+	remote := *peer.local
+	peer.mu.Unlock()
+
+	s := c.ctx.newConn(c.self.GetEventHandler(), fh, tp, sp, 0)
+	s.mu.Lock()
+	s.local = &local
+	s.remote = &remote
+	s.peer = peer
+	s.mu.Unlock()
+
+	peer.mu.Lock()
+	peer.peer = s
+	peer.mu.Unlock()
+
+	s.ready(c)
+	return true
+}
+
+// rendezvous waits for a Connection from remote to this Connection's local
+// endpoint, and makes both Ready once it arrives.
+func (c *conn) rendezvous(remote endpoint) {
+	// Hold the lock while meeting, so that a peer arriving at once sees
+	// this Connection waiting.
+	c.mu.Lock()
+	c.remote = &remote
+	peer := c.ctx.n.meet(*c.local, remote, c)
+	if peer == nil {
+		c.waiting = true
+		c.mu.Unlock()
+		return
+	}
+	c.peer = peer
+	c.mu.Unlock()
+
+	peer.mu.Lock()
+	peer.peer = c
+	peer.waiting = false
+	peer.mu.Unlock()
+
+	latency, _, _ := c.ctx.n.properties()
+	c.schedule(latency, func() {
+		c.ready(nil)
+		peer.ready(nil)
+	})
+}
+
+// ready makes a Connection ready, sending any Messages sent before, and
+// delivers its Ready event with the given antecedent.
+func (c *conn) ready(ante *conn) {
+	c.mu.Lock()
+	if c.state != stateConnecting {
+		c.mu.Unlock()
+		return
+	}
+	c.state = stateReady
+	queued := c.queued
+	c.queued = nil
+	evh := c.evh
+	latency, bandwidth, _ := c.ctx.n.properties()
+	c.mu.Unlock()
+
+	c.ctx.metrics.ConnectionOpened(stackName)
+	c.stats.UpdatePath(2*latency, 0, 0, uint64(bandwidth/8))
+	c.Logger().Debug("connection ready")
+	for _, m := range queued {
+		c.transmit(m)
+	}
+
+	var anteConn postsocket.Connection
+	if ante != nil {
+		anteConn = ante.self
+	}
+	if evh != nil {
+		evh.Ready(c.self, anteConn)
+	}
+	c.dispatch()
+	c.finishClose()
+}
+
+// frame converts a Message passed to Send to bytes.
+func (c *conn) frame(msg interface{}) ([]byte, error) {
+	switch m := msg.(type) {
+	case []byte:
+		return append([]byte(nil), m...), nil
+	case postsocket.Message:
+		return append([]byte(nil), m.Bytes()...), nil
+	}
+	c.mu.Lock()
+	fh := c.fh
+	c.mu.Unlock()
+	if fh == nil {
+		return nil, fmt.Errorf("sim: cannot send %T without a FramingHandler", msg)
+	}
+	return fh.Frame(msg)
+}
+
+// Send implements postsocket.Connection. The Message departs once the link
+// has sent every Message before it, unless its lifetime ends first.
+func (c *conn) Send(msg interface{}, msgref interface{}, sp postsocket.SendParameters) error {
+	data, err := c.frame(msg)
+	if err != nil {
+		return err
+	}
+
+	m := &outMessage{data: data, msgref: msgref}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.listener:
+		return errors.New("sim: cannot send on a listening Connection")
+	case c.state == stateClosed || c.closing:
+		return postsocket.ErrClosed
+	}
+	if sp.Lifetime > 0 {
+		m.expiry = c.ctx.n.clock.AfterFunc(sp.Lifetime, func() { c.expire(m) })
+	}
+	c.unsent = append(c.unsent, m)
+	if c.state == stateReady {
+		c.mu.Unlock()
+		c.transmit(m)
+		c.mu.Lock()
+	} else {
+		c.queued = append(c.queued, m)
+	}
+	return nil
+}
+
+// take removes m from the unsent Messages, and returns false if it was
+// not there because it has already departed or expired.
+func (c *conn) take(m *outMessage) bool {
+	for i, u := range c.unsent {
+		if u == m {
+			c.unsent = append(c.unsent[:i], c.unsent[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// transmit schedules the departure of a Message once the link has sent all
+// Messages before it, and its arrival at the peer after the latency.
+func (c *conn) transmit(m *outMessage) {
+	latency, bandwidth, _ := c.ctx.n.properties()
+	now := c.ctx.n.clock.Now()
+
+	c.mu.Lock()
+	if c.departure.Before(now) {
+		c.departure = now
+	}
+	if bandwidth > 0 {
+		c.departure = c.departure.Add(time.Duration(int64(len(m.data)) * 8 * int64(time.Second) / bandwidth))
+	}
+	delay := c.departure.Sub(now)
+	c.mu.Unlock()
+
+	c.schedule(delay, func() {
+		c.mu.Lock()
+		if !c.take(m) {
+			c.mu.Unlock()
+			return
+		}
+		if m.expiry != nil {
+			m.expiry.Stop()
+		}
+		peer, evh := c.peer, c.evh
+		c.mu.Unlock()
+
+		c.stats.Sent(len(m.data))
+		c.trace.MessageSent(m.msgref, len(m.data))
+		c.capturePacket(true, m.data)
+		if evh != nil {
+			evh.Sent(c.self, m.msgref)
+		}
+		if peer != nil {
+			c.schedule(latency, func() { peer.arrive(m.data) })
+		}
+		c.finishClose()
+	})
+}
+
+// expire expires a Message whose lifetime ended before it departed.
+func (c *conn) expire(m *outMessage) {
+	c.mu.Lock()
+	if !c.take(m) {
+		c.mu.Unlock()
+		return
+	}
+	evh := c.evh
+	c.mu.Unlock()
+
+	c.stats.Expired()
+	c.trace.MessageExpired(m.msgref)
+	if evh != nil {
+		evh.Expired(c.self, m.msgref)
+	}
+	c.finishClose()
+}
+
+// arrive receives the data of a Message from the peer, split into partial
+// Messages if it exceeds the Network's maximum message size.
+func (c *conn) arrive(data []byte) {
+	_, _, maxMsg := c.ctx.n.properties()
+
+	// The state is checked and the data queued under one lock, so that
+	// nothing arrives once the Connection has closed; the capture takes
+	// the lock itself, so comes after.
+	c.mu.Lock()
+	if c.state == stateClosed {
+		c.mu.Unlock()
+		return
+	}
+	if maxMsg <= 0 || len(data) <= maxMsg {
+		c.inbox = append(c.inbox, &message{data: data})
+	} else {
+		for off := 0; off < len(data); off += maxMsg {
+			end := off + maxMsg
+			if end > len(data) {
+				end = len(data)
+			}
+			c.inbox = append(c.inbox, &message{
+				data:    data[off:end],
+				partial: true,
+				offset:  off,
+				more:    end < len(data),
+			})
+		}
+	}
+	c.mu.Unlock()
+	c.capturePacket(false, data)
+	c.dispatch()
+}
+
+// capturePacket captures the data of a Message departing or arriving.
+func (c *conn) capturePacket(outbound bool, data []byte) {
+	if c.capture != nil {
+		c.capture.Packet(c.LocalAddr(), c.RemoteAddr(), outbound, data)
+	}
+}
+
+// dispatch passes received Messages to pending Receive callbacks, in
+// order, and closes the Connection once its peer has closed and every
+// Message has been received.
+func (c *conn) dispatch() {
+	for {
+		c.mu.Lock()
+		if c.state != stateReady {
+			c.mu.Unlock()
+			return
+		}
+		if len(c.inbox) == 0 {
+			peerClosed := c.peerClosed
+			c.mu.Unlock()
+			if peerClosed {
+				c.closeWith(nil, false)
+			}
+			return
+		}
+		if len(c.receivers) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		msg, receiver := c.inbox[0], c.receivers[0]
+		c.inbox, c.receivers = c.inbox[1:], c.receivers[1:]
+		c.mu.Unlock()
+
+		c.stats.Received(len(msg.data))
+		c.trace.MessageReceived(msg)
+		receiver(msg, c.self)
+	}
+}
+
+// Receive implements postsocket.Connection.
+func (c *conn) Receive(receiver func(msg postsocket.Message, conn postsocket.Connection)) {
+	c.mu.Lock()
+	c.receivers = append(c.receivers, receiver)
+	c.mu.Unlock()
+	c.schedule(0, c.dispatch)
+}
+
+// Clone implements postsocket.Connection, establishing a new Connection to
+// the same peer in the same group.
+func (c *conn) Clone() (postsocket.Connection, error) {
+	c.mu.Lock()
+	if c.state != stateReady || c.closing || c.peer == nil {
+		c.mu.Unlock()
+		return nil, errors.New("sim: cannot clone a Connection that is not established")
+	}
+	peer, remote, fh, tp, sp, group := c.peer, *c.remote, c.fh, c.tp.clone(), c.sp.clone(), c.group
+	local := newEndpoint(net.IP(c.local.ip), 0)
+	c.mu.Unlock()
+
+	cl := c.ctx.newConn(c.self.GetEventHandler(), fh, tp, sp, group)
+	cl.bind(local)
+	cl.mu.Lock()
+	cl.remote = &remote
+	cl.mu.Unlock()
+
+	latency, _, _ := c.ctx.n.properties()
+	c.schedule(latency, func() {
+		if !cl.connecting() {
+			return
+		}
+		peer.mu.Lock()
+		if peer.state != stateReady || peer.closing {
+			peer.mu.Unlock()
+			c.schedule(latency, func() { cl.closeWith(errRefused, false) })
+			return
+		}
+		plocal, pfh, ptp, psp, pgroup := *peer.local, peer.fh, peer.tp.clone(), peer.sp.clone(), peer.group
+		peer.mu.Unlock()
+
+		cl.mu.Lock()
+		clocal := *cl.local
+		cl.mu.Unlock()
+
+		s := peer.ctx.newConn(peer.self.GetEventHandler(), pfh, ptp, psp, pgroup)
+		s.mu.Lock()
+		s.local = &plocal
+		s.remote = &clocal
+		s.peer = cl
+		s.mu.Unlock()
+		cl.mu.Lock()
+		cl.peer = s
+		cl.mu.Unlock()
+
+		s.ready(peer)
+		c.schedule(latency, func() { cl.ready(c) })
+	})
+	return cl.self, nil
+}
+
+// Close implements postsocket.Connection. The Connection Closes once every
+// Message sent on it has departed or expired; the remote end Closes once
+// it has received every Message that arrived before the close.
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing || c.state == stateClosed {
+		return nil
+	}
+	c.closing = true
+	if c.listener {
+		c.ctx.n.unlisten(*c.local, c)
+	}
+	if c.waiting {
+		c.ctx.n.unmeet(*c.local, *c.remote, c)
+	}
+	c.schedule(0, func() {
+		// A Connection not yet established with nothing to send, or with
+		// no peer to come, is abandoned; otherwise it is established,
+		// sends, and then Closes.
+		c.mu.Lock()
+		abandon := c.state == stateConnecting && c.peer == nil && (len(c.unsent) == 0 || c.waiting)
+		c.mu.Unlock()
+		if abandon {
+			c.closeWith(nil, false)
+		} else {
+			c.finishClose()
+		}
+	})
+	return nil
+}
+
+// finishClose Closes a Connection being closed once all its Messages have
+// departed or expired.
+func (c *conn) finishClose() {
+	c.mu.Lock()
+	done := c.closing && c.state != stateConnecting && len(c.unsent) == 0
+	c.mu.Unlock()
+	if done {
+		c.closeWith(nil, true)
+	}
+}
+
+// closeWith Closes a Connection with the given error, failing any Messages
+// not yet departed, and if notify is set tells the peer after the latency.
+func (c *conn) closeWith(err error, notify bool) {
+	c.mu.Lock()
+	if c.state == stateClosed {
+		c.mu.Unlock()
+		return
+	}
+	if c.listener {
+		c.ctx.n.unlisten(*c.local, c)
+	}
+	opened := c.state == stateReady
+	c.state = stateClosed
+	unsent, peer, evh := c.unsent, c.peer, c.evh
+	c.unsent, c.queued, c.inbox, c.receivers = nil, nil, nil, nil
+	c.mu.Unlock()
+
+	failure := err
+	if failure == nil {
+		failure = postsocket.ErrClosed
+	}
+	for _, m := range unsent {
+		if m.expiry != nil {
+			m.expiry.Stop()
+		}
+		if evh != nil {
+			evh.Error(c.self, m.msgref, failure)
+		}
+	}
+	if err != nil {
+		c.Logger().Debug("connection failed", "err", err)
+	}
+
+	c.ctx.removeConn(c)
+	if opened {
+		c.ctx.metrics.ConnectionClosed(stackName)
+	}
+	c.trace.Closed(err)
+	if evh != nil {
+		evh.Closed(c.self, err)
+	}
+	if notify && peer != nil {
+		latency, _, _ := c.ctx.n.properties()
+		c.schedule(latency, peer.remoteClose)
+	}
+}
+
+// remoteClose handles the close of the remote end.
+func (c *conn) remoteClose() {
+	c.mu.Lock()
+	if c.state == stateClosed {
+		c.mu.Unlock()
+		return
+	}
+	c.peerClosed = true
+	c.mu.Unlock()
+	c.dispatch()
+}
+
+// GetEventHandler implements postsocket.Connection.
+func (c *conn) GetEventHandler() postsocket.EventHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evh
+}
+
+// SetEventHandler implements postsocket.Connection.
+func (c *conn) SetEventHandler(evh postsocket.EventHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evh = evh
+}
+
+// GetFramingHandler implements postsocket.Connection.
+func (c *conn) GetFramingHandler() postsocket.FramingHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fh
+}
+
+// SetFramingHandler implements postsocket.Connection.
+func (c *conn) SetFramingHandler(fh postsocket.FramingHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fh = fh
+}
+
+// GetTransportParameters implements postsocket.Connection.
+func (c *conn) GetTransportParameters() postsocket.TransportParameters {
+	return c.tp
+}
+
+// LocalAddr implements postsocket.Connection.
+func (c *conn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.local == nil {
+		return nil
+	}
+	return c.local.addr()
+}
+
+// RemoteAddr implements postsocket.Connection. Listening Connections have
+// no remote address.
+func (c *conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote == nil || c.listener {
+		return nil
+	}
+	return c.remote.addr()
+}
+
+// Stats implements postsocket.Connection.
+func (c *conn) Stats() (postsocket.ConnectionStats, error) {
+	return c.stats.Stats(), nil
+}
+
+// Info implements postsocket.Connection.
+func (c *conn) Info() postsocket.ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := postsocket.ConnectionInfo{
+		ID:              c.id,
+		Group:           c.group,
+		PendingReceives: len(c.receivers),
+	}
+	if c.peer != nil || c.listener {
+		info.Stack = stackName
+	}
+	return info
+}
+
+// Logger implements postsocket.Connection.
+func (c *conn) Logger() *slog.Logger {
+	c.mu.Lock()
+	l := c.logger
+	c.mu.Unlock()
+	return postsocket.ConnectionLogger(l, c.self)
+}
@@ -0,0 +1,503 @@
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+// Context is a simulated postsocket.TransportContext on a Network, at a
+// single address. All its Connections use the protocol stack named "sim",
+// which is fully reliable, order-preserving and message-oriented, and
+// secures nothing.
+type Context struct {
+	n *Network
+
+	mu      sync.Mutex
+	addr    net.IP
+	evh     postsocket.EventHandler
+	fh      postsocket.FramingHandler
+	ics     []postsocket.Interceptor
+	metrics *postsocket.Metrics
+	tracer  *postsocket.Tracer
+	capture *postsocket.PacketCapture
+	logger  *slog.Logger
+	cache   *postsocket.ResolutionCache
+	policy  *postsocket.Policy
+	ifType  postsocket.InterfaceType
+	conns   map[*conn]struct{}
+}
+
+// NewContext creates a new Context on this Network at the given address.
+// Connections from the Context are made from this address, and Locals
+// naming a loopback or unspecified address refer to it.
+func (n *Network) NewContext(addr net.IP) *Context {
+	cache := postsocket.NewResolutionCache(tableResolver{n})
+	cache.SetClock(n.clock)
+	return &Context{
+		n:       n,
+		addr:    addr,
+		metrics: postsocket.NewMetrics(),
+		cache:   cache,
+		ifType:  postsocket.InterfaceTypeEthernet,
+		conns:   make(map[*conn]struct{}),
+	}
+}
+
+// Addr returns the address of this Context on its Network.
+func (ctx *Context) Addr() net.IP {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.addr
+}
+
+// Interfaces returns the simulated interfaces of this Context: "lo", the
+// loopback interface, and "sim0", holding its address on the Network.
+// Locals given either, or an alias expanding to them, use that address.
+func (ctx *Context) Interfaces() []postsocket.Interface {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return []postsocket.Interface{
+		{
+			Interface: net.Interface{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			Addrs:     []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+			Type:      postsocket.InterfaceTypeLoopback,
+		},
+		{
+			Interface: net.Interface{Index: 2, Name: "sim0", Flags: net.FlagUp | net.FlagMulticast},
+			Addrs:     []net.IP{ctx.addr},
+			Type:      ctx.ifType,
+		},
+	}
+}
+
+// SetInterfaceType sets the type of the "sim0" interface, which is
+// InterfaceTypeEthernet by default, for the TransportInterfaceType
+// parameter to select by.
+func (ctx *Context) SetInterfaceType(t postsocket.InterfaceType) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.ifType = t
+}
+
+// Network returns the Network this Context is on.
+func (ctx *Context) Network() *Network {
+	return ctx.n
+}
+
+// NewTransportParameters implements postsocket.TransportContext. The only
+// defaults are those of the Context's Policy, if any.
+func (ctx *Context) NewTransportParameters() postsocket.TransportParameters {
+	var tp postsocket.TransportParameters = newTransportParameters()
+	if p := ctx.getPolicy(); p != nil {
+		tp = p.TransportParameters(tp)
+	}
+	return tp
+}
+
+// NewSecurityParameters implements postsocket.TransportContext. The only
+// defaults are those of the Context's Policy, if any.
+func (ctx *Context) NewSecurityParameters() postsocket.SecurityParameters {
+	var sp postsocket.SecurityParameters = newSecurityParameters()
+	if p := ctx.getPolicy(); p != nil {
+		sp = p.SecurityParameters(sp)
+	}
+	return sp
+}
+
+// LoadPolicy implements postsocket.TransportContext. Destination policies
+// apply to the transport and security parameters of Connections
+// initiated, and may select their local interface.
+func (ctx *Context) LoadPolicy(filename string) error {
+	p, err := postsocket.LoadPolicy(filename)
+	if err != nil {
+		return err
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.policy = p
+	return nil
+}
+
+func (ctx *Context) getPolicy() *postsocket.Policy {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.policy
+}
+
+// destinationParameters returns tp and sp with the overrides of the
+// Context's Policy for the hostnames and candidate endpoints of a Remote
+// applied.
+func (ctx *Context) destinationParameters(tp *transportParameters, sp *securityParameters, hostnames []string, cands []endpoint) (*transportParameters, *securityParameters) {
+	p := ctx.getPolicy()
+	if p == nil {
+		return tp, sp
+	}
+	addrs := make([]net.IP, len(cands))
+	for i, ep := range cands {
+		addrs[i] = net.IP(ep.ip)
+	}
+	if len(hostnames) == 0 {
+		hostnames = []string{""}
+	}
+	var ptp postsocket.TransportParameters = tp
+	var psp postsocket.SecurityParameters = sp
+	for _, h := range hostnames {
+		ptp, psp = p.ForDestination(h, addrs, ptp, psp)
+	}
+	return ptp.(*transportParameters), psp.(*securityParameters)
+}
+
+// NewRemote implements postsocket.TransportContext.
+func (ctx *Context) NewRemote() postsocket.Remote {
+	return &remote{}
+}
+
+// NewLocal implements postsocket.TransportContext. Locals may name an
+// interface of the Context, its address, or a loopback or unspecified
+// address.
+func (ctx *Context) NewLocal() postsocket.Local {
+	return &local{}
+}
+
+// DefaultSendParameters implements postsocket.TransportContext: Messages
+// are sent in order by default.
+func (ctx *Context) DefaultSendParameters() postsocket.SendParameters {
+	return postsocket.SendParameters{Ordered: true}
+}
+
+// SetEventHandler implements postsocket.TransportContext.
+func (ctx *Context) SetEventHandler(evh postsocket.EventHandler) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.evh = evh
+}
+
+// SetFramingHandler implements postsocket.TransportContext.
+func (ctx *Context) SetFramingHandler(fh postsocket.FramingHandler) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.fh = fh
+}
+
+// Preconnect implements postsocket.TransportContext. Nil handlers default
+// to those set on the Context.
+func (ctx *Context) Preconnect(evh postsocket.EventHandler, fh postsocket.FramingHandler, rem postsocket.Remote, loc postsocket.Local, tp postsocket.TransportParameters, sp postsocket.SecurityParameters) (postsocket.Preconnection, error) {
+	ctx.mu.Lock()
+	if evh == nil {
+		evh = ctx.evh
+	}
+	if fh == nil {
+		fh = ctx.fh
+	}
+	ctx.mu.Unlock()
+
+	pc := &preconnection{ctx: ctx, evh: evh, fh: fh}
+	pc.AddSpecifier(rem, loc, tp, sp)
+	return pc, nil
+}
+
+// Initiate implements postsocket.TransportContext.
+func (ctx *Context) Initiate(rem postsocket.Remote, loc postsocket.Local, tp postsocket.TransportParameters, sp postsocket.SecurityParameters) (postsocket.Connection, error) {
+	pc, err := ctx.Preconnect(nil, nil, rem, loc, tp, sp)
+	if err != nil {
+		return nil, err
+	}
+	return pc.Initiate()
+}
+
+// Rendezvous implements postsocket.TransportContext.
+func (ctx *Context) Rendezvous(evh postsocket.EventHandler, rem postsocket.Remote, loc postsocket.Local, tp postsocket.TransportParameters, sp postsocket.SecurityParameters) (postsocket.Connection, error) {
+	pc, err := ctx.Preconnect(evh, nil, rem, loc, tp, sp)
+	if err != nil {
+		return nil, err
+	}
+	return pc.Rendezvous()
+}
+
+// Listen implements postsocket.TransportContext.
+func (ctx *Context) Listen(evh postsocket.EventHandler, loc postsocket.Local, tp postsocket.TransportParameters, sp postsocket.SecurityParameters) (postsocket.Connection, error) {
+	pc, err := ctx.Preconnect(evh, nil, nil, loc, tp, sp)
+	if err != nil {
+		return nil, err
+	}
+	return pc.Listen()
+}
+
+// Adopt implements postsocket.TransportContext. There are no sockets on a
+// simulated Network, so it always returns an error.
+func (ctx *Context) Adopt(evh postsocket.EventHandler, fh postsocket.FramingHandler, sock interface{}) (postsocket.Connection, error) {
+	return nil, errors.New("sim: cannot adopt sockets into a simulated network")
+}
+
+// Intercept implements postsocket.TransportContext.
+func (ctx *Context) Intercept(ics ...postsocket.Interceptor) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.ics = append(ctx.ics, ics...)
+}
+
+// Metrics implements postsocket.TransportContext.
+func (ctx *Context) Metrics() *postsocket.Metrics {
+	return ctx.metrics
+}
+
+// SetTracer implements postsocket.TransportContext. The Tracer's clock is
+// set to the Network's Clock, replacing any Clock set before: a Tracer
+// shared with contexts outside this Network timestamps their events in this
+// Network's virtual time too, so give each Network its own Tracer.
+func (ctx *Context) SetTracer(t *postsocket.Tracer) {
+	if t != nil {
+		t.SetClock(ctx.n.clock)
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.tracer = t
+}
+
+// SetPacketCapture implements postsocket.TransportContext, capturing each
+// Message sent or received as a single packet. The PacketCapture's clock is
+// set to the Network's Clock, replacing any Clock set before, as for
+// SetTracer.
+func (ctx *Context) SetPacketCapture(c *postsocket.PacketCapture) {
+	if c != nil {
+		c.SetClock(ctx.n.clock)
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.capture = c
+}
+
+// SetLogger implements postsocket.TransportContext.
+func (ctx *Context) SetLogger(l *slog.Logger) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.logger = l
+}
+
+// SetResolver implements postsocket.TransportContext. By default, a Context
+// resolves hostnames and service names from the tables of its Network;
+// once a Resolver is set, it resolves them through the Resolver instead.
+// Passing nil restores the default.
+func (ctx *Context) SetResolver(r postsocket.Resolver) {
+	if r == nil {
+		r = tableResolver{ctx.n}
+	}
+	ctx.cache.SetResolver(r)
+}
+
+// ResolutionCache implements postsocket.TransportContext. Answers from the
+// tables of the Network, which give no time to live, are cached for
+// postsocket.DefaultResolutionTTL of simulated time.
+func (ctx *Context) ResolutionCache() *postsocket.ResolutionCache {
+	return ctx.cache
+}
+
+func (ctx *Context) resolver() postsocket.Resolver {
+	return ctx.cache
+}
+
+// Connections implements postsocket.TransportContext, returning
+// Connections in order of creation.
+func (ctx *Context) Connections() []postsocket.Connection {
+	ctx.mu.Lock()
+	cs := make([]*conn, 0, len(ctx.conns))
+	for c := range ctx.conns {
+		cs = append(cs, c)
+	}
+	ctx.mu.Unlock()
+
+	sort.Slice(cs, func(i, j int) bool { return cs[i].id < cs[j].id })
+	conns := make([]postsocket.Connection, len(cs))
+	for i, c := range cs {
+		conns[i] = c.self
+	}
+	return conns
+}
+
+// SetClock implements postsocket.TransportContext. A Context always runs on
+// the Clock of its Network, so SetClock does nothing: any other Clock,
+// such as postsocket.SystemClock, is ignored, as the TransportContext
+// interface allows for contexts whose timing is fixed.
+func (ctx *Context) SetClock(c postsocket.Clock) {}
+
+// savedContext is the state of a Context written by Save.
+type savedContext struct {
+	Address net.IP                      `json:"address"`
+	Cache   *postsocket.ResolutionCache `json:"resolution_cache"`
+}
+
+// Save implements postsocket.TransportContext, saving the Context's
+// address and ResolutionCache.
+func (ctx *Context) Save(filename string) error {
+	b, err := json.Marshal(savedContext{Address: ctx.Addr(), Cache: ctx.cache})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
+
+// Restore implements postsocket.TransportContext, restoring the Context's
+// address and ResolutionCache.
+func (ctx *Context) Restore(filename string) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var saved struct {
+		Address net.IP          `json:"address"`
+		Cache   json.RawMessage `json:"resolution_cache"`
+	}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("sim: cannot restore %s: %v", filename, err)
+	}
+	if saved.Address == nil {
+		return fmt.Errorf("sim: cannot restore %s: no address", filename)
+	}
+	if saved.Cache != nil {
+		if err := ctx.cache.UnmarshalJSON(saved.Cache); err != nil {
+			return fmt.Errorf("sim: cannot restore %s: %v", filename, err)
+		}
+	} else {
+		ctx.cache.Flush()
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.addr = saved.Address
+	return nil
+}
+
+// newConn creates a Connection in this Context, with the Context's
+// interceptors and Metrics applied, and registers it as live.
+func (ctx *Context) newConn(evh postsocket.EventHandler, fh postsocket.FramingHandler, tp *transportParameters, sp *securityParameters, group uint64) *conn {
+	id := ctx.n.newID()
+	if group == 0 {
+		group = id
+	}
+
+	ctx.mu.Lock()
+	tracer, capture, logger := ctx.tracer, ctx.capture, ctx.logger
+	ics := append(append([]postsocket.Interceptor(nil), ctx.ics...), ctx.metrics.Interceptor())
+	ctx.mu.Unlock()
+
+	c := &conn{
+		ctx:     ctx,
+		id:      id,
+		group:   group,
+		evh:     evh,
+		fh:      fh,
+		tp:      tp,
+		sp:      sp,
+		trace:   tracer.Connection(id),
+		capture: capture,
+		logger:  logger,
+	}
+	c.self = postsocket.InterceptConnection(c, postsocket.ChainInterceptors(ics...))
+
+	ctx.mu.Lock()
+	ctx.conns[c] = struct{}{}
+	ctx.mu.Unlock()
+	return c
+}
+
+// removeConn unregisters a Connection once it has Closed.
+func (ctx *Context) removeConn(c *conn) {
+	ctx.mu.Lock()
+	delete(ctx.conns, c)
+	ctx.mu.Unlock()
+}
+
+// localEndpoints resolves a Local to the endpoints it denotes in this
+// Context, on the interfaces it names and those the TransportInterfaceType
+// preference of tp selects, mapping loopback and unspecified addresses to
+// the Context's own address.
+func (ctx *Context) localEndpoints(loc *local, tp *transportParameters, trace func(string, []net.IP, error)) ([]endpoint, error) {
+	addr := ctx.Addr()
+	var s specifier
+	if loc != nil {
+		s = loc.specifier
+	}
+	var cands []postsocket.LocalCandidate
+	if len(s.interfaces) > 0 {
+		var aliases map[string][]string
+		if p := ctx.getPolicy(); p != nil {
+			aliases = p.Interfaces
+		}
+		for _, name := range s.interfaces {
+			c, err := postsocket.ExpandInterface(ctx.Interfaces(), name, aliases)
+			if err != nil {
+				return nil, err
+			}
+			cands = append(cands, c...)
+		}
+	} else if pref, _ := tp.Preference(postsocket.TransportInterfaceType); pref != postsocket.PrefIgnore {
+		for _, ifi := range ctx.Interfaces() {
+			c, _ := postsocket.ExpandInterface([]postsocket.Interface{ifi}, ifi.Name, nil)
+			cands = append(cands, c...)
+		}
+	}
+	if cands != nil {
+		var err error
+		if cands, err = postsocket.SelectLocalCandidates(cands, tp); err != nil {
+			return nil, err
+		}
+		if len(s.interfaces) > 0 && len(s.hostnames) == 0 && len(s.addresses) == 0 {
+			s = s.clone()
+			for _, c := range cands {
+				s.addresses = append(s.addresses, c.IP)
+			}
+		}
+	}
+	eps, err := ctx.n.resolve(ctx.resolver(), s, addr, trace)
+	if err != nil {
+		return nil, err
+	}
+	if cands != nil {
+		eps = onInterfaces(eps, cands)
+		if len(eps) == 0 {
+			return nil, fmt.Errorf("sim: no address of the Local is on the selected interfaces")
+		}
+	}
+	for i, ep := range eps {
+		ip := net.IP(ep.ip)
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			eps[i] = newEndpoint(addr, ep.port)
+		} else if !ip.Equal(addr) {
+			return nil, fmt.Errorf("sim: cannot use address %v from context at %v", ip, addr)
+		}
+	}
+	return eps, nil
+}
+
+// onInterfaces returns the endpoints whose addresses are among those of
+// candidates, or of the family of an unspecified candidate address, in the
+// order of the candidates.
+func onInterfaces(eps []endpoint, cands []postsocket.LocalCandidate) []endpoint {
+	var on []endpoint
+	taken := make([]bool, len(eps))
+	for _, c := range cands {
+		for i, ep := range eps {
+			ip := net.IP(ep.ip)
+			if !taken[i] && (c.IP.Equal(ip) || c.IP.IsUnspecified() && (c.IP.To4() == nil) == (ip.To4() == nil)) {
+				taken[i] = true
+				on = append(on, ep)
+			}
+		}
+	}
+	return on
+}
+
+// handshakeLatency returns the time a Connection takes to become Ready
+// at the initiating end.
+func (ctx *Context) handshakeLatency() time.Duration {
+	latency, _, _ := ctx.n.properties()
+	return 2 * latency
+}
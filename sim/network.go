@@ -0,0 +1,362 @@
+// Package sim is an in-memory simulation of the postsocket API, driven by a
+// virtual Clock and a deterministic scheduler. A Network connects any number
+// of simulated TransportContexts, each with its own address; Connections
+// between them carry Messages with their boundaries preserved, after a
+// configurable latency and at a configurable bandwidth. All events and
+// Receive callbacks run as calls scheduled on the Network's Clock, so whole
+// multi-connection scenarios, including their timeouts and lifetimes, run
+// instantly and identically on every run.
+//
+// A typical test creates a Network, contexts on it, and Connections between
+// them, then calls Clock.Run to play the scenario out to completion. Tests
+// that use blocking APIs, or wait in real time, drive the Clock in the
+// background with Clock.Start instead.
+package sim
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+// Defaults for the properties of a Network.
+const (
+	DefaultLatency        = time.Millisecond
+	DefaultMaxMessageSize = 64 << 10
+)
+
+// errRefused is the error a Connection closes with if no candidate remote
+// endpoint is listening.
+var errRefused = fmt.Errorf("sim: no candidate endpoint accepted the connection: %w", syscall.ECONNREFUSED)
+
+// firstEphemeralPort is the first port assigned to unbound endpoints.
+const firstEphemeralPort = 49152
+
+// Addr is the address of an endpoint on a simulated Network.
+type Addr struct {
+	IP   net.IP
+	Port uint16
+}
+
+// Network implements net.Addr, returning "sim".
+func (a *Addr) Network() string {
+	return "sim"
+}
+
+// String implements net.Addr.
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
+}
+
+// endpoint is the comparable form of an Addr.
+type endpoint struct {
+	ip   string // 16-byte form
+	port uint16
+}
+
+func newEndpoint(ip net.IP, port uint16) endpoint {
+	return endpoint{string(ip.To16()), port}
+}
+
+func (ep endpoint) addr() *Addr {
+	return &Addr{IP: net.IP(ep.ip), Port: ep.port}
+}
+
+// rendezvousKey identifies a pending rendezvous by its local and remote
+// endpoints.
+type rendezvousKey struct {
+	local, remote endpoint
+}
+
+// Network is a simulated network connecting simulated TransportContexts.
+type Network struct {
+	clock *Clock
+
+	mu         sync.Mutex
+	latency    time.Duration
+	bandwidth  int64
+	maxMsg     int
+	hosts      map[string][]net.IP
+	services   map[string]uint16
+	listeners  map[endpoint]*conn
+	rendezvous map[rendezvousKey]*conn
+	nextPort   map[string]uint16
+	nextID     uint64
+}
+
+// NewNetwork creates a new Network driven by the given Clock, with the
+// default latency and maximum message size and unlimited bandwidth.
+func NewNetwork(clock *Clock) *Network {
+	return &Network{
+		clock:      clock,
+		latency:    DefaultLatency,
+		maxMsg:     DefaultMaxMessageSize,
+		hosts:      make(map[string][]net.IP),
+		services:   map[string]uint16{"http": 80, "https": 443},
+		listeners:  make(map[endpoint]*conn),
+		rendezvous: make(map[rendezvousKey]*conn),
+		nextPort:   make(map[string]uint16),
+	}
+}
+
+// Clock returns the Clock driving this Network.
+func (n *Network) Clock() *Clock {
+	return n.clock
+}
+
+// SetLatency sets the one-way latency between any two endpoints.
+func (n *Network) SetLatency(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = d
+}
+
+// SetBandwidth sets the bandwidth of each direction of each Connection in
+// bits per second. Zero means unlimited.
+func (n *Network) SetBandwidth(bps int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.bandwidth = bps
+}
+
+// SetMaxMessageSize sets the size above which Messages are received as
+// multiple partial Messages. Zero means Messages are never split.
+func (n *Network) SetMaxMessageSize(size int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.maxMsg = size
+}
+
+// AddHost adds addresses to which a hostname in a Remote resolves.
+func (n *Network) AddHost(hostname string, addrs ...net.IP) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hosts[hostname] = append(n.hosts[hostname], addrs...)
+}
+
+// AddService adds a port to which a service name in a Remote or Local
+// resolves. The services http and https are predefined.
+func (n *Network) AddService(name string, port uint16) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.services[name] = port
+}
+
+func (n *Network) newID() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nextID++
+	return n.nextID
+}
+
+func (n *Network) ephemeralPort(ip net.IP) uint16 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := string(ip.To16())
+	port, ok := n.nextPort[key]
+	if !ok {
+		port = firstEphemeralPort
+	}
+	n.nextPort[key] = port + 1
+	return port
+}
+
+// lookupHost resolves a hostname on this Network.
+func (n *Network) lookupHost(hostname string) ([]net.IP, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addrs, ok := n.hosts[hostname]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: hostname, IsNotFound: true}
+	}
+	return append([]net.IP(nil), addrs...), nil
+}
+
+// lookupService resolves a service name on this Network.
+func (n *Network) lookupService(svc string) (uint16, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	port, ok := n.services[svc]
+	if !ok {
+		return 0, fmt.Errorf("sim: unknown service %q", svc)
+	}
+	return port, nil
+}
+
+// tableResolver is a postsocket.Resolver resolving names from the tables
+// of a Network.
+type tableResolver struct {
+	n *Network
+}
+
+// LookupIP implements postsocket.Resolver.
+func (r tableResolver) LookupIP(_ context.Context, host string) ([]net.IP, error) {
+	return r.n.lookupHost(host)
+}
+
+// LookupPort implements postsocket.Resolver.
+func (r tableResolver) LookupPort(_ context.Context, _, service string) (int, error) {
+	port, err := r.n.lookupService(service)
+	return int(port), err
+}
+
+// resolve expands a specifier into the candidate endpoints it denotes, in
+// order, with defaultIP used if it gives no address or hostname. Names are
+// resolved through res.
+func (n *Network) resolve(res postsocket.Resolver, s specifier, defaultIP net.IP, trace func(name string, addrs []net.IP, err error)) ([]endpoint, error) {
+	// With both hostnames and services, the resolver may discover the
+	// endpoints of each service, which come first.
+	var eps []endpoint
+	if len(s.hostnames) > 0 && len(s.services) > 0 {
+		for _, h := range s.hostnames {
+			for _, svc := range s.services {
+				seps, err := resolveService(res, h, svc, trace)
+				if err != nil {
+					return nil, err
+				}
+				eps = append(eps, seps...)
+			}
+		}
+		for _, ip := range s.addresses {
+			for _, port := range s.ports {
+				eps = append(eps, newEndpoint(ip, port))
+			}
+		}
+		return eps, nil
+	}
+
+	var ips []net.IP
+	ips = append(ips, s.addresses...)
+	for _, h := range s.hostnames {
+		addrs, err := res.LookupIP(context.Background(), h)
+		trace(h, addrs, err)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, addrs...)
+	}
+	if len(ips) == 0 && defaultIP != nil {
+		ips = append(ips, defaultIP)
+	}
+
+	ports := append([]uint16(nil), s.ports...)
+	for _, svc := range s.services {
+		port, err := res.LookupPort(context.Background(), "tcp", svc)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, uint16(port))
+	}
+	if len(ports) == 0 {
+		ports = append(ports, 0)
+	}
+
+	for _, ip := range ips {
+		for _, port := range ports {
+			eps = append(eps, newEndpoint(ip, port))
+		}
+	}
+	return eps, nil
+}
+
+// racedStacks are the protocol stacks the "sim" stack stands in for when
+// ordering discovered endpoints, as an implementation would race them.
+var racedStacks = []string{"quic", "tls/tcp"}
+
+// resolveService resolves the endpoints of a service on a host with
+// postsocket.ResolveService, ordered by the stacks their ALPN hints imply,
+// racing address hints before the addresses of each target.
+func resolveService(res postsocket.Resolver, host, svc string, trace func(name string, addrs []net.IP, err error)) ([]endpoint, error) {
+	ctx := context.Background()
+	cands, err := postsocket.ResolveService(ctx, res, svc, "tcp", host)
+	if err != nil {
+		trace(host, nil, err)
+		return nil, err
+	}
+	cands = postsocket.OrderServiceCandidates(cands, racedStacks)
+	var eps []endpoint
+	seen := make(map[endpoint]bool)
+	add := func(ip net.IP, port uint16) {
+		if ep := newEndpoint(ip, port); !seen[ep] {
+			seen[ep] = true
+			eps = append(eps, ep)
+		}
+	}
+	for _, c := range cands {
+		for _, ip := range c.Hints {
+			add(ip, c.Port)
+		}
+		addrs, err := res.LookupIP(ctx, c.Target)
+		trace(c.Target, addrs, err)
+		if err != nil {
+			// Another candidate may yet resolve.
+			continue
+		}
+		for _, ip := range addrs {
+			add(ip, c.Port)
+		}
+	}
+	if len(eps) == 0 {
+		return nil, &net.DNSError{Err: "no addresses for service", Name: host, IsNotFound: true}
+	}
+	return eps, nil
+}
+
+func (n *Network) listen(ep endpoint, c *conn) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[ep]; ok {
+		return fmt.Errorf("sim: address %v already in use", ep.addr())
+	}
+	n.listeners[ep] = c
+	return nil
+}
+
+func (n *Network) unlisten(ep endpoint, c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners[ep] == c {
+		delete(n.listeners, ep)
+	}
+}
+
+func (n *Network) listener(ep endpoint) *conn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.listeners[ep]
+}
+
+// meet registers a Connection rendezvousing from local to remote, and
+// returns the Connection waiting for it at the other end, if any.
+func (n *Network) meet(local, remote endpoint, c *conn) *conn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if peer, ok := n.rendezvous[rendezvousKey{remote, local}]; ok {
+		delete(n.rendezvous, rendezvousKey{remote, local})
+		return peer
+	}
+	n.rendezvous[rendezvousKey{local, remote}] = c
+	return nil
+}
+
+func (n *Network) unmeet(local, remote endpoint, c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.rendezvous[rendezvousKey{local, remote}] == c {
+		delete(n.rendezvous, rendezvousKey{local, remote})
+	}
+}
+
+// properties returns the current latency, bandwidth and maximum message
+// size.
+func (n *Network) properties() (time.Duration, int64, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency, n.bandwidth, n.maxMsg
+}
@@ -0,0 +1,352 @@
+package sim
+
+import (
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/mami-project/postsocket"
+)
+
+// specifier holds the values added to a Remote or Local.
+type specifier struct {
+	interfaces []string
+	hostnames  []string
+	addresses  []net.IP
+	ports      []uint16
+	services   []string
+}
+
+// clone returns a copy of s that can be added to without affecting s.
+func (s specifier) clone() specifier {
+	return specifier{
+		interfaces: append([]string(nil), s.interfaces...),
+		hostnames:  append([]string(nil), s.hostnames...),
+		addresses:  append([]net.IP(nil), s.addresses...),
+		ports:      append([]uint16(nil), s.ports...),
+		services:   append([]string(nil), s.services...),
+	}
+}
+
+// config returns the values of s as a postsocket.EndpointConfig.
+func (s specifier) config() *postsocket.EndpointConfig {
+	c := s.clone()
+	return &postsocket.EndpointConfig{
+		Interfaces: c.interfaces,
+		Hostnames:  c.hostnames,
+		Addresses:  c.addresses,
+		Ports:      c.ports,
+		Services:   c.services,
+	}
+}
+
+// remote implements postsocket.Remote.
+type remote struct {
+	specifier
+}
+
+// WithHostname implements postsocket.Remote.
+func (r *remote) WithHostname(hostname string) postsocket.Remote {
+	n := &remote{r.clone()}
+	n.hostnames = append(n.hostnames, hostname)
+	return n
+}
+
+// WithAddress implements postsocket.Remote.
+func (r *remote) WithAddress(address net.IP) postsocket.Remote {
+	n := &remote{r.clone()}
+	n.addresses = append(n.addresses, address)
+	return n
+}
+
+// WithPort implements postsocket.Remote.
+func (r *remote) WithPort(port uint16) postsocket.Remote {
+	n := &remote{r.clone()}
+	n.ports = append(n.ports, port)
+	return n
+}
+
+// WithServiceName implements postsocket.Remote.
+func (r *remote) WithServiceName(svc string) postsocket.Remote {
+	n := &remote{r.clone()}
+	n.services = append(n.services, svc)
+	return n
+}
+
+// local implements postsocket.Local.
+type local struct {
+	specifier
+}
+
+// WithInterface implements postsocket.Local.
+func (l *local) WithInterface(iface string) postsocket.Local {
+	n := &local{l.clone()}
+	n.interfaces = append(n.interfaces, iface)
+	return n
+}
+
+// WithHostname implements postsocket.Local.
+func (l *local) WithHostname(hostname string) postsocket.Local {
+	n := &local{l.clone()}
+	n.hostnames = append(n.hostnames, hostname)
+	return n
+}
+
+// WithAddress implements postsocket.Local.
+func (l *local) WithAddress(address net.IP) postsocket.Local {
+	n := &local{l.clone()}
+	n.addresses = append(n.addresses, address)
+	return n
+}
+
+// WithPort implements postsocket.Local.
+func (l *local) WithPort(port uint16) postsocket.Local {
+	n := &local{l.clone()}
+	n.ports = append(n.ports, port)
+	return n
+}
+
+// WithServiceName implements postsocket.Local.
+func (l *local) WithServiceName(svc string) postsocket.Local {
+	n := &local{l.clone()}
+	n.services = append(n.services, svc)
+	return n
+}
+
+// preference is a preference level given to a parameter.
+type preference int
+
+const (
+	prefIgnore preference = iota
+	prefRequire
+	prefPrefer
+	prefAvoid
+	prefProhibit
+)
+
+// preferences maps preference levels to those of the postsocket package.
+var preferences = [...]postsocket.Preference{
+	prefIgnore:   postsocket.PrefIgnore,
+	prefRequire:  postsocket.PrefRequire,
+	prefPrefer:   postsocket.PrefPrefer,
+	prefAvoid:    postsocket.PrefAvoid,
+	prefProhibit: postsocket.PrefProhibit,
+}
+
+// preferenceValue is a preference on a parameter, with its optional value.
+type preferenceValue struct {
+	pref  preference
+	value interface{}
+}
+
+// transportParameters implements postsocket.TransportParameters.
+type transportParameters struct {
+	prefs  map[postsocket.ParameterIdentifier]preferenceValue
+	values map[postsocket.ParameterIdentifier]interface{}
+}
+
+func newTransportParameters() *transportParameters {
+	return &transportParameters{
+		prefs:  make(map[postsocket.ParameterIdentifier]preferenceValue),
+		values: make(map[postsocket.ParameterIdentifier]interface{}),
+	}
+}
+
+func (tp *transportParameters) clone() *transportParameters {
+	n := newTransportParameters()
+	for p, v := range tp.prefs {
+		n.prefs[p] = v
+	}
+	for p, v := range tp.values {
+		n.values[p] = v
+	}
+	return n
+}
+
+// config returns the preferences, in parameter order, and values of tp as
+// a postsocket.TransportConfig.
+func (tp *transportParameters) config() *postsocket.TransportConfig {
+	c := &postsocket.TransportConfig{Values: make(map[postsocket.ParameterIdentifier]interface{})}
+	for p, pv := range tp.prefs {
+		c.Preferences = append(c.Preferences, postsocket.TransportPreference{Parameter: p, Preference: preferences[pv.pref], Value: pv.value})
+	}
+	sort.Slice(c.Preferences, func(i, j int) bool {
+		return c.Preferences[i].Parameter < c.Preferences[j].Parameter
+	})
+	for p, v := range tp.values {
+		c.Values[p] = v
+	}
+	return c
+}
+
+func (tp *transportParameters) with(p postsocket.ParameterIdentifier, pref preference, v interface{}) postsocket.TransportParameters {
+	n := tp.clone()
+	n.prefs[p] = preferenceValue{pref, v}
+	return n
+}
+
+// Require implements postsocket.TransportParameters.
+func (tp *transportParameters) Require(p postsocket.ParameterIdentifier, v interface{}) postsocket.TransportParameters {
+	return tp.with(p, prefRequire, v)
+}
+
+// Prefer implements postsocket.TransportParameters.
+func (tp *transportParameters) Prefer(p postsocket.ParameterIdentifier, v interface{}) postsocket.TransportParameters {
+	return tp.with(p, prefPrefer, v)
+}
+
+// Ignore implements postsocket.TransportParameters.
+func (tp *transportParameters) Ignore(p postsocket.ParameterIdentifier) postsocket.TransportParameters {
+	return tp.with(p, prefIgnore, nil)
+}
+
+// Avoid implements postsocket.TransportParameters.
+func (tp *transportParameters) Avoid(p postsocket.ParameterIdentifier, v interface{}) postsocket.TransportParameters {
+	return tp.with(p, prefAvoid, v)
+}
+
+// Prohibit implements postsocket.TransportParameters.
+func (tp *transportParameters) Prohibit(p postsocket.ParameterIdentifier, v interface{}) postsocket.TransportParameters {
+	return tp.with(p, prefProhibit, v)
+}
+
+// Preference implements postsocket.PreferenceParameters.
+func (tp *transportParameters) Preference(p postsocket.ParameterIdentifier) (postsocket.Preference, interface{}) {
+	pv, ok := tp.prefs[p]
+	if !ok {
+		return postsocket.PrefIgnore, nil
+	}
+	return preferences[pv.pref], pv.value
+}
+
+// Get returns the value set for a parameter, or failing that the value
+// given with its preference.
+func (tp *transportParameters) Get(p postsocket.ParameterIdentifier) (interface{}, error) {
+	if v, ok := tp.values[p]; ok {
+		return v, nil
+	}
+	if pv, ok := tp.prefs[p]; ok && pv.value != nil {
+		return pv.value, nil
+	}
+	return nil, fmt.Errorf("sim: transport parameter %v not set", p)
+}
+
+// Set implements postsocket.TransportParameters.
+func (tp *transportParameters) Set(p postsocket.ParameterIdentifier, v interface{}) error {
+	tp.values[p] = v
+	return nil
+}
+
+// securityParameters implements postsocket.SecurityParameters. The
+// simulated network does not secure Connections, so these are only stored.
+type securityParameters struct {
+	identities      []tls.Certificate
+	privateKeys     []crypto.PrivateKey
+	publicKeys      []crypto.PublicKey
+	psks            map[string][]byte
+	verifyTrust     func(m postsocket.SecurityMetadata) (bool, error)
+	handleChallenge func(m postsocket.SecurityMetadata) (bool, error)
+	trustPolicy     string
+	values          map[postsocket.ParameterIdentifier]interface{}
+}
+
+func newSecurityParameters() *securityParameters {
+	return &securityParameters{
+		psks:   make(map[string][]byte),
+		values: make(map[postsocket.ParameterIdentifier]interface{}),
+	}
+}
+
+// clone returns a copy of sp.
+func (sp *securityParameters) clone() *securityParameters {
+	n := newSecurityParameters()
+	n.identities = append(n.identities, sp.identities...)
+	n.privateKeys = append(n.privateKeys, sp.privateKeys...)
+	n.publicKeys = append(n.publicKeys, sp.publicKeys...)
+	for id, key := range sp.psks {
+		n.psks[id] = key
+	}
+	n.verifyTrust, n.handleChallenge = sp.verifyTrust, sp.handleChallenge
+	n.trustPolicy = sp.trustPolicy
+	for p, v := range sp.values {
+		n.values[p] = v
+	}
+	return n
+}
+
+// AddIdentity implements postsocket.SecurityParameters.
+func (sp *securityParameters) AddIdentity(c tls.Certificate) postsocket.SecurityParameters {
+	sp.identities = append(sp.identities, c)
+	return sp
+}
+
+// AddPrivateKey implements postsocket.SecurityParameters.
+func (sp *securityParameters) AddPrivateKey(sk crypto.PrivateKey, pk crypto.PublicKey) postsocket.SecurityParameters {
+	sp.privateKeys = append(sp.privateKeys, sk)
+	sp.publicKeys = append(sp.publicKeys, pk)
+	return sp
+}
+
+// AddPreSharedKey implements postsocket.SecurityParameters.
+func (sp *securityParameters) AddPreSharedKey(key []byte, identity string) postsocket.SecurityParameters {
+	sp.psks[identity] = key
+	return sp
+}
+
+// VerifyTrustWith implements postsocket.SecurityParameters, replacing any
+// trust policy.
+func (sp *securityParameters) VerifyTrustWith(f func(m postsocket.SecurityMetadata) (bool, error)) postsocket.SecurityParameters {
+	sp.verifyTrust = f
+	sp.trustPolicy = ""
+	return sp
+}
+
+// HandleChallengeWith implements postsocket.SecurityParameters, replacing
+// any trust policy.
+func (sp *securityParameters) HandleChallengeWith(f func(m postsocket.SecurityMetadata) (bool, error)) postsocket.SecurityParameters {
+	sp.handleChallenge = f
+	sp.trustPolicy = ""
+	return sp
+}
+
+// Get implements postsocket.SecurityParameters.
+func (sp *securityParameters) Get(p postsocket.ParameterIdentifier) (interface{}, error) {
+	if v, ok := sp.values[p]; ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("sim: security parameter %v not set", p)
+}
+
+// Set implements postsocket.SecurityParameters.
+func (sp *securityParameters) Set(p postsocket.ParameterIdentifier, v interface{}) error {
+	sp.values[p] = v
+	return nil
+}
+
+// SetTrustPolicy implements postsocket.TrustPolicyParameters.
+func (sp *securityParameters) SetTrustPolicy(name string) {
+	sp.trustPolicy = name
+}
+
+// TrustPolicy implements postsocket.TrustPolicyParameters.
+func (sp *securityParameters) TrustPolicy() string {
+	return sp.trustPolicy
+}
+
+// config returns the trust policy and values of sp as a
+// postsocket.SecurityConfig. Identities and keys are left out.
+func (sp *securityParameters) config() (*postsocket.SecurityConfig, error) {
+	if sp.trustPolicy == "" && (sp.verifyTrust != nil || sp.handleChallenge != nil) {
+		return nil, fmt.Errorf("sim: cannot marshal trust callbacks not set by a trust policy")
+	}
+	c := &postsocket.SecurityConfig{
+		TrustPolicy: sp.trustPolicy,
+		Values:      make(map[postsocket.ParameterIdentifier]interface{}),
+	}
+	for p, v := range sp.values {
+		c.Values[p] = v
+	}
+	return c, nil
+}
@@ -0,0 +1,282 @@
+package sim
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mami-project/postsocket"
+)
+
+// connSpecifier is a set of related remote, local, transport and security
+// parameters held by a Preconnection.
+type connSpecifier struct {
+	rem postsocket.Remote
+	loc postsocket.Local
+	tp  postsocket.TransportParameters
+	sp  postsocket.SecurityParameters
+}
+
+// preconnection implements postsocket.Preconnection.
+type preconnection struct {
+	ctx *Context
+	evh postsocket.EventHandler
+	fh  postsocket.FramingHandler
+
+	mu      sync.Mutex
+	specs   []connSpecifier
+	initial *conn // Connection being initiated by InitialSend
+}
+
+// AddSpecifier implements postsocket.Preconnection. Nil parameters default
+// to those of the Context.
+func (pc *preconnection) AddSpecifier(rem postsocket.Remote, loc postsocket.Local, tp postsocket.TransportParameters, sp postsocket.SecurityParameters) {
+	if tp == nil {
+		tp = pc.ctx.NewTransportParameters()
+	}
+	if sp == nil {
+		sp = pc.ctx.NewSecurityParameters()
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.specs = append(pc.specs, connSpecifier{rem, loc, tp, sp})
+}
+
+// parameters returns the simulated forms of the remotes, the first local,
+// and the first transport and security parameters of this Preconnection.
+func (pc *preconnection) parameters() ([]*remote, *local, *transportParameters, *securityParameters, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	var rems []*remote
+	var loc *local
+	var tp *transportParameters
+	var sp *securityParameters
+	for i, s := range pc.specs {
+		if s.rem != nil {
+			r, ok := s.rem.(*remote)
+			if !ok {
+				return nil, nil, nil, nil, fmt.Errorf("sim: Remote of type %T not created by a sim Context", s.rem)
+			}
+			rems = append(rems, r)
+		}
+		if s.loc != nil && loc == nil {
+			l, ok := s.loc.(*local)
+			if !ok {
+				return nil, nil, nil, nil, fmt.Errorf("sim: Local of type %T not created by a sim Context", s.loc)
+			}
+			loc = l
+		}
+		if i == 0 {
+			t, ok := s.tp.(*transportParameters)
+			if !ok {
+				return nil, nil, nil, nil, fmt.Errorf("sim: TransportParameters of type %T not created by a sim Context", s.tp)
+			}
+			tp = t.clone()
+			p, ok := s.sp.(*securityParameters)
+			if !ok {
+				return nil, nil, nil, nil, fmt.Errorf("sim: SecurityParameters of type %T not created by a sim Context", s.sp)
+			}
+			sp = p.clone()
+		}
+	}
+	return rems, loc, tp, sp, nil
+}
+
+// resolver returns a function reporting resolutions to a Connection's
+// trace and logger.
+func (c *conn) resolver() func(name string, addrs []net.IP, err error) {
+	return func(name string, addrs []net.IP, err error) {
+		c.trace.Resolution(name, addrs, err)
+		if err != nil {
+			c.Logger().Debug("resolution failed", "name", name, "err", err)
+		}
+	}
+}
+
+// Initiate implements postsocket.Preconnection, racing the remote
+// endpoints of every specifier from the first Local.
+func (pc *preconnection) Initiate() (postsocket.Connection, error) {
+	c, err := pc.initiate()
+	if err != nil {
+		return nil, err
+	}
+	return c.self, nil
+}
+
+func (pc *preconnection) initiate() (*conn, error) {
+	rems, loc, tp, sp, err := pc.parameters()
+	if err != nil {
+		return nil, err
+	}
+	if len(rems) == 0 {
+		return nil, fmt.Errorf("sim: cannot initiate without a Remote")
+	}
+
+	c := pc.ctx.newConn(pc.evh, pc.fh, tp, sp, 0)
+	resolve := c.resolver()
+	var cands []endpoint
+	var hostnames []string
+	for _, r := range rems {
+		eps, err := pc.ctx.n.resolve(pc.ctx.resolver(), r.specifier, nil, resolve)
+		if err != nil {
+			c.fail(err)
+			return c, nil
+		}
+		cands = append(cands, eps...)
+		hostnames = append(hostnames, r.hostnames...)
+	}
+	if len(cands) == 0 {
+		c.fail(fmt.Errorf("sim: Remote resolved to no endpoints"))
+		return c, nil
+	}
+
+	tp, sp = pc.ctx.destinationParameters(tp, sp, hostnames, cands)
+	c.mu.Lock()
+	c.tp, c.sp = tp, sp
+	c.mu.Unlock()
+
+	// Destination policies may steer the choice of local interface.
+	locals, err := pc.ctx.localEndpoints(loc, tp, resolve)
+	if err != nil {
+		c.fail(err)
+		return c, nil
+	}
+	c.bind(locals[0])
+	c.connect(cands)
+	return c, nil
+}
+
+// InitialSend implements postsocket.Preconnection. Messages sent before
+// the Connection is Ready all go on the same Connection.
+func (pc *preconnection) InitialSend(message interface{}, sp postsocket.SendParameters) (postsocket.Connection, error) {
+	pc.mu.Lock()
+	c := pc.initial
+	pc.mu.Unlock()
+
+	if c == nil || !c.connecting() {
+		var err error
+		if c, err = pc.initiate(); err != nil {
+			return nil, err
+		}
+		pc.mu.Lock()
+		pc.initial = c
+		pc.mu.Unlock()
+	}
+	if err := c.self.Send(message, nil, sp); err != nil {
+		return nil, err
+	}
+	return c.self, nil
+}
+
+// Rendezvous implements postsocket.Preconnection, with the first Remote.
+// Both the Local and the Remote need a port.
+func (pc *preconnection) Rendezvous() (postsocket.Connection, error) {
+	rems, loc, tp, sp, err := pc.parameters()
+	if err != nil {
+		return nil, err
+	}
+	if len(rems) == 0 {
+		return nil, fmt.Errorf("sim: cannot rendezvous without a Remote")
+	}
+
+	c := pc.ctx.newConn(pc.evh, pc.fh, tp, sp, 0)
+	resolve := c.resolver()
+	locals, err := pc.ctx.localEndpoints(loc, tp, resolve)
+	if err != nil {
+		c.fail(err)
+		return c.self, nil
+	}
+	if locals[0].port == 0 {
+		c.fail(fmt.Errorf("sim: cannot rendezvous without a local port"))
+		return c.self, nil
+	}
+	remotes, err := pc.ctx.n.resolve(pc.ctx.resolver(), rems[0].specifier, nil, resolve)
+	if err != nil {
+		c.fail(err)
+		return c.self, nil
+	}
+	if len(remotes) == 0 || remotes[0].port == 0 {
+		c.fail(fmt.Errorf("sim: cannot rendezvous without a remote address and port"))
+		return c.self, nil
+	}
+
+	c.bind(locals[0])
+	c.rendezvous(remotes[0])
+	return c.self, nil
+}
+
+// Listen implements postsocket.Preconnection.
+func (pc *preconnection) Listen() (postsocket.Connection, error) {
+	_, loc, tp, sp, err := pc.parameters()
+	if err != nil {
+		return nil, err
+	}
+
+	c := pc.ctx.newConn(pc.evh, pc.fh, tp, sp, 0)
+	locals, err := pc.ctx.localEndpoints(loc, tp, c.resolver())
+	if err != nil {
+		c.fail(err)
+		return c.self, nil
+	}
+	if err := c.listen(locals[0]); err != nil {
+		c.fail(err)
+	}
+	return c.self, nil
+}
+
+// Clone implements postsocket.Preconnection.
+func (pc *preconnection) Clone() (postsocket.Preconnection, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return &preconnection{
+		ctx:   pc.ctx,
+		evh:   pc.evh,
+		fh:    pc.fh,
+		specs: append([]connSpecifier(nil), pc.specs...),
+	}, nil
+}
+
+// Config implements postsocket.ConfigPreconnection.
+func (pc *preconnection) Config() (*postsocket.PreconnectionConfig, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	c := &postsocket.PreconnectionConfig{}
+	for _, s := range pc.specs {
+		var sc postsocket.SpecifierConfig
+		if s.rem != nil {
+			r, ok := s.rem.(*remote)
+			if !ok {
+				return nil, fmt.Errorf("sim: Remote of type %T not created by a sim Context", s.rem)
+			}
+			sc.Remote = r.config()
+		}
+		if s.loc != nil {
+			l, ok := s.loc.(*local)
+			if !ok {
+				return nil, fmt.Errorf("sim: Local of type %T not created by a sim Context", s.loc)
+			}
+			sc.Local = l.config()
+		}
+		if s.tp != nil {
+			tp, ok := s.tp.(*transportParameters)
+			if !ok {
+				return nil, fmt.Errorf("sim: TransportParameters of type %T not created by a sim Context", s.tp)
+			}
+			sc.Transport = tp.config()
+		}
+		if s.sp != nil {
+			sp, ok := s.sp.(*securityParameters)
+			if !ok {
+				return nil, fmt.Errorf("sim: SecurityParameters of type %T not created by a sim Context", s.sp)
+			}
+			var err error
+			if sc.Security, err = sp.config(); err != nil {
+				return nil, err
+			}
+		}
+		c.Specifiers = append(c.Specifiers, sc)
+	}
+	return c, nil
+}
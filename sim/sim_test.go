@@ -0,0 +1,40 @@
+package sim_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/postsockettest"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// harness returns a Harness creating Contexts on n at successive
+// addresses.
+func harness(n *sim.Network) postsockettest.Harness {
+	var next byte = 1
+	return postsockettest.Harness{
+		NewContext: func(t *testing.T) postsocket.TransportContext {
+			next++
+			return n.NewContext(net.IPv4(10, 0, 0, next))
+		},
+		Clock: n.Clock(),
+	}
+}
+
+func TestConformance(t *testing.T) {
+	clock := sim.NewClock(time.Unix(0, 0))
+	defer clock.Start()()
+	postsockettest.TestTransportContext(t, harness(sim.NewNetwork(clock)))
+}
+
+func TestConformanceConstrained(t *testing.T) {
+	clock := sim.NewClock(time.Unix(0, 0))
+	defer clock.Start()()
+	n := sim.NewNetwork(clock)
+	n.SetLatency(10 * time.Millisecond)
+	n.SetBandwidth(8e6)
+	n.SetMaxMessageSize(1200)
+	postsockettest.TestTransportContext(t, harness(n))
+}
@@ -0,0 +1,105 @@
+package postsocket
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionStats reports how a Connection is doing. Counters are cumulative
+// over the lifetime of the Connection. Fields an implementation cannot
+// measure for the selected protocol stack are zero.
+type ConnectionStats struct {
+	// BytesSent and BytesReceived count payload bytes passed to and from
+	// the protocol stack, excluding retransmissions.
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// MessagesSent, MessagesReceived and MessagesExpired count Messages
+	// for which the Sent event occurred, Messages passed to Receive
+	// callbacks, and Messages for which the Expired event occurred.
+	MessagesSent     uint64
+	MessagesReceived uint64
+	MessagesExpired  uint64
+
+	// Retransmissions counts segments or packets retransmitted.
+	Retransmissions uint64
+
+	// SmoothedRTT and RTTVariance are the protocol stack's current round
+	// trip time estimate and its variance.
+	SmoothedRTT time.Duration
+	RTTVariance time.Duration
+
+	// CongestionWindow is the current congestion window in bytes.
+	CongestionWindow uint64
+
+	// DeliveryRate is the most recently measured delivery rate in bytes
+	// per second.
+	DeliveryRate uint64
+}
+
+// StatsCounter accumulates ConnectionStats for protocol stacks implemented
+// in userland, which have no kernel to ask. Counting methods may be called
+// concurrently. The zero StatsCounter is ready to use.
+type StatsCounter struct {
+	// 64-bit fields accessed atomically come first, for alignment on
+	// 32-bit platforms.
+	bytesSent        uint64
+	bytesReceived    uint64
+	messagesSent     uint64
+	messagesReceived uint64
+	messagesExpired  uint64
+	retransmissions  uint64
+
+	mu   sync.Mutex
+	path ConnectionStats // path estimates only
+}
+
+// Sent counts a Message of n bytes for which the Sent event occurred.
+func (s *StatsCounter) Sent(n int) {
+	atomic.AddUint64(&s.messagesSent, 1)
+	atomic.AddUint64(&s.bytesSent, uint64(n))
+}
+
+// Received counts a Message of n bytes passed to a Receive callback.
+func (s *StatsCounter) Received(n int) {
+	atomic.AddUint64(&s.messagesReceived, 1)
+	atomic.AddUint64(&s.bytesReceived, uint64(n))
+}
+
+// Expired counts a Message for which the Expired event occurred.
+func (s *StatsCounter) Expired() {
+	atomic.AddUint64(&s.messagesExpired, 1)
+}
+
+// Retransmitted counts a retransmitted segment or packet.
+func (s *StatsCounter) Retransmitted() {
+	atomic.AddUint64(&s.retransmissions, 1)
+}
+
+// UpdatePath records the protocol stack's current path estimates: smoothed
+// round trip time and its variance, congestion window in bytes, and delivery
+// rate in bytes per second.
+func (s *StatsCounter) UpdatePath(srtt, rttvar time.Duration, cwnd, rate uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path.SmoothedRTT = srtt
+	s.path.RTTVariance = rttvar
+	s.path.CongestionWindow = cwnd
+	s.path.DeliveryRate = rate
+}
+
+// Stats returns a snapshot of the statistics accumulated so far.
+func (s *StatsCounter) Stats() ConnectionStats {
+	s.mu.Lock()
+	st := s.path
+	s.mu.Unlock()
+
+	st.BytesSent = atomic.LoadUint64(&s.bytesSent)
+	st.BytesReceived = atomic.LoadUint64(&s.bytesReceived)
+	st.MessagesSent = atomic.LoadUint64(&s.messagesSent)
+	st.MessagesReceived = atomic.LoadUint64(&s.messagesReceived)
+	st.MessagesExpired = atomic.LoadUint64(&s.messagesExpired)
+	st.Retransmissions = atomic.LoadUint64(&s.retransmissions)
+	return st
+}
@@ -0,0 +1,51 @@
+package postsocket_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+)
+
+func TestStatsCounter(t *testing.T) {
+	var s postsocket.StatsCounter
+	if st := s.Stats(); st != (postsocket.ConnectionStats{}) {
+		t.Fatalf("zero StatsCounter reports %+v", st)
+	}
+
+	const workers, each = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				s.Sent(10)
+				s.Received(3)
+				s.Retransmitted()
+				if j%10 == 0 {
+					s.Expired()
+				}
+				s.UpdatePath(20*time.Millisecond, 5*time.Millisecond, 14600, 125000)
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := postsocket.ConnectionStats{
+		BytesSent:        workers * each * 10,
+		BytesReceived:    workers * each * 3,
+		MessagesSent:     workers * each,
+		MessagesReceived: workers * each,
+		MessagesExpired:  workers * each / 10,
+		Retransmissions:  workers * each,
+		SmoothedRTT:      20 * time.Millisecond,
+		RTTVariance:      5 * time.Millisecond,
+		CongestionWindow: 14600,
+		DeliveryRate:     125000,
+	}
+	if st := s.Stats(); st != want {
+		t.Errorf("Stats() = %+v, want %+v", st, want)
+	}
+}
@@ -0,0 +1,92 @@
+//go:build linux && !386
+
+package postsocket
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// tcpInfo mirrors struct tcp_info from linux/tcp.h, up to the fields this
+// package uses. Kernels older than 4.19 fill in a prefix of it.
+type tcpInfo struct {
+	state, caState, retransmits, probes, backoff, options, wscale, flags uint8
+
+	rto, ato, sndMSS, rcvMSS uint32
+
+	unacked, sacked, lost, retrans, fackets uint32
+
+	lastDataSent, lastAckSent, lastDataRecv, lastAckRecv uint32
+
+	pmtu, rcvSsthresh, rtt, rttvar, sndSsthresh, sndCwnd, advmss, reordering uint32
+
+	rcvRTT, rcvSpace uint32
+
+	totalRetrans uint32
+
+	pacingRate, maxPacingRate uint64
+	bytesAcked                uint64
+	bytesReceived             uint64
+	segsOut, segsIn           uint32
+
+	notsentBytes, minRTT, dataSegsIn, dataSegsOut uint32
+
+	deliveryRate uint64
+
+	busyTime, rwndLimited, sndbufLimited uint64
+
+	delivered, deliveredCE uint32
+
+	bytesSent, bytesRetrans uint64
+}
+
+// offsets of fields in tcpInfo that only newer kernels provide.
+var (
+	tcpInfoDeliveryRateEnd = unsafe.Offsetof(tcpInfo{}.deliveryRate) + 8
+	tcpInfoBytesSentEnd    = unsafe.Offsetof(tcpInfo{}.bytesSent) + 8
+)
+
+// TCPInfoStats returns ConnectionStats for a TCP socket, as reported by the
+// kernel's TCP_INFO socket option. Message counters are left at zero, as
+// the kernel has no notion of Messages; BytesSent falls back to bytes
+// acknowledged on kernels that do not report bytes sent.
+func TCPInfoStats(c syscall.Conn) (ConnectionStats, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return ConnectionStats{}, err
+	}
+
+	var info tcpInfo
+	size := uint32(unsafe.Sizeof(info))
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.SOL_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			serr = errno
+		}
+	}); err != nil {
+		return ConnectionStats{}, err
+	}
+	if serr != nil {
+		return ConnectionStats{}, serr
+	}
+
+	st := ConnectionStats{
+		BytesSent:        info.bytesAcked,
+		BytesReceived:    info.bytesReceived,
+		Retransmissions:  uint64(info.totalRetrans),
+		SmoothedRTT:      time.Duration(info.rtt) * time.Microsecond,
+		RTTVariance:      time.Duration(info.rttvar) * time.Microsecond,
+		CongestionWindow: uint64(info.sndCwnd) * uint64(info.sndMSS),
+	}
+	if uintptr(size) >= tcpInfoDeliveryRateEnd {
+		st.DeliveryRate = info.deliveryRate
+	}
+	if uintptr(size) >= tcpInfoBytesSentEnd {
+		st.BytesSent = info.bytesSent - info.bytesRetrans
+	}
+	return st, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux || 386
+
+package postsocket
+
+import (
+	"errors"
+	"syscall"
+)
+
+// TCPInfoStats returns ConnectionStats for a TCP socket, as reported by the
+// kernel's TCP_INFO socket option. TCP_INFO is only supported on Linux, and not on 386.
+func TCPInfoStats(c syscall.Conn) (ConnectionStats, error) {
+	return ConnectionStats{}, errors.New("postsocket: TCP_INFO is not supported on this platform")
+}
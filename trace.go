@@ -0,0 +1,358 @@
+package postsocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// recordSeparator begins each record in a JSON text sequence (RFC 7464).
+const recordSeparator = 0x1e
+
+// Tracer writes a qlog-style timeline of events on Connections, as a JSON
+// text sequence: a header record describing the trace, followed by one
+// record per event. Implementations obtain a ConnectionTrace for each
+// Connection from the Tracer set with TransportContext.SetTracer, and
+// report events on it as they occur. A Tracer either writes the events of
+// all Connections to a single io.Writer, each event labeled with its
+// Connection's group_id, or writes each Connection's events to its own file
+// in a directory. All methods may be called concurrently.
+type Tracer struct {
+	mu    sync.Mutex
+	w     io.Writer // shared writer, or nil if writing to dir
+	dir   string
+	title string
+	clock Clock
+	err   error // first write error
+}
+
+// NewTracer creates a Tracer writing all events to w.
+func NewTracer(w io.Writer) *Tracer {
+	t := &Tracer{w: w, title: "postsocket", clock: SystemClock}
+	t.writeRecord(w, t.header(""))
+	return t
+}
+
+// NewDirTracer creates a Tracer writing the events of each Connection to a
+// file named after the Connection's identifier, with the extension .sqlog,
+// in the given directory. The directory is created if necessary. Existing
+// files are never overwritten: if a file for the identifier exists, as when
+// several TransportContexts or runs share the directory, a number is
+// appended to the name, as in 7-1.sqlog.
+func NewDirTracer(dir string) (*Tracer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Tracer{dir: dir, title: "postsocket", clock: SystemClock}, nil
+}
+
+// SetClock sets the Clock that timestamps events, which should be that of
+// the TransportContexts traced. The default is SystemClock.
+func (t *Tracer) SetClock(c Clock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clock = c
+}
+
+// Err returns the first error encountered writing the trace, if any.
+// Tracing is best-effort: a Tracer that fails to write keeps going.
+func (t *Tracer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// traceHeader is the qlog header record of a JSON-SEQ trace.
+type traceHeader struct {
+	QlogVersion string     `json:"qlog_version"`
+	QlogFormat  string     `json:"qlog_format"`
+	Title       string     `json:"title"`
+	Trace       traceTrace `json:"trace"`
+}
+
+type traceTrace struct {
+	CommonFields traceCommonFields `json:"common_fields"`
+}
+
+type traceCommonFields struct {
+	GroupID    string `json:"group_id,omitempty"`
+	TimeFormat string `json:"time_format"`
+}
+
+// traceEvent is a qlog event record.
+type traceEvent struct {
+	Time    float64     `json:"time"`
+	Name    string      `json:"name"`
+	GroupID string      `json:"group_id,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (t *Tracer) header(groupID string) traceHeader {
+	return traceHeader{
+		QlogVersion: "0.3",
+		QlogFormat:  "JSON-SEQ",
+		Title:       t.title,
+		Trace: traceTrace{
+			CommonFields: traceCommonFields{
+				GroupID:    groupID,
+				TimeFormat: "absolute",
+			},
+		},
+	}
+}
+
+// writeRecord writes a single JSON-SEQ record to w, recording the first
+// error encountered.
+func (t *Tracer) writeRecord(w io.Writer, v interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeRecordLocked(w, v)
+}
+
+// writeRecordLocked is writeRecord with t.mu held.
+func (t *Tracer) writeRecordLocked(w io.Writer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err == nil {
+		rec := make([]byte, 0, len(b)+2)
+		rec = append(rec, recordSeparator)
+		rec = append(rec, b...)
+		rec = append(rec, '\n')
+		_, err = w.Write(rec)
+	}
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+// fail records the first error encountered writing the trace.
+func (t *Tracer) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// ConnectionTrace records the events of a single Connection to a Tracer.
+// A nil *ConnectionTrace discards all events, so implementations may trace
+// unconditionally. Events after Closed are discarded too.
+type ConnectionTrace struct {
+	t       *Tracer
+	groupID string
+	w       io.Writer
+	f       *os.File // per-connection file, if any
+	closed  bool     // guarded by t.mu
+}
+
+// Connection starts the trace of the Connection with the given identifier.
+// If t is nil, Connection returns nil.
+func (t *Tracer) Connection(id uint64) *ConnectionTrace {
+	if t == nil {
+		return nil
+	}
+
+	ct := &ConnectionTrace{t: t, groupID: strconv.FormatUint(id, 10), w: t.w}
+	if t.dir != "" {
+		f, err := createTraceFile(t.dir, ct.groupID)
+		if err != nil {
+			t.fail(err)
+			return nil
+		}
+		ct.f = f
+		ct.w = f
+		t.writeRecord(f, t.header(ct.groupID))
+	}
+	return ct
+}
+
+// maxTraceFileSuffix bounds the numbers tried to name a trace file not
+// already in its directory.
+const maxTraceFileSuffix = 1000
+
+// createTraceFile creates a new trace file for the given group identifier
+// in dir, numbering its name if a file by that name already exists.
+func createTraceFile(dir, groupID string) (*os.File, error) {
+	name := groupID
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, name+".sqlog"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) || i > maxTraceFileSuffix {
+			return f, err
+		}
+		name = groupID + "-" + strconv.Itoa(i)
+	}
+}
+
+func (ct *ConnectionTrace) event(name string, data interface{}) {
+	if ct == nil {
+		return
+	}
+	ct.t.mu.Lock()
+	defer ct.t.mu.Unlock()
+	ct.eventLocked(name, data)
+}
+
+// eventLocked records an event with ct.t.mu held, unless the trace has
+// ended.
+func (ct *ConnectionTrace) eventLocked(name string, data interface{}) {
+	if ct.closed {
+		return
+	}
+	ev := traceEvent{
+		Time: float64(ct.t.clock.Now().UnixNano()) / 1e6,
+		Name: name,
+		Data: data,
+	}
+	if ct.f == nil {
+		ev.GroupID = ct.groupID
+	}
+	ct.t.writeRecordLocked(ct.w, ev)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func msgrefString(msgref interface{}) string {
+	if msgref == nil {
+		return ""
+	}
+	return fmt.Sprint(msgref)
+}
+
+type traceResolution struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Resolution records the resolution of a hostname or service name in a
+// Remote or Local to a set of addresses, or the error resolution failed
+// with.
+func (ct *ConnectionTrace) Resolution(name string, addrs []net.IP, err error) {
+	if ct == nil {
+		return
+	}
+	data := traceResolution{Name: name, Error: errorString(err)}
+	for _, a := range addrs {
+		data.Addresses = append(data.Addresses, a.String())
+	}
+	ct.event("postsocket:resolution", data)
+}
+
+type traceCandidate struct {
+	Stack  string `json:"stack"`
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CandidateStarted records the start of connection establishment for a
+// candidate in candidate racing: a protocol stack over a path from local to
+// remote.
+func (ct *ConnectionTrace) CandidateStarted(stack string, local, remote net.Addr) {
+	ct.event("postsocket:candidate_started", traceCandidate{
+		Stack: stack, Local: addrString(local), Remote: addrString(remote),
+	})
+}
+
+// CandidateFailed records the failure of a candidate in candidate racing.
+func (ct *ConnectionTrace) CandidateFailed(stack string, local, remote net.Addr, err error) {
+	ct.event("postsocket:candidate_failed", traceCandidate{
+		Stack: stack, Local: addrString(local), Remote: addrString(remote), Error: errorString(err),
+	})
+}
+
+// CandidateWon records the selection of a candidate in candidate racing.
+func (ct *ConnectionTrace) CandidateWon(stack string, local, remote net.Addr) {
+	ct.event("postsocket:candidate_won", traceCandidate{
+		Stack: stack, Local: addrString(local), Remote: addrString(remote),
+	})
+}
+
+type traceHandshake struct {
+	Stack string `json:"stack"`
+	Step  string `json:"step"`
+}
+
+// Handshake records a step in the handshake of the named protocol stack,
+// such as "syn_sent" or "client_hello".
+func (ct *ConnectionTrace) Handshake(stack string, step string) {
+	ct.event("postsocket:handshake", traceHandshake{Stack: stack, Step: step})
+}
+
+type traceMessage struct {
+	MsgRef  string `json:"msgref,omitempty"`
+	Length  int    `json:"length"`
+	Partial bool   `json:"partial,omitempty"`
+	Offset  int    `json:"offset,omitempty"`
+	More    bool   `json:"more,omitempty"`
+}
+
+// MessageSent records that the Message with the given reference and length
+// was sent.
+func (ct *ConnectionTrace) MessageSent(msgref interface{}, length int) {
+	if ct == nil {
+		return
+	}
+	ct.event("postsocket:message_sent", traceMessage{MsgRef: msgrefString(msgref), Length: length})
+}
+
+// MessageReceived records a received Message.
+func (ct *ConnectionTrace) MessageReceived(msg Message) {
+	if ct == nil {
+		return
+	}
+	partial, offset, more := msg.Partial()
+	ct.event("postsocket:message_received", traceMessage{
+		Length: len(msg.Bytes()), Partial: partial, Offset: offset, More: more,
+	})
+}
+
+// MessageExpired records that the lifetime of the Message with the given
+// reference expired before it was sent.
+func (ct *ConnectionTrace) MessageExpired(msgref interface{}) {
+	if ct == nil {
+		return
+	}
+	ct.event("postsocket:message_expired", traceMessage{MsgRef: msgrefString(msgref)})
+}
+
+type traceClosed struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Closed records that the Connection closed, with the given error if any,
+// and ends this trace: later events, including further calls to Closed,
+// are discarded.
+func (ct *ConnectionTrace) Closed(err error) {
+	if ct == nil {
+		return
+	}
+	ct.t.mu.Lock()
+	defer ct.t.mu.Unlock()
+	if ct.closed {
+		return
+	}
+	ct.eventLocked("postsocket:closed", traceClosed{Error: errorString(err)})
+	ct.closed = true
+	if ct.f != nil {
+		if err := ct.f.Close(); err != nil && ct.t.err == nil {
+			ct.t.err = err
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package postsocket_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+// traceRecords decodes the JSON-SEQ records of a trace.
+func traceRecords(t *testing.T, b []byte) []map[string]interface{} {
+	t.Helper()
+	var recs []map[string]interface{}
+	for _, rec := range strings.Split(string(b), "\x1e") {
+		if strings.TrimSpace(rec) == "" {
+			continue
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(rec), &v); err != nil {
+			t.Fatalf("bad record %q: %v", rec, err)
+		}
+		recs = append(recs, v)
+	}
+	return recs
+}
+
+func TestTracerEvents(t *testing.T) {
+	var buf bytes.Buffer
+	tr := postsocket.NewTracer(&buf)
+	tr.SetClock(sim.NewClock(time.Unix(1, 0)))
+
+	ct := tr.Connection(7)
+	ct.MessageSent("empty", 0)
+	ct.Closed(nil)
+	ct.MessageSent("late", 1)
+
+	recs := traceRecords(t, buf.Bytes())
+	if len(recs) != 3 {
+		t.Fatalf("trace has %d records, want header, message_sent and closed:\n%s", len(recs), buf.Bytes())
+	}
+	ev := recs[1]
+	data, _ := ev["data"].(map[string]interface{})
+	if ev["name"] != "postsocket:message_sent" || ev["group_id"] != "7" || ev["time"] != 1000.0 {
+		t.Errorf("event %v, want message_sent in group 7 at 1000ms", ev)
+	}
+	if length, ok := data["length"]; !ok || length != 0.0 {
+		t.Errorf("empty Message recorded with data %v, want length 0", data)
+	}
+}
+
+func TestDirTracerNeverOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		tr, err := postsocket.NewDirTracer(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct := tr.Connection(1)
+		ct.MessageSent(i, 1)
+		ct.Closed(nil)
+		if err := tr.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"1.sqlog", "1-1.sqlog"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recs := traceRecords(t, b); len(recs) != 3 {
+			t.Errorf("%s has %d records, want 3", name, len(recs))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package postsocket
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TrustPolicy is a named pair of trust verification and challenge
+// callbacks, registered with RegisterTrustPolicy so that configuration,
+// such as a PreconnectionConfig, can refer to it by name.
+type TrustPolicy struct {
+	// VerifyTrust and HandleChallenge are passed to the VerifyTrustWith and
+	// HandleChallengeWith methods of SecurityParameters; either may be nil.
+	VerifyTrust     func(m SecurityMetadata) (bool, error)
+	HandleChallenge func(m SecurityMetadata) (bool, error)
+}
+
+// TrustPolicyParameters is implemented by SecurityParameters that remember
+// the name of the trust policy they use, so that it can be marshalled.
+type TrustPolicyParameters interface {
+	SecurityParameters
+
+	// SetTrustPolicy records the name of the trust policy whose callbacks
+	// were last set. Setting a callback directly clears it.
+	SetTrustPolicy(name string)
+
+	// TrustPolicy returns the name of the trust policy in use, or the empty
+	// string if there is none.
+	TrustPolicy() string
+}
+
+var trustPolicies struct {
+	sync.Mutex
+	m map[string]TrustPolicy
+}
+
+// RegisterTrustPolicy makes a trust policy available by name. It panics if
+// the name is empty or already registered, as these are programming errors.
+func RegisterTrustPolicy(name string, tp TrustPolicy) {
+	trustPolicies.Lock()
+	defer trustPolicies.Unlock()
+	if name == "" {
+		panic("postsocket: RegisterTrustPolicy with empty name")
+	}
+	if _, dup := trustPolicies.m[name]; dup {
+		panic("postsocket: RegisterTrustPolicy called twice for " + name)
+	}
+	if trustPolicies.m == nil {
+		trustPolicies.m = make(map[string]TrustPolicy)
+	}
+	trustPolicies.m[name] = tp
+}
+
+// LookupTrustPolicy returns the trust policy registered with a name.
+func LookupTrustPolicy(name string) (TrustPolicy, bool) {
+	trustPolicies.Lock()
+	defer trustPolicies.Unlock()
+	tp, ok := trustPolicies.m[name]
+	return tp, ok
+}
+
+// WithTrustPolicy sets the callbacks of the named trust policy on sp, and
+// records its name if sp is a TrustPolicyParameters.
+func WithTrustPolicy(sp SecurityParameters, name string) (SecurityParameters, error) {
+	tp, ok := LookupTrustPolicy(name)
+	if !ok {
+		return nil, fmt.Errorf("postsocket: unknown trust policy %q", name)
+	}
+	if tp.VerifyTrust != nil {
+		sp = sp.VerifyTrustWith(tp.VerifyTrust)
+	}
+	if tp.HandleChallenge != nil {
+		sp = sp.HandleChallengeWith(tp.HandleChallenge)
+	}
+	if tpp, ok := sp.(TrustPolicyParameters); ok {
+		tpp.SetTrustPolicy(name)
+	}
+	return sp, nil
+}
@@ -0,0 +1,362 @@
+package postsocket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Endpoint is a Remote or Local specifier parsed from a string, as found in
+// configuration, by ParseRemote or ParseLocal. The forms accepted are:
+//
+//	tcp://example.com:443      scheme, hostname and port
+//	quic://[::1]:4433          scheme, IPv6 address and port
+//	https://example.com        scheme as the service name, if not a transport
+//	example.com:https          hostname and service name
+//	192.0.2.1                  address alone
+//	eth0:0                     interface and port, for Locals only
+//	[fe80::1%eth0]:8080        address with interface, for Locals only
+//	2001:db8::1                IPv6 address alone, without brackets
+//	:8080                      port alone, for Locals only
+//
+// Transport schemes (tcp, udp, tls, dtls, quic, sctp and unix) imply
+// transport preferences, as applied by ImpliedParameters. Any other scheme
+// is taken as the service name if no port or service is given.
+type Endpoint struct {
+	// Scheme is the scheme of the endpoint, in lower case, or empty.
+	Scheme string
+
+	// Interface is the name or alias of a local interface.
+	Interface string
+
+	// Hostname is a hostname, in lower case, and Address an address; at
+	// most one of them is set.
+	Hostname string
+	Address  net.IP
+
+	// Port and Service are the port and service name; at most one of them
+	// is set, and a Port of zero is unset.
+	Port    uint16
+	Service string
+
+	// Path is the path of a Unix domain socket.
+	Path string
+}
+
+// PathRemote is implemented by Remotes that can name Unix domain sockets.
+// An Endpoint parsed from a unix URI, such as unix:///run/x.sock, can only
+// give a Remote for a TransportContext whose Remotes are PathRemotes.
+type PathRemote interface {
+	Remote
+
+	// WithPath returns a remote specifier with the given socket path added
+	// to this specifier.
+	WithPath(path string) Remote
+}
+
+// PathLocal is implemented by Locals that can name Unix domain sockets,
+// as PathRemote is by Remotes.
+type PathLocal interface {
+	Local
+
+	// WithPath returns a local specifier with the given socket path added
+	// to this specifier.
+	WithPath(path string) Local
+}
+
+// schemePreferences lists the transport preferences implied by transport
+// schemes.
+var schemePreferences = map[string][]TransportPreference{
+	"tcp":  {{TransportFullyReliable, PrefRequire, nil}, {TransportOrderPreserved, PrefRequire, nil}},
+	"tls":  {{TransportFullyReliable, PrefRequire, nil}, {TransportOrderPreserved, PrefRequire, nil}},
+	"unix": {{TransportFullyReliable, PrefRequire, nil}, {TransportOrderPreserved, PrefRequire, nil}},
+	"udp":  {{TransportFullyReliable, PrefProhibit, nil}},
+	"dtls": {{TransportFullyReliable, PrefProhibit, nil}},
+	"quic": {{TransportFullyReliable, PrefRequire, nil}, {TransportMultistreaming, PrefRequire, nil}},
+	"sctp": {{TransportMultistreaming, PrefRequire, nil}, {TransportPerMessageReliable, PrefPrefer, nil}},
+}
+
+// ParseRemote parses a Remote specifier from a string, in one of the forms
+// accepted for an Endpoint other than those for Locals only.
+func ParseRemote(s string) (*Endpoint, error) {
+	e, err := parseEndpoint(s, false)
+	if err != nil {
+		return nil, fmt.Errorf("postsocket: invalid remote %q: %v", s, err)
+	}
+	return e, nil
+}
+
+// ParseLocal parses a Local specifier from a string, in one of the forms
+// accepted for an Endpoint. A name without dots, other than "localhost",
+// is taken as the name or alias of an interface rather than a hostname.
+func ParseLocal(s string) (*Endpoint, error) {
+	e, err := parseEndpoint(s, true)
+	if err != nil {
+		return nil, fmt.Errorf("postsocket: invalid local %q: %v", s, err)
+	}
+	return e, nil
+}
+
+func parseEndpoint(s string, local bool) (*Endpoint, error) {
+	if s == "" {
+		return nil, errors.New("empty")
+	}
+	e := &Endpoint{}
+	rest := s
+	if i := strings.Index(s, "://"); i >= 0 {
+		e.Scheme = strings.ToLower(s[:i])
+		if !isSchemeName(e.Scheme) {
+			return nil, errors.New("bad scheme")
+		}
+		rest = s[i+3:]
+	}
+
+	if e.Scheme == "unix" {
+		if !strings.HasPrefix(rest, "/") {
+			return nil, errors.New("unix socket path must be absolute, as in unix:///path")
+		}
+		e.Path = rest
+		return e, nil
+	}
+	if strings.Contains(rest, "/") {
+		return nil, errors.New("unexpected path")
+	}
+
+	host, port := rest, ""
+	switch {
+	case strings.HasPrefix(rest, "["):
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return nil, errors.New("missing ]")
+		}
+		host = rest[:end+1]
+		if after := rest[end+1:]; after != "" {
+			if !strings.HasPrefix(after, ":") {
+				return nil, errors.New("unexpected text after ]")
+			}
+			if port = after[1:]; port == "" {
+				return nil, errors.New("empty port")
+			}
+		}
+	case net.ParseIP(rest) != nil:
+		// An IPv6 address without brackets or port.
+		host = ""
+		e.Address = net.ParseIP(rest)
+	default:
+		if i := strings.LastIndex(rest, ":"); i >= 0 {
+			host, port = rest[:i], rest[i+1:]
+			if port == "" {
+				return nil, errors.New("empty port")
+			}
+		}
+	}
+
+	if strings.HasPrefix(host, "[") {
+		host = host[1 : len(host)-1]
+		if i := strings.Index(host, "%"); i >= 0 {
+			if !local {
+				return nil, errors.New("interface zones are only allowed in locals")
+			}
+			e.Interface = host[i+1:]
+			host = host[:i]
+		}
+		// IPv4-mapped addresses are accepted, and stand for their IPv4
+		// address, as net.IP does not tell them apart.
+		if e.Address = net.ParseIP(host); e.Address == nil || !strings.Contains(host, ":") {
+			return nil, errors.New("bad IPv6 address")
+		}
+	} else if host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.To4() == nil {
+				return nil, errors.New("IPv6 address with port must be in brackets")
+			}
+			e.Address = ip
+		} else if !isHostname(host) {
+			return nil, fmt.Errorf("bad hostname %q", host)
+		} else if local && !strings.Contains(host, ".") && !strings.EqualFold(host, "localhost") {
+			e.Interface = host
+		} else {
+			e.Hostname = strings.ToLower(host)
+		}
+	}
+	if !local && e.Hostname == "" && e.Address == nil {
+		return nil, errors.New("no hostname or address")
+	}
+
+	if port != "" {
+		if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+			e.Port = uint16(n)
+		} else if isServiceName(port) {
+			e.Service = strings.ToLower(port)
+		} else {
+			return nil, fmt.Errorf("bad port %q", port)
+		}
+	}
+	return e, nil
+}
+
+// isSchemeName returns true if s is a URI scheme, per RFC 3986.
+func isSchemeName(s string) bool {
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isHostname returns true if s is made of letters, digits, hyphens,
+// underscores and dots, as hostnames and interface names are.
+func isHostname(s string) bool {
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isServiceName returns true if s is a service name, per RFC 6335.
+func isServiceName(s string) bool {
+	letter := false
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letter = true
+		case c >= '0' && c <= '9' || c == '-':
+		default:
+			return false
+		}
+	}
+	return letter && len(s) <= 15
+}
+
+// String returns the canonical form of the endpoint, which ParseRemote or
+// ParseLocal parse back to the same Endpoint: schemes and hostnames are in
+// lower case, IPv6 addresses in brackets, and port zero is omitted.
+func (e *Endpoint) String() string {
+	var b strings.Builder
+	if e.Scheme != "" {
+		b.WriteString(e.Scheme + "://")
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path)
+		return b.String()
+	}
+
+	switch {
+	case e.Address != nil && e.Address.To4() != nil && e.Interface != "":
+		// An IPv4 address with an interface is only written IPv4-mapped,
+		// as zones are only allowed in brackets.
+		b.WriteString("[::ffff:" + e.Address.String() + "%" + e.Interface + "]")
+	case e.Address != nil && e.Address.To4() == nil:
+		b.WriteString("[" + e.Address.String())
+		if e.Interface != "" {
+			b.WriteString("%" + e.Interface)
+		}
+		b.WriteString("]")
+	case e.Address != nil:
+		b.WriteString(e.Address.String())
+	case e.Hostname != "":
+		b.WriteString(e.Hostname)
+	default:
+		b.WriteString(e.Interface)
+	}
+
+	switch {
+	case e.Port != 0:
+		b.WriteString(":" + strconv.Itoa(int(e.Port)))
+	case e.Service != "":
+		b.WriteString(":" + e.Service)
+	}
+	return b.String()
+}
+
+// service returns the service name of the endpoint, which is its scheme if
+// that is not a transport and it has no port or service name.
+func (e *Endpoint) service() string {
+	if e.Service != "" || e.Port != 0 {
+		return e.Service
+	}
+	if _, ok := schemePreferences[e.Scheme]; ok {
+		return ""
+	}
+	return e.Scheme
+}
+
+// Remote returns a Remote bound to a TransportContext holding the values of
+// the endpoint. It returns an error for a Unix domain socket path if the
+// context's Remotes are not PathRemotes, or for an endpoint naming an
+// interface.
+func (e *Endpoint) Remote(ctx TransportContext) (Remote, error) {
+	if e.Interface != "" {
+		return nil, fmt.Errorf("postsocket: remote %s cannot name an interface", e)
+	}
+	r := ctx.NewRemote()
+	if e.Path != "" {
+		pr, ok := r.(PathRemote)
+		if !ok {
+			return nil, fmt.Errorf("postsocket: remote %s: Unix domain sockets not supported", e)
+		}
+		return pr.WithPath(e.Path), nil
+	}
+	if e.Hostname != "" {
+		r = r.WithHostname(e.Hostname)
+	}
+	if e.Address != nil {
+		r = r.WithAddress(e.Address)
+	}
+	if e.Port != 0 {
+		r = r.WithPort(e.Port)
+	}
+	if svc := e.service(); svc != "" {
+		r = r.WithServiceName(svc)
+	}
+	return r, nil
+}
+
+// Local returns a Local bound to a TransportContext holding the values of
+// the endpoint. It returns an error for a Unix domain socket path if the
+// context's Locals are not PathLocals.
+func (e *Endpoint) Local(ctx TransportContext) (Local, error) {
+	l := ctx.NewLocal()
+	if e.Path != "" {
+		pl, ok := l.(PathLocal)
+		if !ok {
+			return nil, fmt.Errorf("postsocket: local %s: Unix domain sockets not supported", e)
+		}
+		return pl.WithPath(e.Path), nil
+	}
+	if e.Interface != "" {
+		l = l.WithInterface(e.Interface)
+	}
+	if e.Hostname != "" {
+		l = l.WithHostname(e.Hostname)
+	}
+	if e.Address != nil {
+		l = l.WithAddress(e.Address)
+	}
+	if e.Port != 0 {
+		l = l.WithPort(e.Port)
+	}
+	if svc := e.service(); svc != "" {
+		l = l.WithServiceName(svc)
+	}
+	return l, nil
+}
+
+// ImpliedParameters returns tp with the transport preferences implied by
+// the endpoint's scheme added: reliability and order for tcp, tls and
+// unix, no reliability for udp and dtls, reliability and multistreaming
+// for quic, and multistreaming with per-Message reliability for sctp.
+func (e *Endpoint) ImpliedParameters(tp TransportParameters) TransportParameters {
+	return applyTransportPreferences(tp, schemePreferences[e.Scheme])
+}
@@ -0,0 +1,103 @@
+package postsocket_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mami-project/postsocket"
+	"github.com/mami-project/postsocket/sim"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		in    string
+		local bool
+		want  *postsocket.Endpoint // nil if the input is invalid
+		str   string               // canonical form, if not in
+	}{
+		{"tcp://Example.COM:443", false, &postsocket.Endpoint{Scheme: "tcp", Hostname: "example.com", Port: 443}, "tcp://example.com:443"},
+		{"quic://[::1]:4433", false, &postsocket.Endpoint{Scheme: "quic", Address: net.ParseIP("::1"), Port: 4433}, ""},
+		{"https://example.com", false, &postsocket.Endpoint{Scheme: "https", Hostname: "example.com"}, ""},
+		{"unix:///run/x.sock", false, &postsocket.Endpoint{Scheme: "unix", Path: "/run/x.sock"}, ""},
+		{"example.com:HTTPS", false, &postsocket.Endpoint{Hostname: "example.com", Service: "https"}, "example.com:https"},
+		{"192.0.2.1", false, &postsocket.Endpoint{Address: net.ParseIP("192.0.2.1")}, ""},
+		{"192.0.2.1:0", false, &postsocket.Endpoint{Address: net.ParseIP("192.0.2.1")}, "192.0.2.1"},
+		{"2001:db8::1", false, &postsocket.Endpoint{Address: net.ParseIP("2001:db8::1")}, "[2001:db8::1]"},
+		{"[::ffff:192.0.2.1]:80", false, &postsocket.Endpoint{Address: net.ParseIP("192.0.2.1"), Port: 80}, "192.0.2.1:80"},
+		{"eth0:0", true, &postsocket.Endpoint{Interface: "eth0"}, "eth0"},
+		{"localhost:80", true, &postsocket.Endpoint{Hostname: "localhost", Port: 80}, ""},
+		{"[fe80::1%eth0]:8080", true, &postsocket.Endpoint{Interface: "eth0", Address: net.ParseIP("fe80::1"), Port: 8080}, ""},
+		{"[::ffff:192.0.2.1%eth0]:80", true, &postsocket.Endpoint{Interface: "eth0", Address: net.ParseIP("192.0.2.1"), Port: 80}, ""},
+		{":8080", true, &postsocket.Endpoint{Port: 8080}, ""},
+
+		{"", false, nil, ""},
+		{"1tcp://example.com", false, nil, ""},
+		{"unix://run/x.sock", false, nil, ""},
+		{"tcp://example.com/path", false, nil, ""},
+		{"[::1", false, nil, ""},
+		{"[::1]x", false, nil, ""},
+		{"[::1]:", false, nil, ""},
+		{"example.com:", false, nil, ""},
+		{"[192.0.2.1]:80", false, nil, ""},
+		{"2001:db8::1:80:x", false, nil, ""},
+		{"exa mple.com", false, nil, ""},
+		{"example.com:not_a_port", false, nil, ""},
+		{"example.com:99999", false, nil, ""},
+		{"[fe80::1%eth0]:8080", false, nil, ""},
+		{"eth0:0", false, &postsocket.Endpoint{Hostname: "eth0"}, "eth0"},
+		{":8080", false, nil, ""},
+	}
+	for _, test := range tests {
+		parse := postsocket.ParseRemote
+		if test.local {
+			parse = postsocket.ParseLocal
+		}
+		e, err := parse(test.in)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("parsing %q (local %v) returned %+v, want an error", test.in, test.local, e)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsing %q (local %v): %v", test.in, test.local, err)
+			continue
+		}
+		if !reflect.DeepEqual(e, test.want) {
+			t.Errorf("parsing %q (local %v) returned %+v, want %+v", test.in, test.local, e, test.want)
+		}
+
+		str := test.str
+		if str == "" {
+			str = test.in
+		}
+		if got := e.String(); got != str {
+			t.Errorf("%q formatted as %q, want %q", test.in, got, str)
+		}
+		if again, err := parse(e.String()); err != nil || !reflect.DeepEqual(again, e) {
+			t.Errorf("%q reparsed from %q as %+v, %v", test.in, e, again, err)
+		}
+	}
+}
+
+func TestEndpointSpecifiers(t *testing.T) {
+	ctx := sim.NewNetwork(sim.NewClock(time.Unix(0, 0))).NewContext(net.IPv4(10, 0, 0, 1))
+
+	e, _ := postsocket.ParseRemote("unix:///run/x.sock")
+	if _, err := e.Remote(ctx); err == nil {
+		t.Error("Remote for a socket path succeeded on a context without PathRemotes")
+	}
+	if _, err := e.Local(ctx); err == nil {
+		t.Error("Local for a socket path succeeded on a context without PathLocals")
+	}
+
+	e, _ = postsocket.ParseLocal("[fe80::1%eth0]:8080")
+	if _, err := e.Remote(ctx); err == nil {
+		t.Error("Remote naming an interface succeeded")
+	}
+	if _, err := e.Local(ctx); err != nil {
+		t.Error(err)
+	}
+}